@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/naijcloud/control-plane/internal/services"
+	"github.com/sirupsen/logrus"
+)
+
+// getACMEChallenge returns the key authorization for an HTTP-01 challenge
+// token, which edges serve at /.well-known/acme-challenge/<token>. service
+// is nil when automatic certificates are disabled.
+func getACMEChallenge(service *services.ACMEService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if service == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Challenge not found"})
+			return
+		}
+
+		keyAuth, err := service.ChallengeResponse(c.Request.Context(), c.Param("token"))
+		if err != nil {
+			if err.Error() == "challenge not found" {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Challenge not found"})
+				return
+			}
+			logrus.WithError(err).Error("Failed to get ACME challenge")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get challenge"})
+			return
+		}
+
+		c.String(http.StatusOK, keyAuth)
+	}
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/naijcloud/control-plane/internal/middleware"
+	"github.com/naijcloud/control-plane/internal/models"
+	"github.com/naijcloud/control-plane/internal/services"
+	"github.com/sirupsen/logrus"
+)
+
+// CachePolicyHandler manages the ordered cache policies of a domain
+type CachePolicyHandler struct {
+	cachePolicyService *services.CachePolicyService
+}
+
+func NewCachePolicyHandler(cachePolicyService *services.CachePolicyService) *CachePolicyHandler {
+	return &CachePolicyHandler{
+		cachePolicyService: cachePolicyService,
+	}
+}
+
+// ListCachePolicies returns a domain's cache policies in evaluation order
+func (h *CachePolicyHandler) ListCachePolicies(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+
+	policies, err := h.cachePolicyService.ListPolicies(orgID, domainName)
+	if err != nil {
+		respondCachePolicyError(c, err, domainName, "Failed to list cache policies")
+		return
+	}
+	if policies == nil {
+		policies = []*models.CachePolicy{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cache_policies": policies})
+}
+
+// CreateCachePolicy adds a cache policy to a domain
+func (h *CachePolicyHandler) CreateCachePolicy(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+
+	var req models.CreateCachePolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	policy, err := h.cachePolicyService.CreatePolicy(orgID, domainName, &req)
+	if err != nil {
+		respondCachePolicyError(c, err, domainName, "Failed to create cache policy")
+		return
+	}
+
+	c.JSON(http.StatusCreated, policy)
+}
+
+// GetCachePolicy retrieves a single cache policy
+func (h *CachePolicyHandler) GetCachePolicy(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+	policyID, err := uuid.Parse(c.Param("policyId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid policy ID"})
+		return
+	}
+
+	policy, err := h.cachePolicyService.GetPolicy(orgID, domainName, policyID)
+	if err != nil {
+		respondCachePolicyError(c, err, domainName, "Failed to get cache policy")
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// UpdateCachePolicy changes a cache policy, including its position
+func (h *CachePolicyHandler) UpdateCachePolicy(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+	policyID, err := uuid.Parse(c.Param("policyId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid policy ID"})
+		return
+	}
+
+	var req models.UpdateCachePolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	policy, err := h.cachePolicyService.UpdatePolicy(orgID, domainName, policyID, &req)
+	if err != nil {
+		respondCachePolicyError(c, err, domainName, "Failed to update cache policy")
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// DeleteCachePolicy removes a cache policy
+func (h *CachePolicyHandler) DeleteCachePolicy(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+	policyID, err := uuid.Parse(c.Param("policyId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid policy ID"})
+		return
+	}
+
+	if err := h.cachePolicyService.DeletePolicy(orgID, domainName, policyID); err != nil {
+		respondCachePolicyError(c, err, domainName, "Failed to delete cache policy")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Cache policy deleted successfully"})
+}
+
+// MatchCachePolicy is a dry run that reports which policy applies to a URL
+func (h *CachePolicyHandler) MatchCachePolicy(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+
+	var req models.MatchCachePolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	match, err := h.cachePolicyService.MatchPolicy(orgID, domainName, req.URL)
+	if err != nil {
+		respondCachePolicyError(c, err, domainName, "Failed to match cache policies")
+		return
+	}
+
+	c.JSON(http.StatusOK, match)
+}
+
+// respondCachePolicyError maps cache policy service errors to responses
+func respondCachePolicyError(c *gin.Context, err error, domainName, message string) {
+	switch {
+	case err.Error() == "domain not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+	case err.Error() == "cache policy not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cache policy not found"})
+	case strings.HasPrefix(err.Error(), "invalid cache policy"), strings.HasPrefix(err.Error(), "invalid url"):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		logrus.WithError(err).WithField("domain", domainName).Error(message)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/naijcloud/control-plane/internal/middleware"
+	"github.com/naijcloud/control-plane/internal/models"
+	"github.com/naijcloud/control-plane/internal/services"
+	"github.com/sirupsen/logrus"
+)
+
+// CertificateHandler manages the custom certificates of a domain
+type CertificateHandler struct {
+	certificateService *services.CertificateService
+}
+
+func NewCertificateHandler(certificateService *services.CertificateService) *CertificateHandler {
+	return &CertificateHandler{
+		certificateService: certificateService,
+	}
+}
+
+// ListCertificates returns a domain's uploaded certificates, newest first
+func (h *CertificateHandler) ListCertificates(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+
+	certs, err := h.certificateService.ListCertificates(orgID, domainName)
+	if err != nil {
+		respondCertificateError(c, err, domainName, "Failed to list certificates")
+		return
+	}
+	if certs == nil {
+		certs = []*models.CustomCertificate{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"certificates": certs})
+}
+
+// UploadCertificate stores a certificate chain and private key for a domain
+func (h *CertificateHandler) UploadCertificate(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+
+	var req models.UploadCertificateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cert, err := h.certificateService.UploadCertificate(orgID, domainName, &req)
+	if err != nil {
+		respondCertificateError(c, err, domainName, "Failed to upload certificate")
+		return
+	}
+
+	c.JSON(http.StatusCreated, cert)
+}
+
+// GetCertificate retrieves a single uploaded certificate
+func (h *CertificateHandler) GetCertificate(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+	certID, err := uuid.Parse(c.Param("certId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid certificate ID"})
+		return
+	}
+
+	cert, err := h.certificateService.GetCertificate(orgID, domainName, certID)
+	if err != nil {
+		respondCertificateError(c, err, domainName, "Failed to get certificate")
+		return
+	}
+
+	c.JSON(http.StatusOK, cert)
+}
+
+// ActivateCertificate switches the domain to an uploaded certificate
+func (h *CertificateHandler) ActivateCertificate(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+	certID, err := uuid.Parse(c.Param("certId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid certificate ID"})
+		return
+	}
+
+	cert, err := h.certificateService.ActivateCertificate(orgID, domainName, certID)
+	if err != nil {
+		respondCertificateError(c, err, domainName, "Failed to activate certificate")
+		return
+	}
+
+	c.JSON(http.StatusOK, cert)
+}
+
+// DeleteCertificate removes an uploaded certificate
+func (h *CertificateHandler) DeleteCertificate(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+	certID, err := uuid.Parse(c.Param("certId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid certificate ID"})
+		return
+	}
+
+	if err := h.certificateService.DeleteCertificate(orgID, domainName, certID); err != nil {
+		respondCertificateError(c, err, domainName, "Failed to delete certificate")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Certificate deleted successfully"})
+}
+
+// respondCertificateError maps certificate service errors to responses
+func respondCertificateError(c *gin.Context, err error, domainName, message string) {
+	switch {
+	case err.Error() == "domain not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+	case err.Error() == "certificate not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Certificate not found"})
+	case strings.HasPrefix(err.Error(), "invalid certificate"):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		logrus.WithError(err).WithField("domain", domainName).Error(message)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+// getEdgeCertificate serves a domain's certificate with its private key to
+// an edge authenticated by requireEdgeToken
+func getEdgeCertificate(service *services.DomainService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		edgeOrgID, _ := c.Get(edgeOrganizationKey)
+		orgID, _ := edgeOrgID.(*uuid.UUID)
+		domainName := c.Param("domain")
+
+		cert, err := service.GetDomainCertificate(orgID, domainName)
+		if err != nil {
+			switch err.Error() {
+			case "domain not found":
+				c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+			case "certificate not found":
+				c.JSON(http.StatusNotFound, gin.H{"error": "Certificate not found"})
+			default:
+				logrus.WithError(err).WithField("domain", domainName).Error("Failed to get domain certificate")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get certificate"})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, cert)
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/naijcloud/control-plane/internal/services"
+	"github.com/sirupsen/logrus"
+)
+
+// requireEdgeRegistrationSecret admits only requests carrying the operator's
+// edge registration secret as a bearer token. With no secret configured,
+// edges cannot register.
+func requireEdgeRegistrationSecret(secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if secret == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Edge registration is not configured"})
+			return
+		}
+
+		presented := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(secret)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid edge registration secret"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// edgeOrganizationKey is the gin context key holding the organization an
+// authenticated edge is dedicated to, nil for edges serving every organization
+const edgeOrganizationKey = "edge_organization_id"
+
+// requireEdgeToken admits only the edge named by edgeParam, authenticated by
+// the bearer token it was issued at registration
+func requireEdgeToken(service *services.EdgeService, edgeParam string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		edgeID, err := uuid.Parse(c.Param(edgeParam))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid edge ID"})
+			return
+		}
+
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		orgID, err := service.AuthenticateEdge(edgeID, token)
+		if err != nil {
+			switch err.Error() {
+			case "edge not found", "invalid edge token":
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid edge credentials"})
+			default:
+				logrus.WithError(err).WithField("edge_id", edgeID).Error("Failed to authenticate edge")
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate edge"})
+			}
+			return
+		}
+		c.Set(edgeOrganizationKey, orgID)
+		c.Next()
+	}
+}
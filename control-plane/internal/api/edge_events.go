@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/naijcloud/control-plane/internal/services"
+	"github.com/sirupsen/logrus"
+)
+
+// edgeEventsKeepalive is how often an idle event stream sends a comment, so
+// proxies keep the connection open and edges can detect a dead stream
+const edgeEventsKeepalive = 15 * time.Second
+
+// streamEdgeEvents serves an edge node's purge and domain change events as
+// Server-Sent Events. Each event's data is a JSON services.EdgeEvent; purge
+// events carry the purge ID as their event ID. The edge acknowledges a purge
+// by completing it, as with polled purges. edgeParam names the route
+// parameter holding the edge ID.
+func streamEdgeEvents(service *services.EdgeEventService, edgeParam string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		edgeID, err := uuid.Parse(c.Param(edgeParam))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid edge ID"})
+			return
+		}
+
+		events, err := service.Subscribe(c.Request.Context(), edgeID)
+		if err != nil {
+			logrus.WithError(err).WithField("edge_id", edgeID).Error("Failed to subscribe edge to events")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Event stream unavailable"})
+			return
+		}
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+
+		logrus.WithField("edge_id", edgeID).Info("Edge node connected to event stream")
+		defer logrus.WithField("edge_id", edgeID).Info("Edge node disconnected from event stream")
+
+		keepalive := time.NewTicker(edgeEventsKeepalive)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				if err := writeEdgeEvent(c.Writer, event); err != nil {
+					logrus.WithError(err).WithField("edge_id", edgeID).Debug("Failed to write edge event")
+					return
+				}
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+					return
+				}
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// writeEdgeEvent writes one event in Server-Sent Events framing
+func writeEdgeEvent(w gin.ResponseWriter, event services.EdgeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if event.Purge != nil {
+		if _, err := fmt.Fprintf(w, "id: %s\n", event.Purge.ID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -27,8 +28,12 @@ func SetupRoutes(
 	r *gin.RouterGroup,
 	domainService *services.DomainService,
 	edgeService *services.EdgeService,
+	edgeRegistrationSecret string,
 	analyticsService *services.AnalyticsService,
 	cacheService *services.CacheService,
+	edgeEventService *services.EdgeEventService,
+	acmeService *services.ACMEService,
+	originService *services.OriginService,
 	apiKeyService *services.APIKeyService,
 ) {
 	// Create API key handler
@@ -61,14 +66,20 @@ func SetupRoutes(
 	edges := r.Group("/edges")
 	{
 		edges.GET("", listEdges(edgeService))
-		edges.POST("", registerEdge(edgeService))
+		edges.POST("", requireEdgeRegistrationSecret(edgeRegistrationSecret), registerEdge(edgeService))
 		edges.GET("/:edge_id", getEdge(edgeService))
 		edges.DELETE("/:edge_id", deleteEdge(edgeService))
 		edges.POST("/:edge_id/heartbeat", updateHeartbeat(edgeService))
-		edges.GET("/:edge_id/purges", getPendingPurges(cacheService))
-		edges.POST("/:edge_id/purges/:purge_id/complete", completePurge(cacheService))
+		edges.GET("/:edge_id/purges", requireEdgeToken(edgeService, "edge_id"), getPendingPurges(cacheService))
+		edges.POST("/:edge_id/purges/:purge_id/complete", requireEdgeToken(edgeService, "edge_id"), completePurge(cacheService))
+		edges.GET("/:edge_id/events", requireEdgeToken(edgeService, "edge_id"), streamEdgeEvents(edgeEventService, "edge_id"))
+		edges.POST("/:edge_id/origin-health", requireEdgeToken(edgeService, "edge_id"), reportOriginHealth(originService, "edge_id"))
+		edges.GET("/:edge_id/certificates/:domain", requireEdgeToken(edgeService, "edge_id"), getEdgeCertificate(domainService))
 	}
 
+	// HTTP-01 challenge responses for automatic certificates, served by edges
+	r.GET("/acme/http-01/:token", getACMEChallenge(acmeService))
+
 	// Analytics routes
 	analytics := r.Group("/analytics")
 	{
@@ -107,6 +118,10 @@ func createDomain(service *services.DomainService) gin.HandlerFunc {
 		domain, err := service.CreateDomain(orgID, &req)
 		if err != nil {
 			logrus.WithError(err).WithField("domain", req.Domain).Error("Failed to create domain")
+			if strings.HasPrefix(err.Error(), "invalid domain settings") {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
 			if err.Error() == "domain "+req.Domain+" already exists" {
 				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 				return
@@ -124,7 +139,7 @@ func getDomain(service *services.DomainService) gin.HandlerFunc {
 		orgID := getOrganizationID(c)
 		domainName := c.Param("domain")
 
-		domain, err := service.GetDomain(orgID, domainName)
+		domain, err := service.GetDomainConfig(orgID, domainName)
 		if err != nil {
 			if err.Error() == "domain not found" {
 				c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
@@ -155,7 +170,7 @@ func getDomainByID(service *services.DomainService) gin.HandlerFunc {
 			defaultOrgID = orgID.(uuid.UUID)
 		}
 
-		domain, err := service.GetDomainByID(defaultOrgID, domainID)
+		domain, err := service.GetDomainConfigByID(defaultOrgID, domainID)
 		if err != nil {
 			if err.Error() == "domain not found" {
 				c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
@@ -187,6 +202,10 @@ func updateDomain(service *services.DomainService) gin.HandlerFunc {
 				c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
 				return
 			}
+			if strings.HasPrefix(err.Error(), "invalid domain settings") {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
 			logrus.WithError(err).WithField("domain", domainName).Error("Failed to update domain")
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update domain"})
 			return
@@ -238,12 +257,12 @@ func purgeDomainCache(domainService *services.DomainService, cacheService *servi
 			return
 		}
 
-		// Default to purging all paths if none specified
-		if len(req.Paths) == 0 {
+		// Default to purging all paths if neither paths nor tags are specified
+		if len(req.Paths) == 0 && len(req.Tags) == 0 {
 			req.Paths = []string{"/*"}
 		}
 
-		purgeReq, err := cacheService.PurgeCache(domain.ID, req.Paths, "api")
+		purgeReq, err := cacheService.PurgeCache(domain.ID, req.Paths, req.Tags, "api")
 		if err != nil {
 			logrus.WithError(err).WithField("domain", domainName).Error("Failed to initiate cache purge")
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate cache purge"})
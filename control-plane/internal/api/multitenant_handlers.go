@@ -61,6 +61,10 @@ func (h *DomainHandler) CreateDomain(c *gin.Context) {
 	domain, err := h.domainService.CreateDomain(orgID, &req)
 	if err != nil {
 		logrus.WithError(err).WithField("domain", req.Domain).Error("Failed to create domain")
+		if strings.HasPrefix(err.Error(), "invalid domain settings") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		if err.Error() == "domain "+req.Domain+" already exists" {
 			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 			return
@@ -118,6 +122,10 @@ func (h *DomainHandler) UpdateDomain(c *gin.Context) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
 			return
 		}
+		if strings.HasPrefix(err.Error(), "invalid domain settings") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		logrus.WithError(err).WithField("domain", domainName).Error("Failed to update domain")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update domain"})
 		return
@@ -184,7 +192,7 @@ func (h *DomainHandler) PurgeDomainCache(c *gin.Context) {
 		return
 	}
 
-	purgeRequest, err := h.cacheService.PurgeCache(domain.ID, req.Paths, userID.String())
+	purgeRequest, err := h.cacheService.PurgeCache(domain.ID, req.Paths, req.Tags, userID.String())
 	if err != nil {
 		logrus.WithError(err).WithField("domain", domainName).Error("Failed to create purge request")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create purge request"})
@@ -513,8 +521,14 @@ func SetupMultiTenantRoutes(
 	userService *services.UserService,
 	domainService *services.DomainService,
 	edgeService *services.EdgeService,
+	edgeRegistrationSecret string,
 	analyticsService *services.AnalyticsService,
 	cacheService *services.CacheService,
+	cachePolicyService *services.CachePolicyService,
+	edgeEventService *services.EdgeEventService,
+	acmeService *services.ACMEService,
+	certificateService *services.CertificateService,
+	originService *services.OriginService,
 	apiKeyService *services.APIKeyService,
 	authService *services.AuthService,
 	emailService *services.EmailService,
@@ -614,6 +628,43 @@ func SetupMultiTenantRoutes(
 		domains.POST("/:domain/purge", domainHandler.PurgeDomainCache)
 	}
 
+	// Per-domain cache policies, evaluated in priority order by edges
+	cachePolicyHandler := NewCachePolicyHandler(cachePolicyService)
+	cachePolicies := domains.Group("/:domain/cache-policies")
+	{
+		cachePolicies.GET("", cachePolicyHandler.ListCachePolicies)
+		cachePolicies.POST("", cachePolicyHandler.CreateCachePolicy)
+		cachePolicies.POST("/match", cachePolicyHandler.MatchCachePolicy)
+		cachePolicies.GET("/:policyId", cachePolicyHandler.GetCachePolicy)
+		cachePolicies.PUT("/:policyId", cachePolicyHandler.UpdateCachePolicy)
+		cachePolicies.DELETE("/:policyId", cachePolicyHandler.DeleteCachePolicy)
+	}
+
+	// Customer-supplied TLS certificates; the active one is served by edges
+	// in place of an ACME certificate
+	certificateHandler := NewCertificateHandler(certificateService)
+	certificates := domains.Group("/:domain/certificates")
+	certificates.Use(middleware.RequireOrganizationAccess(orgService, "owner", "admin"))
+	{
+		certificates.GET("", certificateHandler.ListCertificates)
+		certificates.POST("", certificateHandler.UploadCertificate)
+		certificates.GET("/:certId", certificateHandler.GetCertificate)
+		certificates.POST("/:certId/activate", certificateHandler.ActivateCertificate)
+		certificates.DELETE("/:certId", certificateHandler.DeleteCertificate)
+	}
+
+	// Origin pools; edges balance requests over the healthy origins and
+	// report what their health checks see
+	originHandler := NewOriginHandler(originService)
+	origins := domains.Group("/:domain/origins")
+	{
+		origins.GET("", originHandler.ListOrigins)
+		origins.POST("", originHandler.CreateOrigin)
+		origins.GET("/:originId", originHandler.GetOrigin)
+		origins.PUT("/:originId", originHandler.UpdateOrigin)
+		origins.DELETE("/:originId", originHandler.DeleteOrigin)
+	}
+
 	// Edge node management
 	edgeHandler := NewEdgeHandler(edgeService, cacheService)
 	edges := api.Group("/edges")
@@ -740,7 +791,9 @@ func SetupMultiTenantRoutes(
 				c.JSON(http.StatusOK, gin.H{"edges": enhancedEdges})
 			})
 
-			edges.POST("", func(c *gin.Context) {
+			// Only edges holding the operator's registration secret may
+			// register and receive an edge token
+			edges.POST("", requireEdgeRegistrationSecret(edgeRegistrationSecret), func(c *gin.Context) {
 				var req models.RegisterEdgeRequest
 				if err := c.ShouldBindJSON(&req); err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -786,22 +839,29 @@ func SetupMultiTenantRoutes(
 				c.JSON(http.StatusOK, gin.H{"status": "acknowledged"})
 			})
 
-			// Purges endpoint for edge nodes
-			edges.GET("/:edgeId/purges", func(c *gin.Context) {
+			// Purges endpoint for edge nodes. Purges and the event stream
+			// name other tenants' domains and paths, so only the edge itself
+			// may read them.
+			edges.GET("/:edgeId/purges", requireEdgeToken(edgeService, "edgeId"), func(c *gin.Context) {
 				edgeIDStr := c.Param("edgeId")
-				_, err := uuid.Parse(edgeIDStr)
+				edgeID, err := uuid.Parse(edgeIDStr)
 				if err != nil {
 					c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid edge ID"})
 					return
 				}
 
-				// For now, return empty purges list
-				// TODO: Implement actual purge requests from database
-				c.JSON(http.StatusOK, gin.H{"purges": []interface{}{}})
+				purges, err := cacheService.GetPendingPurges(edgeID)
+				if err != nil {
+					logrus.WithError(err).WithField("edge_id", edgeID).Error("Failed to get pending purges")
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get pending purges"})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{"purges": purges})
 			})
 
 			// Complete purge endpoint for edge nodes
-			edges.POST("/:edgeId/purges/:purgeId/complete", func(c *gin.Context) {
+			edges.POST("/:edgeId/purges/:purgeId/complete", requireEdgeToken(edgeService, "edgeId"), func(c *gin.Context) {
 				edgeIDStr := c.Param("edgeId")
 				edgeID, err := uuid.Parse(edgeIDStr)
 				if err != nil {
@@ -816,17 +876,31 @@ func SetupMultiTenantRoutes(
 					return
 				}
 
-				// For now, just acknowledge completion
-				// TODO: Update purge status in database
-				logrus.WithFields(logrus.Fields{
-					"edge_id":  edgeID,
-					"purge_id": purgeID,
-				}).Info("Purge completed by edge node")
+				if err := cacheService.CompletePurge(edgeID, purgeID); err != nil {
+					logrus.WithError(err).WithFields(logrus.Fields{
+						"edge_id":  edgeID,
+						"purge_id": purgeID,
+					}).Error("Failed to complete purge")
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete purge"})
+					return
+				}
 
 				c.JSON(http.StatusOK, gin.H{"status": "completed"})
 			})
+
+			// Push channel for purges and domain changes
+			edges.GET("/:edgeId/events", requireEdgeToken(edgeService, "edgeId"), streamEdgeEvents(edgeEventService, "edgeId"))
+
+			// Origin health check results from edge nodes
+			edges.POST("/:edgeId/origin-health", requireEdgeToken(edgeService, "edgeId"), reportOriginHealth(originService, "edgeId"))
+
+			// Domain private keys, only for the edge presenting its registration token
+			edges.GET("/:edgeId/certificates/:domain", requireEdgeToken(edgeService, "edgeId"), getEdgeCertificate(domainService))
 		}
 
+		// HTTP-01 challenge responses for automatic certificates, served by edges
+		global.GET("/acme/http-01/:token", getACMEChallenge(acmeService))
+
 		// Dashboard backward-compatibility routes (use demo organization)
 		demoOrgID := uuid.MustParse("3fbdbdad-dbf5-4ac1-9335-e644302769ad")
 
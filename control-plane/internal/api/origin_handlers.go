@@ -0,0 +1,190 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/naijcloud/control-plane/internal/middleware"
+	"github.com/naijcloud/control-plane/internal/models"
+	"github.com/naijcloud/control-plane/internal/services"
+	"github.com/sirupsen/logrus"
+)
+
+// OriginHandler manages the origin pool of a domain
+type OriginHandler struct {
+	originService *services.OriginService
+}
+
+func NewOriginHandler(originService *services.OriginService) *OriginHandler {
+	return &OriginHandler{
+		originService: originService,
+	}
+}
+
+// ListOrigins returns a domain's origin pool with each origin's health
+func (h *OriginHandler) ListOrigins(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+
+	origins, err := h.originService.ListOrigins(orgID, domainName)
+	if err != nil {
+		respondOriginError(c, err, domainName, "Failed to list origins")
+		return
+	}
+	if origins == nil {
+		origins = []*models.DomainOrigin{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"origins": origins})
+}
+
+// CreateOrigin adds an origin to a domain's pool
+func (h *OriginHandler) CreateOrigin(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+
+	var req models.CreateOriginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	origin, err := h.originService.CreateOrigin(orgID, domainName, &req)
+	if err != nil {
+		respondOriginError(c, err, domainName, "Failed to create origin")
+		return
+	}
+
+	c.JSON(http.StatusCreated, origin)
+}
+
+// GetOrigin retrieves a single pool origin with its health
+func (h *OriginHandler) GetOrigin(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+	originID, err := uuid.Parse(c.Param("originId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid origin ID"})
+		return
+	}
+
+	origin, err := h.originService.GetOrigin(orgID, domainName, originID)
+	if err != nil {
+		respondOriginError(c, err, domainName, "Failed to get origin")
+		return
+	}
+
+	c.JSON(http.StatusOK, origin)
+}
+
+// UpdateOrigin changes a pool origin's URL, weight, priority or state
+func (h *OriginHandler) UpdateOrigin(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+	originID, err := uuid.Parse(c.Param("originId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid origin ID"})
+		return
+	}
+
+	var req models.UpdateOriginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	origin, err := h.originService.UpdateOrigin(orgID, domainName, originID, &req)
+	if err != nil {
+		respondOriginError(c, err, domainName, "Failed to update origin")
+		return
+	}
+
+	c.JSON(http.StatusOK, origin)
+}
+
+// DeleteOrigin removes an origin from a domain's pool
+func (h *OriginHandler) DeleteOrigin(c *gin.Context) {
+	orgID, err := middleware.ExtractOrganizationID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organization not specified"})
+		return
+	}
+
+	domainName := c.Param("domain")
+	originID, err := uuid.Parse(c.Param("originId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid origin ID"})
+		return
+	}
+
+	if err := h.originService.DeleteOrigin(orgID, domainName, originID); err != nil {
+		respondOriginError(c, err, domainName, "Failed to delete origin")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Origin deleted successfully"})
+}
+
+// respondOriginError maps origin service errors to responses
+func respondOriginError(c *gin.Context, err error, domainName, message string) {
+	switch {
+	case err.Error() == "domain not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+	case err.Error() == "origin not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Origin not found"})
+	case strings.HasPrefix(err.Error(), "invalid origin"):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		logrus.WithError(err).WithField("domain", domainName).Error(message)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+// reportOriginHealth records the origin health check results an edge node
+// sends after each round of checks. edgeParam names the route parameter
+// holding the edge ID.
+func reportOriginHealth(service *services.OriginService, edgeParam string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		edgeID, err := uuid.Parse(c.Param(edgeParam))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid edge ID"})
+			return
+		}
+
+		var req models.OriginHealthReport
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := service.RecordOriginHealth(edgeID, &req); err != nil {
+			logrus.WithError(err).WithField("edge_id", edgeID).Error("Failed to record origin health")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record origin health"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "recorded"})
+	}
+}
@@ -15,6 +15,23 @@ type Config struct {
 	LogLevel    string
 	JWTSecret   string
 	Environment string
+
+	// Automatic certificates for active domains over ACME. The directory
+	// URL can point at a local Pebble instance for testing, with its CA
+	// added through ACMECAFile.
+	ACMEEnabled       bool
+	ACMEDirectoryURL  string
+	ACMECAFile        string
+	AutoCertEmail     string
+	ACMERenewBefore   int // days before expiry
+	ACMECheckInterval int // seconds
+
+	// Base64-encoded 32-byte key that encrypts certificate private keys at
+	// rest
+	CertEncryptionKey string
+
+	// Secret edges present to register. Edges cannot register without one.
+	EdgeRegistrationSecret string
 }
 
 func Load() (*Config, error) {
@@ -28,6 +45,10 @@ func Load() (*Config, error) {
 	viper.SetDefault("metrics_port", "9091")
 	viper.SetDefault("log_level", "info")
 	viper.SetDefault("environment", "development")
+	viper.SetDefault("acme_enabled", false)
+	viper.SetDefault("acme_directory_url", "https://acme-v02.api.letsencrypt.org/directory")
+	viper.SetDefault("acme_renew_before", 30)
+	viper.SetDefault("acme_check_interval", 300)
 
 	// Environment variables
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
@@ -48,6 +69,17 @@ func Load() (*Config, error) {
 		LogLevel:    viper.GetString("log_level"),
 		JWTSecret:   getEnvOrDefault("JWT_SECRET", "dev-secret-change-in-production"),
 		Environment: viper.GetString("environment"),
+
+		ACMEEnabled:       viper.GetBool("acme_enabled"),
+		ACMEDirectoryURL:  viper.GetString("acme_directory_url"),
+		ACMECAFile:        viper.GetString("acme_ca_file"),
+		AutoCertEmail:     viper.GetString("autocert_email"),
+		ACMERenewBefore:   viper.GetInt("acme_renew_before"),
+		ACMECheckInterval: viper.GetInt("acme_check_interval"),
+
+		CertEncryptionKey: os.Getenv("CERT_ENCRYPTION_KEY"),
+
+		EdgeRegistrationSecret: os.Getenv("EDGE_REGISTRATION_SECRET"),
 	}
 
 	return config, nil
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -88,15 +89,212 @@ type APIKeyUsage struct {
 
 // Domain represents a registered domain in the system
 type Domain struct {
-	ID             uuid.UUID  `json:"id" db:"id"`
-	OrganizationID *uuid.UUID `json:"organization_id" db:"organization_id"`
-	Domain         string     `json:"domain" db:"domain"`
-	OriginURL      string     `json:"origin_url" db:"origin_url"`
-	CacheTTL       int        `json:"cache_ttl" db:"cache_ttl"`
-	RateLimit      int        `json:"rate_limit" db:"rate_limit"`
-	Status         string     `json:"status" db:"status"`
-	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
-	UpdatedAt      time.Time  `json:"updated_at" db:"updated_at"`
+	ID                uuid.UUID          `json:"id" db:"id"`
+	OrganizationID    *uuid.UUID         `json:"organization_id" db:"organization_id"`
+	Domain            string             `json:"domain" db:"domain"`
+	OriginURL         string             `json:"origin_url" db:"origin_url"`
+	CacheTTL          int                `json:"cache_ttl" db:"cache_ttl"`
+	RateLimit         int                `json:"rate_limit" db:"rate_limit"`
+	Status            string             `json:"status" db:"status"`
+	Settings          DomainSettings     `json:"settings" db:"settings"`
+	CachePolicies     []*CachePolicy     `json:"cache_policies,omitempty" db:"-"` // ordered, delivered to edges with the domain
+	Certificate       *DomainCertificate `json:"certificate,omitempty" db:"-"`    // only included in the configuration edges fetch, without its key
+	CertificateStatus *CertificateStatus `json:"certificate_status,omitempty" db:"-"`
+	Origins           []*DomainOrigin    `json:"origins,omitempty" db:"-"` // pool replacing OriginURL when non-empty
+	Shield            *DomainShield      `json:"shield,omitempty" db:"-"`  // only included in the configuration edges fetch
+	CreatedAt         time.Time          `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time          `json:"updated_at" db:"updated_at"`
+}
+
+// DomainSettings holds per-domain edge behaviour delivered to edge nodes
+type DomainSettings struct {
+	CoalesceRequests  bool `json:"coalesce_requests"`   // collapse concurrent cache misses into one origin fetch
+	CoalesceTimeoutMs int  `json:"coalesce_timeout_ms"` // how long waiting requests wait for the shared fetch
+
+	// Stale serving windows in seconds, used when the origin response does
+	// not carry its own stale-while-revalidate / stale-if-error directives
+	StaleWhileRevalidate int `json:"stale_while_revalidate"`
+	StaleIfError         int `json:"stale_if_error"`
+
+	// AllowUpgrades lets WebSocket and other Upgrade requests be tunnelled
+	// to the origin. Tunnels idle for UpgradeIdleTimeout seconds are closed;
+	// zero uses the edge's default.
+	AllowUpgrades      bool `json:"allow_upgrades"`
+	UpgradeIdleTimeout int  `json:"upgrade_idle_timeout"`
+
+	// HTTPSRedirect sends plain HTTP requests to HTTPS. HSTSMaxAge, in
+	// seconds, adds a Strict-Transport-Security header to HTTPS responses
+	// when non-zero.
+	HTTPSRedirect         bool `json:"https_redirect"`
+	HSTSMaxAge            int  `json:"hsts_max_age"`
+	HSTSIncludeSubdomains bool `json:"hsts_include_subdomains"`
+	HSTSPreload           bool `json:"hsts_preload"`
+
+	// Compression lets edges compress responses the origin sent
+	// uncompressed, with brotli or gzip as the client accepts, caching one
+	// copy per encoding. CompressionTypes replaces the edge's list of
+	// compressible content types when set ("text/*" and
+	// "application/*+json" style wildcards are allowed), and bodies smaller
+	// than CompressionMinSize bytes are sent as-is; zero uses 1KB.
+	Compression        bool     `json:"compression"`
+	CompressionTypes   []string `json:"compression_types,omitempty"`
+	CompressionMinSize int      `json:"compression_min_size"`
+
+	// LoadBalancing picks how edges spread requests over the origin pool:
+	// round_robin, least_connections or consistent_hash. Edges probe each
+	// origin at HealthCheckPath and stop sending it requests while it
+	// fails.
+	LoadBalancing   string `json:"load_balancing"`
+	HealthCheckPath string `json:"health_check_path"`
+
+	// ShieldRegion names the region whose edges act as an origin shield:
+	// edges in other regions fetch cache misses through a healthy edge
+	// there instead of from the origin. Empty disables shielding.
+	ShieldRegion string `json:"shield_region,omitempty"`
+}
+
+// DomainShield lists the healthy edges in a domain's shield region
+type DomainShield struct {
+	Region string        `json:"region"`
+	Edges  []*ShieldEdge `json:"edges"`
+}
+
+// ShieldEdge is an edge other edges can fetch through
+type ShieldEdge struct {
+	ID      uuid.UUID `json:"id"`
+	Address string    `json:"address"` // host:port of the edge's HTTP listener
+}
+
+// DomainCertificate is the TLS certificate edges serve for a domain
+type DomainCertificate struct {
+	CertPEM   string    `json:"cert_pem"` // leaf first, then intermediates
+	KeyPEM    string    `json:"key_pem,omitempty"` // only served to authenticated edges
+	NotAfter  time.Time `json:"not_after"`
+	Source    string    `json:"source"` // acme or custom
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Certificate sources
+const (
+	CertificateSourceACME   = "acme"
+	CertificateSourceCustom = "custom"
+)
+
+// CustomCertificate is a certificate uploaded for a domain. Its private key
+// is stored encrypted and never returned.
+type CustomCertificate struct {
+	ID          uuid.UUID `json:"id" db:"id"`
+	DomainID    uuid.UUID `json:"domain_id" db:"domain_id"`
+	CertPEM     string    `json:"certificate_pem" db:"cert_pem"`
+	Subject     string    `json:"subject" db:"subject"`
+	Issuer      string    `json:"issuer" db:"issuer"`
+	SANs        []string  `json:"sans" db:"sans"`
+	Fingerprint string    `json:"fingerprint" db:"fingerprint"` // SHA-256 of the leaf certificate
+	NotBefore   time.Time `json:"not_before" db:"not_before"`
+	NotAfter    time.Time `json:"not_after" db:"not_after"`
+	Active      bool      `json:"active" db:"-"` // served by edges
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+// UploadCertificateRequest uploads a PEM certificate chain, leaf first, and
+// its private key. The certificate is activated unless Activate is false.
+type UploadCertificateRequest struct {
+	CertificatePEM string `json:"certificate_pem" binding:"required"`
+	PrivateKeyPEM  string `json:"private_key_pem" binding:"required"`
+	Activate       *bool  `json:"activate,omitempty"`
+}
+
+// Automatic certificate states
+const (
+	CertificateStatusPending = "pending"
+	CertificateStatusIssued  = "issued"
+	CertificateStatusFailed  = "failed"
+)
+
+// CertificateStatus is the state of a domain's automatic (ACME) certificate
+type CertificateStatus struct {
+	Status        string     `json:"status"`
+	NotAfter      *time.Time `json:"not_after,omitempty"`
+	Failures      int        `json:"failures"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+// DefaultDomainSettings returns the settings used for new domains and for
+// any keys missing from a domain's stored settings
+func DefaultDomainSettings() DomainSettings {
+	return DomainSettings{
+		CoalesceRequests:  true,
+		CoalesceTimeoutMs: 5000,
+		Compression:       true,
+		LoadBalancing:     LoadBalancingRoundRobin,
+		HealthCheckPath:   "/",
+	}
+}
+
+// Origin pool load balancing modes
+const (
+	LoadBalancingRoundRobin       = "round_robin"
+	LoadBalancingLeastConnections = "least_connections"
+	LoadBalancingConsistentHash   = "consistent_hash"
+)
+
+// DomainOrigin is one origin server in a domain's pool. Edges send requests
+// to the enabled origins of the lowest priority that has a healthy member,
+// so higher priorities only take traffic on failover.
+type DomainOrigin struct {
+	ID        uuid.UUID     `json:"id" db:"id"`
+	DomainID  uuid.UUID     `json:"domain_id" db:"domain_id"`
+	URL       string        `json:"url" db:"url"`
+	Weight    int           `json:"weight" db:"weight"`
+	Priority  int           `json:"priority" db:"priority"`
+	Enabled   bool          `json:"enabled" db:"enabled"`
+	Health    *OriginHealth `json:"health,omitempty" db:"-"` // only included when listing a pool
+	CreatedAt time.Time     `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at" db:"updated_at"`
+}
+
+// Origin health states, as seen across the edges probing an origin
+const (
+	OriginHealthHealthy   = "healthy"
+	OriginHealthDegraded  = "degraded" // failing on some edges
+	OriginHealthUnhealthy = "unhealthy"
+	OriginHealthUnknown   = "unknown" // no recent reports
+)
+
+// OriginHealth summarizes the health check results edges recently reported
+// for an origin
+type OriginHealth struct {
+	Status       string              `json:"status"`
+	HealthyEdges int                 `json:"healthy_edges"`
+	TotalEdges   int                 `json:"total_edges"`
+	Edges        []*OriginEdgeHealth `json:"edges"`
+}
+
+// OriginEdgeHealth is one edge's view of an origin
+type OriginEdgeHealth struct {
+	EdgeID            uuid.UUID `json:"edge_id"`
+	Healthy           bool      `json:"healthy"`
+	LatencyMs         int64     `json:"latency_ms"`
+	Error             string    `json:"error,omitempty"`
+	ActiveConnections int64     `json:"active_connections"`
+	CheckedAt         time.Time `json:"checked_at"`
+}
+
+// OriginHealthReport is an edge's batch of health check results
+type OriginHealthReport struct {
+	Origins []OriginHealthCheck `json:"origins" binding:"required"`
+}
+
+// OriginHealthCheck is the latest health check result for one origin
+type OriginHealthCheck struct {
+	OriginID          uuid.UUID `json:"origin_id" binding:"required"`
+	Healthy           bool      `json:"healthy"`
+	LatencyMs         int64     `json:"latency_ms"`
+	Error             string    `json:"error,omitempty"`
+	ActiveConnections int64     `json:"active_connections"`
+	CheckedAt         time.Time `json:"checked_at"`
 }
 
 // Edge represents an edge proxy node
@@ -111,18 +309,25 @@ type Edge struct {
 	LastHeartbeat  time.Time   `json:"last_heartbeat" db:"last_heartbeat"`
 	CreatedAt      time.Time   `json:"created_at" db:"created_at"`
 	Metadata       interface{} `json:"metadata" db:"metadata"`
+	Token          string      `json:"token,omitempty" db:"-"` // only returned when the edge registers
 }
 
-// CachePolicy represents caching rules for a domain
+// CachePolicy represents caching rules for a domain. A domain's policies are
+// evaluated in ascending priority order and the first whose pattern matches
+// the request path applies.
 type CachePolicy struct {
 	ID               uuid.UUID  `json:"id" db:"id"`
 	OrganizationID   *uuid.UUID `json:"organization_id" db:"organization_id"`
 	DomainID         uuid.UUID  `json:"domain_id" db:"domain_id"`
+	Priority         int        `json:"priority" db:"priority"`
+	MatchType        string     `json:"match_type" db:"match_type"` // glob, regex
 	PathPattern      string     `json:"path_pattern" db:"path_pattern"`
-	CacheTTL         int        `json:"cache_ttl" db:"cache_ttl"`
+	CacheTTL         int        `json:"cache_ttl" db:"cache_ttl"` // seconds, 0 keeps the origin's TTL
 	CacheKeyTemplate string     `json:"cache_key_template" db:"cache_key_template"`
 	HeadersToVary    []string   `json:"headers_to_vary" db:"headers_to_vary"`
+	Bypass           bool       `json:"bypass" db:"bypass"` // send matching requests straight to the origin
 	CreatedAt        time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at" db:"updated_at"`
 }
 
 // RequestLog represents a logged HTTP request
@@ -149,6 +354,7 @@ type PurgeRequest struct {
 	OrganizationID *uuid.UUID `json:"organization_id" db:"organization_id"`
 	DomainID       uuid.UUID  `json:"domain_id" db:"domain_id"`
 	Paths          []string   `json:"paths" db:"paths"`
+	Tags           []string   `json:"tags,omitempty" db:"tags"`
 	Status         string     `json:"status" db:"status"`
 	RequestedBy    string     `json:"requested_by" db:"requested_by"`
 	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
@@ -169,16 +375,72 @@ type Analytics struct {
 
 // CreateDomainRequest represents the request to create a new domain
 type CreateDomainRequest struct {
-	Domain    string `json:"domain" binding:"required"`
-	OriginURL string `json:"origin_url" binding:"required"`
-	CacheTTL  int    `json:"cache_ttl"`
+	Domain    string          `json:"domain" binding:"required"`
+	OriginURL string          `json:"origin_url" binding:"required"`
+	CacheTTL  int             `json:"cache_ttl"`
+	Settings  json.RawMessage `json:"settings"` // partial DomainSettings, merged over the defaults
 }
 
 // UpdateDomainRequest represents the request to update a domain
 type UpdateDomainRequest struct {
-	OriginURL string `json:"origin_url"`
-	CacheTTL  int    `json:"cache_ttl"`
-	RateLimit int    `json:"rate_limit"`
+	OriginURL string          `json:"origin_url"`
+	CacheTTL  int             `json:"cache_ttl"`
+	RateLimit int             `json:"rate_limit"`
+	Settings  json.RawMessage `json:"settings"` // partial DomainSettings, merged over the current settings
+}
+
+// CreateOriginRequest represents the request to add an origin to a domain's pool
+type CreateOriginRequest struct {
+	URL      string `json:"url" binding:"required"`
+	Weight   *int   `json:"weight"` // defaults to 1
+	Priority int    `json:"priority"`
+	Enabled  *bool  `json:"enabled"` // defaults to true
+}
+
+// UpdateOriginRequest represents the request to update a pool origin.
+// Omitted fields keep their current values.
+type UpdateOriginRequest struct {
+	URL      *string `json:"url"`
+	Weight   *int    `json:"weight"`
+	Priority *int    `json:"priority"`
+	Enabled  *bool   `json:"enabled"`
+}
+
+// CreateCachePolicyRequest represents the request to add a cache policy to a domain
+type CreateCachePolicyRequest struct {
+	Priority         *int     `json:"priority"`   // defaults to after the domain's existing policies
+	MatchType        string   `json:"match_type"` // defaults to glob
+	PathPattern      string   `json:"path_pattern" binding:"required"`
+	CacheTTL         int      `json:"cache_ttl"`
+	CacheKeyTemplate string   `json:"cache_key_template"`
+	HeadersToVary    []string `json:"headers_to_vary"`
+	Bypass           bool     `json:"bypass"`
+}
+
+// UpdateCachePolicyRequest represents the request to update a cache policy.
+// Omitted fields keep their current values.
+type UpdateCachePolicyRequest struct {
+	Priority         *int     `json:"priority"`
+	MatchType        *string  `json:"match_type"`
+	PathPattern      *string  `json:"path_pattern"`
+	CacheTTL         *int     `json:"cache_ttl"`
+	CacheKeyTemplate *string  `json:"cache_key_template"`
+	HeadersToVary    []string `json:"headers_to_vary"`
+	Bypass           *bool    `json:"bypass"`
+}
+
+// MatchCachePolicyRequest asks which of a domain's cache policies applies to a URL
+type MatchCachePolicyRequest struct {
+	URL string `json:"url" binding:"required"` // full URL or path with optional query
+}
+
+// CachePolicyMatch is the result of a cache policy dry run
+type CachePolicyMatch struct {
+	Path      string       `json:"path"`
+	Matched   bool         `json:"matched"`
+	Position  int          `json:"position,omitempty"` // 1-based position in evaluation order
+	Policy    *CachePolicy `json:"policy,omitempty"`
+	Evaluated int          `json:"evaluated"` // policies checked before a match was found
 }
 
 // RegisterEdgeRequest represents the request to register an edge node
@@ -187,6 +449,7 @@ type RegisterEdgeRequest struct {
 	IPAddress string `json:"ip_address" binding:"required"`
 	Hostname  string `json:"hostname"`
 	Capacity  int    `json:"capacity"`
+	Port      int    `json:"port"` // HTTP port other edges reach it on when it is a shield
 }
 
 // HeartbeatRequest represents an edge node heartbeat
@@ -195,9 +458,11 @@ type HeartbeatRequest struct {
 	Metrics map[string]interface{} `json:"metrics"`
 }
 
-// PurgeRequestBody represents a cache purge request
+// PurgeRequestBody represents a cache purge request. Tags purge everything
+// the origin tagged with them through Surrogate-Key or Cache-Tag headers.
 type PurgeRequestBody struct {
 	Paths []string `json:"paths"`
+	Tags  []string `json:"tags"`
 }
 
 // CreateAPIKeyRequest represents the request to create a new API key
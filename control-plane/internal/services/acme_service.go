@@ -0,0 +1,503 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/naijcloud/control-plane/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+var acmeOrders = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "acme_certificate_orders_total",
+		Help: "ACME certificate orders by result (issued, failed)",
+	},
+	[]string{"result"},
+)
+
+const (
+	// acmeChallengeTTL bounds how long an HTTP-01 key authorization is
+	// served, well past the time a CA takes to validate it
+	acmeChallengeTTL = time.Hour
+
+	// acmeOrderTimeout bounds a single certificate order
+	acmeOrderTimeout = 5 * time.Minute
+
+	// Failed orders are retried with exponential backoff up to a day, and
+	// owners are notified at most once a day while they keep failing
+	acmeRetryBase      = time.Hour
+	acmeRetryMax       = 24 * time.Hour
+	acmeNotifyInterval = 24 * time.Hour
+
+	// acmeBatchSize caps the orders placed per check
+	acmeBatchSize = 50
+)
+
+// ACMEConfig configures automatic certificates
+type ACMEConfig struct {
+	DirectoryURL  string
+	Email         string        // account contact, optional
+	RenewBefore   time.Duration // renew certificates expiring within this window
+	CheckInterval time.Duration
+	HTTPClient    *http.Client // for the ACME directory, e.g. trusting Pebble's CA
+}
+
+// ACMEService obtains and renews certificates for active domains over ACME,
+// using HTTP-01 challenges that edges answer on the control plane's behalf
+type ACMEService struct {
+	db            *sql.DB
+	redis         *redis.Client
+	notifications *NotificationService
+	keys          *CertificateKeys
+	config        ACMEConfig
+
+	clientMu sync.Mutex
+	client   *acme.Client
+}
+
+func NewACMEService(db *sql.DB, redis *redis.Client, notifications *NotificationService, keys *CertificateKeys, config ACMEConfig) *ACMEService {
+	if config.RenewBefore <= 0 {
+		config.RenewBefore = 30 * 24 * time.Hour
+	}
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = 5 * time.Minute
+	}
+	return &ACMEService{
+		db:            db,
+		redis:         redis,
+		notifications: notifications,
+		keys:          keys,
+		config:        config,
+	}
+}
+
+// Run renews due certificates every check interval until ctx is done
+func (s *ACMEService) Run(ctx context.Context) {
+	logrus.WithFields(logrus.Fields{
+		"directory": s.config.DirectoryURL,
+		"email":     s.config.Email,
+	}).Info("Automatic certificates enabled")
+
+	ticker := time.NewTicker(s.config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.RenewDue(ctx); err != nil {
+			logrus.WithError(err).Error("Failed to check certificates for renewal")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dueDomain is an active domain whose certificate is missing or expiring
+type dueDomain struct {
+	id             uuid.UUID
+	name           string
+	organizationID *uuid.UUID
+	failures       int
+	lastNotifiedAt *time.Time
+}
+
+// RenewDue orders certificates for active domains that have none or whose
+// ACME certificate expires within the renewal window, skipping domains
+// still backing off from a failed order. Domains serving a custom
+// certificate are left alone.
+func (s *ACMEService) RenewDue(ctx context.Context) error {
+	query := `
+		SELECT d.id, d.domain, d.organization_id, COALESCE(r.failures, 0), r.last_notified_at
+		FROM domains d
+		LEFT JOIN domain_certificates c ON c.domain_id = d.id
+		LEFT JOIN domain_certificate_renewals r ON r.domain_id = d.id
+		WHERE d.status = 'active'
+		  AND (c.domain_id IS NULL OR (c.source = 'acme' AND c.not_after < $1))
+		  AND (r.next_attempt_at IS NULL OR r.next_attempt_at <= NOW())
+		ORDER BY c.not_after NULLS FIRST
+		LIMIT $2
+	`
+	rows, err := s.db.QueryContext(ctx, query, time.Now().Add(s.config.RenewBefore), acmeBatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to list domains due for certificates: %w", err)
+	}
+
+	var due []dueDomain
+	for rows.Next() {
+		var domain dueDomain
+		if err := rows.Scan(&domain.id, &domain.name, &domain.organizationID, &domain.failures, &domain.lastNotifiedAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan domain: %w", err)
+		}
+		due = append(due, domain)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list domains due for certificates: %w", err)
+	}
+
+	for _, domain := range due {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.renew(ctx, domain)
+	}
+	return nil
+}
+
+// renew orders a certificate for a domain and records the outcome. Only one
+// control plane instance works on a domain at a time.
+func (s *ACMEService) renew(ctx context.Context, domain dueDomain) {
+	lockKey := fmt.Sprintf("acme:lock:%s", domain.id)
+	locked, err := s.redis.SetNX(ctx, lockKey, "1", acmeOrderTimeout).Result()
+	if err != nil || !locked {
+		return
+	}
+	defer s.redis.Del(context.Background(), lockKey)
+
+	logger := logrus.WithField("domain", domain.name)
+
+	orderCtx, cancel := context.WithTimeout(ctx, acmeOrderTimeout)
+	cert, err := s.obtainCertificate(orderCtx, domain.name)
+	cancel()
+	if err != nil {
+		acmeOrders.WithLabelValues("failed").Inc()
+		logger.WithError(err).Warn("Failed to obtain certificate")
+		s.recordFailure(domain, err)
+		return
+	}
+
+	if err := saveACMECertificate(s.db, s.keys, domain.id, cert); err != nil {
+		acmeOrders.WithLabelValues("failed").Inc()
+		logger.WithError(err).Error("Failed to store certificate")
+		s.recordFailure(domain, err)
+		return
+	}
+	acmeOrders.WithLabelValues("issued").Inc()
+
+	query := `
+		INSERT INTO domain_certificate_renewals (domain_id, status, failures, last_attempt_at, next_attempt_at)
+		VALUES ($1, $2, 0, NOW(), NULL)
+		ON CONFLICT (domain_id) DO UPDATE
+		SET status = EXCLUDED.status, failures = 0, last_error = NULL, last_attempt_at = NOW(),
+		    next_attempt_at = NULL, last_notified_at = NULL, updated_at = NOW()
+	`
+	if _, err := s.db.Exec(query, domain.id, models.CertificateStatusIssued); err != nil {
+		logger.WithError(err).Warn("Failed to record certificate renewal")
+	}
+
+	// Edges pick the certificate up with the domain's configuration
+	if err := s.redis.Del(context.Background(), fmt.Sprintf("domain:%s", domain.name)).Err(); err != nil {
+		logger.WithError(err).Warn("Failed to invalidate cached domain config")
+	}
+	publishDomainChange(s.redis, domain.name)
+
+	logger.WithField("not_after", cert.NotAfter).Info("Certificate issued")
+}
+
+// recordFailure backs off the domain's next order and notifies its
+// organization's owners and admins
+func (s *ACMEService) recordFailure(domain dueDomain, orderErr error) {
+	failures := domain.failures + 1
+	backoff := acmeRetryBase << (failures - 1)
+	if backoff > acmeRetryMax || backoff <= 0 {
+		backoff = acmeRetryMax
+	}
+
+	notify := domain.organizationID != nil &&
+		(domain.lastNotifiedAt == nil || time.Since(*domain.lastNotifiedAt) >= acmeNotifyInterval)
+
+	query := `
+		INSERT INTO domain_certificate_renewals (domain_id, status, failures, last_error, last_attempt_at, next_attempt_at, last_notified_at)
+		VALUES ($1, $2, $3, $4, NOW(), $5, CASE WHEN $6 THEN NOW() END)
+		ON CONFLICT (domain_id) DO UPDATE
+		SET status = EXCLUDED.status, failures = EXCLUDED.failures, last_error = EXCLUDED.last_error,
+		    last_attempt_at = NOW(), next_attempt_at = EXCLUDED.next_attempt_at,
+		    last_notified_at = COALESCE(EXCLUDED.last_notified_at, domain_certificate_renewals.last_notified_at),
+		    updated_at = NOW()
+	`
+	_, err := s.db.Exec(query, domain.id, models.CertificateStatusFailed, failures, orderErr.Error(), time.Now().Add(backoff), notify)
+	if err != nil {
+		logrus.WithError(err).WithField("domain", domain.name).Error("Failed to record certificate failure")
+		return
+	}
+
+	if notify {
+		s.notifyFailure(domain, failures, orderErr)
+	}
+}
+
+// notifyFailure tells an organization's owners and admins that a domain's
+// certificate could not be obtained
+func (s *ACMEService) notifyFailure(domain dueDomain, failures int, orderErr error) {
+	ctx := context.Background()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT user_id FROM organization_members
+		WHERE organization_id = $1 AND role IN ('owner', 'admin')
+	`, *domain.organizationID)
+	if err != nil {
+		logrus.WithError(err).WithField("domain", domain.name).Error("Failed to find users to notify of certificate failure")
+		return
+	}
+	defer rows.Close()
+
+	title := fmt.Sprintf("Certificate renewal failed for %s", domain.name)
+	message := fmt.Sprintf("We could not obtain a TLS certificate for %s: %v. Check that the domain's DNS points at NaijCloud; we will keep retrying.", domain.name, orderErr)
+	data := map[string]interface{}{
+		"domain":   domain.name,
+		"failures": failures,
+		"error":    orderErr.Error(),
+	}
+
+	for rows.Next() {
+		var userID uuid.UUID
+		if err := rows.Scan(&userID); err != nil {
+			logrus.WithError(err).Warn("Failed to scan organization member")
+			continue
+		}
+		notification := &Notification{
+			OrganizationID: domain.organizationID,
+			UserID:         userID,
+			Type:           "in_app",
+			Channel:        "certificate_renewal_failed",
+			Title:          title,
+			Message:        message,
+			Data:           data,
+			Priority:       "high",
+		}
+		if err := s.notifications.CreateNotification(ctx, notification); err != nil {
+			logrus.WithError(err).WithField("user_id", userID).Warn("Failed to send certificate failure notification")
+		}
+	}
+}
+
+// obtainCertificate runs an ACME order for a domain, answering its HTTP-01
+// challenge through the edges, and returns the issued certificate
+func (s *ACMEService) obtainCertificate(ctx context.Context, domain string) (*models.DomainCertificate, error) {
+	client, err := s.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order: %w", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := s.authorize(ctx, client, authzURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, fmt.Errorf("order not ready: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize order: %w", err)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("CA returned no certificate")
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate from CA: %w", err)
+	}
+
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	return &models.DomainCertificate{
+		CertPEM:  string(certPEM),
+		KeyPEM:   string(keyPEM),
+		NotAfter: leaf.NotAfter,
+	}, nil
+}
+
+// authorize completes an authorization with its HTTP-01 challenge
+func (s *ACMEService) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to get authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("CA offered no http-01 challenge for %s", authz.Identifier.Value)
+	}
+
+	keyAuth, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return fmt.Errorf("failed to compute challenge response: %w", err)
+	}
+	key := acmeChallengeKey(challenge.Token)
+	if err := s.redis.Set(ctx, key, keyAuth, acmeChallengeTTL).Err(); err != nil {
+		return fmt.Errorf("failed to store challenge response: %w", err)
+	}
+	defer s.redis.Del(context.Background(), key)
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept challenge: %w", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("challenge failed: %w", err)
+	}
+	return nil
+}
+
+// ChallengeResponse returns the key authorization edges serve for an
+// HTTP-01 challenge token
+func (s *ACMEService) ChallengeResponse(ctx context.Context, token string) (string, error) {
+	keyAuth, err := s.redis.Get(ctx, acmeChallengeKey(token)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", fmt.Errorf("challenge not found")
+		}
+		return "", fmt.Errorf("failed to get challenge: %w", err)
+	}
+	return keyAuth, nil
+}
+
+func acmeChallengeKey(token string) string {
+	return fmt.Sprintf("acme:http-01:%s", token)
+}
+
+// acmeClient returns a client for the configured directory, registering an
+// account on first use and reusing its key afterwards
+func (s *ACMEService) acmeClient(ctx context.Context) (*acme.Client, error) {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	key, err := s.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: s.config.DirectoryURL,
+		HTTPClient:   s.config.HTTPClient,
+		UserAgent:    "naijcloud-control-plane",
+	}
+
+	account := &acme.Account{}
+	if s.config.Email != "" {
+		account.Contact = []string{"mailto:" + s.config.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %w", err)
+	}
+
+	s.client = client
+	return client, nil
+}
+
+// accountKey loads the account key for the configured directory, creating
+// one if there is none
+func (s *ACMEService) accountKey(ctx context.Context) (crypto.Signer, error) {
+	var keyPEM string
+	err := s.db.QueryRowContext(ctx, "SELECT key_pem FROM acme_accounts WHERE directory_url = $1", s.config.DirectoryURL).Scan(&keyPEM)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to load ACME account: %w", err)
+	}
+
+	if err == sql.ErrNoRows {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ACME account key: %w", err)
+		}
+		encoded, err := encodeECKey(key)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := s.keys.Seal(string(encoded))
+		if err != nil {
+			return nil, err
+		}
+		// Another instance may have created the account first; use its key
+		_, err = s.db.ExecContext(ctx, `
+			INSERT INTO acme_accounts (directory_url, email, key_pem) VALUES ($1, $2, $3)
+			ON CONFLICT (directory_url) DO NOTHING
+		`, s.config.DirectoryURL, s.config.Email, sealed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store ACME account: %w", err)
+		}
+		if err := s.db.QueryRowContext(ctx, "SELECT key_pem FROM acme_accounts WHERE directory_url = $1", s.config.DirectoryURL).Scan(&keyPEM); err != nil {
+			return nil, fmt.Errorf("failed to load ACME account: %w", err)
+		}
+	}
+
+	if keyPEM, err = s.keys.Open(keyPEM); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("invalid ACME account key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACME account key: %w", err)
+	}
+	return key, nil
+}
+
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,401 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/naijcloud/control-plane/internal/models"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// Cache policy match types
+const (
+	MatchTypeGlob  = "glob"
+	MatchTypeRegex = "regex"
+)
+
+// cachePolicyPriorityStep is the gap left between policies added without an
+// explicit priority, so others can later be inserted between them
+const cachePolicyPriorityStep = 10
+
+const cachePolicyColumns = `id, organization_id, domain_id, priority, match_type, path_pattern, cache_ttl,
+	COALESCE(cache_key_template, ''), headers_to_vary, bypass, created_at, COALESCE(updated_at, created_at)`
+
+var (
+	// keyTemplateVariable matches {name} and {name:argument} placeholders
+	keyTemplateVariable = regexp.MustCompile(`\{([a-z]+)(?::([^{}]*))?\}`)
+	headerNamePattern   = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+)
+
+// keyTemplateVariables lists the cache key placeholders edges understand and
+// whether each takes an argument
+var keyTemplateVariables = map[string]bool{
+	"scheme": false,
+	"host":   false,
+	"path":   false,
+	"query":  true, // {query} is the whole query string, {query:name} one parameter
+	"header": true,
+	"cookie": true,
+}
+
+type CachePolicyService struct {
+	db            *sql.DB
+	redis         *redis.Client
+	domainService *DomainService
+}
+
+func NewCachePolicyService(db *sql.DB, redis *redis.Client, domainService *DomainService) *CachePolicyService {
+	return &CachePolicyService{
+		db:            db,
+		redis:         redis,
+		domainService: domainService,
+	}
+}
+
+// ListPolicies returns a domain's cache policies in evaluation order
+func (s *CachePolicyService) ListPolicies(orgID uuid.UUID, domainName string) ([]*models.CachePolicy, error) {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+	return domain.CachePolicies, nil
+}
+
+// GetPolicy retrieves one of a domain's cache policies
+func (s *CachePolicyService) GetPolicy(orgID uuid.UUID, domainName string, policyID uuid.UUID) (*models.CachePolicy, error) {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, policy := range domain.CachePolicies {
+		if policy.ID == policyID {
+			return policy, nil
+		}
+	}
+	return nil, fmt.Errorf("cache policy not found")
+}
+
+// CreatePolicy adds a cache policy to a domain
+func (s *CachePolicyService) CreatePolicy(orgID uuid.UUID, domainName string, req *models.CreateCachePolicyRequest) (*models.CachePolicy, error) {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	policy := &models.CachePolicy{
+		ID:               uuid.New(),
+		OrganizationID:   &orgID,
+		DomainID:         domain.ID,
+		MatchType:        req.MatchType,
+		PathPattern:      req.PathPattern,
+		CacheTTL:         req.CacheTTL,
+		CacheKeyTemplate: req.CacheKeyTemplate,
+		HeadersToVary:    req.HeadersToVary,
+		Bypass:           req.Bypass,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+
+	// Without an explicit priority the policy is evaluated last
+	if req.Priority != nil {
+		policy.Priority = *req.Priority
+	} else if n := len(domain.CachePolicies); n > 0 {
+		policy.Priority = domain.CachePolicies[n-1].Priority + cachePolicyPriorityStep
+	}
+
+	if err := normalizeCachePolicy(policy); err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO cache_policies (id, organization_id, domain_id, priority, match_type, path_pattern, cache_ttl,
+			cache_key_template, headers_to_vary, bypass, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`
+	_, err = s.db.Exec(query, policy.ID, policy.OrganizationID, policy.DomainID, policy.Priority, policy.MatchType,
+		policy.PathPattern, policy.CacheTTL, policy.CacheKeyTemplate, pq.Array(policy.HeadersToVary), policy.Bypass,
+		policy.CreatedAt, policy.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache policy: %w", err)
+	}
+
+	s.invalidateDomainConfig(domainName)
+
+	logrus.WithFields(logrus.Fields{
+		"domain":       domainName,
+		"policy_id":    policy.ID,
+		"path_pattern": policy.PathPattern,
+	}).Info("Cache policy created successfully")
+	return policy, nil
+}
+
+// UpdatePolicy applies a partial update to a cache policy
+func (s *CachePolicyService) UpdatePolicy(orgID uuid.UUID, domainName string, policyID uuid.UUID, req *models.UpdateCachePolicyRequest) (*models.CachePolicy, error) {
+	policy, err := s.GetPolicy(orgID, domainName, policyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Priority != nil {
+		policy.Priority = *req.Priority
+	}
+	if req.MatchType != nil {
+		policy.MatchType = *req.MatchType
+	}
+	if req.PathPattern != nil {
+		policy.PathPattern = *req.PathPattern
+	}
+	if req.CacheTTL != nil {
+		policy.CacheTTL = *req.CacheTTL
+	}
+	if req.CacheKeyTemplate != nil {
+		policy.CacheKeyTemplate = *req.CacheKeyTemplate
+	}
+	if req.HeadersToVary != nil {
+		policy.HeadersToVary = req.HeadersToVary
+	}
+	if req.Bypass != nil {
+		policy.Bypass = *req.Bypass
+	}
+	if err := normalizeCachePolicy(policy); err != nil {
+		return nil, err
+	}
+	policy.UpdatedAt = time.Now()
+
+	query := `
+		UPDATE cache_policies
+		SET priority = $1, match_type = $2, path_pattern = $3, cache_ttl = $4, cache_key_template = $5,
+			headers_to_vary = $6, bypass = $7, updated_at = $8
+		WHERE id = $9 AND domain_id = $10
+	`
+	_, err = s.db.Exec(query, policy.Priority, policy.MatchType, policy.PathPattern, policy.CacheTTL,
+		policy.CacheKeyTemplate, pq.Array(policy.HeadersToVary), policy.Bypass, policy.UpdatedAt, policy.ID, policy.DomainID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update cache policy: %w", err)
+	}
+
+	s.invalidateDomainConfig(domainName)
+
+	logrus.WithFields(logrus.Fields{
+		"domain":    domainName,
+		"policy_id": policy.ID,
+	}).Info("Cache policy updated successfully")
+	return policy, nil
+}
+
+// DeletePolicy removes a cache policy from a domain
+func (s *CachePolicyService) DeletePolicy(orgID uuid.UUID, domainName string, policyID uuid.UUID) error {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec("DELETE FROM cache_policies WHERE id = $1 AND domain_id = $2", policyID, domain.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete cache policy: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("cache policy not found")
+	}
+
+	s.invalidateDomainConfig(domainName)
+
+	logrus.WithFields(logrus.Fields{
+		"domain":    domainName,
+		"policy_id": policyID,
+	}).Info("Cache policy deleted successfully")
+	return nil
+}
+
+// MatchPolicy reports which of a domain's policies an edge would apply to
+// rawURL, without touching any cache
+func (s *CachePolicyService) MatchPolicy(orgID uuid.UUID, domainName string, rawURL string) (*models.CachePolicyMatch, error) {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	match := &models.CachePolicyMatch{Path: path}
+	for i, policy := range domain.CachePolicies {
+		match.Evaluated++
+
+		pattern, err := compileCachePolicyPattern(policy.MatchType, policy.PathPattern)
+		if err != nil {
+			logrus.WithError(err).WithField("policy_id", policy.ID).Warn("Skipping cache policy with invalid pattern")
+			continue
+		}
+		if pattern.MatchString(path) {
+			match.Matched = true
+			match.Position = i + 1
+			match.Policy = policy
+			break
+		}
+	}
+
+	return match, nil
+}
+
+// invalidateDomainConfig drops the cached domain configuration and notifies
+// edges so they pick up the changed policies on their next lookup
+func (s *CachePolicyService) invalidateDomainConfig(domainName string) {
+	key := fmt.Sprintf("domain:%s", domainName)
+	if err := s.redis.Del(context.Background(), key).Err(); err != nil {
+		logrus.WithError(err).Warn("Failed to invalidate cached domain config")
+	}
+	publishDomainChange(s.redis, domainName)
+}
+
+// listCachePolicies loads a domain's cache policies in evaluation order
+func listCachePolicies(db *sql.DB, domainID uuid.UUID) ([]*models.CachePolicy, error) {
+	query := `SELECT ` + cachePolicyColumns + ` FROM cache_policies WHERE domain_id = $1 ORDER BY priority, created_at, id`
+	rows, err := db.Query(query, domainID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache policies: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []*models.CachePolicy
+	for rows.Next() {
+		policy := &models.CachePolicy{}
+		err := rows.Scan(
+			&policy.ID, &policy.OrganizationID, &policy.DomainID, &policy.Priority, &policy.MatchType,
+			&policy.PathPattern, &policy.CacheTTL, &policy.CacheKeyTemplate, pq.Array(&policy.HeadersToVary),
+			&policy.Bypass, &policy.CreatedAt, &policy.UpdatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan cache policy: %w", err)
+		}
+		policies = append(policies, policy)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list cache policies: %w", err)
+	}
+
+	return policies, nil
+}
+
+// normalizeCachePolicy fills in defaults and validates a policy before it is
+// stored, so edges only ever receive policies they can compile
+func normalizeCachePolicy(policy *models.CachePolicy) error {
+	if policy.MatchType == "" {
+		policy.MatchType = MatchTypeGlob
+	}
+	policy.PathPattern = strings.TrimSpace(policy.PathPattern)
+	if policy.PathPattern == "" {
+		return fmt.Errorf("invalid cache policy: path_pattern is required")
+	}
+	if _, err := compileCachePolicyPattern(policy.MatchType, policy.PathPattern); err != nil {
+		return fmt.Errorf("invalid cache policy: %w", err)
+	}
+	if policy.CacheTTL < 0 {
+		return fmt.Errorf("invalid cache policy: cache_ttl must not be negative")
+	}
+	if err := validateKeyTemplate(policy.CacheKeyTemplate); err != nil {
+		return fmt.Errorf("invalid cache policy: %w", err)
+	}
+
+	headers := make([]string, 0, len(policy.HeadersToVary))
+	for _, name := range policy.HeadersToVary {
+		name = strings.TrimSpace(name)
+		if !headerNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid cache policy: invalid header name %q", name)
+		}
+		headers = append(headers, http.CanonicalHeaderKey(name))
+	}
+	policy.HeadersToVary = headers
+
+	return nil
+}
+
+// compileCachePolicyPattern compiles a policy's path pattern. Globs match the
+// whole path, with "*" matching any run of characters and "?" any single
+// character other than "/". Regular expressions match anywhere in the path
+// unless anchored.
+func compileCachePolicyPattern(matchType, pattern string) (*regexp.Regexp, error) {
+	switch matchType {
+	case MatchTypeGlob:
+		if !strings.HasPrefix(pattern, "/") && !strings.HasPrefix(pattern, "*") {
+			return nil, fmt.Errorf("glob pattern must start with / or *")
+		}
+		return regexp.Compile(globToRegexp(pattern))
+	case MatchTypeRegex:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		return re, nil
+	}
+	return nil, fmt.Errorf("unknown match_type %q", matchType)
+}
+
+// globToRegexp translates a path glob into an anchored regular expression
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// validateKeyTemplate checks that a cache key template only uses placeholders
+// edges can fill in. Templates need not use {host}: edges always scope keys
+// to the requesting host.
+func validateKeyTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+
+	for _, m := range keyTemplateVariable.FindAllStringSubmatch(template, -1) {
+		takesArgument, ok := keyTemplateVariables[m[1]]
+		if !ok {
+			return fmt.Errorf("unknown cache key variable {%s}", m[1])
+		}
+		hasArgument := strings.Contains(m[0], ":")
+		if hasArgument && (!takesArgument || m[2] == "") {
+			return fmt.Errorf("invalid cache key variable %s", m[0])
+		}
+		if !hasArgument && m[1] != "query" && takesArgument {
+			return fmt.Errorf("cache key variable {%s} needs a name, e.g. {%s:name}", m[1], m[1])
+		}
+	}
+
+	// Any brace left over is an unterminated or malformed placeholder
+	if strings.ContainsAny(keyTemplateVariable.ReplaceAllString(template, ""), "{}") {
+		return fmt.Errorf("malformed cache key template %q", template)
+	}
+	return nil
+}
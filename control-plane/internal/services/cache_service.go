@@ -24,12 +24,13 @@ func NewCacheService(redis *redis.Client, edgeService *EdgeService) *CacheServic
 	}
 }
 
-// PurgeCache initiates a cache purge for specified paths
-func (s *CacheService) PurgeCache(domainID uuid.UUID, paths []string, requestedBy string) (*models.PurgeRequest, error) {
+// PurgeCache initiates a cache purge for specified paths and cache tags
+func (s *CacheService) PurgeCache(domainID uuid.UUID, paths, tags []string, requestedBy string) (*models.PurgeRequest, error) {
 	purgeReq := &models.PurgeRequest{
 		ID:          uuid.New(),
 		DomainID:    domainID,
 		Paths:       paths,
+		Tags:        tags,
 		Status:      "pending",
 		RequestedBy: requestedBy,
 		CreatedAt:   time.Now(),
@@ -43,12 +44,17 @@ func (s *CacheService) PurgeCache(domainID uuid.UUID, paths []string, requestedB
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal paths: %w", err)
 	}
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tags: %w", err)
+	}
 
 	// Use individual SET operations instead of HMSet to avoid marshalling issues
 	pipe := s.redis.Pipeline()
 	pipe.HSet(context.Background(), purgeKey, "id", purgeReq.ID.String())
 	pipe.HSet(context.Background(), purgeKey, "domain_id", domainID.String())
 	pipe.HSet(context.Background(), purgeKey, "paths", string(pathsJSON))
+	pipe.HSet(context.Background(), purgeKey, "tags", string(tagsJSON))
 	pipe.HSet(context.Background(), purgeKey, "created_at", fmt.Sprintf("%d", purgeReq.CreatedAt.Unix()))
 	pipe.Expire(context.Background(), purgeKey, time.Hour)
 
@@ -59,15 +65,18 @@ func (s *CacheService) PurgeCache(domainID uuid.UUID, paths []string, requestedB
 		logrus.WithError(err).Warn("Failed to set purge request expiration")
 	}
 
-	// Notify all healthy edge nodes
+	// Queue the purge for all healthy edge nodes, then push it to the ones
+	// connected to an event stream
 	if err := s.notifyEdgeNodes(purgeReq); err != nil {
 		logrus.WithError(err).Warn("Failed to notify some edge nodes")
 	}
+	publishEdgeEvent(s.redis, EdgeEvent{Type: EdgeEventPurge, Purge: purgeReq})
 
 	logrus.WithFields(logrus.Fields{
 		"purge_id":  purgeReq.ID,
 		"domain_id": domainID,
 		"paths":     paths,
+		"tags":      tags,
 	}).Info("Cache purge initiated")
 
 	return purgeReq, nil
@@ -109,10 +118,18 @@ func (s *CacheService) GetPendingPurges(edgeID uuid.UUID) ([]*models.PurgeReques
 			}
 		}
 
+		var tags []string
+		if tagsStr, exists := purgeData["tags"]; exists {
+			if err := json.Unmarshal([]byte(tagsStr), &tags); err != nil {
+				logrus.WithError(err).WithField("purge_id", purgeIDStr).Warn("Failed to parse purge tags")
+			}
+		}
+
 		purgeReq := &models.PurgeRequest{
 			ID:       purgeID,
 			DomainID: domainID,
 			Paths:    paths,
+			Tags:     tags,
 			Status:   "pending",
 		}
 		purgeRequests = append(purgeRequests, purgeReq)
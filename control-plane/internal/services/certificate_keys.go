@@ -0,0 +1,64 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// sealedKeyPrefix marks private keys encrypted by CertificateKeys; keys
+// stored without it predate encryption and are read as plain PEM
+const sealedKeyPrefix = "v1:"
+
+// CertificateKeys encrypts the private keys of certificates and ACME
+// accounts at rest with AES-256-GCM
+type CertificateKeys struct {
+	aead cipher.AEAD
+}
+
+// NewCertificateKeys creates a key cipher from a 32-byte secret
+func NewCertificateKeys(secret []byte) (*CertificateKeys, error) {
+	if len(secret) != 32 {
+		return nil, fmt.Errorf("certificate encryption key must be 32 bytes, got %d", len(secret))
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate key cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate key cipher: %w", err)
+	}
+	return &CertificateKeys{aead: aead}, nil
+}
+
+// Seal encrypts a PEM private key for storage
+func (k *CertificateKeys) Seal(keyPEM string) (string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(keyPEM), nil)
+	return sealedKeyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a stored private key
+func (k *CertificateKeys) Open(stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedKeyPrefix) {
+		return stored, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedKeyPrefix))
+	if err != nil || len(sealed) < k.aead.NonceSize() {
+		return "", fmt.Errorf("failed to decrypt private key: malformed ciphertext")
+	}
+	nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	keyPEM, err := k.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt private key: %w", err)
+	}
+	return string(keyPEM), nil
+}
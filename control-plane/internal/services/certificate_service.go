@@ -0,0 +1,460 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/naijcloud/control-plane/internal/models"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// getDomainCertificateInfo loads the certificate edges serve for a domain
+// without its private key, or nil when the domain has none
+func getDomainCertificateInfo(db *sql.DB, domainID uuid.UUID) (*models.DomainCertificate, error) {
+	var cert models.DomainCertificate
+	row := db.QueryRow("SELECT cert_pem, not_after, source, updated_at FROM domain_certificates WHERE domain_id = $1", domainID)
+	if err := row.Scan(&cert.CertPEM, &cert.NotAfter, &cert.Source, &cert.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get domain certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// getDomainCertificate loads the certificate edges serve for a domain with
+// its decrypted private key, or nil when the domain has none
+func getDomainCertificate(db *sql.DB, keys *CertificateKeys, domainID uuid.UUID) (*models.DomainCertificate, error) {
+	var cert models.DomainCertificate
+	var storedKey string
+	row := db.QueryRow("SELECT cert_pem, key_pem, not_after, source, updated_at FROM domain_certificates WHERE domain_id = $1", domainID)
+	if err := row.Scan(&cert.CertPEM, &storedKey, &cert.NotAfter, &cert.Source, &cert.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get domain certificate: %w", err)
+	}
+
+	keyPEM, err := keys.Open(storedKey)
+	if err != nil {
+		return nil, err
+	}
+	cert.KeyPEM = keyPEM
+	return &cert, nil
+}
+
+// getCertificateStatus loads the state of a domain's automatic certificate,
+// or nil when none has been requested
+func getCertificateStatus(db *sql.DB, domainID uuid.UUID) (*models.CertificateStatus, error) {
+	var status models.CertificateStatus
+	var lastError sql.NullString
+	query := `
+		SELECT r.status, c.not_after, r.failures, r.last_error, r.last_attempt_at, r.next_attempt_at
+		FROM domain_certificate_renewals r
+		LEFT JOIN domain_certificates c ON c.domain_id = r.domain_id AND c.source = 'acme'
+		WHERE r.domain_id = $1
+	`
+	row := db.QueryRow(query, domainID)
+	if err := row.Scan(&status.Status, &status.NotAfter, &status.Failures, &lastError, &status.LastAttemptAt, &status.NextAttemptAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get certificate status: %w", err)
+	}
+	status.LastError = lastError.String
+	return &status, nil
+}
+
+// saveACMECertificate stores an ACME certificate as the one edges serve for a
+// domain, unless a custom certificate has been activated in the meantime
+func saveACMECertificate(db *sql.DB, keys *CertificateKeys, domainID uuid.UUID, cert *models.DomainCertificate) error {
+	sealedKey, err := keys.Seal(cert.KeyPEM)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO domain_certificates (domain_id, cert_pem, key_pem, not_after, source)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (domain_id) DO UPDATE
+		SET cert_pem = EXCLUDED.cert_pem, key_pem = EXCLUDED.key_pem, not_after = EXCLUDED.not_after, updated_at = NOW()
+		WHERE domain_certificates.source = EXCLUDED.source
+	`
+	if _, err := db.Exec(query, domainID, cert.CertPEM, sealedKey, cert.NotAfter, models.CertificateSourceACME); err != nil {
+		return fmt.Errorf("failed to save domain certificate: %w", err)
+	}
+	return nil
+}
+
+// Upload limits for certificate chains and private keys
+const (
+	maxCertificateChainSize = 64 * 1024
+	maxPrivateKeySize       = 16 * 1024
+)
+
+const customCertificateColumns = `c.id, c.domain_id, c.cert_pem, c.subject, c.issuer, c.sans, c.fingerprint,
+	c.not_before, c.not_after, c.created_at, (dc.custom_certificate_id IS NOT NULL)`
+
+// CertificateService manages the custom certificates customers upload for
+// their domains
+type CertificateService struct {
+	db            *sql.DB
+	redis         *redis.Client
+	domainService *DomainService
+	keys          *CertificateKeys
+}
+
+func NewCertificateService(db *sql.DB, redis *redis.Client, domainService *DomainService, keys *CertificateKeys) *CertificateService {
+	return &CertificateService{
+		db:            db,
+		redis:         redis,
+		domainService: domainService,
+		keys:          keys,
+	}
+}
+
+// ListCertificates returns a domain's custom certificates, newest first
+func (s *CertificateService) ListCertificates(orgID uuid.UUID, domainName string) ([]*models.CustomCertificate, error) {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + customCertificateColumns + `
+		FROM custom_certificates c
+		LEFT JOIN domain_certificates dc ON dc.custom_certificate_id = c.id
+		WHERE c.domain_id = $1
+		ORDER BY c.created_at DESC`
+	rows, err := s.db.Query(query, domain.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificates: %w", err)
+	}
+	defer rows.Close()
+
+	var certs []*models.CustomCertificate
+	for rows.Next() {
+		cert, err := scanCustomCertificate(rows)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list certificates: %w", err)
+	}
+	return certs, nil
+}
+
+// GetCertificate retrieves one of a domain's custom certificates
+func (s *CertificateService) GetCertificate(orgID uuid.UUID, domainName string, certID uuid.UUID) (*models.CustomCertificate, error) {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+	return s.getCertificate(domain.ID, certID)
+}
+
+func (s *CertificateService) getCertificate(domainID, certID uuid.UUID) (*models.CustomCertificate, error) {
+	query := `SELECT ` + customCertificateColumns + `
+		FROM custom_certificates c
+		LEFT JOIN domain_certificates dc ON dc.custom_certificate_id = c.id
+		WHERE c.id = $1 AND c.domain_id = $2`
+	cert, err := scanCustomCertificate(s.db.QueryRow(query, certID, domainID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("certificate not found")
+		}
+		return nil, err
+	}
+	return cert, nil
+}
+
+// UploadCertificate validates and stores a certificate chain and key for a
+// domain, activating it unless the request says otherwise
+func (s *CertificateService) UploadCertificate(orgID uuid.UUID, domainName string, req *models.UploadCertificateRequest) (*models.CustomCertificate, error) {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	chainPEM, keyPEM, leaf, err := parseCertificateUpload(domain.Domain, req.CertificatePEM, req.PrivateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	activate := req.Activate == nil || *req.Activate
+	if activate {
+		if err := checkCertificateCurrent(leaf); err != nil {
+			return nil, err
+		}
+	}
+
+	sealedKey, err := s.keys.Seal(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+	cert := &models.CustomCertificate{
+		ID:          uuid.New(),
+		DomainID:    domain.ID,
+		CertPEM:     chainPEM,
+		Subject:     leaf.Subject.String(),
+		Issuer:      leaf.Issuer.String(),
+		SANs:        certificateSANs(leaf),
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		NotBefore:   leaf.NotBefore,
+		NotAfter:    leaf.NotAfter,
+	}
+
+	query := `
+		INSERT INTO custom_certificates (id, domain_id, cert_pem, key_pem, subject, issuer, sans, fingerprint, not_before, not_after)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING created_at
+	`
+	err = s.db.QueryRow(query, cert.ID, cert.DomainID, cert.CertPEM, sealedKey, cert.Subject, cert.Issuer,
+		pq.Array(cert.SANs), cert.Fingerprint, cert.NotBefore, cert.NotAfter).Scan(&cert.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store certificate: %w", err)
+	}
+
+	if activate {
+		if err := s.activate(domain.Domain, cert.ID, chainPEM, sealedKey, cert.NotAfter); err != nil {
+			return nil, err
+		}
+		cert.Active = true
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"domain":         domain.Domain,
+		"certificate_id": cert.ID,
+		"not_after":      cert.NotAfter,
+		"active":         cert.Active,
+	}).Info("Custom certificate uploaded")
+	return cert, nil
+}
+
+// ActivateCertificate makes a custom certificate the one edges serve for its
+// domain. Edges switch to it for new connections as soon as they refetch the
+// domain's configuration; open connections are unaffected.
+func (s *CertificateService) ActivateCertificate(orgID uuid.UUID, domainName string, certID uuid.UUID) (*models.CustomCertificate, error) {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	var chainPEM, sealedKey string
+	err = s.db.QueryRow("SELECT cert_pem, key_pem FROM custom_certificates WHERE id = $1 AND domain_id = $2", certID, domain.ID).Scan(&chainPEM, &sealedKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("certificate not found")
+		}
+		return nil, fmt.Errorf("failed to get certificate: %w", err)
+	}
+
+	leaf, err := parseLeafCertificate(chainPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCertificateCurrent(leaf); err != nil {
+		return nil, err
+	}
+
+	if err := s.activate(domain.Domain, certID, chainPEM, sealedKey, leaf.NotAfter); err != nil {
+		return nil, err
+	}
+	return s.getCertificate(domain.ID, certID)
+}
+
+// activate replaces the certificate edges serve for a domain in one write,
+// so edges always find either the old certificate or the new one
+func (s *CertificateService) activate(domainName string, certID uuid.UUID, chainPEM, sealedKey string, notAfter time.Time) error {
+	query := `
+		INSERT INTO domain_certificates (domain_id, cert_pem, key_pem, not_after, source, custom_certificate_id)
+		SELECT domain_id, $2, $3, $4, $5, id FROM custom_certificates WHERE id = $1
+		ON CONFLICT (domain_id) DO UPDATE
+		SET cert_pem = EXCLUDED.cert_pem, key_pem = EXCLUDED.key_pem, not_after = EXCLUDED.not_after,
+		    source = EXCLUDED.source, custom_certificate_id = EXCLUDED.custom_certificate_id, updated_at = NOW()
+	`
+	if _, err := s.db.Exec(query, certID, chainPEM, sealedKey, notAfter, models.CertificateSourceCustom); err != nil {
+		return fmt.Errorf("failed to activate certificate: %w", err)
+	}
+
+	s.invalidateDomainConfig(domainName)
+	logrus.WithFields(logrus.Fields{
+		"domain":         domainName,
+		"certificate_id": certID,
+	}).Info("Custom certificate activated")
+	return nil
+}
+
+// DeleteCertificate removes a custom certificate. If it was active, edges
+// fall back to their default certificate until an ACME certificate is
+// issued for the domain.
+func (s *CertificateService) DeleteCertificate(orgID uuid.UUID, domainName string, certID uuid.UUID) error {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return err
+	}
+
+	cert, err := s.getCertificate(domain.ID, certID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec("DELETE FROM custom_certificates WHERE id = $1", certID); err != nil {
+		return fmt.Errorf("failed to delete certificate: %w", err)
+	}
+
+	if cert.Active {
+		s.invalidateDomainConfig(domain.Domain)
+	}
+	return nil
+}
+
+// invalidateDomainConfig drops the cached domain configuration and notifies
+// edges so they pick up the changed certificate
+func (s *CertificateService) invalidateDomainConfig(domainName string) {
+	key := fmt.Sprintf("domain:%s", domainName)
+	if err := s.redis.Del(context.Background(), key).Err(); err != nil {
+		logrus.WithError(err).Warn("Failed to invalidate cached domain config")
+	}
+	publishDomainChange(s.redis, domainName)
+}
+
+func scanCustomCertificate(row interface{ Scan(...interface{}) error }) (*models.CustomCertificate, error) {
+	var cert models.CustomCertificate
+	err := row.Scan(&cert.ID, &cert.DomainID, &cert.CertPEM, &cert.Subject, &cert.Issuer, pq.Array(&cert.SANs),
+		&cert.Fingerprint, &cert.NotBefore, &cert.NotAfter, &cert.CreatedAt, &cert.Active)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to scan certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// parseCertificateUpload checks that an uploaded chain is well formed, in
+// order from the leaf, valid for the domain and matches the key. It returns
+// the chain and key re-encoded as PEM, with anything else in the upload
+// dropped, and the leaf certificate.
+func parseCertificateUpload(domain, certPEM, keyPEM string) (string, string, *x509.Certificate, error) {
+	if len(certPEM) > maxCertificateChainSize {
+		return "", "", nil, fmt.Errorf("invalid certificate: chain larger than %d bytes", maxCertificateChainSize)
+	}
+	if len(keyPEM) > maxPrivateKeySize {
+		return "", "", nil, fmt.Errorf("invalid certificate: private key larger than %d bytes", maxPrivateKeySize)
+	}
+
+	var chain []*x509.Certificate
+	var chainPEM strings.Builder
+	rest := []byte(certPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid certificate: certificate %d: %v", len(chain)+1, err)
+		}
+		chain = append(chain, cert)
+		chainPEM.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: block.Bytes}))
+	}
+	if len(chain) == 0 {
+		return "", "", nil, fmt.Errorf("invalid certificate: no PEM certificates found")
+	}
+
+	leaf := chain[0]
+	if err := leaf.VerifyHostname(domain); err != nil {
+		sans := certificateSANs(leaf)
+		if len(sans) == 0 {
+			return "", "", nil, fmt.Errorf("invalid certificate: not valid for %s; the leaf certificate must come first", domain)
+		}
+		return "", "", nil, fmt.Errorf("invalid certificate: not valid for %s (covers %s)", domain, strings.Join(sans, ", "))
+	}
+	for i := 1; i < len(chain); i++ {
+		if err := chain[i-1].CheckSignatureFrom(chain[i]); err != nil {
+			return "", "", nil, fmt.Errorf("invalid certificate: certificate %d is not signed by certificate %d; the chain must be in order from the leaf", i, i+1)
+		}
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return "", "", nil, fmt.Errorf("invalid certificate: expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	keyBlock := findPrivateKeyBlock([]byte(keyPEM))
+	if keyBlock == nil {
+		return "", "", nil, fmt.Errorf("invalid certificate: no PEM private key found")
+	}
+	normalizedKey := string(pem.EncodeToMemory(keyBlock))
+	if _, err := tls.X509KeyPair([]byte(chainPEM.String()), []byte(normalizedKey)); err != nil {
+		return "", "", nil, fmt.Errorf("invalid certificate: private key does not match the certificate: %v", err)
+	}
+
+	return chainPEM.String(), normalizedKey, leaf, nil
+}
+
+// findPrivateKeyBlock returns the first private key in PEM data
+func findPrivateKeyBlock(data []byte) *pem.Block {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if block.Type == "PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY") {
+			return &pem.Block{Type: block.Type, Bytes: block.Bytes}
+		}
+	}
+}
+
+// parseLeafCertificate parses the first certificate of a stored chain
+func parseLeafCertificate(chainPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(chainPEM))
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse stored certificate")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse stored certificate: %w", err)
+	}
+	return leaf, nil
+}
+
+// checkCertificateCurrent rejects activating a certificate outside its
+// validity period
+func checkCertificateCurrent(leaf *x509.Certificate) error {
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("invalid certificate: not valid until %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("invalid certificate: expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// certificateSANs lists the DNS names and IP addresses a certificate covers
+func certificateSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,14 +15,18 @@ import (
 )
 
 type DomainService struct {
-	db    *sql.DB
-	redis *redis.Client
+	db          *sql.DB
+	redis       *redis.Client
+	keys        *CertificateKeys
+	edgeService *EdgeService
 }
 
-func NewDomainService(db *sql.DB, redis *redis.Client) *DomainService {
+func NewDomainService(db *sql.DB, redis *redis.Client, keys *CertificateKeys, edgeService *EdgeService) *DomainService {
 	return &DomainService{
-		db:    db,
-		redis: redis,
+		db:          db,
+		redis:       redis,
+		keys:        keys,
+		edgeService: edgeService,
 	}
 }
 
@@ -43,6 +48,11 @@ func (s *DomainService) CreateDomain(orgID uuid.UUID, req *models.CreateDomainRe
 		cacheTTL = 3600 // 1 hour default
 	}
 
+	settings := models.DefaultDomainSettings()
+	if err := mergeDomainSettings(&settings, req.Settings); err != nil {
+		return nil, err
+	}
+
 	domain := &models.Domain{
 		ID:             uuid.New(),
 		OrganizationID: &orgID,
@@ -51,22 +61,29 @@ func (s *DomainService) CreateDomain(orgID uuid.UUID, req *models.CreateDomainRe
 		CacheTTL:       cacheTTL,
 		RateLimit:      1000, // Default rate limit
 		Status:         "active",
+		Settings:       settings,
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
 	}
 
+	settingsJSON, err := json.Marshal(domain.Settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal domain settings: %w", err)
+	}
+
 	query := `
-		INSERT INTO domains (id, organization_id, domain, origin_url, cache_ttl, rate_limit, status, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		INSERT INTO domains (id, organization_id, domain, origin_url, cache_ttl, rate_limit, status, settings, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	`
 	_, err = s.db.Exec(query, domain.ID, domain.OrganizationID, domain.Domain, domain.OriginURL, domain.CacheTTL,
-		domain.RateLimit, domain.Status, domain.CreatedAt, domain.UpdatedAt)
+		domain.RateLimit, domain.Status, settingsJSON, domain.CreatedAt, domain.UpdatedAt)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create domain: %w", err)
 	}
 
 	// Cache domain configuration in Redis
 	s.cacheDomainConfig(domain)
+	publishDomainChange(s.redis, domain.Domain)
 
 	logrus.WithFields(logrus.Fields{
 		"domain":          domain.Domain,
@@ -78,35 +95,133 @@ func (s *DomainService) CreateDomain(orgID uuid.UUID, req *models.CreateDomainRe
 // GetDomain retrieves a domain by name for an organization
 func (s *DomainService) GetDomain(orgID uuid.UUID, domainName string) (*models.Domain, error) {
 	var domain models.Domain
-	row := s.db.QueryRow("SELECT id, organization_id, domain, origin_url, cache_ttl, rate_limit, status, created_at, updated_at FROM domains WHERE domain = $1 AND organization_id = $2", domainName, orgID)
-	err := row.Scan(&domain.ID, &domain.OrganizationID, &domain.Domain, &domain.OriginURL, &domain.CacheTTL, &domain.RateLimit, &domain.Status, &domain.CreatedAt, &domain.UpdatedAt)
+	var settingsJSON []byte
+	row := s.db.QueryRow("SELECT id, organization_id, domain, origin_url, cache_ttl, rate_limit, status, settings, created_at, updated_at FROM domains WHERE domain = $1 AND organization_id = $2", domainName, orgID)
+	err := row.Scan(&domain.ID, &domain.OrganizationID, &domain.Domain, &domain.OriginURL, &domain.CacheTTL, &domain.RateLimit, &domain.Status, &settingsJSON, &domain.CreatedAt, &domain.UpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("domain not found")
 		}
 		return nil, fmt.Errorf("failed to get domain: %w", err)
 	}
+	domain.Settings = parseDomainSettings(settingsJSON)
+	if domain.CachePolicies, err = listCachePolicies(s.db, domain.ID); err != nil {
+		return nil, err
+	}
+	if domain.Origins, err = listDomainOrigins(s.db, domain.ID); err != nil {
+		return nil, err
+	}
+	if domain.CertificateStatus, err = getCertificateStatus(s.db, domain.ID); err != nil {
+		return nil, err
+	}
 	return &domain, nil
 }
 
 // GetDomainByID retrieves a domain by ID for an organization
 func (s *DomainService) GetDomainByID(orgID uuid.UUID, domainID uuid.UUID) (*models.Domain, error) {
 	var domain models.Domain
-	row := s.db.QueryRow("SELECT id, organization_id, domain, origin_url, cache_ttl, rate_limit, status, created_at, updated_at FROM domains WHERE id = $1 AND organization_id = $2", domainID, orgID)
-	err := row.Scan(&domain.ID, &domain.OrganizationID, &domain.Domain, &domain.OriginURL, &domain.CacheTTL, &domain.RateLimit, &domain.Status, &domain.CreatedAt, &domain.UpdatedAt)
+	var settingsJSON []byte
+	row := s.db.QueryRow("SELECT id, organization_id, domain, origin_url, cache_ttl, rate_limit, status, settings, created_at, updated_at FROM domains WHERE id = $1 AND organization_id = $2", domainID, orgID)
+	err := row.Scan(&domain.ID, &domain.OrganizationID, &domain.Domain, &domain.OriginURL, &domain.CacheTTL, &domain.RateLimit, &domain.Status, &settingsJSON, &domain.CreatedAt, &domain.UpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("domain not found")
 		}
 		return nil, fmt.Errorf("failed to get domain: %w", err)
 	}
+	domain.Settings = parseDomainSettings(settingsJSON)
+	if domain.CachePolicies, err = listCachePolicies(s.db, domain.ID); err != nil {
+		return nil, err
+	}
+	if domain.Origins, err = listDomainOrigins(s.db, domain.ID); err != nil {
+		return nil, err
+	}
+	if domain.CertificateStatus, err = getCertificateStatus(s.db, domain.ID); err != nil {
+		return nil, err
+	}
 	return &domain, nil
 }
 
+// GetDomainConfig retrieves a domain by name with everything edges need to
+// serve it. Its TLS certificate comes without the private key, which edges
+// fetch with GetDomainCertificate.
+func (s *DomainService) GetDomainConfig(orgID uuid.UUID, domainName string) (*models.Domain, error) {
+	domain, err := s.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+	if domain.Certificate, err = getDomainCertificateInfo(s.db, domain.ID); err != nil {
+		return nil, err
+	}
+	domain.Shield = s.domainShield(domain)
+	return domain, nil
+}
+
+// GetDomainConfigByID is GetDomainConfig for a domain ID
+func (s *DomainService) GetDomainConfigByID(orgID uuid.UUID, domainID uuid.UUID) (*models.Domain, error) {
+	domain, err := s.GetDomainByID(orgID, domainID)
+	if err != nil {
+		return nil, err
+	}
+	if domain.Certificate, err = getDomainCertificateInfo(s.db, domain.ID); err != nil {
+		return nil, err
+	}
+	domain.Shield = s.domainShield(domain)
+	return domain, nil
+}
+
+// GetDomainCertificate retrieves the certificate a domain is served with and
+// its decrypted private key, looking the domain up by name across
+// organizations. An edge dedicated to an organization passes it as orgID and
+// only gets that organization's domains; nil is for edges serving every
+// organization. It is only for the route authenticated edges fetch keys from.
+func (s *DomainService) GetDomainCertificate(orgID *uuid.UUID, domainName string) (*models.DomainCertificate, error) {
+	var domainID uuid.UUID
+	err := s.db.QueryRow("SELECT id FROM domains WHERE domain = $1 AND ($2::uuid IS NULL OR organization_id = $2)", domainName, orgID).Scan(&domainID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("domain not found")
+		}
+		return nil, fmt.Errorf("failed to get domain: %w", err)
+	}
+	cert, err := getDomainCertificate(s.db, s.keys, domainID)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, fmt.Errorf("certificate not found")
+	}
+	return cert, nil
+}
+
+// domainShield resolves the domain's shield region to the healthy edges in
+// it. Edges fetch from the origin when the shield cannot be resolved, so a
+// failed lookup leaves the domain unshielded rather than failing.
+func (s *DomainService) domainShield(domain *models.Domain) *models.DomainShield {
+	region := domain.Settings.ShieldRegion
+	if region == "" {
+		return nil
+	}
+
+	edges, err := s.edgeService.GetHealthyEdges(region)
+	if err != nil {
+		logrus.WithError(err).WithField("domain", domain.Domain).Warn("Failed to resolve shield edges")
+		return nil
+	}
+
+	shield := &models.DomainShield{Region: region, Edges: []*models.ShieldEdge{}}
+	for _, edge := range edges {
+		if address := edgeAddress(edge); address != "" {
+			shield.Edges = append(shield.Edges, &models.ShieldEdge{ID: edge.ID, Address: address})
+		}
+	}
+	return shield
+}
+
 // ListDomains retrieves all domains for an organization
 func (s *DomainService) ListDomains(orgID uuid.UUID) ([]*models.Domain, error) {
 	query := `
-		SELECT id, organization_id, domain, origin_url, cache_ttl, rate_limit, status, created_at, updated_at
+		SELECT id, organization_id, domain, origin_url, cache_ttl, rate_limit, status, settings, created_at, updated_at
 		FROM domains WHERE organization_id = $1 ORDER BY created_at DESC
 	`
 	rows, err := s.db.Query(query, orgID)
@@ -118,13 +233,15 @@ func (s *DomainService) ListDomains(orgID uuid.UUID) ([]*models.Domain, error) {
 	var domains []*models.Domain
 	for rows.Next() {
 		domain := &models.Domain{}
+		var settingsJSON []byte
 		err := rows.Scan(
 			&domain.ID, &domain.OrganizationID, &domain.Domain, &domain.OriginURL, &domain.CacheTTL,
-			&domain.RateLimit, &domain.Status, &domain.CreatedAt, &domain.UpdatedAt,
+			&domain.RateLimit, &domain.Status, &settingsJSON, &domain.CreatedAt, &domain.UpdatedAt,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan domain: %w", err)
 		}
+		domain.Settings = parseDomainSettings(settingsJSON)
 		domains = append(domains, domain)
 	}
 
@@ -149,20 +266,29 @@ func (s *DomainService) UpdateDomain(orgID uuid.UUID, domainName string, req *mo
 	if req.RateLimit > 0 {
 		domain.RateLimit = req.RateLimit
 	}
+	if err := mergeDomainSettings(&domain.Settings, req.Settings); err != nil {
+		return nil, err
+	}
 	domain.UpdatedAt = time.Now()
 
+	settingsJSON, err := json.Marshal(domain.Settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal domain settings: %w", err)
+	}
+
 	query := `
 		UPDATE domains 
-		SET origin_url = $1, cache_ttl = $2, rate_limit = $3, updated_at = $4
-		WHERE domain = $5 AND organization_id = $6
+		SET origin_url = $1, cache_ttl = $2, rate_limit = $3, settings = $4, updated_at = $5
+		WHERE domain = $6 AND organization_id = $7
 	`
-	_, err = s.db.Exec(query, domain.OriginURL, domain.CacheTTL, domain.RateLimit, domain.UpdatedAt, domainName, orgID)
+	_, err = s.db.Exec(query, domain.OriginURL, domain.CacheTTL, domain.RateLimit, settingsJSON, domain.UpdatedAt, domainName, orgID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update domain: %w", err)
 	}
 
 	// Update cache
 	s.cacheDomainConfig(domain)
+	publishDomainChange(s.redis, domainName)
 
 	logrus.WithFields(logrus.Fields{
 		"domain":          domainName,
@@ -188,6 +314,7 @@ func (s *DomainService) DeleteDomain(orgID uuid.UUID, domainName string) error {
 
 	// Remove from cache
 	s.redis.Del(context.Background(), fmt.Sprintf("domain:%s", domainName))
+	publishDomainChange(s.redis, domainName)
 
 	logrus.WithFields(logrus.Fields{
 		"domain":          domainName,
@@ -196,6 +323,73 @@ func (s *DomainService) DeleteDomain(orgID uuid.UUID, domainName string) error {
 	return nil
 }
 
+// parseDomainSettings decodes stored settings over the defaults so that keys
+// added after a domain was created pick up their default values
+func parseDomainSettings(data []byte) models.DomainSettings {
+	settings := models.DefaultDomainSettings()
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &settings); err != nil {
+			logrus.WithError(err).Warn("Failed to parse domain settings, using defaults")
+			return models.DefaultDomainSettings()
+		}
+	}
+	return settings
+}
+
+// mergeDomainSettings applies a partial settings document from a request
+func mergeDomainSettings(settings *models.DomainSettings, raw json.RawMessage) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, settings); err != nil {
+		return fmt.Errorf("invalid domain settings: %w", err)
+	}
+	if settings.CoalesceTimeoutMs < 0 {
+		return fmt.Errorf("invalid domain settings: coalesce_timeout_ms must not be negative")
+	}
+	if settings.StaleWhileRevalidate < 0 || settings.StaleIfError < 0 {
+		return fmt.Errorf("invalid domain settings: stale windows must not be negative")
+	}
+	if settings.UpgradeIdleTimeout < 0 {
+		return fmt.Errorf("invalid domain settings: upgrade_idle_timeout must not be negative")
+	}
+	if settings.HSTSMaxAge < 0 {
+		return fmt.Errorf("invalid domain settings: hsts_max_age must not be negative")
+	}
+	if settings.CompressionMinSize < 0 {
+		return fmt.Errorf("invalid domain settings: compression_min_size must not be negative")
+	}
+	for _, contentType := range settings.CompressionTypes {
+		if mainType, subType, ok := strings.Cut(contentType, "/"); !ok || mainType == "" || subType == "" {
+			return fmt.Errorf("invalid domain settings: compression type %q is not a media type", contentType)
+		}
+	}
+	switch settings.LoadBalancing {
+	case models.LoadBalancingRoundRobin, models.LoadBalancingLeastConnections, models.LoadBalancingConsistentHash:
+	default:
+		return fmt.Errorf("invalid domain settings: unknown load_balancing %q", settings.LoadBalancing)
+	}
+	if !strings.HasPrefix(settings.HealthCheckPath, "/") {
+		return fmt.Errorf("invalid domain settings: health_check_path must start with /")
+	}
+	if len(settings.ShieldRegion) > 64 || strings.ContainsAny(settings.ShieldRegion, " \t\r\n") {
+		return fmt.Errorf("invalid domain settings: shield_region must be a region name")
+	}
+	return nil
+}
+
+// DomainChangesChannel is the Redis channel edges watch for domain
+// configuration changes; each message is the changed domain's name
+const DomainChangesChannel = "domain-config-changes"
+
+// publishDomainChange tells edges to drop their cached configuration for a
+// domain. Edges that miss it pick the change up when their copy expires.
+func publishDomainChange(client *redis.Client, domainName string) {
+	if err := client.Publish(context.Background(), DomainChangesChannel, domainName).Err(); err != nil {
+		logrus.WithError(err).WithField("domain", domainName).Warn("Failed to publish domain change")
+	}
+}
+
 // Helper methods for caching
 func (s *DomainService) cacheDomainConfig(domain *models.Domain) {
 	data, err := json.Marshal(domain)
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/naijcloud/control-plane/internal/models"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// EdgeEventsChannel is the Redis channel purge events are published on, so
+// every control plane instance can forward them to the edges connected to it
+const EdgeEventsChannel = "edge-events"
+
+// Edge event types
+const (
+	EdgeEventPurge         = "purge"
+	EdgeEventDomainChanged = "domain_changed"
+)
+
+// EdgeEvent is a message pushed to edge nodes
+type EdgeEvent struct {
+	Type   string               `json:"type"`
+	Purge  *models.PurgeRequest `json:"purge,omitempty"`
+	Domain string               `json:"domain,omitempty"`
+}
+
+// EdgeEventService streams purge and domain change events to edge nodes
+type EdgeEventService struct {
+	redis        *redis.Client
+	cacheService *CacheService
+}
+
+func NewEdgeEventService(redis *redis.Client, cacheService *CacheService) *EdgeEventService {
+	return &EdgeEventService{
+		redis:        redis,
+		cacheService: cacheService,
+	}
+}
+
+// Subscribe returns the events for an edge node until ctx is done: first the
+// purges still queued for it, then live purges and domain changes. Purges
+// stay queued until the edge completes them, so none are lost if the
+// stream drops before they are acknowledged.
+func (s *EdgeEventService) Subscribe(ctx context.Context, edgeID uuid.UUID) (<-chan EdgeEvent, error) {
+	// Subscribe before reading the queue so nothing published in between
+	// is missed
+	pubsub := s.redis.Subscribe(ctx, EdgeEventsChannel, DomainChangesChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to edge events: %w", err)
+	}
+
+	pending, err := s.cacheService.GetPendingPurges(edgeID)
+	if err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	events := make(chan EdgeEvent, 64)
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+
+		send := func(event EdgeEvent) bool {
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, purge := range pending {
+			if !send(EdgeEvent{Type: EdgeEventPurge, Purge: purge}) {
+				return
+			}
+		}
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+
+				event := EdgeEvent{Type: EdgeEventDomainChanged, Domain: msg.Payload}
+				if msg.Channel == EdgeEventsChannel {
+					if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+						logrus.WithError(err).Warn("Dropping malformed edge event")
+						continue
+					}
+				}
+				if !send(event) {
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// publishEdgeEvent sends an event to every connected edge node
+func publishEdgeEvent(client *redis.Client, event EdgeEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to encode edge event")
+		return
+	}
+	if err := client.Publish(context.Background(), EdgeEventsChannel, data).Err(); err != nil {
+		logrus.WithError(err).WithField("type", event.Type).Warn("Failed to publish edge event")
+	}
+}
@@ -2,9 +2,15 @@ package services
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,8 +32,21 @@ func NewEdgeService(db *sql.DB, redis *redis.Client) *EdgeService {
 	}
 }
 
-// RegisterEdge registers a new edge node
+// RegisterEdge registers a new edge node. The returned edge carries the token
+// it authenticates with; only the token's hash is stored, so it cannot be
+// retrieved again.
 func (s *EdgeService) RegisterEdge(req *models.RegisterEdgeRequest) (*models.Edge, error) {
+	token, err := generateEdgeToken()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]interface{}{}
+	if req.Port > 0 {
+		// Shield lookups give other edges this edge's address
+		metadata["port"] = req.Port
+	}
+
 	edge := &models.Edge{
 		ID:            uuid.New(),
 		Region:        req.Region,
@@ -37,7 +56,7 @@ func (s *EdgeService) RegisterEdge(req *models.RegisterEdgeRequest) (*models.Edg
 		Status:        "healthy",
 		LastHeartbeat: time.Now(),
 		CreatedAt:     time.Now(),
-		Metadata:      map[string]interface{}{},
+		Metadata:      metadata,
 	}
 
 	if edge.Capacity == 0 {
@@ -45,18 +64,19 @@ func (s *EdgeService) RegisterEdge(req *models.RegisterEdgeRequest) (*models.Edg
 	}
 
 	query := `
-		INSERT INTO edges (id, region, ip_address, hostname, capacity, status, last_heartbeat, created_at, metadata)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		INSERT INTO edges (id, region, ip_address, hostname, capacity, status, last_heartbeat, created_at, metadata, token_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	`
 	metadataJSON, _ := json.Marshal(edge.Metadata)
-	_, err := s.db.Exec(query, edge.ID, edge.Region, edge.IPAddress, edge.Hostname,
-		edge.Capacity, edge.Status, edge.LastHeartbeat, edge.CreatedAt, metadataJSON)
+	_, err = s.db.Exec(query, edge.ID, edge.Region, edge.IPAddress, edge.Hostname,
+		edge.Capacity, edge.Status, edge.LastHeartbeat, edge.CreatedAt, metadataJSON, hashEdgeToken(token))
 	if err != nil {
 		return nil, fmt.Errorf("failed to register edge: %w", err)
 	}
 
-	// Cache edge information
+	// Cache edge information, before the token is set so it stays out of Redis
 	s.cacheEdge(edge)
+	edge.Token = token
 
 	logrus.WithFields(logrus.Fields{
 		"edge_id": edge.ID,
@@ -67,6 +87,42 @@ func (s *EdgeService) RegisterEdge(req *models.RegisterEdgeRequest) (*models.Edg
 	return edge, nil
 }
 
+// AuthenticateEdge checks the token an edge presents against the one it was
+// issued at registration. It returns the organization the edge is dedicated
+// to, or nil for an edge that serves every organization.
+func (s *EdgeService) AuthenticateEdge(edgeID uuid.UUID, token string) (*uuid.UUID, error) {
+	var tokenHash sql.NullString
+	var orgID *uuid.UUID
+	err := s.db.QueryRow("SELECT token_hash, organization_id FROM edges WHERE id = $1", edgeID).Scan(&tokenHash, &orgID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("edge not found")
+		}
+		return nil, fmt.Errorf("failed to authenticate edge: %w", err)
+	}
+
+	// Edges registered before tokens were issued have none and must register again
+	if !tokenHash.Valid || subtle.ConstantTimeCompare([]byte(tokenHash.String), []byte(hashEdgeToken(token))) != 1 {
+		return nil, fmt.Errorf("invalid edge token")
+	}
+	return orgID, nil
+}
+
+// generateEdgeToken returns a random edge token
+func generateEdgeToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", fmt.Errorf("failed to generate edge token: %w", err)
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// hashEdgeToken returns the hex SHA-256 of an edge token, as stored
+func hashEdgeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 // GetEdge retrieves an edge by ID
 func (s *EdgeService) GetEdge(edgeID uuid.UUID) (*models.Edge, error) {
 	// Try cache first
@@ -510,3 +566,20 @@ func (s *EdgeService) getCachedEdge(edgeID uuid.UUID) (*models.Edge, error) {
 
 	return &edge, nil
 }
+
+// edgeAddress returns the host:port other edges reach an edge's HTTP
+// listener at, or "" when the edge did not register its port
+func edgeAddress(edge *models.Edge) string {
+	metadata, _ := edge.Metadata.(map[string]interface{})
+	var port int
+	switch p := metadata["port"].(type) {
+	case float64:
+		port = int(p)
+	case int:
+		port = p
+	}
+	if port <= 0 || edge.IPAddress == "" {
+		return ""
+	}
+	return net.JoinHostPort(edge.IPAddress, strconv.Itoa(port))
+}
@@ -0,0 +1,347 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/naijcloud/control-plane/internal/models"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// originHealthTTL is how long an edge's health report for an origin counts.
+// Edges report every health check interval, so a report this old belongs to
+// an edge that stopped checking the origin or went away.
+const originHealthTTL = 5 * time.Minute
+
+const originColumns = `id, domain_id, url, weight, priority, enabled, created_at, COALESCE(updated_at, created_at)`
+
+type OriginService struct {
+	db            *sql.DB
+	redis         *redis.Client
+	domainService *DomainService
+}
+
+func NewOriginService(db *sql.DB, redis *redis.Client, domainService *DomainService) *OriginService {
+	return &OriginService{
+		db:            db,
+		redis:         redis,
+		domainService: domainService,
+	}
+}
+
+// ListOrigins returns a domain's origin pool in failover order, with the
+// health edges last reported for each origin
+func (s *OriginService) ListOrigins(orgID uuid.UUID, domainName string) ([]*models.DomainOrigin, error) {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, origin := range domain.Origins {
+		if origin.Health, err = s.originHealth(origin.ID); err != nil {
+			return nil, err
+		}
+	}
+	return domain.Origins, nil
+}
+
+// GetOrigin retrieves one origin of a domain's pool with its health
+func (s *OriginService) GetOrigin(orgID uuid.UUID, domainName string, originID uuid.UUID) (*models.DomainOrigin, error) {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, origin := range domain.Origins {
+		if origin.ID == originID {
+			if origin.Health, err = s.originHealth(origin.ID); err != nil {
+				return nil, err
+			}
+			return origin, nil
+		}
+	}
+	return nil, fmt.Errorf("origin not found")
+}
+
+// CreateOrigin adds an origin to a domain's pool
+func (s *OriginService) CreateOrigin(orgID uuid.UUID, domainName string, req *models.CreateOriginRequest) (*models.DomainOrigin, error) {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	origin := &models.DomainOrigin{
+		ID:        uuid.New(),
+		DomainID:  domain.ID,
+		URL:       req.URL,
+		Weight:    1,
+		Priority:  req.Priority,
+		Enabled:   true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if req.Weight != nil {
+		origin.Weight = *req.Weight
+	}
+	if req.Enabled != nil {
+		origin.Enabled = *req.Enabled
+	}
+	if err := normalizeOrigin(origin, domain.Origins); err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO domain_origins (id, domain_id, url, weight, priority, enabled, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err = s.db.Exec(query, origin.ID, origin.DomainID, origin.URL, origin.Weight, origin.Priority, origin.Enabled,
+		origin.CreatedAt, origin.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create origin: %w", err)
+	}
+
+	s.invalidateDomainConfig(domainName)
+
+	logrus.WithFields(logrus.Fields{
+		"domain":    domainName,
+		"origin_id": origin.ID,
+		"url":       origin.URL,
+	}).Info("Origin added to pool")
+	return origin, nil
+}
+
+// UpdateOrigin applies a partial update to a pool origin
+func (s *OriginService) UpdateOrigin(orgID uuid.UUID, domainName string, originID uuid.UUID, req *models.UpdateOriginRequest) (*models.DomainOrigin, error) {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	var origin *models.DomainOrigin
+	var others []*models.DomainOrigin
+	for _, o := range domain.Origins {
+		if o.ID == originID {
+			origin = o
+		} else {
+			others = append(others, o)
+		}
+	}
+	if origin == nil {
+		return nil, fmt.Errorf("origin not found")
+	}
+
+	if req.URL != nil {
+		origin.URL = *req.URL
+	}
+	if req.Weight != nil {
+		origin.Weight = *req.Weight
+	}
+	if req.Priority != nil {
+		origin.Priority = *req.Priority
+	}
+	if req.Enabled != nil {
+		origin.Enabled = *req.Enabled
+	}
+	if err := normalizeOrigin(origin, others); err != nil {
+		return nil, err
+	}
+	origin.UpdatedAt = time.Now()
+
+	query := `
+		UPDATE domain_origins
+		SET url = $1, weight = $2, priority = $3, enabled = $4, updated_at = $5
+		WHERE id = $6 AND domain_id = $7
+	`
+	_, err = s.db.Exec(query, origin.URL, origin.Weight, origin.Priority, origin.Enabled, origin.UpdatedAt,
+		origin.ID, origin.DomainID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update origin: %w", err)
+	}
+
+	s.invalidateDomainConfig(domainName)
+
+	logrus.WithFields(logrus.Fields{
+		"domain":    domainName,
+		"origin_id": origin.ID,
+	}).Info("Origin updated successfully")
+	return origin, nil
+}
+
+// DeleteOrigin removes an origin from a domain's pool
+func (s *OriginService) DeleteOrigin(orgID uuid.UUID, domainName string, originID uuid.UUID) error {
+	domain, err := s.domainService.GetDomain(orgID, domainName)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec("DELETE FROM domain_origins WHERE id = $1 AND domain_id = $2", originID, domain.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete origin: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("origin not found")
+	}
+
+	if err := s.redis.Del(context.Background(), originHealthKey(originID)).Err(); err != nil {
+		logrus.WithError(err).Warn("Failed to delete origin health")
+	}
+	s.invalidateDomainConfig(domainName)
+
+	logrus.WithFields(logrus.Fields{
+		"domain":    domainName,
+		"origin_id": originID,
+	}).Info("Origin removed from pool")
+	return nil
+}
+
+// RecordOriginHealth stores an edge's latest health check results. Each
+// origin keeps one entry per edge, replaced by the edge's next report.
+func (s *OriginService) RecordOriginHealth(edgeID uuid.UUID, report *models.OriginHealthReport) error {
+	ctx := context.Background()
+	pipe := s.redis.Pipeline()
+	for _, check := range report.Origins {
+		if check.CheckedAt.IsZero() {
+			check.CheckedAt = time.Now()
+		}
+		data, err := json.Marshal(models.OriginEdgeHealth{
+			EdgeID:            edgeID,
+			Healthy:           check.Healthy,
+			LatencyMs:         check.LatencyMs,
+			Error:             check.Error,
+			ActiveConnections: check.ActiveConnections,
+			CheckedAt:         check.CheckedAt,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal origin health: %w", err)
+		}
+
+		key := originHealthKey(check.OriginID)
+		pipe.HSet(ctx, key, edgeID.String(), data)
+		pipe.Expire(ctx, key, originHealthTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record origin health: %w", err)
+	}
+	return nil
+}
+
+// originHealth summarizes the recent reports edges sent for an origin
+func (s *OriginService) originHealth(originID uuid.UUID) (*models.OriginHealth, error) {
+	reports, err := s.redis.HGetAll(context.Background(), originHealthKey(originID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get origin health: %w", err)
+	}
+
+	health := &models.OriginHealth{Edges: []*models.OriginEdgeHealth{}}
+	cutoff := time.Now().Add(-originHealthTTL)
+	for _, data := range reports {
+		var edge models.OriginEdgeHealth
+		if err := json.Unmarshal([]byte(data), &edge); err != nil || edge.CheckedAt.Before(cutoff) {
+			continue
+		}
+		health.Edges = append(health.Edges, &edge)
+		health.TotalEdges++
+		if edge.Healthy {
+			health.HealthyEdges++
+		}
+	}
+	sort.Slice(health.Edges, func(i, j int) bool {
+		return health.Edges[i].EdgeID.String() < health.Edges[j].EdgeID.String()
+	})
+
+	switch {
+	case health.TotalEdges == 0:
+		health.Status = models.OriginHealthUnknown
+	case health.HealthyEdges == health.TotalEdges:
+		health.Status = models.OriginHealthHealthy
+	case health.HealthyEdges == 0:
+		health.Status = models.OriginHealthUnhealthy
+	default:
+		health.Status = models.OriginHealthDegraded
+	}
+	return health, nil
+}
+
+// invalidateDomainConfig drops the cached domain configuration and notifies
+// edges so they pick up the changed pool on their next lookup
+func (s *OriginService) invalidateDomainConfig(domainName string) {
+	key := fmt.Sprintf("domain:%s", domainName)
+	if err := s.redis.Del(context.Background(), key).Err(); err != nil {
+		logrus.WithError(err).Warn("Failed to invalidate cached domain config")
+	}
+	publishDomainChange(s.redis, domainName)
+}
+
+func originHealthKey(originID uuid.UUID) string {
+	return fmt.Sprintf("origin-health:%s", originID)
+}
+
+// listDomainOrigins loads a domain's origin pool in failover order
+func listDomainOrigins(db *sql.DB, domainID uuid.UUID) ([]*models.DomainOrigin, error) {
+	query := `SELECT ` + originColumns + ` FROM domain_origins WHERE domain_id = $1 ORDER BY priority, created_at, id`
+	rows, err := db.Query(query, domainID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list origins: %w", err)
+	}
+	defer rows.Close()
+
+	var origins []*models.DomainOrigin
+	for rows.Next() {
+		origin := &models.DomainOrigin{}
+		err := rows.Scan(&origin.ID, &origin.DomainID, &origin.URL, &origin.Weight, &origin.Priority,
+			&origin.Enabled, &origin.CreatedAt, &origin.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan origin: %w", err)
+		}
+		origins = append(origins, origin)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list origins: %w", err)
+	}
+
+	return origins, nil
+}
+
+// normalizeOrigin validates an origin before it is stored. Edges only use an
+// origin URL's scheme and host, so anything else is rejected rather than
+// silently ignored. pool holds the domain's other origins.
+func normalizeOrigin(origin *models.DomainOrigin, pool []*models.DomainOrigin) error {
+	u, err := url.Parse(strings.TrimSpace(origin.URL))
+	if err != nil {
+		return fmt.Errorf("invalid origin: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid origin: url must use http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid origin: url must include a host")
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("invalid origin: url must only have a scheme, host and port")
+	}
+	origin.URL = u.Scheme + "://" + strings.ToLower(u.Host)
+	for _, other := range pool {
+		if other.URL == origin.URL {
+			return fmt.Errorf("invalid origin: %s is already in the pool", origin.URL)
+		}
+	}
+
+	if origin.Weight < 1 {
+		return fmt.Errorf("invalid origin: weight must be at least 1")
+	}
+	return nil
+}
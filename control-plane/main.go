@@ -2,6 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -42,11 +47,27 @@ func main() {
 	}
 	defer redisClient.Close()
 
+	certificateKeys, err := newCertificateKeys(cfg)
+	if err != nil {
+		logrus.Fatalf("Failed to configure certificate encryption: %v", err)
+	}
+
+	if cfg.EdgeRegistrationSecret == "" {
+		if cfg.Environment == "production" {
+			logrus.Fatal("EDGE_REGISTRATION_SECRET is required in production")
+		}
+		logrus.Warn("EDGE_REGISTRATION_SECRET not set, edges cannot register")
+	}
+
 	// Initialize services
-	domainService := services.NewDomainService(db, redisClient)
 	edgeService := services.NewEdgeService(db, redisClient)
+	domainService := services.NewDomainService(db, redisClient, certificateKeys, edgeService)
 	analyticsService := services.NewAnalyticsService(db)
 	cacheService := services.NewCacheService(redisClient, edgeService)
+	cachePolicyService := services.NewCachePolicyService(db, redisClient, domainService)
+	edgeEventService := services.NewEdgeEventService(redisClient, cacheService)
+	certificateService := services.NewCertificateService(db, redisClient, domainService, certificateKeys)
+	originService := services.NewOriginService(db, redisClient, domainService)
 
 	// Initialize multi-tenancy services
 	orgService := services.NewOrganizationService(db)
@@ -57,6 +78,25 @@ func main() {
 	activityService := services.NewActivityService(db)
 	notificationService := services.NewNotificationService(db)
 
+	// Obtain and renew certificates for active domains
+	var acmeService *services.ACMEService
+	acmeCtx, stopACME := context.WithCancel(context.Background())
+	defer stopACME()
+	if cfg.ACMEEnabled {
+		acmeHTTPClient, err := newACMEHTTPClient(cfg.ACMECAFile)
+		if err != nil {
+			logrus.Fatalf("Failed to configure ACME client: %v", err)
+		}
+		acmeService = services.NewACMEService(db, redisClient, notificationService, certificateKeys, services.ACMEConfig{
+			DirectoryURL:  cfg.ACMEDirectoryURL,
+			Email:         cfg.AutoCertEmail,
+			RenewBefore:   time.Duration(cfg.ACMERenewBefore) * 24 * time.Hour,
+			CheckInterval: time.Duration(cfg.ACMECheckInterval) * time.Second,
+			HTTPClient:    acmeHTTPClient,
+		})
+		go acmeService.Run(acmeCtx)
+	}
+
 	// Setup HTTP server
 	router := gin.New()
 	router.Use(gin.Recovery())
@@ -78,7 +118,7 @@ func main() {
 	})
 
 	// API routes - use multi-tenant setup with enhanced features
-	api.SetupMultiTenantRoutes(router, orgService, userService, domainService, edgeService, analyticsService, cacheService, apiKeyService, authService, emailService, activityService, notificationService, jwtMiddleware)
+	api.SetupMultiTenantRoutes(router, orgService, userService, domainService, edgeService, cfg.EdgeRegistrationSecret, analyticsService, cacheService, cachePolicyService, edgeEventService, acmeService, certificateService, originService, apiKeyService, authService, emailService, activityService, notificationService, jwtMiddleware)
 
 	// Metrics server
 	go func() {
@@ -124,6 +164,49 @@ func main() {
 	logrus.Info("Server exited")
 }
 
+// newACMEHTTPClient returns the HTTP client for the ACME directory, also
+// trusting the CA in caFile if set, as a local Pebble instance needs
+func newACMEHTTPClient(caFile string) (*http.Client, error) {
+	if caFile == "" {
+		return &http.Client{Timeout: 30 * time.Second}, nil
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACME CA file: %w", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in ACME CA file %s", caFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}, nil
+}
+
+// newCertificateKeys returns the cipher for certificate private keys. Outside
+// production a key derived from the JWT secret is used when none is set.
+func newCertificateKeys(cfg *config.Config) (*services.CertificateKeys, error) {
+	if cfg.CertEncryptionKey == "" {
+		if cfg.Environment == "production" {
+			return nil, fmt.Errorf("CERT_ENCRYPTION_KEY is required in production")
+		}
+		logrus.Warn("CERT_ENCRYPTION_KEY not set, deriving certificate encryption key from JWT secret")
+		secret := sha256.Sum256([]byte(cfg.JWTSecret))
+		return services.NewCertificateKeys(secret[:])
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(cfg.CertEncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("CERT_ENCRYPTION_KEY must be base64: %w", err)
+	}
+	return services.NewCertificateKeys(secret)
+}
+
 func setupLogger(level string) {
 	logrus.SetFormatter(&logrus.JSONFormatter{})
 
@@ -74,6 +74,7 @@ func TestRegisterEdgeRequest(t *testing.T) {
 func TestPurgeRequestBody(t *testing.T) {
 	purgeReq := models.PurgeRequestBody{
 		Paths: []string{"/", "/api/*", "/images/*"},
+		Tags:  []string{"product-123", "blog"},
 	}
 
 	jsonData, err := json.Marshal(purgeReq)
@@ -85,4 +86,5 @@ func TestPurgeRequestBody(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, len(purgeReq.Paths), len(parsed.Paths))
 	assert.Equal(t, purgeReq.Paths[0], parsed.Paths[0])
+	assert.Equal(t, purgeReq.Tags, parsed.Tags)
 }
@@ -0,0 +1,5 @@
+-- Migration 010: Add per-domain edge settings
+-- Stores edge behaviour toggles (request coalescing, etc.) as a JSON document
+-- so new settings can be added without further schema changes
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS settings JSONB DEFAULT '{}';
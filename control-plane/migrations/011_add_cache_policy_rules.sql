@@ -0,0 +1,10 @@
+-- Migration 011: Turn cache policies into ordered per-domain rules
+-- Policies are evaluated by ascending priority; the first whose pattern
+-- matches the request path decides the TTL, cache key and bypass behaviour
+
+ALTER TABLE cache_policies ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE cache_policies ADD COLUMN IF NOT EXISTS match_type VARCHAR(16) NOT NULL DEFAULT 'glob';
+ALTER TABLE cache_policies ADD COLUMN IF NOT EXISTS bypass BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE cache_policies ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS idx_cache_policies_domain_priority ON cache_policies(domain_id, priority);
@@ -0,0 +1,14 @@
+-- Migration 012: Add per-domain TLS certificates
+-- Edges terminate HTTPS with the certificate stored for the domain the
+-- client asks for (SNI), delivered with the domain's configuration
+
+CREATE TABLE IF NOT EXISTS domain_certificates (
+    domain_id UUID PRIMARY KEY REFERENCES domains(id) ON DELETE CASCADE,
+    cert_pem TEXT NOT NULL,
+    key_pem TEXT NOT NULL,
+    not_after TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_domain_certificates_not_after ON domain_certificates(not_after);
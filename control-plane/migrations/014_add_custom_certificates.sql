@@ -0,0 +1,25 @@
+-- Migration 014: Add custom certificates
+-- Customers can upload their own certificates; the active one is copied to
+-- domain_certificates, which edges are served from. Private keys in both
+-- tables, and ACME account keys, are stored encrypted.
+
+CREATE TABLE IF NOT EXISTS custom_certificates (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    domain_id UUID NOT NULL REFERENCES domains(id) ON DELETE CASCADE,
+    cert_pem TEXT NOT NULL,
+    key_pem TEXT NOT NULL,
+    subject VARCHAR(512) NOT NULL DEFAULT '',
+    issuer VARCHAR(512) NOT NULL DEFAULT '',
+    sans TEXT[] NOT NULL DEFAULT '{}',
+    fingerprint VARCHAR(64) NOT NULL,
+    not_before TIMESTAMP WITH TIME ZONE NOT NULL,
+    not_after TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_custom_certificates_domain_id ON custom_certificates(domain_id);
+
+-- Deleting the active custom certificate stops edges serving it
+ALTER TABLE domain_certificates
+    ADD COLUMN IF NOT EXISTS source VARCHAR(20) NOT NULL DEFAULT 'acme' CHECK (source IN ('acme', 'custom')),
+    ADD COLUMN IF NOT EXISTS custom_certificate_id UUID REFERENCES custom_certificates(id) ON DELETE CASCADE;
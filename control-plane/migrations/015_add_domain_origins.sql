@@ -0,0 +1,18 @@
+-- Migration 015: Add origin pools
+-- A domain with origins in domain_origins is served from that pool instead
+-- of its single origin_url. Edges spread requests over the enabled origins
+-- with the lowest priority that pass their health checks, by weight.
+
+CREATE TABLE IF NOT EXISTS domain_origins (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    domain_id UUID NOT NULL REFERENCES domains(id) ON DELETE CASCADE,
+    url VARCHAR(2048) NOT NULL,
+    weight INTEGER NOT NULL DEFAULT 1 CHECK (weight > 0),
+    priority INTEGER NOT NULL DEFAULT 0,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE (domain_id, url)
+);
+
+CREATE INDEX IF NOT EXISTS idx_domain_origins_domain_id ON domain_origins(domain_id);
@@ -0,0 +1,5 @@
+-- Migration 016: Add edge tokens
+-- Edges get a token when they register, which they present to fetch domain
+-- private keys. Only its SHA-256 hash is stored.
+
+ALTER TABLE edges ADD COLUMN IF NOT EXISTS token_hash VARCHAR(64);
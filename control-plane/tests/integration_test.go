@@ -1,14 +1,23 @@
 package tests
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -24,6 +33,9 @@ import (
 	_ "github.com/lib/pq"
 )
 
+// testEdgeRegistrationSecret is the secret edges register with in tests
+const testEdgeRegistrationSecret = "test-edge-registration-secret"
+
 type IntegrationTestSuite struct {
 	suite.Suite
 	db           *sql.DB
@@ -34,6 +46,11 @@ type IntegrationTestSuite struct {
 	cacheSvc     *services.CacheService
 	analyticsSvc *services.AnalyticsService
 	apiKeySvc    *services.APIKeyService
+	policySvc    *services.CachePolicyService
+	eventSvc     *services.EdgeEventService
+	acmeSvc      *services.ACMEService
+	certSvc      *services.CertificateService
+	originSvc    *services.OriginService
 }
 
 func (suite *IntegrationTestSuite) SetupSuite() {
@@ -65,12 +82,22 @@ func (suite *IntegrationTestSuite) SetupSuite() {
 	_, err = suite.redis.Ping(context.Background()).Result()
 	suite.Require().NoError(err)
 
+	keys, err := services.NewCertificateKeys([]byte("0123456789abcdef0123456789abcdef"))
+	suite.Require().NoError(err)
+
 	// Initialize services
-	suite.domainSvc = services.NewDomainService(suite.db, suite.redis)
 	suite.edgeSvc = services.NewEdgeService(suite.db, suite.redis)
+	suite.domainSvc = services.NewDomainService(suite.db, suite.redis, keys, suite.edgeSvc)
 	suite.analyticsSvc = services.NewAnalyticsService(suite.db)
 	suite.cacheSvc = services.NewCacheService(suite.redis, suite.edgeSvc)
 	suite.apiKeySvc = services.NewAPIKeyService(suite.db)
+	suite.policySvc = services.NewCachePolicyService(suite.db, suite.redis, suite.domainSvc)
+	suite.eventSvc = services.NewEdgeEventService(suite.redis, suite.cacheSvc)
+	suite.acmeSvc = services.NewACMEService(suite.db, suite.redis, services.NewNotificationService(suite.db), keys, services.ACMEConfig{
+		DirectoryURL: "http://127.0.0.1:1/directory", // unreachable, so orders fail
+	})
+	suite.certSvc = services.NewCertificateService(suite.db, suite.redis, suite.domainSvc, keys)
+	suite.originSvc = services.NewOriginService(suite.db, suite.redis, suite.domainSvc)
 
 	// Set up router
 	gin.SetMode(gin.TestMode)
@@ -89,7 +116,7 @@ func (suite *IntegrationTestSuite) SetupSuite() {
 
 	// API routes
 	v1 := suite.router.Group("/v1")
-	api.SetupRoutes(v1, suite.domainSvc, suite.edgeSvc, suite.analyticsSvc, suite.cacheSvc, suite.apiKeySvc)
+	api.SetupRoutes(v1, suite.domainSvc, suite.edgeSvc, testEdgeRegistrationSecret, suite.analyticsSvc, suite.cacheSvc, suite.eventSvc, suite.acmeSvc, suite.originSvc, suite.apiKeySvc)
 }
 
 func (suite *IntegrationTestSuite) SetupTest() {
@@ -110,7 +137,7 @@ func (suite *IntegrationTestSuite) TearDownSuite() {
 
 func (suite *IntegrationTestSuite) cleanupTestData() {
 	// Clean up database tables in reverse dependency order
-	tables := []string{"purge_requests", "cache_policies", "request_logs", "edges", "domains"}
+	tables := []string{"acme_accounts", "custom_certificates", "domain_origins", "purge_requests", "cache_policies", "request_logs", "edges", "domains"}
 	for _, table := range tables {
 		_, err := suite.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE 1=1", table))
 		suite.Require().NoError(err)
@@ -182,6 +209,98 @@ func (suite *IntegrationTestSuite) TestDomainCRUD() {
 	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
 }
 
+func (suite *IntegrationTestSuite) TestCachePolicies() {
+	// Domains created through the legacy routes belong to the demo organization
+	orgID := uuid.MustParse("3fbdbdad-dbf5-4ac1-9335-e644302769ad")
+
+	body, _ := json.Marshal(models.CreateDomainRequest{
+		Domain:    "policy-domain.com",
+		OriginURL: "https://example.com",
+	})
+	req := httptest.NewRequest("POST", "/v1/domains", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusCreated, w.Code)
+
+	// Policies without a priority are appended in order
+	images, err := suite.policySvc.CreatePolicy(orgID, "policy-domain.com", &models.CreateCachePolicyRequest{
+		PathPattern:   "/images/*.jpg",
+		CacheTTL:      86400,
+		HeadersToVary: []string{"accept"},
+	})
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), services.MatchTypeGlob, images.MatchType)
+	assert.Equal(suite.T(), []string{"Accept"}, images.HeadersToVary)
+
+	apiPolicy, err := suite.policySvc.CreatePolicy(orgID, "policy-domain.com", &models.CreateCachePolicyRequest{
+		MatchType:   services.MatchTypeRegex,
+		PathPattern: "^/api/",
+		Bypass:      true,
+	})
+	suite.Require().NoError(err)
+	assert.Greater(suite.T(), apiPolicy.Priority, images.Priority)
+
+	// An explicit priority moves a policy ahead of the others
+	first := -1
+	catchAll, err := suite.policySvc.CreatePolicy(orgID, "policy-domain.com", &models.CreateCachePolicyRequest{
+		Priority:         &first,
+		PathPattern:      "/*",
+		CacheTTL:         60,
+		CacheKeyTemplate: "{host}{path}?lang={query:lang}",
+	})
+	suite.Require().NoError(err)
+
+	// Edges receive the policies in evaluation order with the domain
+	req = httptest.NewRequest("GET", "/v1/domains/policy-domain.com", nil)
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusOK, w.Code)
+
+	var domain models.Domain
+	suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), &domain))
+	suite.Require().Len(domain.CachePolicies, 3)
+	assert.Equal(suite.T(), catchAll.ID, domain.CachePolicies[0].ID)
+	assert.Equal(suite.T(), images.ID, domain.CachePolicies[1].ID)
+	assert.Equal(suite.T(), apiPolicy.ID, domain.CachePolicies[2].ID)
+
+	// Dry run matching follows the same order
+	match, err := suite.policySvc.MatchPolicy(orgID, "policy-domain.com", "https://policy-domain.com/images/cat.jpg?size=2")
+	suite.Require().NoError(err)
+	assert.True(suite.T(), match.Matched)
+	assert.Equal(suite.T(), 1, match.Position)
+	assert.Equal(suite.T(), "/images/cat.jpg", match.Path)
+
+	lower := 100
+	_, err = suite.policySvc.UpdatePolicy(orgID, "policy-domain.com", catchAll.ID, &models.UpdateCachePolicyRequest{Priority: &lower})
+	suite.Require().NoError(err)
+
+	match, err = suite.policySvc.MatchPolicy(orgID, "policy-domain.com", "/images/cat.jpg")
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), images.ID, match.Policy.ID)
+
+	match, err = suite.policySvc.MatchPolicy(orgID, "policy-domain.com", "/api/users")
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), apiPolicy.ID, match.Policy.ID)
+
+	// Invalid patterns and templates are rejected before reaching edges
+	_, err = suite.policySvc.CreatePolicy(orgID, "policy-domain.com", &models.CreateCachePolicyRequest{
+		MatchType:   services.MatchTypeRegex,
+		PathPattern: "^/(unclosed",
+	})
+	assert.ErrorContains(suite.T(), err, "invalid cache policy")
+
+	_, err = suite.policySvc.CreatePolicy(orgID, "policy-domain.com", &models.CreateCachePolicyRequest{
+		PathPattern:      "/*",
+		CacheKeyTemplate: "{path}{unknown}",
+	})
+	assert.ErrorContains(suite.T(), err, "invalid cache policy")
+
+	suite.Require().NoError(suite.policySvc.DeletePolicy(orgID, "policy-domain.com", apiPolicy.ID))
+	_, err = suite.policySvc.GetPolicy(orgID, "policy-domain.com", apiPolicy.ID)
+	assert.EqualError(suite.T(), err, "cache policy not found")
+}
+
 func (suite *IntegrationTestSuite) TestEdgeNodeManagement() {
 	// Test edge registration
 	registerReq := models.RegisterEdgeRequest{
@@ -191,9 +310,23 @@ func (suite *IntegrationTestSuite) TestEdgeNodeManagement() {
 		Capacity:  1000,
 	}
 
+	// Registering, and so getting an edge token, takes the registration secret
 	body, _ := json.Marshal(registerReq)
+	for _, auth := range []string{"", "Bearer wrong-secret"} {
+		req := httptest.NewRequest("POST", "/v1/edges", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		suite.router.ServeHTTP(w, req)
+		assert.Equal(suite.T(), http.StatusUnauthorized, w.Code)
+		assert.NotContains(suite.T(), w.Body.String(), "token")
+	}
+
 	req := httptest.NewRequest("POST", "/v1/edges", bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testEdgeRegistrationSecret)
 	w := httptest.NewRecorder()
 
 	suite.router.ServeHTTP(w, req)
@@ -269,6 +402,7 @@ func (suite *IntegrationTestSuite) TestCachePurgeWorkflow() {
 	body, _ = json.Marshal(registerReq)
 	req = httptest.NewRequest("POST", "/v1/edges", bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testEdgeRegistrationSecret)
 	w = httptest.NewRecorder()
 
 	suite.router.ServeHTTP(w, req)
@@ -281,6 +415,7 @@ func (suite *IntegrationTestSuite) TestCachePurgeWorkflow() {
 	// Test cache purge initiation
 	purgeReq := models.PurgeRequestBody{
 		Paths: []string{"/api/users", "/static/css/*"},
+		Tags:  []string{"product-123"},
 	}
 
 	body, _ = json.Marshal(purgeReq)
@@ -301,8 +436,15 @@ func (suite *IntegrationTestSuite) TestCachePurgeWorkflow() {
 	assert.Equal(suite.T(), "accepted", purgeResp.Status)
 	assert.NotEmpty(suite.T(), purgeResp.PurgeID)
 
+	// Purges are only listed for the edge itself
+	req = httptest.NewRequest("GET", fmt.Sprintf("/v1/edges/%s/purges", edge.ID), nil)
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusUnauthorized, w.Code)
+
 	// Test getting pending purges for edge
 	req = httptest.NewRequest("GET", fmt.Sprintf("/v1/edges/%s/purges", edge.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+edge.Token)
 	w = httptest.NewRecorder()
 	suite.router.ServeHTTP(w, req)
 	assert.Equal(suite.T(), http.StatusOK, w.Code)
@@ -313,15 +455,18 @@ func (suite *IntegrationTestSuite) TestCachePurgeWorkflow() {
 	err = json.Unmarshal(w.Body.Bytes(), &purgeList)
 	suite.Require().NoError(err)
 	assert.Len(suite.T(), purgeList.Purges, 1)
+	assert.Equal(suite.T(), []string{"product-123"}, purgeList.Purges[0].Tags)
 
 	// Test completing a purge
 	req = httptest.NewRequest("POST", fmt.Sprintf("/v1/edges/%s/purges/%s/complete", edge.ID, purgeResp.PurgeID), nil)
+	req.Header.Set("Authorization", "Bearer "+edge.Token)
 	w = httptest.NewRecorder()
 	suite.router.ServeHTTP(w, req)
 	assert.Equal(suite.T(), http.StatusOK, w.Code)
 
 	// Verify purge is no longer pending
 	req = httptest.NewRequest("GET", fmt.Sprintf("/v1/edges/%s/purges", edge.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+edge.Token)
 	w = httptest.NewRecorder()
 	suite.router.ServeHTTP(w, req)
 	assert.Equal(suite.T(), http.StatusOK, w.Code)
@@ -331,6 +476,373 @@ func (suite *IntegrationTestSuite) TestCachePurgeWorkflow() {
 	assert.Len(suite.T(), purgeList.Purges, 0)
 }
 
+func (suite *IntegrationTestSuite) TestEdgeEventStream() {
+	createReq := models.CreateDomainRequest{
+		Domain:    "events-test.com",
+		OriginURL: "https://example.com",
+		CacheTTL:  3600,
+	}
+	body, _ := json.Marshal(createReq)
+	req := httptest.NewRequest("POST", "/v1/domains", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusCreated, w.Code)
+
+	edge, err := suite.edgeSvc.RegisterEdge(&models.RegisterEdgeRequest{Region: "us-east-1", IPAddress: "192.168.1.70"})
+	suite.Require().NoError(err)
+	edgeID := edge.ID
+	server := httptest.NewServer(suite.router)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Only the edge itself may subscribe
+	for _, token := range []string{"", "not-the-token"} {
+		streamReq, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/edges/%s/events", server.URL, edgeID), nil)
+		suite.Require().NoError(err)
+		streamReq.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(streamReq)
+		suite.Require().NoError(err)
+		resp.Body.Close()
+		assert.Equal(suite.T(), http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	streamReq, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/edges/%s/events", server.URL, edgeID), nil)
+	suite.Require().NoError(err)
+	streamReq.Header.Set("Authorization", "Bearer "+edge.Token)
+	resp, err := http.DefaultClient.Do(streamReq)
+	suite.Require().NoError(err)
+	defer resp.Body.Close()
+	suite.Require().Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(suite.T(), "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// readEvent returns the next event's id, type and data
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() (string, string, services.EdgeEvent) {
+		var id, eventType string
+		var event services.EdgeEvent
+		for {
+			line, err := reader.ReadString('\n')
+			suite.Require().NoError(err)
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case line == "":
+				if eventType != "" {
+					return id, eventType, event
+				}
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				eventType = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				suite.Require().NoError(json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+			}
+		}
+	}
+
+	// Purges are pushed as soon as they are requested
+	body, _ = json.Marshal(models.PurgeRequestBody{Paths: []string{"/index.html"}})
+	req = httptest.NewRequest("POST", "/v1/domains/events-test.com/purge", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusAccepted, w.Code)
+
+	var purgeResp struct {
+		PurgeID string `json:"purge_id"`
+	}
+	suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), &purgeResp))
+
+	id, eventType, event := readEvent()
+	assert.Equal(suite.T(), services.EdgeEventPurge, eventType)
+	assert.Equal(suite.T(), purgeResp.PurgeID, id)
+	suite.Require().NotNil(event.Purge)
+	assert.Equal(suite.T(), []string{"/index.html"}, event.Purge.Paths)
+
+	// Domain changes are forwarded too
+	updateReq := models.UpdateDomainRequest{CacheTTL: 60}
+	body, _ = json.Marshal(updateReq)
+	req = httptest.NewRequest("PUT", "/v1/domains/events-test.com", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusOK, w.Code)
+
+	_, eventType, event = readEvent()
+	assert.Equal(suite.T(), services.EdgeEventDomainChanged, eventType)
+	assert.Equal(suite.T(), "events-test.com", event.Domain)
+}
+
+func (suite *IntegrationTestSuite) TestAutomaticCertificates() {
+	ctx := context.Background()
+
+	createReq := models.CreateDomainRequest{
+		Domain:    "acme-test.com",
+		OriginURL: "https://example.com",
+		CacheTTL:  3600,
+	}
+	body, _ := json.Marshal(createReq)
+	req := httptest.NewRequest("POST", "/v1/domains", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusCreated, w.Code)
+
+	// A failed order is recorded and backed off
+	suite.Require().NoError(suite.acmeSvc.RenewDue(ctx))
+
+	req = httptest.NewRequest("GET", "/v1/domains/acme-test.com", nil)
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusOK, w.Code)
+
+	var domain models.Domain
+	suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), &domain))
+	suite.Require().NotNil(domain.CertificateStatus)
+	assert.Equal(suite.T(), models.CertificateStatusFailed, domain.CertificateStatus.Status)
+	assert.Equal(suite.T(), 1, domain.CertificateStatus.Failures)
+	assert.NotEmpty(suite.T(), domain.CertificateStatus.LastError)
+	suite.Require().NotNil(domain.CertificateStatus.NextAttemptAt)
+	assert.True(suite.T(), domain.CertificateStatus.NextAttemptAt.After(time.Now().Add(30*time.Minute)))
+	assert.Nil(suite.T(), domain.Certificate)
+
+	// Backed off domains are skipped until their next attempt
+	suite.Require().NoError(suite.acmeSvc.RenewDue(ctx))
+	var failures int
+	suite.Require().NoError(suite.db.QueryRow("SELECT failures FROM domain_certificate_renewals WHERE domain_id = $1", domain.ID).Scan(&failures))
+	assert.Equal(suite.T(), 1, failures)
+
+	// Edges fetch HTTP-01 challenge responses
+	suite.Require().NoError(suite.redis.Set(ctx, "acme:http-01:test-token", "test-token.thumbprint", time.Minute).Err())
+	req = httptest.NewRequest("GET", "/v1/acme/http-01/test-token", nil)
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "test-token.thumbprint", w.Body.String())
+
+	req = httptest.NewRequest("GET", "/v1/acme/http-01/unknown-token", nil)
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
+}
+
+func (suite *IntegrationTestSuite) TestCustomCertificates() {
+	orgID := uuid.MustParse("3fbdbdad-dbf5-4ac1-9335-e644302769ad")
+
+	body, _ := json.Marshal(models.CreateDomainRequest{
+		Domain:    "custom-cert.com",
+		OriginURL: "https://example.com",
+	})
+	req := httptest.NewRequest("POST", "/v1/domains", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusCreated, w.Code)
+
+	// Uploads must cover the domain and match their key
+	otherCert, otherKey := suite.certificatePEM("other.com")
+	_, err := suite.certSvc.UploadCertificate(orgID, "custom-cert.com", &models.UploadCertificateRequest{
+		CertificatePEM: otherCert,
+		PrivateKeyPEM:  otherKey,
+	})
+	suite.Require().Error(err)
+	assert.Contains(suite.T(), err.Error(), "invalid certificate: not valid for custom-cert.com")
+
+	firstCert, firstKey := suite.certificatePEM("custom-cert.com")
+	_, err = suite.certSvc.UploadCertificate(orgID, "custom-cert.com", &models.UploadCertificateRequest{
+		CertificatePEM: firstCert,
+		PrivateKeyPEM:  otherKey,
+	})
+	suite.Require().Error(err)
+	assert.Contains(suite.T(), err.Error(), "invalid certificate: private key does not match")
+
+	first, err := suite.certSvc.UploadCertificate(orgID, "custom-cert.com", &models.UploadCertificateRequest{
+		CertificatePEM: firstCert,
+		PrivateKeyPEM:  firstKey,
+	})
+	suite.Require().NoError(err)
+	assert.True(suite.T(), first.Active)
+	assert.Equal(suite.T(), []string{"custom-cert.com"}, first.SANs)
+	assert.Len(suite.T(), first.Fingerprint, 64)
+
+	// Private keys are encrypted at rest
+	var storedKey string
+	suite.Require().NoError(suite.db.QueryRow("SELECT key_pem FROM custom_certificates WHERE id = $1", first.ID).Scan(&storedKey))
+	assert.True(suite.T(), strings.HasPrefix(storedKey, "v1:"))
+	suite.Require().NoError(suite.db.QueryRow("SELECT key_pem FROM domain_certificates WHERE custom_certificate_id = $1", first.ID).Scan(&storedKey))
+	assert.True(suite.T(), strings.HasPrefix(storedKey, "v1:"))
+
+	// Edges receive the active certificate with the domain config, but not its key
+	domain, err := suite.domainSvc.GetDomainConfig(orgID, "custom-cert.com")
+	suite.Require().NoError(err)
+	suite.Require().NotNil(domain.Certificate)
+	assert.Equal(suite.T(), firstCert, domain.Certificate.CertPEM)
+	assert.Empty(suite.T(), domain.Certificate.KeyPEM)
+	assert.Equal(suite.T(), models.CertificateSourceCustom, domain.Certificate.Source)
+
+	req = httptest.NewRequest("GET", "/v1/domains/custom-cert.com", nil)
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), "cert_pem")
+	assert.NotContains(suite.T(), w.Body.String(), "key_pem")
+	assert.NotContains(suite.T(), w.Body.String(), "PRIVATE KEY")
+
+	// The key is only served to a registered edge presenting its token
+	body, _ = json.Marshal(models.RegisterEdgeRequest{Region: "us-east-1", IPAddress: "192.168.1.50"})
+	req = httptest.NewRequest("POST", "/v1/edges", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testEdgeRegistrationSecret)
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusCreated, w.Code)
+
+	var edge models.Edge
+	suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), &edge))
+	suite.Require().NotEmpty(edge.Token)
+
+	fetchKey := func(edgeID uuid.UUID, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/v1/edges/%s/certificates/custom-cert.com", edgeID), nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		suite.router.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(suite.T(), http.StatusUnauthorized, fetchKey(edge.ID, "").Code)
+	assert.Equal(suite.T(), http.StatusUnauthorized, fetchKey(edge.ID, "not-the-token").Code)
+	assert.Equal(suite.T(), http.StatusUnauthorized, fetchKey(uuid.New(), edge.Token).Code)
+
+	w = fetchKey(edge.ID, edge.Token)
+	suite.Require().Equal(http.StatusOK, w.Code)
+	var served models.DomainCertificate
+	suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), &served))
+	assert.Equal(suite.T(), firstCert, served.CertPEM)
+	assert.Equal(suite.T(), firstKey, served.KeyPEM)
+
+	// The token is not stored or returned again
+	var tokenHash string
+	suite.Require().NoError(suite.db.QueryRow("SELECT token_hash FROM edges WHERE id = $1", edge.ID).Scan(&tokenHash))
+	assert.NotEqual(suite.T(), edge.Token, tokenHash)
+	fetched, err := suite.edgeSvc.GetEdge(edge.ID)
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), fetched.Token)
+
+	// Rotation uploads a replacement without activating it, then switches over
+	secondCert, secondKey := suite.certificatePEM("custom-cert.com")
+	inactive := false
+	second, err := suite.certSvc.UploadCertificate(orgID, "custom-cert.com", &models.UploadCertificateRequest{
+		CertificatePEM: secondCert,
+		PrivateKeyPEM:  secondKey,
+		Activate:       &inactive,
+	})
+	suite.Require().NoError(err)
+	assert.False(suite.T(), second.Active)
+
+	second, err = suite.certSvc.ActivateCertificate(orgID, "custom-cert.com", second.ID)
+	suite.Require().NoError(err)
+	assert.True(suite.T(), second.Active)
+
+	domain, err = suite.domainSvc.GetDomainConfig(orgID, "custom-cert.com")
+	suite.Require().NoError(err)
+	suite.Require().NotNil(domain.Certificate)
+	assert.Equal(suite.T(), secondCert, domain.Certificate.CertPEM)
+
+	certs, err := suite.certSvc.ListCertificates(orgID, "custom-cert.com")
+	suite.Require().NoError(err)
+	suite.Require().Len(certs, 2)
+	assert.Equal(suite.T(), second.ID, certs[0].ID)
+	assert.False(suite.T(), certs[1].Active)
+
+	// Deleting the active certificate stops edges serving it
+	suite.Require().NoError(suite.certSvc.DeleteCertificate(orgID, "custom-cert.com", second.ID))
+	domain, err = suite.domainSvc.GetDomainConfig(orgID, "custom-cert.com")
+	suite.Require().NoError(err)
+	assert.Nil(suite.T(), domain.Certificate)
+	assert.Equal(suite.T(), http.StatusNotFound, fetchKey(edge.ID, edge.Token).Code)
+
+	_, err = suite.certSvc.GetCertificate(orgID, "custom-cert.com", second.ID)
+	suite.Require().Error(err)
+	assert.Equal(suite.T(), "certificate not found", err.Error())
+}
+
+func (suite *IntegrationTestSuite) TestEdgeCertificateScope() {
+	demoOrgID := uuid.MustParse("3fbdbdad-dbf5-4ac1-9335-e644302769ad")
+	otherOrgID := uuid.MustParse("5b0e6a52-8c7d-4f3e-9a1b-2c4d6e8f0a13")
+	_, err := suite.db.Exec(`INSERT INTO organizations (id, name, slug) VALUES ($1, 'Edge Cert Org', 'edge-cert-org') ON CONFLICT (id) DO NOTHING`, otherOrgID)
+	suite.Require().NoError(err)
+	defer suite.db.Exec("DELETE FROM organizations WHERE id = $1", otherOrgID)
+
+	// One domain with a certificate in each organization
+	keys := map[string]string{}
+	for orgID, name := range map[uuid.UUID]string{demoOrgID: "demo-scope.com", otherOrgID: "other-scope.com"} {
+		_, err := suite.domainSvc.CreateDomain(orgID, &models.CreateDomainRequest{Domain: name, OriginURL: "https://example.com"})
+		suite.Require().NoError(err)
+		certPEM, keyPEM := suite.certificatePEM(name)
+		_, err = suite.certSvc.UploadCertificate(orgID, name, &models.UploadCertificateRequest{CertificatePEM: certPEM, PrivateKeyPEM: keyPEM})
+		suite.Require().NoError(err)
+		keys[name] = keyPEM
+	}
+
+	body, _ := json.Marshal(models.RegisterEdgeRequest{Region: "us-east-1", IPAddress: "192.168.1.60"})
+	req := httptest.NewRequest("POST", "/v1/edges", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testEdgeRegistrationSecret)
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusCreated, w.Code)
+	var edge models.Edge
+	suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), &edge))
+
+	fetchKey := func(domain string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/v1/edges/%s/certificates/%s", edge.ID, domain), nil)
+		req.Header.Set("Authorization", "Bearer "+edge.Token)
+		w := httptest.NewRecorder()
+		suite.router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Edges serving every organization get keys for domains in any of them
+	for name, keyPEM := range keys {
+		w := fetchKey(name)
+		suite.Require().Equal(http.StatusOK, w.Code, name)
+		var served models.DomainCertificate
+		suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), &served))
+		assert.Equal(suite.T(), keyPEM, served.KeyPEM, name)
+	}
+	assert.Equal(suite.T(), http.StatusNotFound, fetchKey("unknown-scope.com").Code)
+
+	// An edge dedicated to an organization only gets its domains' keys
+	_, err = suite.db.Exec("UPDATE edges SET organization_id = $1 WHERE id = $2", otherOrgID, edge.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), http.StatusOK, fetchKey("other-scope.com").Code)
+	assert.Equal(suite.T(), http.StatusNotFound, fetchKey("demo-scope.com").Code)
+}
+
+// certificatePEM returns a self-signed certificate and key for host
+func (suite *IntegrationTestSuite) certificatePEM(host string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	suite.Require().NoError(err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	suite.Require().NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	suite.Require().NoError(err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
 func (suite *IntegrationTestSuite) TestAnalyticsCollection() {
 	// Create a test domain
 	createReq := models.CreateDomainRequest{
@@ -362,6 +874,7 @@ func (suite *IntegrationTestSuite) TestAnalyticsCollection() {
 	body, _ = json.Marshal(registerReq)
 	req = httptest.NewRequest("POST", "/v1/edges", bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testEdgeRegistrationSecret)
 	w = httptest.NewRecorder()
 
 	suite.router.ServeHTTP(w, req)
@@ -434,3 +947,167 @@ func TestIntegrationTestSuite(t *testing.T) {
 	}
 	suite.Run(t, new(IntegrationTestSuite))
 }
+
+func (suite *IntegrationTestSuite) TestOriginPools() {
+	orgID := uuid.MustParse("3fbdbdad-dbf5-4ac1-9335-e644302769ad")
+
+	body, _ := json.Marshal(models.CreateDomainRequest{
+		Domain:    "pooled.com",
+		OriginURL: "https://example.com",
+	})
+	req := httptest.NewRequest("POST", "/v1/domains", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusCreated, w.Code)
+
+	// Origins are scheme and host only, and appear once per pool
+	_, err := suite.originSvc.CreateOrigin(orgID, "pooled.com", &models.CreateOriginRequest{URL: "https://a.example.com/app"})
+	suite.Require().Error(err)
+	assert.Contains(suite.T(), err.Error(), "invalid origin")
+
+	weight := 3
+	primary, err := suite.originSvc.CreateOrigin(orgID, "pooled.com", &models.CreateOriginRequest{
+		URL:    "https://A.example.com/",
+		Weight: &weight,
+	})
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), "https://a.example.com", primary.URL)
+	assert.Equal(suite.T(), 3, primary.Weight)
+	assert.True(suite.T(), primary.Enabled)
+
+	_, err = suite.originSvc.CreateOrigin(orgID, "pooled.com", &models.CreateOriginRequest{URL: "https://a.example.com"})
+	suite.Require().Error(err)
+	assert.Contains(suite.T(), err.Error(), "already in the pool")
+
+	backup, err := suite.originSvc.CreateOrigin(orgID, "pooled.com", &models.CreateOriginRequest{
+		URL:      "https://b.example.com",
+		Priority: 10,
+	})
+	suite.Require().NoError(err)
+
+	// Edges receive the pool in failover order with the domain config
+	domain, err := suite.domainSvc.GetDomainConfig(orgID, "pooled.com")
+	suite.Require().NoError(err)
+	suite.Require().Len(domain.Origins, 2)
+	assert.Equal(suite.T(), primary.ID, domain.Origins[0].ID)
+	assert.Equal(suite.T(), backup.ID, domain.Origins[1].ID)
+	assert.Equal(suite.T(), models.LoadBalancingRoundRobin, domain.Settings.LoadBalancing)
+	assert.Equal(suite.T(), "/", domain.Settings.HealthCheckPath)
+
+	// Health is unknown until edges report it
+	origin, err := suite.originSvc.GetOrigin(orgID, "pooled.com", primary.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), models.OriginHealthUnknown, origin.Health.Status)
+
+	edgeA, err := suite.edgeSvc.RegisterEdge(&models.RegisterEdgeRequest{Region: "us-east-1", IPAddress: "192.168.1.80"})
+	suite.Require().NoError(err)
+	edgeB := uuid.New()
+	report, _ := json.Marshal(models.OriginHealthReport{Origins: []models.OriginHealthCheck{
+		{OriginID: primary.ID, Healthy: true, LatencyMs: 12, CheckedAt: time.Now()},
+		{OriginID: backup.ID, Healthy: false, Error: "connection refused", CheckedAt: time.Now()},
+	}})
+
+	// Only the edge itself may report
+	for _, token := range []string{"", "not-the-token"} {
+		req = httptest.NewRequest("POST", "/v1/edges/"+edgeA.ID.String()+"/origin-health", bytes.NewBuffer(report))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w = httptest.NewRecorder()
+		suite.router.ServeHTTP(w, req)
+		assert.Equal(suite.T(), http.StatusUnauthorized, w.Code)
+	}
+	origin, err = suite.originSvc.GetOrigin(orgID, "pooled.com", primary.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), models.OriginHealthUnknown, origin.Health.Status)
+
+	req = httptest.NewRequest("POST", "/v1/edges/"+edgeA.ID.String()+"/origin-health", bytes.NewBuffer(report))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+edgeA.Token)
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusOK, w.Code)
+
+	suite.Require().NoError(suite.originSvc.RecordOriginHealth(edgeB, &models.OriginHealthReport{
+		Origins: []models.OriginHealthCheck{{OriginID: primary.ID, Healthy: false, Error: "timeout", CheckedAt: time.Now()}},
+	}))
+
+	origins, err := suite.originSvc.ListOrigins(orgID, "pooled.com")
+	suite.Require().NoError(err)
+	suite.Require().Len(origins, 2)
+	assert.Equal(suite.T(), models.OriginHealthDegraded, origins[0].Health.Status)
+	assert.Equal(suite.T(), 1, origins[0].Health.HealthyEdges)
+	assert.Equal(suite.T(), 2, origins[0].Health.TotalEdges)
+	assert.Equal(suite.T(), models.OriginHealthUnhealthy, origins[1].Health.Status)
+	assert.Equal(suite.T(), "connection refused", origins[1].Health.Edges[0].Error)
+
+	// Disabling keeps the origin in the pool
+	disabled := false
+	backup, err = suite.originSvc.UpdateOrigin(orgID, "pooled.com", backup.ID, &models.UpdateOriginRequest{Enabled: &disabled})
+	suite.Require().NoError(err)
+	assert.False(suite.T(), backup.Enabled)
+
+	suite.Require().NoError(suite.originSvc.DeleteOrigin(orgID, "pooled.com", primary.ID))
+	_, err = suite.originSvc.GetOrigin(orgID, "pooled.com", primary.ID)
+	suite.Require().Error(err)
+	assert.Equal(suite.T(), "origin not found", err.Error())
+
+	// Load balancing modes are validated with the other settings
+	body, _ = json.Marshal(map[string]interface{}{"settings": map[string]interface{}{"load_balancing": "random"}})
+	req = httptest.NewRequest("PUT", "/v1/domains/pooled.com", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+}
+
+func (suite *IntegrationTestSuite) TestOriginShield() {
+	orgID := uuid.MustParse("3fbdbdad-dbf5-4ac1-9335-e644302769ad")
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"domain":     "shielded.com",
+		"origin_url": "https://example.com",
+		"settings":   map[string]interface{}{"shield_region": "eu-west"},
+	})
+	req := httptest.NewRequest("POST", "/v1/domains", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusCreated, w.Code)
+
+	// Only healthy edges of the shield region that registered a port can
+	// be fetched through
+	shield, err := suite.edgeSvc.RegisterEdge(&models.RegisterEdgeRequest{Region: "eu-west", IPAddress: "10.0.0.1", Port: 8081})
+	suite.Require().NoError(err)
+	_, err = suite.edgeSvc.RegisterEdge(&models.RegisterEdgeRequest{Region: "eu-west", IPAddress: "10.0.0.2"})
+	suite.Require().NoError(err)
+	_, err = suite.edgeSvc.RegisterEdge(&models.RegisterEdgeRequest{Region: "us-east", IPAddress: "10.0.1.1", Port: 8081})
+	suite.Require().NoError(err)
+
+	domain, err := suite.domainSvc.GetDomainConfig(orgID, "shielded.com")
+	suite.Require().NoError(err)
+	suite.Require().NotNil(domain.Shield)
+	assert.Equal(suite.T(), "eu-west", domain.Shield.Region)
+	suite.Require().Len(domain.Shield.Edges, 1)
+	assert.Equal(suite.T(), shield.ID, domain.Shield.Edges[0].ID)
+	assert.Equal(suite.T(), "10.0.0.1:8081", domain.Shield.Edges[0].Address)
+
+	// Clearing the region turns shielding off
+	body, _ = json.Marshal(map[string]interface{}{"settings": map[string]interface{}{"shield_region": ""}})
+	req = httptest.NewRequest("PUT", "/v1/domains/shielded.com", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	suite.Require().Equal(http.StatusOK, w.Code)
+
+	domain, err = suite.domainSvc.GetDomainConfig(orgID, "shielded.com")
+	suite.Require().NoError(err)
+	assert.Nil(suite.T(), domain.Shield)
+
+	body, _ = json.Marshal(map[string]interface{}{"settings": map[string]interface{}{"shield_region": "eu west"}})
+	req = httptest.NewRequest("PUT", "/v1/domains/shielded.com", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+}
@@ -3,39 +3,111 @@ package cache
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 )
 
+// ErrEntryTooLarge is returned by Set when an entry can never fit in the cache.
+var ErrEntryTooLarge = errors.New("cache entry exceeds cache capacity")
+
 type CacheEntry struct {
 	StatusCode int
 	Headers    http.Header
 	Body       []byte
 	CachedAt   time.Time
 	TTL        time.Duration
+
+	// Grace windows after TTL during which the entry may still be served
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+
+	// Vary lists the request headers the response varies on and Variant
+	// the normalized values of those headers this copy was stored for
+	Vary    []string
+	Variant string
+
+	// Host and Path identify the request the entry was stored for, so purges
+	// can find it whatever its key. Host has no port; Path includes the
+	// query string.
+	Host string
+	Path string
+	// Tags are the origin's Surrogate-Key / Cache-Tag values, which purges
+	// can target instead of URLs
+	Tags []string
+}
+
+// IsFresh reports whether the entry is still within its TTL
+func (e *CacheEntry) IsFresh() bool {
+	return time.Since(e.CachedAt) <= e.TTL
+}
+
+// Staleness returns how long ago the entry expired, or zero while it is fresh
+func (e *CacheEntry) Staleness() time.Duration {
+	if stale := time.Since(e.CachedAt) - e.TTL; stale > 0 {
+		return stale
+	}
+	return 0
+}
+
+// CanServeWhileRevalidating reports whether the expired entry may be served
+// while a fresh copy is fetched in the background
+func (e *CacheEntry) CanServeWhileRevalidating() bool {
+	return !e.IsFresh() && e.Staleness() <= e.StaleWhileRevalidate
+}
+
+// CanServeOnError reports whether the entry may stand in for an origin error
+func (e *CacheEntry) CanServeOnError() bool {
+	return e.Staleness() <= e.StaleIfError
+}
+
+// HasValidators reports whether the entry can be revalidated with a
+// conditional request
+func (e *CacheEntry) HasValidators() bool {
+	return e.Headers.Get("ETag") != "" || e.Headers.Get("Last-Modified") != ""
+}
+
+// validatorRetention is how long past its TTL an entry with validators is
+// kept so it can be revalidated with a conditional request instead of being
+// refetched in full
+const validatorRetention = time.Hour
+
+// retention is how long the entry is kept after it was cached, including
+// any stale or revalidation grace window
+func (e *CacheEntry) retention() time.Duration {
+	grace := e.StaleWhileRevalidate
+	if e.StaleIfError > grace {
+		grace = e.StaleIfError
+	}
+	if e.HasValidators() && validatorRetention > grace {
+		grace = validatorRetention
+	}
+	return e.TTL + grace
+}
+
+// isRetained reports whether the entry is fresh or inside its grace window
+func (e *CacheEntry) isRetained() bool {
+	return time.Since(e.CachedAt) <= e.retention()
 }
 
 type Cache interface {
+	// Get returns fresh entries and expired entries still inside their stale
+	// or revalidation grace window; callers check CacheEntry.IsFresh
 	Get(ctx context.Context, key string) (*CacheEntry, bool)
 	Set(ctx context.Context, key string, entry *CacheEntry) error
 	Delete(ctx context.Context, key string) error
 	Clear(ctx context.Context) error
 	Size() int64
-}
-
-// MemoryCache implements in-memory caching with LRU eviction
-type MemoryCache struct {
-	mu       sync.RWMutex
-	entries  map[string]*CacheEntry
-	maxSize  int64
-	currSize int64
+	// DomainKeys returns the keys stored for a host and what each was
+	// stored for
+	DomainKeys(ctx context.Context, host string) (map[string]KeyInfo, error)
 }
 
 // RedisCache implements Redis-backed caching
@@ -45,14 +117,6 @@ type RedisCache struct {
 	defaultTTL time.Duration
 }
 
-// NewMemoryCache creates a new in-memory cache
-func NewMemoryCache(maxSizeBytes int64) *MemoryCache {
-	return &MemoryCache{
-		entries: make(map[string]*CacheEntry),
-		maxSize: maxSizeBytes,
-	}
-}
-
 // NewRedisCache creates a new Redis cache
 func NewRedisCache(redisURL, keyPrefix string, defaultTTL time.Duration) (*RedisCache, error) {
 	opt, err := redis.ParseURL(redisURL)
@@ -77,106 +141,6 @@ func NewRedisCache(redisURL, keyPrefix string, defaultTTL time.Duration) (*Redis
 	}, nil
 }
 
-// MemoryCache implementation
-func (m *MemoryCache) Get(ctx context.Context, key string) (*CacheEntry, bool) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	entry, exists := m.entries[key]
-	if !exists {
-		return nil, false
-	}
-
-	// Check if entry has expired
-	if time.Since(entry.CachedAt) > entry.TTL {
-		delete(m.entries, key)
-		m.currSize -= m.entrySize(entry)
-		return nil, false
-	}
-
-	return entry, true
-}
-
-func (m *MemoryCache) Set(ctx context.Context, key string, entry *CacheEntry) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	entrySize := m.entrySize(entry)
-
-	// Remove existing entry if it exists
-	if existing, exists := m.entries[key]; exists {
-		m.currSize -= m.entrySize(existing)
-	}
-
-	// Evict entries if necessary
-	for m.currSize+entrySize > m.maxSize && len(m.entries) > 0 {
-		m.evictOldest()
-	}
-
-	m.entries[key] = entry
-	m.currSize += entrySize
-
-	return nil
-}
-
-func (m *MemoryCache) Delete(ctx context.Context, key string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	if entry, exists := m.entries[key]; exists {
-		delete(m.entries, key)
-		m.currSize -= m.entrySize(entry)
-	}
-
-	return nil
-}
-
-func (m *MemoryCache) Clear(ctx context.Context) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	m.entries = make(map[string]*CacheEntry)
-	m.currSize = 0
-
-	return nil
-}
-
-func (m *MemoryCache) Size() int64 {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return m.currSize
-}
-
-func (m *MemoryCache) entrySize(entry *CacheEntry) int64 {
-	size := int64(len(entry.Body))
-	for name, values := range entry.Headers {
-		size += int64(len(name))
-		for _, value := range values {
-			size += int64(len(value))
-		}
-	}
-	return size + 64 // overhead for struct fields
-}
-
-func (m *MemoryCache) evictOldest() {
-	var oldestKey string
-	var oldestTime time.Time
-
-	for key, entry := range m.entries {
-		if oldestKey == "" || entry.CachedAt.Before(oldestTime) {
-			oldestKey = key
-			oldestTime = entry.CachedAt
-		}
-	}
-
-	if oldestKey != "" {
-		if entry := m.entries[oldestKey]; entry != nil {
-			m.currSize -= m.entrySize(entry)
-		}
-		delete(m.entries, oldestKey)
-	}
-}
-
 // RedisCache implementation
 func (r *RedisCache) Get(ctx context.Context, key string) (*CacheEntry, bool) {
 	fullKey := r.keyPrefix + key
@@ -225,8 +189,31 @@ func (r *RedisCache) Get(ctx context.Context, key string) (*CacheEntry, bool) {
 		}
 	}
 
-	// Check if entry has expired
-	if time.Since(entry.CachedAt) > entry.TTL {
+	// Parse stale grace windows
+	if swrStr, exists := result["stale_while_revalidate"]; exists {
+		if swrSecs, err := strconv.Atoi(swrStr); err == nil {
+			entry.StaleWhileRevalidate = time.Duration(swrSecs) * time.Second
+		}
+	}
+	if sieStr, exists := result["stale_if_error"]; exists {
+		if sieSecs, err := strconv.Atoi(sieStr); err == nil {
+			entry.StaleIfError = time.Duration(sieSecs) * time.Second
+		}
+	}
+
+	// Parse variant
+	if vary, exists := result["vary"]; exists && vary != "" {
+		entry.Vary = strings.Split(vary, ",")
+	}
+	entry.Variant = result["variant"]
+	entry.Host = result["host"]
+	entry.Path = result["path"]
+	if tags, exists := result["tags"]; exists && tags != "" {
+		entry.Tags = strings.Split(tags, " ")
+	}
+
+	// Check if entry has expired past its grace window
+	if !entry.isRetained() {
 		r.client.Del(ctx, fullKey)
 		return nil, false
 	}
@@ -254,8 +241,31 @@ func (r *RedisCache) Set(ctx context.Context, key string, entry *CacheEntry) err
 		"body":        string(entry.Body),
 		"cached_at":   entry.CachedAt.Unix(),
 		"ttl":         int(entry.TTL.Seconds()),
+
+		"stale_while_revalidate": int(entry.StaleWhileRevalidate.Seconds()),
+		"stale_if_error":         int(entry.StaleIfError.Seconds()),
+
+		"vary":    strings.Join(entry.Vary, ","),
+		"variant": entry.Variant,
+		"host":    entry.Host,
+		"path":    entry.Path,
+		"tags":    strings.Join(entry.Tags, " "),
 	})
-	pipe.Expire(ctx, fullKey, entry.TTL)
+	pipe.Expire(ctx, fullKey, entry.retention())
+
+	// Index the key under its host. The index lives as long as the longest
+	// lived entry in it, so keys that expire sooner stay listed until then;
+	// purging them again is harmless.
+	if entry.Host != "" {
+		info, err := json.Marshal(entry.keyInfo())
+		if err != nil {
+			return fmt.Errorf("failed to encode cache index entry: %w", err)
+		}
+		indexKey := r.indexKey(entry.Host)
+		pipe.HSet(ctx, indexKey, key, info)
+		pipe.ExpireNX(ctx, indexKey, entry.retention())
+		pipe.ExpireGT(ctx, indexKey, entry.retention())
+	}
 
 	_, err := pipe.Exec(ctx)
 	return err
@@ -263,7 +273,44 @@ func (r *RedisCache) Set(ctx context.Context, key string, entry *CacheEntry) err
 
 func (r *RedisCache) Delete(ctx context.Context, key string) error {
 	fullKey := r.keyPrefix + key
-	return r.client.Del(ctx, fullKey).Err()
+
+	host, err := r.client.HGet(ctx, fullKey, "host").Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	pipe := r.client.Pipeline()
+	pipe.Del(ctx, fullKey)
+	if host != "" {
+		pipe.HDel(ctx, r.indexKey(host), key)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// DomainKeys returns the keys indexed for host
+func (r *RedisCache) DomainKeys(ctx context.Context, host string) (map[string]KeyInfo, error) {
+	fields, err := r.client.HGetAll(ctx, r.indexKey(host)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache index: %w", err)
+	}
+
+	keys := make(map[string]KeyInfo, len(fields))
+	for key, value := range fields {
+		var info KeyInfo
+		if err := json.Unmarshal([]byte(value), &info); err != nil {
+			logrus.WithError(err).WithField("cache_key", key).Warn("Skipping unreadable cache index entry")
+			continue
+		}
+		keys[key] = info
+	}
+	return keys, nil
+}
+
+// indexKey is the Redis hash holding the keys stored for host. Cache keys
+// start with the request method, so the lowercase prefix cannot collide.
+func (r *RedisCache) indexKey(host string) string {
+	return r.keyPrefix + "index:" + host
 }
 
 func (r *RedisCache) Clear(ctx context.Context) error {
@@ -292,7 +339,9 @@ func (r *RedisCache) Size() int64 {
 	return int64(len(keys))
 }
 
-// GenerateCacheKey creates a cache key from request
+// GenerateCacheKey creates the primary cache key for a request. Request
+// headers only select between variants when the origin's Vary header says
+// so; see Lookup and Store.
 func GenerateCacheKey(req *http.Request) string {
 	var buf bytes.Buffer
 	buf.WriteString(req.Method)
@@ -304,17 +353,6 @@ func GenerateCacheKey(req *http.Request) string {
 		buf.WriteString(req.URL.RawQuery)
 	}
 
-	// Include relevant headers that affect caching
-	headers := []string{"Accept", "Accept-Encoding", "Authorization"}
-	for _, header := range headers {
-		if value := req.Header.Get(header); value != "" {
-			buf.WriteByte('|')
-			buf.WriteString(header)
-			buf.WriteByte('=')
-			buf.WriteString(value)
-		}
-	}
-
 	return buf.String()
 }
 
@@ -325,11 +363,42 @@ func IsCacheable(req *http.Request, resp *http.Response) bool {
 		return false
 	}
 
+	if !allowsStorage(resp) {
+		return false
+	}
+
+	// Authorized responses are shared only when the origin says so
+	if req.Header.Get("Authorization") != "" && !allowsSharedAuthorized(resp) {
+		return false
+	}
+
+	// Only cache successful responses. Partial content is never stored under
+	// the full object's key; see IsCacheableSlice.
+	return resp.StatusCode >= 200 && resp.StatusCode < 300 && resp.StatusCode != http.StatusPartialContent
+}
+
+// IsCacheableSlice determines if a 206 response to a slice request should be
+// cached
+func IsCacheableSlice(req *http.Request, resp *http.Response) bool {
+	if req.Header.Get("Authorization") != "" && !allowsSharedAuthorized(resp) {
+		return false
+	}
+	return req.Method == "GET" && resp.StatusCode == http.StatusPartialContent && allowsStorage(resp)
+}
+
+// allowsStorage reports whether the response headers permit a shared cache
+// to store it
+func allowsStorage(resp *http.Response) bool {
 	// Don't cache responses with Set-Cookie headers
 	if resp.Header.Get("Set-Cookie") != "" {
 		return false
 	}
 
+	// Vary: * means no request can be matched to the stored response
+	if _, ok := ParseVary(resp.Header); !ok {
+		return false
+	}
+
 	// Don't cache private responses
 	if cacheControl := resp.Header.Get("Cache-Control"); cacheControl != "" {
 		if strings.Contains(strings.ToLower(cacheControl), "private") ||
@@ -339,6 +408,14 @@ func IsCacheable(req *http.Request, resp *http.Response) bool {
 		}
 	}
 
-	// Only cache successful responses
-	return resp.StatusCode >= 200 && resp.StatusCode < 300
+	return true
+}
+
+// allowsSharedAuthorized reports whether a response to a request carrying
+// Authorization may be stored by a shared cache
+func allowsSharedAuthorized(resp *http.Response) bool {
+	cacheControl := strings.ToLower(resp.Header.Get("Cache-Control"))
+	return strings.Contains(cacheControl, "public") ||
+		strings.Contains(cacheControl, "s-maxage") ||
+		strings.Contains(cacheControl, "must-revalidate")
 }
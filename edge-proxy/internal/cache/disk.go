@@ -0,0 +1,532 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// diskMagic starts every entry file so foreign or truncated files are
+	// recognised when the index is rebuilt
+	diskMagic = "NCE1"
+
+	diskEntrySuffix = ".entry"
+	diskTempDir     = "tmp"
+
+	// diskExpiryInterval is how often expired entry files are removed
+	diskExpiryInterval = 5 * time.Minute
+)
+
+// DiskCache implements a persistent cache tier backed by one file per entry.
+// Each file carries its own metadata, and files are written to a temporary
+// name, synced and renamed into place, so a crash never leaves a partially
+// written entry behind. The in-memory index is rebuilt from the files on
+// startup and evicts least recently used entries to stay within maxSize.
+type DiskCache struct {
+	dir     string
+	maxSize int64
+
+	mu       sync.Mutex
+	index    map[string]*list.Element
+	lru      *list.List
+	currSize int64
+	hosts    *keyIndex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type diskItem struct {
+	key     string
+	path    string
+	size    int64
+	expires time.Time
+
+	// host and info index the entry for purges
+	host string
+	info KeyInfo
+}
+
+// diskMetadata is the JSON header stored in front of each entry body
+type diskMetadata struct {
+	Key                  string      `json:"key"`
+	StatusCode           int         `json:"status_code"`
+	Headers              http.Header `json:"headers"`
+	CachedAt             time.Time   `json:"cached_at"`
+	TTL                  int64       `json:"ttl"`
+	StaleWhileRevalidate int64       `json:"stale_while_revalidate"`
+	StaleIfError         int64       `json:"stale_if_error"`
+	Vary                 []string    `json:"vary,omitempty"`
+	Variant              string      `json:"variant,omitempty"`
+	Host                 string      `json:"host,omitempty"`
+	Path                 string      `json:"path,omitempty"`
+	Tags                 []string    `json:"tags,omitempty"`
+	BodySize             int64       `json:"body_size"`
+}
+
+// NewDiskCache opens the disk cache in dir, creating it if needed, and
+// rebuilds its index from the entry files already there
+func NewDiskCache(dir string, maxSizeBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, diskTempDir), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create disk cache directory: %w", err)
+	}
+
+	d := &DiskCache{
+		dir:     dir,
+		maxSize: maxSizeBytes,
+		index:   make(map[string]*list.Element),
+		lru:     list.New(),
+		hosts:   newKeyIndex(),
+		stop:    make(chan struct{}),
+	}
+
+	if err := d.rebuildIndex(); err != nil {
+		return nil, fmt.Errorf("failed to rebuild disk cache index: %w", err)
+	}
+
+	go d.expireLoop()
+	return d, nil
+}
+
+func (d *DiskCache) Get(ctx context.Context, key string) (*CacheEntry, bool) {
+	d.mu.Lock()
+	elem, exists := d.index[key]
+	if !exists {
+		d.mu.Unlock()
+		return nil, false
+	}
+	item := elem.Value.(*diskItem)
+	d.lru.MoveToFront(elem)
+	d.mu.Unlock()
+
+	entry, err := readDiskEntry(item.path, key)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logrus.WithError(err).WithField("path", item.path).Warn("Dropping unreadable disk cache entry")
+		}
+		d.removeItem(key, item)
+		return nil, false
+	}
+
+	// Check if entry has expired past its grace window
+	if !entry.isRetained() {
+		d.removeItem(key, item)
+		return nil, false
+	}
+
+	return entry, true
+}
+
+func (d *DiskCache) Set(ctx context.Context, key string, entry *CacheEntry) error {
+	meta, err := encodeDiskMetadata(key, entry)
+	if err != nil {
+		return err
+	}
+	size := int64(len(diskMagic)+4+len(meta)) + int64(len(entry.Body))
+	if size > d.maxSize {
+		return ErrEntryTooLarge
+	}
+
+	tmp, err := d.writeTemp(meta, entry.Body)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // no-op once renamed
+
+	path := d.pathFor(key)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create disk cache directory: %w", err)
+	}
+
+	// The file is renamed into place under d.mu so that it always matches
+	// the index, and a concurrent Delete or eviction cannot remove it
+	// between the rename and the index update
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to store disk cache file: %w", err)
+	}
+	if err := syncDir(dir); err != nil {
+		logrus.WithError(err).WithField("dir", dir).Warn("Failed to sync disk cache directory")
+	}
+
+	if elem, exists := d.index[key]; exists {
+		old := elem.Value.(*diskItem)
+		d.currSize -= old.size
+		d.lru.Remove(elem)
+		d.hosts.remove(key, old.host)
+	}
+	d.index[key] = d.lru.PushFront(&diskItem{
+		key:     key,
+		path:    path,
+		size:    size,
+		expires: entry.CachedAt.Add(entry.retention()),
+		host:    entry.Host,
+		info:    entry.keyInfo(),
+	})
+	d.currSize += size
+	d.hosts.add(key, entry.Host, entry.keyInfo())
+
+	// Evict least recently used entries until we are back under the limit
+	for d.currSize > d.maxSize {
+		oldest := d.lru.Back()
+		if oldest == nil {
+			break
+		}
+		d.evict(oldest)
+		diskEvictions.Inc()
+	}
+
+	return nil
+}
+
+func (d *DiskCache) Delete(ctx context.Context, key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if elem, exists := d.index[key]; exists {
+		d.evict(elem)
+	}
+	return nil
+}
+
+func (d *DiskCache) Clear(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for elem := d.lru.Front(); elem != nil; {
+		next := elem.Next()
+		d.evict(elem)
+		elem = next
+	}
+	return nil
+}
+
+func (d *DiskCache) Size() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.currSize
+}
+
+// DomainKeys returns the keys stored for host
+func (d *DiskCache) DomainKeys(ctx context.Context, host string) (map[string]KeyInfo, error) {
+	return d.hosts.keys(host), nil
+}
+
+// Len returns the number of entries on disk
+func (d *DiskCache) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.index)
+}
+
+// Close stops the background expiry sweep
+func (d *DiskCache) Close() {
+	d.stopOnce.Do(func() { close(d.stop) })
+}
+
+// pathFor spreads entry files over 256 subdirectories by key hash
+func (d *DiskCache) pathFor(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(d.dir, name[:2], name+diskEntrySuffix)
+}
+
+// encodeDiskMetadata encodes the metadata header stored in front of
+// entry's body
+func encodeDiskMetadata(key string, entry *CacheEntry) ([]byte, error) {
+	meta, err := json.Marshal(diskMetadata{
+		Key:                  key,
+		StatusCode:           entry.StatusCode,
+		Headers:              entry.Headers,
+		CachedAt:             entry.CachedAt,
+		TTL:                  int64(entry.TTL),
+		StaleWhileRevalidate: int64(entry.StaleWhileRevalidate),
+		StaleIfError:         int64(entry.StaleIfError),
+		Vary:                 entry.Vary,
+		Variant:              entry.Variant,
+		Host:                 entry.Host,
+		Path:                 entry.Path,
+		Tags:                 entry.Tags,
+		BodySize:             int64(len(entry.Body)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode disk cache metadata: %w", err)
+	}
+	return meta, nil
+}
+
+// writeTemp writes an entry file under a unique temporary name, syncs it and
+// returns its path
+func (d *DiskCache) writeTemp(meta, body []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Join(d.dir, diskTempDir), "entry-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create disk cache file: %w", err)
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(meta)))
+
+	_, err = tmp.WriteString(diskMagic)
+	if err == nil {
+		_, err = tmp.Write(header[:])
+	}
+	if err == nil {
+		_, err = tmp.Write(meta)
+	}
+	if err == nil {
+		_, err = tmp.Write(body)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write disk cache file: %w", err)
+	}
+
+	return tmp.Name(), nil
+}
+
+// syncDir flushes dir so that a rename into it survives a crash
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// readDiskMetadata reads the metadata header of an entry file, leaving f
+// positioned at the start of the body
+func readDiskMetadata(f *os.File) (*diskMetadata, error) {
+	var prefix [len(diskMagic) + 4]byte
+	if _, err := io.ReadFull(f, prefix[:]); err != nil {
+		return nil, fmt.Errorf("failed to read entry header: %w", err)
+	}
+	if string(prefix[:len(diskMagic)]) != diskMagic {
+		return nil, errors.New("not a cache entry file")
+	}
+
+	metaLen := binary.BigEndian.Uint32(prefix[len(diskMagic):])
+	meta := make([]byte, metaLen)
+	if _, err := io.ReadFull(f, meta); err != nil {
+		return nil, fmt.Errorf("failed to read entry metadata: %w", err)
+	}
+
+	var md diskMetadata
+	if err := json.Unmarshal(meta, &md); err != nil {
+		return nil, fmt.Errorf("failed to decode entry metadata: %w", err)
+	}
+	return &md, nil
+}
+
+// readDiskEntry loads the entry stored at path, checking it belongs to key
+func readDiskEntry(path, key string) (*CacheEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	md, err := readDiskMetadata(f)
+	if err != nil {
+		return nil, err
+	}
+	if md.Key != key {
+		return nil, fmt.Errorf("entry file belongs to another key")
+	}
+
+	body := make([]byte, md.BodySize)
+	if _, err := io.ReadFull(f, body); err != nil {
+		return nil, fmt.Errorf("failed to read entry body: %w", err)
+	}
+
+	headers := md.Headers
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	return &CacheEntry{
+		StatusCode:           md.StatusCode,
+		Headers:              headers,
+		Body:                 body,
+		CachedAt:             md.CachedAt,
+		TTL:                  time.Duration(md.TTL),
+		StaleWhileRevalidate: time.Duration(md.StaleWhileRevalidate),
+		StaleIfError:         time.Duration(md.StaleIfError),
+		Vary:                 md.Vary,
+		Variant:              md.Variant,
+		Host:                 md.Host,
+		Path:                 md.Path,
+		Tags:                 md.Tags,
+	}, nil
+}
+
+// rebuildIndex scans the cache directory, indexing valid entries from least
+// to most recently written and removing expired, corrupt and temporary files
+func (d *DiskCache) rebuildIndex() error {
+	os.RemoveAll(filepath.Join(d.dir, diskTempDir))
+	if err := os.MkdirAll(filepath.Join(d.dir, diskTempDir), 0o755); err != nil {
+		return err
+	}
+
+	type found struct {
+		item    *diskItem
+		modTime time.Time
+	}
+	var items []found
+
+	err := filepath.WalkDir(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(path, diskEntrySuffix) {
+			return nil
+		}
+
+		item, modTime, err := loadDiskItem(path)
+		if err != nil {
+			logrus.WithError(err).WithField("path", path).Warn("Removing invalid disk cache entry")
+			os.Remove(path)
+			return nil
+		}
+		if time.Now().After(item.expires) {
+			os.Remove(path)
+			return nil
+		}
+
+		items = append(items, found{item: item, modTime: modTime})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].modTime.Before(items[j].modTime)
+	})
+	for _, f := range items {
+		d.index[f.item.key] = d.lru.PushFront(f.item)
+		d.currSize += f.item.size
+		d.hosts.add(f.item.key, f.item.host, f.item.info)
+	}
+	for d.currSize > d.maxSize && d.lru.Len() > 0 {
+		d.evict(d.lru.Back())
+		diskEvictions.Inc()
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"dir":     d.dir,
+		"entries": len(d.index),
+		"size":    d.currSize,
+	}).Info("Disk cache index rebuilt")
+	return nil
+}
+
+// loadDiskItem reads just enough of an entry file to index it
+func loadDiskItem(path string) (*diskItem, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	md, err := readDiskMetadata(f)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// A body shorter than recorded means the file was damaged
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if info.Size() != offset+md.BodySize {
+		return nil, time.Time{}, errors.New("entry body size does not match metadata")
+	}
+
+	entry := &CacheEntry{
+		Headers:              md.Headers,
+		CachedAt:             md.CachedAt,
+		TTL:                  time.Duration(md.TTL),
+		StaleWhileRevalidate: time.Duration(md.StaleWhileRevalidate),
+		StaleIfError:         time.Duration(md.StaleIfError),
+	}
+	return &diskItem{
+		key:     md.Key,
+		path:    path,
+		size:    info.Size(),
+		expires: md.CachedAt.Add(entry.retention()),
+		host:    md.Host,
+		info:    KeyInfo{Path: md.Path, Tags: md.Tags},
+	}, info.ModTime(), nil
+}
+
+// evict removes elem from the index and its file from disk; d.mu is held
+func (d *DiskCache) evict(elem *list.Element) {
+	item := elem.Value.(*diskItem)
+	d.lru.Remove(elem)
+	delete(d.index, item.key)
+	d.hosts.remove(item.key, item.host)
+	d.currSize -= item.size
+	os.Remove(item.path)
+}
+
+// removeItem evicts key if it still refers to item
+func (d *DiskCache) removeItem(key string, item *diskItem) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if elem, exists := d.index[key]; exists && elem.Value.(*diskItem) == item {
+		d.evict(elem)
+	}
+}
+
+func (d *DiskCache) expireLoop() {
+	ticker := time.NewTicker(diskExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			d.mu.Lock()
+			for _, elem := range d.index {
+				if now.After(elem.Value.(*diskItem).expires) {
+					d.evict(elem)
+				}
+			}
+			d.mu.Unlock()
+		case <-d.stop:
+			return
+		}
+	}
+}
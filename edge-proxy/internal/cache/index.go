@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"sync"
+)
+
+// KeyInfo describes what a cache key was stored for
+type KeyInfo struct {
+	// Path of the request, including the query string
+	Path string `json:"path"`
+	// Tags the origin attached to the response
+	Tags []string `json:"tags,omitempty"`
+}
+
+// keyInfo returns the index record for an entry
+func (e *CacheEntry) keyInfo() KeyInfo {
+	return KeyInfo{Path: e.Path, Tags: e.Tags}
+}
+
+// keyIndex is the secondary index from host to the keys stored for it, used
+// to find everything a purge covers
+type keyIndex struct {
+	mu    sync.RWMutex
+	hosts map[string]map[string]KeyInfo
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{hosts: make(map[string]map[string]KeyInfo)}
+}
+
+// add records key as stored for host. Entries without a host are not
+// indexed.
+func (ix *keyIndex) add(key, host string, info KeyInfo) {
+	if host == "" {
+		return
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	keys, exists := ix.hosts[host]
+	if !exists {
+		keys = make(map[string]KeyInfo)
+		ix.hosts[host] = keys
+	}
+	keys[key] = info
+}
+
+// remove drops key from host's keys
+func (ix *keyIndex) remove(key, host string) {
+	if host == "" {
+		return
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if keys, exists := ix.hosts[host]; exists {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(ix.hosts, host)
+		}
+	}
+}
+
+// keys returns a copy of the keys stored for host
+func (ix *keyIndex) keys(host string) map[string]KeyInfo {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	keys := make(map[string]KeyInfo, len(ix.hosts[host]))
+	for key, info := range ix.hosts[host] {
+		keys[key] = info
+	}
+	return keys
+}
+
+func (ix *keyIndex) clear() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.hosts = make(map[string]map[string]KeyInfo)
+}
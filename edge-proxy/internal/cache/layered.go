@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LayeredCache stacks caches from fastest to slowest, typically memory (L1),
+// disk (L2) and Redis (L3). Writes go to every layer; a hit in a lower layer
+// is copied into the layers above it so the next lookup is served faster.
+type LayeredCache struct {
+	layers []Cache
+}
+
+// NewLayeredCache creates a layered cache, fastest layer first
+func NewLayeredCache(layers ...Cache) *LayeredCache {
+	return &LayeredCache{layers: layers}
+}
+
+// Layers returns the underlying caches, fastest first
+func (l *LayeredCache) Layers() []Cache {
+	return l.layers
+}
+
+func (l *LayeredCache) Get(ctx context.Context, key string) (*CacheEntry, bool) {
+	for i, layer := range l.layers {
+		entry, found := layer.Get(ctx, key)
+		if !found {
+			continue
+		}
+
+		// Promote into the faster layers that missed
+		for _, upper := range l.layers[:i] {
+			if err := upper.Set(ctx, key, entry); err != nil && !errors.Is(err, ErrEntryTooLarge) {
+				logrus.WithError(err).WithField("cache_key", key).Warn("Failed to promote cache entry")
+			}
+		}
+		return entry, true
+	}
+	return nil, false
+}
+
+// Set stores entry in every layer that can hold it. It fails only if no
+// layer stored the entry.
+func (l *LayeredCache) Set(ctx context.Context, key string, entry *CacheEntry) error {
+	var firstErr error
+	stored := false
+	for _, layer := range l.layers {
+		if err := layer.Set(ctx, key, entry); err != nil {
+			if firstErr == nil || errors.Is(firstErr, ErrEntryTooLarge) {
+				firstErr = err
+			}
+			continue
+		}
+		stored = true
+	}
+
+	if stored {
+		return nil
+	}
+	return firstErr
+}
+
+func (l *LayeredCache) Delete(ctx context.Context, key string) error {
+	var errs []error
+	for _, layer := range l.layers {
+		if err := layer.Delete(ctx, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *LayeredCache) Clear(ctx context.Context) error {
+	var errs []error
+	for _, layer := range l.layers {
+		if err := layer.Clear(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DomainKeys returns the keys stored for host in any layer, along with the
+// errors of any layers that could not answer
+func (l *LayeredCache) DomainKeys(ctx context.Context, host string) (map[string]KeyInfo, error) {
+	keys := make(map[string]KeyInfo)
+	var errs []error
+	for _, layer := range l.layers {
+		layerKeys, err := layer.DomainKeys(ctx, host)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for key, info := range layerKeys {
+			keys[key] = info
+		}
+	}
+	return keys, errors.Join(errs...)
+}
+
+// Size reports the size of the largest layer, which holds the most content
+// since upper layers only keep copies of it
+func (l *LayeredCache) Size() int64 {
+	var size int64
+	for _, layer := range l.layers {
+		if s := layer.Size(); s > size {
+			size = s
+		}
+	}
+	return size
+}
@@ -0,0 +1,449 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxMemoryShards caps the shard count; shards are never made smaller
+	// than minMemoryShardSize so a single large object still fits in one.
+	maxMemoryShards    = 64
+	minMemoryShardSize = 8 * 1024 * 1024
+
+	// windowPercent and protectedPercent split each shard between the
+	// admission window and the protected part of the main space
+	windowPercent    = 1
+	protectedPercent = 80
+
+	// averageEntrySize is used to size the frequency sketch
+	averageEntrySize = 4 * 1024
+
+	// memoryExpiryInterval is how often expired entries are swept out
+	memoryExpiryInterval = time.Minute
+)
+
+// LRU segments an entry can live in
+const (
+	segmentWindow = iota
+	segmentProbation
+	segmentProtected
+)
+
+// MemoryCache implements in-memory caching with W-TinyLFU eviction. Keys are
+// spread over independently locked shards. New entries land in a small LRU
+// window; entries leaving the window are only admitted to the main space if
+// they have been requested more often than the entry they would displace, so
+// one-off requests cannot flush popular objects.
+type MemoryCache struct {
+	shards    []*memoryShard
+	shardBits uint
+	seed      maphash.Seed
+	maxSize   int64
+	index     *keyIndex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// ShardStats is a snapshot of one memory cache shard
+type ShardStats struct {
+	Shard       int   `json:"shard"`
+	Entries     int   `json:"entries"`
+	Bytes       int64 `json:"bytes"`
+	Capacity    int64 `json:"capacity"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Evictions   int64 `json:"evictions"`
+	Rejections  int64 `json:"rejections"` // entries refused by the admission policy
+	Expirations int64 `json:"expirations"`
+}
+
+type memoryShard struct {
+	mu        sync.Mutex
+	items     map[string]*list.Element
+	window    *list.List
+	probation *list.List
+	protected *list.List
+	sketch    *frequencySketch
+	index     *keyIndex
+
+	capacity      int64
+	windowCap     int64
+	protectedCap  int64
+	windowSize    int64
+	probationSize int64
+	protectedSize int64
+
+	hits        atomic.Int64
+	misses      atomic.Int64
+	evictions   atomic.Int64
+	rejections  atomic.Int64
+	expirations atomic.Int64
+}
+
+type memoryItem struct {
+	key     string
+	hash    uint64
+	entry   *CacheEntry
+	size    int64
+	segment int
+}
+
+// NewMemoryCache creates a new in-memory cache
+func NewMemoryCache(maxSizeBytes int64) *MemoryCache {
+	shardBits := uint(0)
+	for (1<<(shardBits+1)) <= maxMemoryShards && maxSizeBytes/int64(1<<(shardBits+1)) >= minMemoryShardSize {
+		shardBits++
+	}
+	numShards := 1 << shardBits
+	shardCap := maxSizeBytes / int64(numShards)
+
+	m := &MemoryCache{
+		shards:    make([]*memoryShard, numShards),
+		shardBits: shardBits,
+		seed:      maphash.MakeSeed(),
+		maxSize:   maxSizeBytes,
+		index:     newKeyIndex(),
+		stop:      make(chan struct{}),
+	}
+	for i := range m.shards {
+		m.shards[i] = newMemoryShard(shardCap, m.index)
+	}
+
+	go m.expireLoop()
+	return m
+}
+
+func newMemoryShard(capacity int64, index *keyIndex) *memoryShard {
+	windowCap := capacity * windowPercent / 100
+	return &memoryShard{
+		items:        make(map[string]*list.Element),
+		window:       list.New(),
+		probation:    list.New(),
+		protected:    list.New(),
+		sketch:       newFrequencySketch(int(capacity / averageEntrySize)),
+		index:        index,
+		capacity:     capacity,
+		windowCap:    windowCap,
+		protectedCap: (capacity - windowCap) * protectedPercent / 100,
+	}
+}
+
+func (m *MemoryCache) Get(ctx context.Context, key string) (*CacheEntry, bool) {
+	hash := maphash.String(m.seed, key)
+	s := m.shardFor(hash)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sketch.increment(hash)
+
+	elem, exists := s.items[key]
+	if !exists {
+		s.misses.Add(1)
+		return nil, false
+	}
+
+	// Check if entry has expired past its grace window
+	item := elem.Value.(*memoryItem)
+	if !item.entry.isRetained() {
+		s.remove(elem)
+		s.expirations.Add(1)
+		s.misses.Add(1)
+		return nil, false
+	}
+
+	s.touch(elem)
+	s.hits.Add(1)
+	return item.entry, true
+}
+
+func (m *MemoryCache) Set(ctx context.Context, key string, entry *CacheEntry) error {
+	hash := maphash.String(m.seed, key)
+	s := m.shardFor(hash)
+
+	size := entrySize(entry)
+	if size > s.capacity {
+		return ErrEntryTooLarge
+	}
+
+	// Accesses are counted by Get alone: a miss followed by a fill is one
+	// request, and counting both would let one-off keys start out warm
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Replace an existing entry in place
+	if elem, exists := s.items[key]; exists {
+		item := elem.Value.(*memoryItem)
+		s.addSize(item.segment, size-item.size)
+		s.index.remove(key, item.entry.Host)
+		s.index.add(key, entry.Host, entry.keyInfo())
+		item.entry = entry
+		item.size = size
+		s.touch(elem)
+		s.maintain()
+		return nil
+	}
+
+	item := &memoryItem{
+		key:     key,
+		hash:    hash,
+		entry:   entry,
+		size:    size,
+		segment: segmentWindow,
+	}
+	s.items[key] = s.window.PushFront(item)
+	s.windowSize += size
+	s.index.add(key, entry.Host, entry.keyInfo())
+	s.maintain()
+
+	return nil
+}
+
+func (m *MemoryCache) Delete(ctx context.Context, key string) error {
+	s := m.shardFor(maphash.String(m.seed, key))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, exists := s.items[key]; exists {
+		s.remove(elem)
+	}
+
+	return nil
+}
+
+func (m *MemoryCache) Clear(ctx context.Context) error {
+	for _, s := range m.shards {
+		s.mu.Lock()
+		s.items = make(map[string]*list.Element)
+		s.window.Init()
+		s.probation.Init()
+		s.protected.Init()
+		s.windowSize, s.probationSize, s.protectedSize = 0, 0, 0
+		s.sketch.clear()
+		s.mu.Unlock()
+	}
+	m.index.clear()
+
+	return nil
+}
+
+func (m *MemoryCache) Size() int64 {
+	var size int64
+	for _, s := range m.shards {
+		s.mu.Lock()
+		size += s.size()
+		s.mu.Unlock()
+	}
+	return size
+}
+
+// DomainKeys returns the keys stored for host
+func (m *MemoryCache) DomainKeys(ctx context.Context, host string) (map[string]KeyInfo, error) {
+	return m.index.keys(host), nil
+}
+
+// Stats returns a snapshot of every shard
+func (m *MemoryCache) Stats() []ShardStats {
+	stats := make([]ShardStats, len(m.shards))
+	for i, s := range m.shards {
+		s.mu.Lock()
+		stats[i] = ShardStats{
+			Shard:    i,
+			Entries:  len(s.items),
+			Bytes:    s.size(),
+			Capacity: s.capacity,
+		}
+		s.mu.Unlock()
+
+		stats[i].Hits = s.hits.Load()
+		stats[i].Misses = s.misses.Load()
+		stats[i].Evictions = s.evictions.Load()
+		stats[i].Rejections = s.rejections.Load()
+		stats[i].Expirations = s.expirations.Load()
+	}
+	return stats
+}
+
+// Close stops the background expiry sweep
+func (m *MemoryCache) Close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+func (m *MemoryCache) shardFor(hash uint64) *memoryShard {
+	if m.shardBits == 0 {
+		return m.shards[0]
+	}
+	return m.shards[hash>>(64-m.shardBits)]
+}
+
+// expireLoop periodically drops entries that are past their grace window so
+// memory is returned even for keys that are never requested again
+func (m *MemoryCache) expireLoop() {
+	ticker := time.NewTicker(memoryExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, s := range m.shards {
+				s.expire()
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func entrySize(entry *CacheEntry) int64 {
+	size := int64(len(entry.Body))
+	for name, values := range entry.Headers {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size + 64 // overhead for struct fields
+}
+
+// Shard internals; callers hold s.mu.
+
+func (s *memoryShard) size() int64 {
+	return s.windowSize + s.probationSize + s.protectedSize
+}
+
+func (s *memoryShard) list(segment int) *list.List {
+	switch segment {
+	case segmentWindow:
+		return s.window
+	case segmentProbation:
+		return s.probation
+	}
+	return s.protected
+}
+
+func (s *memoryShard) addSize(segment int, delta int64) {
+	switch segment {
+	case segmentWindow:
+		s.windowSize += delta
+	case segmentProbation:
+		s.probationSize += delta
+	default:
+		s.protectedSize += delta
+	}
+}
+
+// moveTo moves elem to the front of another segment and returns its new
+// element
+func (s *memoryShard) moveTo(elem *list.Element, segment int) *list.Element {
+	item := elem.Value.(*memoryItem)
+	s.list(item.segment).Remove(elem)
+	s.addSize(item.segment, -item.size)
+
+	item.segment = segment
+	s.addSize(segment, item.size)
+	moved := s.list(segment).PushFront(item)
+	s.items[item.key] = moved
+	return moved
+}
+
+// touch records an access: probation entries are promoted to the protected
+// segment, everything else moves to the front of its own segment
+func (s *memoryShard) touch(elem *list.Element) {
+	item := elem.Value.(*memoryItem)
+	if item.segment != segmentProbation {
+		s.list(item.segment).MoveToFront(elem)
+		return
+	}
+
+	s.moveTo(elem, segmentProtected)
+	for s.protectedSize > s.protectedCap && s.protected.Len() > 1 {
+		s.moveTo(s.protected.Back(), segmentProbation)
+	}
+}
+
+func (s *memoryShard) remove(elem *list.Element) {
+	item := elem.Value.(*memoryItem)
+	s.list(item.segment).Remove(elem)
+	s.addSize(item.segment, -item.size)
+	delete(s.items, item.key)
+	s.index.remove(item.key, item.entry.Host)
+}
+
+// maintain moves entries that overflow the window into probation, admitting
+// each only if it is more popular than the entries it would displace
+func (s *memoryShard) maintain() {
+	for s.windowSize > s.windowCap && s.window.Len() > 0 {
+		candidate := s.moveTo(s.window.Back(), segmentProbation)
+		s.admit(candidate)
+	}
+
+	// An in-place update can still leave the shard over capacity
+	for s.size() > s.capacity {
+		victim := s.coldest(nil)
+		if victim == nil {
+			break
+		}
+		s.remove(victim)
+		s.evictions.Add(1)
+		memoryEvictions.Inc()
+	}
+}
+
+// admit makes room for candidate by evicting colder entries, or rejects the
+// candidate once it meets a victim that is at least as popular
+func (s *memoryShard) admit(candidate *list.Element) {
+	candidateItem := candidate.Value.(*memoryItem)
+	for s.size() > s.capacity {
+		victim := s.coldest(candidate)
+		if victim == nil {
+			s.remove(candidate)
+			s.rejections.Add(1)
+			return
+		}
+
+		victimItem := victim.Value.(*memoryItem)
+		if s.sketch.estimate(candidateItem.hash) > s.sketch.estimate(victimItem.hash) {
+			s.remove(victim)
+			s.evictions.Add(1)
+			memoryEvictions.Inc()
+			continue
+		}
+
+		s.remove(candidate)
+		s.rejections.Add(1)
+		return
+	}
+}
+
+// coldest returns the least recently used entry of the main space, falling
+// back to the window, skipping exclude
+func (s *memoryShard) coldest(exclude *list.Element) *list.Element {
+	for _, l := range []*list.List{s.probation, s.protected, s.window} {
+		for elem := l.Back(); elem != nil; elem = elem.Prev() {
+			if elem != exclude {
+				return elem
+			}
+		}
+	}
+	return nil
+}
+
+// expire removes entries past their grace window
+func (s *memoryShard) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, elem := range s.items {
+		if !elem.Value.(*memoryItem).entry.isRetained() {
+			s.remove(elem)
+			s.expirations.Add(1)
+		}
+	}
+}
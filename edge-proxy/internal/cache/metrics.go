@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var cacheEvictions = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "edge_cache_evictions_total",
+		Help: "Entries evicted to make room for others, by cache tier (memory, disk)",
+	},
+	[]string{"tier"},
+)
+
+var (
+	memoryEvictions = cacheEvictions.WithLabelValues("memory")
+	diskEvictions   = cacheEvictions.WithLabelValues("disk")
+)
+
+// RegisterMetrics exports the size of c's memory and disk tiers as
+// edge_cache_size_bytes. It must be called at most once, for the cache the
+// edge serves from. Redis tiers are left out: their size is a key count that
+// takes a scan of the keyspace to read.
+func RegisterMetrics(c Cache) {
+	layers := []Cache{c}
+	if layered, ok := c.(*LayeredCache); ok {
+		layers = layered.Layers()
+	}
+
+	for _, layer := range layers {
+		var tier string
+		switch layer.(type) {
+		case *MemoryCache:
+			tier = "memory"
+		case *DiskCache:
+			tier = "disk"
+		default:
+			continue
+		}
+		promauto.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "edge_cache_size_bytes",
+				Help:        "Bytes stored in each cache tier",
+				ConstLabels: prometheus.Labels{"tier": tier},
+			},
+			func() float64 { return float64(layer.Size()) },
+		)
+	}
+}
@@ -0,0 +1,101 @@
+package cache
+
+// frequencySketch is a count-min sketch that estimates how often keys have
+// been seen recently. Counters saturate at 15 and are halved once the sketch
+// has recorded sampleSize increments, so old popularity fades over time.
+type frequencySketch struct {
+	rows       [sketchDepth][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+const (
+	sketchDepth      = 4
+	sketchMaxCounter = 15
+)
+
+// newFrequencySketch sizes the sketch for roughly the given number of
+// distinct keys.
+func newFrequencySketch(expectedKeys int) *frequencySketch {
+	width := 64
+	for width < expectedKeys {
+		width <<= 1
+	}
+
+	s := &frequencySketch{
+		mask:       uint64(width - 1),
+		sampleSize: 10 * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// increment records one occurrence of the key hash.
+func (s *frequencySketch) increment(hash uint64) {
+	added := false
+	for i := range s.rows {
+		idx := s.index(hash, i)
+		if s.rows[i][idx] < sketchMaxCounter {
+			s.rows[i][idx]++
+			added = true
+		}
+	}
+
+	if added {
+		s.additions++
+		if s.additions >= s.sampleSize {
+			s.reset()
+		}
+	}
+}
+
+// estimate returns the approximate number of recent occurrences of the hash.
+func (s *frequencySketch) estimate(hash uint64) uint8 {
+	min := uint8(sketchMaxCounter)
+	for i := range s.rows {
+		if v := s.rows[i][s.index(hash, i)]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// reset halves every counter to age out old popularity.
+func (s *frequencySketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
+
+// clear zeroes the sketch.
+func (s *frequencySketch) clear() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] = 0
+		}
+	}
+	s.additions = 0
+}
+
+// sketchSeeds rehash the key for each row. Deriving the rows from the halves
+// of one hash is not enough: the halves are correlated, so keys that collided
+// in one row tended to collide in all of them.
+var sketchSeeds = [sketchDepth]uint64{
+	0xc3a5c85c97cb3127,
+	0xb492b66fbe98f273,
+	0x9ae16a3b2f90404f,
+	0xcbf29ce484222325,
+}
+
+// index derives the counter for row i.
+func (s *frequencySketch) index(hash uint64, i int) uint64 {
+	h := (hash + sketchSeeds[i]) * sketchSeeds[i]
+	h ^= h >> 32
+	return h & s.mask
+}
@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A resource whose responses carry Vary is stored in two parts: a vary index
+// at its primary key (from GenerateCacheKey) that records which request
+// headers it varies on, and one entry per variant under a variant key built
+// from the normalized values of those headers. Each new index starts a new
+// generation, so variants left behind by a purged index are never served.
+
+// varyIndexStatus is the StatusCode of a vary index entry.
+const varyIndexStatus = 0
+
+// IsVaryIndex reports whether the entry is a vary index rather than a response
+func (e *CacheEntry) IsVaryIndex() bool {
+	return e.StatusCode == varyIndexStatus && len(e.Vary) > 0
+}
+
+// Matches reports whether the entry is the variant req should be served
+func (e *CacheEntry) Matches(req *http.Request) bool {
+	return len(e.Vary) == 0 || VariantID(req, e.Vary) == e.Variant
+}
+
+// ParseVary returns the canonical, sorted header names listed in a response's
+// Vary header. It returns false for Vary: *, which cannot be cached.
+func ParseVary(header http.Header) ([]string, bool) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, false
+			}
+			name = http.CanonicalHeaderKey(name)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// VariantID identifies the variant of a resource that req selects, given the
+// header names the resource varies on
+func VariantID(req *http.Request, names []string) string {
+	var buf strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte('&')
+		}
+		buf.WriteString(strings.ToLower(name))
+		buf.WriteByte('=')
+		buf.WriteString(url.QueryEscape(NormalizeHeader(name, req.Header.Values(name))))
+	}
+	return buf.String()
+}
+
+// NormalizeHeader collapses equivalent request header values so they select
+// the same variant
+func NormalizeHeader(name string, values []string) string {
+	switch http.CanonicalHeaderKey(name) {
+	case "Accept-Encoding":
+		return normalizeAcceptEncoding(values)
+	case "Accept", "Accept-Language":
+		return strings.ToLower(joinHeaderValues(values))
+	}
+	return joinHeaderValues(values)
+}
+
+// normalizeAcceptEncoding reduces Accept-Encoding to the best encoding the
+// client accepts out of br, gzip and identity. Clients that accept br almost
+// always accept gzip too, so this keeps one variant per encoding instead of
+// one per browser.
+func normalizeAcceptEncoding(values []string) string {
+	var gzip, br bool
+	for _, value := range values {
+		for _, token := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(token), ";")
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if qv, err := strconv.ParseFloat(q, 64); err == nil && qv == 0 {
+					continue
+				}
+			}
+			switch strings.ToLower(strings.TrimSpace(coding)) {
+			case "br":
+				br = true
+			case "gzip", "x-gzip":
+				gzip = true
+			case "*":
+				br, gzip = true, true
+			}
+		}
+	}
+
+	switch {
+	case br:
+		return "br"
+	case gzip:
+		return "gzip"
+	}
+	return "identity"
+}
+
+// joinHeaderValues joins all values of a header into one comma-separated
+// list with consistent spacing
+func joinHeaderValues(values []string) string {
+	var elements []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				elements = append(elements, element)
+			}
+		}
+	}
+	return strings.Join(elements, ",")
+}
+
+// variantKey is the key a variant of the resource at primaryKey is stored
+// under for the given index generation
+func variantKey(primaryKey string, generation int64, variant string) string {
+	return primaryKey + "|vary:" + strconv.FormatInt(generation, 10) + ":" + variant
+}
+
+// Lookup returns the cached response for req, following a vary index at
+// primaryKey to the variant req selects. The returned key is the one the
+// response is, or would be, stored under; it equals primaryKey unless the
+// resource is known to vary.
+func Lookup(ctx context.Context, c Cache, primaryKey string, req *http.Request) (*CacheEntry, string, bool) {
+	entry, found := c.Get(ctx, primaryKey)
+	if !found || !entry.IsVaryIndex() {
+		return entry, primaryKey, found
+	}
+
+	key := variantKey(primaryKey, entry.CachedAt.Unix(), VariantID(req, entry.Vary))
+	variant, found := c.Get(ctx, key)
+	if found && !variant.Matches(req) {
+		return nil, key, false
+	}
+	return variant, key, found
+}
+
+// Store saves a response under primaryKey, or under its variant key with a
+// vary index at primaryKey when the response varies
+func Store(ctx context.Context, c Cache, primaryKey string, entry *CacheEntry) error {
+	if len(entry.Vary) == 0 {
+		return c.Set(ctx, primaryKey, entry)
+	}
+
+	// Keep the current index generation while the resource keeps varying on
+	// the same headers, so existing variants stay reachable and the index
+	// carries the tags of all of them for purges
+	generation := time.Now()
+	expires := entry.CachedAt.Add(entry.retention())
+	tags := entry.Tags
+	if index, found := c.Get(ctx, primaryKey); found && index.IsVaryIndex() && sameNames(index.Vary, entry.Vary) {
+		generation = index.CachedAt
+		if indexExpires := index.CachedAt.Add(index.TTL); indexExpires.After(expires) {
+			expires = indexExpires
+		}
+		tags = mergeTags(index.Tags, entry.Tags)
+	}
+	generation = time.Unix(generation.Unix(), 0)
+
+	if err := c.Set(ctx, variantKey(primaryKey, generation.Unix(), entry.Variant), entry); err != nil {
+		return err
+	}
+	return c.Set(ctx, primaryKey, &CacheEntry{
+		StatusCode: varyIndexStatus,
+		Headers:    make(http.Header),
+		Vary:       entry.Vary,
+		CachedAt:   generation,
+		TTL:        expires.Sub(generation),
+		Host:       entry.Host,
+		Path:       entry.Path,
+		Tags:       tags,
+	})
+}
+
+// mergeTags returns the sorted union of two tag lists
+func mergeTags(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var tags []string
+	for _, tag := range append(append([]string(nil), a...), b...) {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,255 @@
+// Package certs picks the certificate the edge presents to each TLS client.
+package certs
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/naijcloud/edge-proxy/internal/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+var certificateLookups = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "edge_tls_certificate_lookups_total",
+		Help: "TLS handshake certificate lookups by result (domain, default, missing, error)",
+	},
+	[]string{"result"},
+)
+
+// lookupTimeout bounds the domain configuration lookup during a handshake
+const lookupTimeout = 5 * time.Second
+
+// DomainLookup returns a domain's configuration, as services.DomainCache does
+type DomainLookup interface {
+	Get(ctx context.Context, domain string) (*services.DomainResponse, error)
+}
+
+// KeyLookup returns a domain's certificate with its private key, as
+// services.ControlPlaneClient does
+type KeyLookup interface {
+	GetDomainCertificate(ctx context.Context, domain string) (*services.DomainCertificate, error)
+}
+
+// Store selects certificates by SNI. Each domain's certificate comes with the
+// domain configuration fetched from the control plane, so a new certificate
+// is picked up as soon as the configuration is refreshed; connections already
+// established keep the certificate they were opened with. The configuration
+// carries no private key: it is fetched from the control plane's
+// authenticated edge route the first time a certificate is served. Clients
+// without SNI, and domains without a certificate, get the default
+// certificate if one is loaded.
+type Store struct {
+	domains DomainLookup
+	keys    KeyLookup
+
+	mu    sync.RWMutex
+	certs map[string]*storedCert
+
+	defaultMu   sync.RWMutex
+	defaultCert *tls.Certificate
+	certFile    string
+	keyFile     string
+	defaultMod  time.Time
+}
+
+// storedCert is a parsed certificate and the fingerprint of the certificate
+// PEM in the domain configuration it was loaded for
+type storedCert struct {
+	fingerprint [sha256.Size]byte
+	cert        *tls.Certificate
+}
+
+// NewStore creates a certificate store backed by domains, fetching private
+// keys from keys
+func NewStore(domains DomainLookup, keys KeyLookup) *Store {
+	return &Store{
+		domains: domains,
+		keys:    keys,
+		certs:   make(map[string]*storedCert),
+	}
+}
+
+// LoadDefault loads the default certificate from PEM files. WatchDefault
+// reloads it when the files change.
+func (s *Store) LoadDefault(certFile, keyFile string) error {
+	s.defaultMu.Lock()
+	s.certFile = certFile
+	s.keyFile = keyFile
+	s.defaultMu.Unlock()
+
+	return s.reloadDefault()
+}
+
+// WatchDefault checks the default certificate files every interval until ctx
+// is done, reloading them when they change. A failed reload keeps the
+// current certificate.
+func (s *Store) WatchDefault(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.reloadDefault(); err != nil {
+				logrus.WithError(err).Warn("Failed to reload default TLS certificate")
+			}
+		}
+	}
+}
+
+// reloadDefault loads the default certificate files if they changed since
+// the last load
+func (s *Store) reloadDefault() error {
+	s.defaultMu.RLock()
+	certFile, keyFile, loaded := s.certFile, s.keyFile, s.defaultMod
+	s.defaultMu.RUnlock()
+
+	if certFile == "" || keyFile == "" {
+		return nil
+	}
+
+	modTime, err := latestModTime(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	if !modTime.After(loaded) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load default certificate: %w", err)
+	}
+
+	s.defaultMu.Lock()
+	s.defaultCert = &cert
+	s.defaultMod = modTime
+	s.defaultMu.Unlock()
+
+	logrus.WithField("cert_file", certFile).Info("Default TLS certificate loaded")
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if host == "" {
+		return s.fallback(host)
+	}
+
+	ctx, cancel := context.WithTimeout(hello.Context(), lookupTimeout)
+	defer cancel()
+
+	domain, err := s.domains.Get(ctx, host)
+	if err != nil {
+		if errors.Is(err, services.ErrNotFound) {
+			s.forget(host)
+		} else {
+			certificateLookups.WithLabelValues("error").Inc()
+			logrus.WithError(err).WithField("host", host).Warn("Failed to look up domain for TLS handshake")
+		}
+		return s.fallback(host)
+	}
+	if domain.Certificate == nil || domain.Certificate.CertPEM == "" {
+		s.forget(host)
+		return s.fallback(host)
+	}
+
+	cert, err := s.domainCertificate(ctx, host, domain.Certificate)
+	if err != nil {
+		certificateLookups.WithLabelValues("error").Inc()
+		logrus.WithError(err).WithField("host", host).Error("Invalid domain certificate")
+		return s.fallback(host)
+	}
+
+	certificateLookups.WithLabelValues("domain").Inc()
+	return cert, nil
+}
+
+// domainCertificate returns the parsed certificate for host, fetching its key
+// and parsing it again only when the configured certificate changed
+func (s *Store) domainCertificate(ctx context.Context, host string, configured *services.DomainCertificate) (*tls.Certificate, error) {
+	fingerprint := sha256.Sum256([]byte(configured.CertPEM))
+
+	s.mu.RLock()
+	stored := s.certs[host]
+	s.mu.RUnlock()
+	if stored != nil && stored.fingerprint == fingerprint {
+		return stored.cert, nil
+	}
+
+	// The key is parsed with the certificate it was fetched with, which is
+	// the configured one unless it has been rotated again since
+	pem, err := s.keys.GetDomainCertificate(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch certificate key: %w", err)
+	}
+	cert, err := tls.X509KeyPair([]byte(pem.CertPEM), []byte(pem.KeyPEM))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.certs[host] = &storedCert{fingerprint: fingerprint, cert: &cert}
+	s.mu.Unlock()
+
+	if stored != nil {
+		logrus.WithField("host", host).Info("Domain TLS certificate reloaded")
+	}
+	return &cert, nil
+}
+
+// forget drops the certificate parsed for a host that no longer has one
+func (s *Store) forget(host string) {
+	s.mu.Lock()
+	delete(s.certs, host)
+	s.mu.Unlock()
+}
+
+// fallback returns the default certificate, if any
+func (s *Store) fallback(host string) (*tls.Certificate, error) {
+	s.defaultMu.RLock()
+	cert := s.defaultCert
+	s.defaultMu.RUnlock()
+
+	if cert == nil {
+		certificateLookups.WithLabelValues("missing").Inc()
+		return nil, fmt.Errorf("no certificate for %q", host)
+	}
+	certificateLookups.WithLabelValues("default").Inc()
+	return cert, nil
+}
+
+// Len returns the number of domain certificates loaded
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.certs)
+}
+
+// latestModTime returns the most recent modification time of files
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -14,8 +14,18 @@ type Config struct {
 	LogLevel    string `mapstructure:"log_level"`
 	Region      string `mapstructure:"region"`
 
-	// Control plane configuration
-	ControlPlaneURL string `mapstructure:"control_plane_url"`
+	// ShieldSecret is shared by all edges to authenticate the requests they
+	// fetch through each other as origin shields
+	ShieldSecret string `mapstructure:"shield_secret"`
+
+	// MetricsMaxDomains caps how many domains get their own label value in
+	// request metrics; requests for domains past it are labelled "other"
+	MetricsMaxDomains int `mapstructure:"metrics_max_domains"`
+
+	// Control plane configuration. edge_registration_secret is the secret
+	// the control plane's operator issues for edges to register with.
+	ControlPlaneURL        string `mapstructure:"control_plane_url"`
+	EdgeRegistrationSecret string `mapstructure:"edge_registration_secret"`
 
 	// Redis configuration
 	RedisURL string `mapstructure:"redis_url"`
@@ -26,20 +36,78 @@ type Config struct {
 	MaxCacheAge int    `mapstructure:"max_cache_age"`
 	MinCacheAge int    `mapstructure:"min_cache_age"`
 
+	// CacheMode selects the cache backend: "auto" (Redis when configured,
+	// otherwise memory), "memory", "redis", "disk" or "layered" (memory,
+	// then disk, then Redis when configured)
+	CacheMode     string `mapstructure:"cache_mode"`
+	DiskCacheDir  string `mapstructure:"disk_cache_dir"`
+	DiskCacheSize string `mapstructure:"disk_cache_size"`
+
+	// Domain configuration cache, in seconds. Unknown hosts are remembered
+	// for domain_negative_ttl; expired configurations keep being served for
+	// up to domain_max_stale while they are refreshed.
+	DomainCacheTTL    int `mapstructure:"domain_cache_ttl"`
+	DomainNegativeTTL int `mapstructure:"domain_negative_ttl"`
+	DomainMaxStale    int `mapstructure:"domain_max_stale"`
+
+	// TunnelIdleTimeout closes WebSocket and other upgraded connections idle
+	// for this many seconds, unless the domain sets its own
+	TunnelIdleTimeout int `mapstructure:"tunnel_idle_timeout"`
+
 	// Rate limiting configuration
 	RateLimitRPS   int `mapstructure:"rate_limit_rps"`
 	RateLimitBurst int `mapstructure:"rate_limit_burst"`
 
-	// TLS configuration
-	TLSEnabled    bool   `mapstructure:"tls_enabled"`
-	TLSCertFile   string `mapstructure:"tls_cert_file"`
-	TLSKeyFile    string `mapstructure:"tls_key_file"`
-	AutoCertEmail string `mapstructure:"autocert_email"`
-	AutoCertHosts string `mapstructure:"autocert_hosts"`
+	// HTTP/2 configuration. HTTP/2 is offered to TLS clients unless
+	// http2_enabled is false; h2c_enabled also accepts cleartext HTTP/2, for
+	// deployments behind a load balancer that terminates TLS. origin_http2 is
+	// "auto", "off" or "h2c".
+	HTTP2Enabled              bool   `mapstructure:"http2_enabled"`
+	H2CEnabled                bool   `mapstructure:"h2c_enabled"`
+	HTTP2MaxConcurrentStreams int    `mapstructure:"http2_max_concurrent_streams"`
+	OriginHTTP2               string `mapstructure:"origin_http2"`
 
-	// Health check configuration
+	// TLS configuration. With TLS enabled, HTTPS is served on tls_port
+	// alongside plain HTTP on port, with certificates chosen by SNI from the
+	// domains' configurations; tls_cert_file and tls_key_file hold the
+	// default certificate for clients without SNI and domains without one.
+	// Domain certificates are ordered over ACME by the control plane, which
+	// takes the account email as its own autocert_email; edges only answer
+	// the HTTP-01 challenges.
+	TLSEnabled  bool   `mapstructure:"tls_enabled"`
+	TLSPort     int    `mapstructure:"tls_port"`
+	TLSCertFile string `mapstructure:"tls_cert_file"`
+	TLSKeyFile  string `mapstructure:"tls_key_file"`
+
+	// Active health checks of pool origins, in seconds
 	HealthCheckInterval int `mapstructure:"health_check_interval"`
 	HealthCheckTimeout  int `mapstructure:"health_check_timeout"`
+
+	// Per-origin circuit breaker. It opens when, within
+	// circuit_breaker_window seconds, at least circuit_breaker_min_requests
+	// requests were sent and circuit_breaker_threshold of them failed or took
+	// longer than circuit_breaker_slow_call seconds, and stays open for
+	// circuit_breaker_open_duration seconds.
+	CircuitBreakerEnabled      bool    `mapstructure:"circuit_breaker_enabled"`
+	CircuitBreakerWindow       int     `mapstructure:"circuit_breaker_window"`
+	CircuitBreakerMinRequests  int     `mapstructure:"circuit_breaker_min_requests"`
+	CircuitBreakerThreshold    float64 `mapstructure:"circuit_breaker_threshold"`
+	CircuitBreakerSlowCall     int     `mapstructure:"circuit_breaker_slow_call"`
+	CircuitBreakerOpenDuration int     `mapstructure:"circuit_breaker_open_duration"`
+
+	// Per-origin concurrency cap; 0 leaves origins uncapped. Requests over
+	// the cap queue, up to origin_max_queue of them, for at most
+	// origin_queue_timeout seconds.
+	OriginMaxConcurrent int `mapstructure:"origin_max_concurrent"`
+	OriginMaxQueue      int `mapstructure:"origin_max_queue"`
+	OriginQueueTimeout  int `mapstructure:"origin_queue_timeout"`
+
+	// Retries of idempotent origin requests after connection errors and
+	// origin_retry_statuses responses, with a jittered backoff of up to
+	// origin_retry_backoff_ms, doubling per retry
+	OriginRetries        int   `mapstructure:"origin_retries"`
+	OriginRetryBackoffMs int   `mapstructure:"origin_retry_backoff_ms"`
+	OriginRetryStatuses  []int `mapstructure:"origin_retry_statuses"`
 }
 
 func Load() (*Config, error) {
@@ -51,19 +119,46 @@ func Load() (*Config, error) {
 	// Set defaults
 	viper.SetDefault("port", 8081)
 	viper.SetDefault("metrics_port", 9092)
+	viper.SetDefault("metrics_max_domains", 1000)
 	viper.SetDefault("log_level", "info")
 	viper.SetDefault("region", "local")
+	viper.SetDefault("shield_secret", "")
 	viper.SetDefault("control_plane_url", "http://localhost:8080")
+	viper.SetDefault("edge_registration_secret", "")
 	viper.SetDefault("redis_url", "redis://localhost:6379")
 	viper.SetDefault("cache_size", "100MB")
 	viper.SetDefault("default_ttl", 3600)
 	viper.SetDefault("max_cache_age", 86400)
 	viper.SetDefault("min_cache_age", 60)
+	viper.SetDefault("cache_mode", "auto")
+	viper.SetDefault("disk_cache_dir", "/var/cache/naijcloud-edge")
+	viper.SetDefault("disk_cache_size", "10GB")
+	viper.SetDefault("domain_cache_ttl", 60)
+	viper.SetDefault("domain_negative_ttl", 30)
+	viper.SetDefault("domain_max_stale", 3600)
+	viper.SetDefault("tunnel_idle_timeout", 300)
 	viper.SetDefault("rate_limit_rps", 1000)
 	viper.SetDefault("rate_limit_burst", 2000)
+	viper.SetDefault("http2_enabled", true)
+	viper.SetDefault("h2c_enabled", false)
+	viper.SetDefault("http2_max_concurrent_streams", 250)
+	viper.SetDefault("origin_http2", "auto")
 	viper.SetDefault("tls_enabled", false)
+	viper.SetDefault("tls_port", 8443)
 	viper.SetDefault("health_check_interval", 30)
 	viper.SetDefault("health_check_timeout", 10)
+	viper.SetDefault("circuit_breaker_enabled", true)
+	viper.SetDefault("circuit_breaker_window", 10)
+	viper.SetDefault("circuit_breaker_min_requests", 20)
+	viper.SetDefault("circuit_breaker_threshold", 0.5)
+	viper.SetDefault("circuit_breaker_slow_call", 5)
+	viper.SetDefault("circuit_breaker_open_duration", 30)
+	viper.SetDefault("origin_max_concurrent", 256)
+	viper.SetDefault("origin_max_queue", 512)
+	viper.SetDefault("origin_queue_timeout", 5)
+	viper.SetDefault("origin_retries", 2)
+	viper.SetDefault("origin_retry_backoff_ms", 50)
+	viper.SetDefault("origin_retry_statuses", []int{502, 503, 504})
 
 	// Allow environment variables
 	viper.AutomaticEnv()
@@ -31,27 +31,3 @@ func LoggingMiddleware() gin.HandlerFunc {
 		}).Info("HTTP request")
 	}
 }
-
-// MetricsMiddleware for collecting request metrics
-func MetricsMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		start := time.Now()
-
-		// Process request
-		c.Next()
-
-		// Record metrics
-		duration := time.Since(start)
-
-		// Here you would increment Prometheus counters
-		// For now, we'll just log metrics
-		logrus.WithFields(logrus.Fields{
-			"type":         "metrics",
-			"method":       c.Request.Method,
-			"path":         c.Request.URL.Path,
-			"status":       c.Writer.Status(),
-			"duration_ms":  duration.Milliseconds(),
-			"cache_status": c.GetHeader("X-Cache-Status"),
-		}).Debug("Request metrics")
-	}
-}
@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metricsDomainKey is the gin context key holding the configured domain a
+// request was served for
+const metricsDomainKey = "metrics_domain"
+
+// Label values for requests that were not served for a configured domain,
+// and for domains past the label limit
+const (
+	unknownDomainLabel = "unknown"
+	otherDomainLabel   = "other"
+)
+
+// DefaultMaxDomainLabels is how many domains get their own label value when
+// MetricsMiddleware is not given a limit
+const DefaultMaxDomainLabels = 1000
+
+// cacheStatuses are the X-Cache-Status values the proxy sets; anything else
+// is counted as "other" and no status at all as "none"
+var cacheStatuses = map[string]bool{
+	"HIT":         true,
+	"MISS":        true,
+	"STALE":       true,
+	"UPDATING":    true,
+	"REVALIDATED": true,
+	"COALESCED":   true,
+	"BYPASS":      true,
+}
+
+// requestDurationBuckets start below a millisecond, where cache hits land
+var requestDurationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	clientRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "edge_client_requests_total",
+			Help: "Client requests by HTTP protocol version",
+		},
+		[]string{"protocol"},
+	)
+
+	httpRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "edge_http_requests_total",
+			Help: "Requests served, by domain, status class and cache status",
+		},
+		[]string{"domain", "status_class", "cache_status"},
+	)
+
+	httpRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "edge_http_request_duration_seconds",
+			Help:    "Time from receiving a request to finishing its response, by domain, status class and cache status",
+			Buckets: requestDurationBuckets,
+		},
+		[]string{"domain", "status_class", "cache_status"},
+	)
+
+	httpResponseBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "edge_http_response_bytes_total",
+			Help: "Response body bytes served to clients, by domain and cache status",
+		},
+		[]string{"domain", "cache_status"},
+	)
+)
+
+// requestsHandled counts every request for the control plane heartbeat
+var requestsHandled atomic.Int64
+
+// RequestsHandled returns how many requests the edge has served since it
+// started
+func RequestsHandled() int64 {
+	return requestsHandled.Load()
+}
+
+// SetMetricsDomain records that the request was served for a configured
+// domain, so its metrics are labelled with it. Requests that never reach a
+// configured domain are labelled "unknown", keeping arbitrary Host headers
+// out of the label values.
+func SetMetricsDomain(c *gin.Context, domain string) {
+	c.Set(metricsDomainKey, domain)
+}
+
+// MetricsMiddleware records Prometheus metrics for every request once its
+// response is written. The first maxDomains configured domains seen get
+// their own label value and later ones share "other"; zero or less uses
+// DefaultMaxDomainLabels.
+func MetricsMiddleware(maxDomains int) gin.HandlerFunc {
+	if maxDomains <= 0 {
+		maxDomains = DefaultMaxDomainLabels
+	}
+	domains := &domainLabels{seen: make(map[string]struct{}), max: maxDomains}
+
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		// Process request
+		c.Next()
+
+		// Record metrics
+		duration := time.Since(start)
+		requestsHandled.Add(1)
+		clientRequests.WithLabelValues(c.Request.Proto).Inc()
+
+		domain := domains.label(c.GetString(metricsDomainKey))
+		class := statusClass(c.Writer.Status())
+		cacheStatus := cacheStatusLabel(c.Writer.Header().Get("X-Cache-Status"))
+
+		httpRequests.WithLabelValues(domain, class, cacheStatus).Inc()
+		httpRequestDuration.WithLabelValues(domain, class, cacheStatus).Observe(duration.Seconds())
+		if size := c.Writer.Size(); size > 0 {
+			httpResponseBytes.WithLabelValues(domain, cacheStatus).Add(float64(size))
+		}
+	}
+}
+
+// domainLabels hands out domain label values, up to max distinct domains.
+// Domains keep their label once given one, even after they are removed.
+type domainLabels struct {
+	mu   sync.RWMutex
+	seen map[string]struct{}
+	max  int
+}
+
+func (d *domainLabels) label(domain string) string {
+	if domain == "" {
+		return unknownDomainLabel
+	}
+
+	d.mu.RLock()
+	_, ok := d.seen[domain]
+	d.mu.RUnlock()
+	if ok {
+		return domain
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.seen[domain]; ok {
+		return domain
+	}
+	if len(d.seen) >= d.max {
+		return otherDomainLabel
+	}
+	d.seen[domain] = struct{}{}
+	return domain
+}
+
+// statusClass returns "2xx" style classes for status codes
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// cacheStatusLabel maps an X-Cache-Status value to a bounded label value
+func cacheStatusLabel(status string) string {
+	switch {
+	case status == "":
+		return "none"
+	case cacheStatuses[status]:
+		return status
+	default:
+		return "other"
+	}
+}
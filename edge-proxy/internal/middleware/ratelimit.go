@@ -6,9 +6,19 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"golang.org/x/time/rate"
 )
 
+var rateLimitRejections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "edge_rate_limit_rejections_total",
+		Help: "Requests rejected by rate limiting, by the limit they exceeded (client, domain)",
+	},
+	[]string{"scope"},
+)
+
 // RateLimiter implements token bucket rate limiting
 type RateLimiter struct {
 	limiters map[string]*rate.Limiter
@@ -40,6 +50,37 @@ func (rl *RateLimiter) GetLimiter(key string) *rate.Limiter {
 	return limiter
 }
 
+// AllowDomain reports whether a request to domain fits within the domain's
+// own limit of rps requests per second, shared by all of its clients. The
+// burst is twice the rate. A changed rps is applied to the existing limiter
+// so updates from the control plane take effect without a restart.
+func (rl *RateLimiter) AllowDomain(domain string, rps int) bool {
+	if rps <= 0 {
+		return true
+	}
+
+	limit := rate.Limit(rps)
+	burst := rps * 2
+	key := "domain:" + domain
+
+	rl.mu.Lock()
+	limiter, exists := rl.limiters[key]
+	if !exists {
+		limiter = rate.NewLimiter(limit, burst)
+		rl.limiters[key] = limiter
+	} else if limiter.Limit() != limit {
+		limiter.SetLimit(limit)
+		limiter.SetBurst(burst)
+	}
+	rl.mu.Unlock()
+
+	if !limiter.Allow() {
+		rateLimitRejections.WithLabelValues("domain").Inc()
+		return false
+	}
+	return true
+}
+
 // CleanupExpired removes expired limiters (call periodically)
 func (rl *RateLimiter) CleanupExpired() {
 	rl.mu.Lock()
@@ -47,7 +88,7 @@ func (rl *RateLimiter) CleanupExpired() {
 
 	// Remove limiters that haven't been used recently
 	for key, limiter := range rl.limiters {
-		if limiter.Tokens() == float64(rl.burst) {
+		if limiter.Tokens() == float64(limiter.Burst()) {
 			delete(rl.limiters, key)
 		}
 	}
@@ -72,6 +113,7 @@ func (rl *RateLimiter) RateLimit() gin.HandlerFunc {
 		limiter := rl.GetLimiter(key)
 
 		if !limiter.Allow() {
+			rateLimitRejections.WithLabelValues("client").Inc()
 			c.JSON(http.StatusTooManyRequests, gin.H{
 				"error":       "Rate limit exceeded",
 				"retry_after": "60s",
@@ -93,6 +135,7 @@ func (rl *RateLimiter) PerDomainRateLimit() gin.HandlerFunc {
 		limiter := rl.GetLimiter(key)
 
 		if !limiter.Allow() {
+			rateLimitRejections.WithLabelValues("client").Inc()
 			c.JSON(http.StatusTooManyRequests, gin.H{
 				"error":       "Rate limit exceeded for this domain",
 				"retry_after": "60s",
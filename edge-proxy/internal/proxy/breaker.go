@@ -0,0 +1,540 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/naijcloud/edge-proxy/internal/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"
+	CircuitHalfOpen = "half_open"
+	CircuitOpen     = "open"
+)
+
+const (
+	defaultBreakerWindow       = 10 * time.Second
+	defaultBreakerMinRequests  = 20
+	defaultBreakerThreshold    = 0.5
+	defaultBreakerSlowCall     = 5 * time.Second
+	defaultBreakerOpenDuration = 30 * time.Second
+	defaultOriginQueueTimeout  = 5 * time.Second
+
+	// breakerBuckets is how many slices the breaker window is counted in;
+	// the oldest slice is dropped as the window rolls forward
+	breakerBuckets = 10
+)
+
+var (
+	// errCircuitOpen is returned for requests to an origin whose circuit
+	// breaker is open
+	errCircuitOpen = errors.New("origin circuit breaker is open")
+	// errOriginOverloaded is returned for requests that found the origin at
+	// its concurrency cap and could not wait for a slot
+	errOriginOverloaded = errors.New("origin concurrency limit reached")
+)
+
+var (
+	originCircuitState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "edge_origin_circuit_state",
+			Help: "Circuit breaker state per origin (0 closed, 1 half-open, 2 open)",
+		},
+		[]string{"origin"},
+	)
+
+	originCircuitTransitions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "edge_origin_circuit_transitions_total",
+			Help: "Circuit breaker state changes, by origin and the state entered",
+		},
+		[]string{"origin", "state"},
+	)
+
+	originRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "edge_origin_rejections_total",
+			Help: "Requests not sent to an origin, by origin and reason (circuit_open, queue_full, queue_timeout)",
+		},
+		[]string{"origin", "reason"},
+	)
+
+	originInflight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "edge_origin_requests_inflight",
+			Help: "Requests in flight to each capped origin",
+		},
+		[]string{"origin"},
+	)
+
+	originQueued = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "edge_origin_requests_queued",
+			Help: "Requests waiting for a slot at each capped origin",
+		},
+		[]string{"origin"},
+	)
+
+	originRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "edge_origin_request_duration_seconds",
+			Help:    "Time until an origin's response headers arrived, by origin and status class (error when none did)",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"origin", "status_class"},
+	)
+)
+
+var circuitStateValues = map[string]float64{
+	CircuitClosed:   0,
+	CircuitHalfOpen: 1,
+	CircuitOpen:     2,
+}
+
+// CircuitStatus is the state of one origin's circuit breaker and
+// concurrency cap
+type CircuitStatus struct {
+	Origin   string    `json:"origin"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Requests int       `json:"requests"` // in the breaker window
+	Failures int       `json:"failures"`
+	Slow     int       `json:"slow"`
+	Inflight int       `json:"inflight"`
+	Queued   int64     `json:"queued"`
+}
+
+// gateConfig holds the breaker and concurrency settings shared by every
+// origin gate
+type gateConfig struct {
+	breaker      bool
+	window       time.Duration
+	minRequests  int
+	threshold    float64
+	slowCall     time.Duration
+	openDuration time.Duration
+
+	maxConcurrent int
+	maxQueue      int64
+	queueTimeout  time.Duration
+}
+
+func newGateConfig(config ProxyConfig) gateConfig {
+	gc := gateConfig{
+		breaker:       config.CircuitBreaker,
+		window:        config.BreakerWindow,
+		minRequests:   config.BreakerMinRequests,
+		threshold:     config.BreakerThreshold,
+		slowCall:      config.BreakerSlowCall,
+		openDuration:  config.BreakerOpenDuration,
+		maxConcurrent: config.OriginMaxConcurrent,
+		maxQueue:      int64(config.OriginMaxQueue),
+		queueTimeout:  config.OriginQueueTimeout,
+	}
+	if gc.window <= 0 {
+		gc.window = defaultBreakerWindow
+	}
+	if gc.minRequests <= 0 {
+		gc.minRequests = defaultBreakerMinRequests
+	}
+	if gc.threshold <= 0 || gc.threshold > 1 {
+		gc.threshold = defaultBreakerThreshold
+	}
+	if gc.slowCall <= 0 {
+		gc.slowCall = defaultBreakerSlowCall
+	}
+	if gc.openDuration <= 0 {
+		gc.openDuration = defaultBreakerOpenDuration
+	}
+	if gc.queueTimeout <= 0 {
+		gc.queueTimeout = defaultOriginQueueTimeout
+	}
+	return gc
+}
+
+// originGates holds the gate of every origin the edge has sent requests to
+type originGates struct {
+	mu     sync.Mutex
+	gates  map[string]*originGate
+	config gateConfig
+}
+
+func newOriginGates(config gateConfig) *originGates {
+	return &originGates{
+		gates:  make(map[string]*originGate),
+		config: config,
+	}
+}
+
+// get returns the gate for an origin, creating it on first use
+func (g *originGates) get(origin string) *originGate {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	gate, ok := g.gates[origin]
+	if !ok {
+		gate = &originGate{
+			origin: origin,
+			config: &g.config,
+			state:  CircuitClosed,
+			since:  time.Now(),
+		}
+		if g.config.maxConcurrent > 0 {
+			gate.slots = make(chan struct{}, g.config.maxConcurrent)
+		}
+		g.gates[origin] = gate
+		originCircuitState.WithLabelValues(origin).Set(0)
+	}
+	return gate
+}
+
+// available reports whether requests to an origin would get past its
+// circuit breaker, so origin pools can route around it
+func (g *originGates) available(origin string) bool {
+	g.mu.Lock()
+	gate, ok := g.gates[origin]
+	g.mu.Unlock()
+	if !ok {
+		return true
+	}
+
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	return gate.state != CircuitOpen || time.Since(gate.since) >= gate.config.openDuration
+}
+
+// breakerBucket counts the outcomes of one slice of the breaker window
+type breakerBucket struct {
+	slice    int64
+	total    int
+	failures int
+	slow     int
+}
+
+// originGate is the circuit breaker and concurrency cap of one origin. The
+// breaker trips when too many requests in its window fail or are slow. Once
+// open it rejects requests until openDuration has passed, then lets a single
+// trial request through: success closes it and failure opens it again.
+type originGate struct {
+	origin string
+	config *gateConfig
+
+	mu      sync.Mutex
+	state   string
+	since   time.Time
+	trial   bool // half-open trial request in flight
+	buckets [breakerBuckets]breakerBucket
+
+	slots  chan struct{} // nil when uncapped
+	queued atomic.Int64
+}
+
+// admit lets a request through the breaker and waits for a concurrency
+// slot. The returned trial flag must be passed back to record.
+func (g *originGate) admit(ctx context.Context) (bool, error) {
+	trial, err := g.allow()
+	if err != nil {
+		return false, err
+	}
+	if err := g.acquire(ctx); err != nil {
+		g.abandon(trial)
+		return false, err
+	}
+	return trial, nil
+}
+
+// allow checks the breaker, moving an open breaker whose open period has
+// passed to half-open. It reports whether the request is the half-open
+// trial.
+func (g *originGate) allow() (bool, error) {
+	if !g.config.breaker {
+		return false, nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch g.state {
+	case CircuitOpen:
+		if time.Since(g.since) < g.config.openDuration {
+			originRejections.WithLabelValues(g.origin, "circuit_open").Inc()
+			return false, errCircuitOpen
+		}
+		g.transition(CircuitHalfOpen)
+		fallthrough
+	case CircuitHalfOpen:
+		if g.trial {
+			originRejections.WithLabelValues(g.origin, "circuit_open").Inc()
+			return false, errCircuitOpen
+		}
+		g.trial = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// acquire takes a concurrency slot, queueing for one when the origin is at
+// its cap
+func (g *originGate) acquire(ctx context.Context) error {
+	if g.slots == nil {
+		return nil
+	}
+
+	select {
+	case g.slots <- struct{}{}:
+		originInflight.WithLabelValues(g.origin).Inc()
+		return nil
+	default:
+	}
+
+	if g.queued.Add(1) > g.config.maxQueue {
+		g.queued.Add(-1)
+		originRejections.WithLabelValues(g.origin, "queue_full").Inc()
+		return errOriginOverloaded
+	}
+	originQueued.WithLabelValues(g.origin).Inc()
+	defer func() {
+		g.queued.Add(-1)
+		originQueued.WithLabelValues(g.origin).Dec()
+	}()
+
+	timer := time.NewTimer(g.config.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case g.slots <- struct{}{}:
+		originInflight.WithLabelValues(g.origin).Inc()
+		return nil
+	case <-timer.C:
+		originRejections.WithLabelValues(g.origin, "queue_timeout").Inc()
+		return errOriginOverloaded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the request's concurrency slot
+func (g *originGate) release() {
+	if g.slots == nil {
+		return
+	}
+	<-g.slots
+	originInflight.WithLabelValues(g.origin).Dec()
+}
+
+// abandon gives up a half-open trial that never reached the origin
+func (g *originGate) abandon(trial bool) {
+	if !trial {
+		return
+	}
+	g.mu.Lock()
+	g.trial = false
+	g.mu.Unlock()
+}
+
+// record counts the outcome of a request that reached the origin. Errors
+// and 5xx responses are failures; responses slower than slowCall count
+// against the breaker too.
+func (g *originGate) record(ctx context.Context, trial bool, statusCode int, err error, latency time.Duration) {
+	if !g.config.breaker {
+		return
+	}
+	if err != nil && ctx.Err() != nil {
+		// The client went away; that says nothing about the origin
+		g.abandon(trial)
+		return
+	}
+	failed := err != nil || statusCode >= http.StatusInternalServerError
+	slow := latency >= g.config.slowCall
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if trial {
+		g.trial = false
+		if failed || slow {
+			logrus.WithField("origin", g.origin).Warn("Origin failed trial request, reopening circuit breaker")
+			g.transition(CircuitOpen)
+		} else {
+			logrus.WithField("origin", g.origin).Info("Origin recovered, closing circuit breaker")
+			g.transition(CircuitClosed)
+		}
+		return
+	}
+	if g.state != CircuitClosed {
+		return
+	}
+
+	now := time.Now()
+	bucket := g.bucket(now)
+	bucket.total++
+	if failed {
+		bucket.failures++
+	}
+	if slow {
+		bucket.slow++
+	}
+
+	total, failures, slowCalls := g.counts(now)
+	if total < g.config.minRequests {
+		return
+	}
+	threshold := g.config.threshold * float64(total)
+	if float64(failures) >= threshold || float64(slowCalls) >= threshold {
+		logrus.WithFields(logrus.Fields{
+			"origin":   g.origin,
+			"requests": total,
+			"failures": failures,
+			"slow":     slowCalls,
+		}).Warn("Origin failing, opening circuit breaker")
+		g.transition(CircuitOpen)
+	}
+}
+
+// transition moves the breaker to state. Callers hold g.mu.
+func (g *originGate) transition(state string) {
+	g.state = state
+	g.since = time.Now()
+	g.buckets = [breakerBuckets]breakerBucket{}
+	originCircuitState.WithLabelValues(g.origin).Set(circuitStateValues[state])
+	originCircuitTransitions.WithLabelValues(g.origin, state).Inc()
+}
+
+// bucket returns the window slice for now, clearing it if it last counted
+// an earlier slice. Callers hold g.mu.
+func (g *originGate) bucket(now time.Time) *breakerBucket {
+	slice := now.UnixNano() / int64(g.config.window/breakerBuckets)
+	bucket := &g.buckets[slice%breakerBuckets]
+	if bucket.slice != slice {
+		*bucket = breakerBucket{slice: slice}
+	}
+	return bucket
+}
+
+// counts sums the outcomes still inside the window. Callers hold g.mu.
+func (g *originGate) counts(now time.Time) (total, failures, slow int) {
+	slice := now.UnixNano() / int64(g.config.window/breakerBuckets)
+	for _, bucket := range g.buckets {
+		if bucket.slice > slice-breakerBuckets {
+			total += bucket.total
+			failures += bucket.failures
+			slow += bucket.slow
+		}
+	}
+	return total, failures, slow
+}
+
+// doOrigin sends a request to its origin through the origin's circuit
+// breaker and concurrency cap. The concurrency slot is held until the
+// response body is closed. Requests the edge holds back fail with
+// errCircuitOpen or errOriginOverloaded without reaching the origin.
+func (p *ProxyService) doOrigin(req *http.Request) (*http.Response, error) {
+	gate := p.gates.get(originKey(req.URL))
+	trial, err := gate.admit(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := p.httpClient.Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		originRequestDuration.WithLabelValues(gate.origin, "error").Observe(latency.Seconds())
+		gate.record(req.Context(), trial, 0, err, latency)
+		gate.release()
+		return nil, err
+	}
+	originRequestDuration.WithLabelValues(gate.origin, strconv.Itoa(resp.StatusCode/100)+"xx").Observe(latency.Seconds())
+	gate.record(req.Context(), trial, resp.StatusCode, nil, latency)
+
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: gate.release}
+	return resp, nil
+}
+
+// releaseBody calls release once when the response body is closed
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// originKey identifies an origin by scheme and host
+func originKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// shortCircuited reports whether err means the edge held a request back
+// from its origin rather than the origin failing it
+func shortCircuited(err error) bool {
+	return errors.Is(err, errCircuitOpen) || errors.Is(err, errOriginOverloaded)
+}
+
+// serveShortCircuit answers a request the edge held back from its origin:
+// from stale content when any is cached, whatever its stale-if-error window,
+// and otherwise with an immediate 503
+func (p *ProxyService) serveShortCircuit(w http.ResponseWriter, r *http.Request, stale *cache.CacheEntry, err error) {
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"host": r.Host,
+		"path": r.URL.Path,
+	}).Debug("Request held back from origin")
+
+	if stale != nil {
+		p.serveCachedResponse(w, r, stale, "STALE")
+		return
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Origin temporarily unavailable", http.StatusServiceUnavailable)
+}
+
+// OriginCircuits returns the breaker state of every origin whose breaker is
+// not closed or that has requests queued
+func (p *ProxyService) OriginCircuits() []CircuitStatus {
+	p.gates.mu.Lock()
+	gates := make([]*originGate, 0, len(p.gates.gates))
+	for _, gate := range p.gates.gates {
+		gates = append(gates, gate)
+	}
+	p.gates.mu.Unlock()
+
+	now := time.Now()
+	statuses := []CircuitStatus{}
+	for _, gate := range gates {
+		gate.mu.Lock()
+		status := CircuitStatus{
+			Origin: gate.origin,
+			State:  gate.state,
+			Since:  gate.since,
+			Queued: gate.queued.Load(),
+		}
+		status.Requests, status.Failures, status.Slow = gate.counts(now)
+		gate.mu.Unlock()
+		if gate.slots != nil {
+			status.Inflight = len(gate.slots)
+		}
+
+		if status.State != CircuitClosed || status.Queued > 0 {
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Origin < statuses[j].Origin })
+	return statuses
+}
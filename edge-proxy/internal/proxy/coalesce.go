@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/naijcloud/edge-proxy/internal/cache"
+)
+
+// defaultCoalesceTimeout is used when ProxyConfig.CoalesceTimeout is not set.
+const defaultCoalesceTimeout = 5 * time.Second
+
+// flight is a single in-progress origin fetch that other requests for the
+// same cache key can wait on.
+type flight struct {
+	done  chan struct{}
+	entry *cache.CacheEntry
+}
+
+// coalescer collapses concurrent cache misses for the same key so that only
+// one request goes to the origin while the rest wait for its result.
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		flights: make(map[string]*flight),
+	}
+}
+
+// join returns the flight for key, creating it if none is running. The
+// caller that creates the flight is the leader and must call finish.
+func (c *coalescer) join(key string) (*flight, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, exists := c.flights[key]; exists {
+		return f, false
+	}
+
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	return f, true
+}
+
+// finish publishes the leader's result and releases all waiters. A nil entry
+// means the response could not be shared and waiters must fetch on their own.
+func (c *coalescer) finish(key string, f *flight, entry *cache.CacheEntry) {
+	c.mu.Lock()
+	delete(c.flights, key)
+	c.mu.Unlock()
+
+	f.entry = entry
+	close(f.done)
+}
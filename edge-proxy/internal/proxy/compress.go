@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/naijcloud/edge-proxy/internal/cache"
+)
+
+// Content codings the edge compresses responses with
+const (
+	EncodingBrotli = "br"
+	EncodingGzip   = "gzip"
+)
+
+// defaultCompressionMinSize is used when DomainConfig.CompressionMinSize is
+// not set. Smaller bodies gain little and cost a round of compressor setup.
+const defaultCompressionMinSize = 1024
+
+// brotliLevel trades ratio for speed, since responses are compressed as they
+// stream to the first client
+const brotliLevel = 5
+
+// DefaultCompressibleTypes are compressed when a domain does not list its
+// own. A "/*" suffix matches any subtype and a "*+" subtype any structured
+// syntax suffix, so "application/*+json" matches "application/ld+json".
+var DefaultCompressibleTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/*+json",
+	"application/xml",
+	"application/*+xml",
+	"application/wasm",
+	"image/svg+xml",
+	"image/x-icon",
+	"font/ttf",
+	"font/otf",
+}
+
+var (
+	gzipWriters   sync.Pool
+	brotliWriters sync.Pool
+)
+
+// prepareCompression decides whether the edge compresses an origin response
+// and returns the content coding to use, or "" to pass the body through. It
+// rewrites resp's headers for the compressed body. Compressible responses
+// get Vary: Accept-Encoding even when the client accepts no compression, so
+// every encoding is cached as its own variant of the resource.
+//
+// The coding is the one the client's normalized Accept-Encoding selects, the
+// same value that picks the cache variant, so clients sharing a variant also
+// share an encoding.
+func (p *ProxyService) prepareCompression(r *http.Request, resp *http.Response, domain DomainConfig) string {
+	if !domain.Compression || !compressible(r, resp, domain) {
+		return ""
+	}
+	addVary(resp.Header, "Accept-Encoding")
+
+	encoding := cache.NormalizeHeader("Accept-Encoding", r.Header.Values("Accept-Encoding"))
+	if encoding != EncodingBrotli && encoding != EncodingGzip {
+		return ""
+	}
+
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	// The compressed body is a different representation, so a strong
+	// validator from the origin no longer holds byte for byte
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return encoding
+}
+
+// compressible reports whether an origin response is one the edge may
+// compress for the domain
+func compressible(r *http.Request, resp *http.Response, domain DomainConfig) bool {
+	if r.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if coding := resp.Header.Get("Content-Encoding"); coding != "" && !strings.EqualFold(coding, "identity") {
+		return false
+	}
+	if resp.Header.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+
+	minSize := domain.CompressionMinSize
+	if minSize <= 0 {
+		minSize = defaultCompressionMinSize
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < minSize {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType == "text/event-stream" {
+		// Event streams are flushed per message, which compression defeats
+		return false
+	}
+	types := domain.CompressionTypes
+	if len(types) == 0 {
+		types = DefaultCompressibleTypes
+	}
+	for _, pattern := range types {
+		if matchMediaType(strings.ToLower(strings.TrimSpace(pattern)), mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMediaType matches a lower-case media type against a pattern such as
+// "text/html", "text/*" or "application/*+json"
+func matchMediaType(pattern, mediaType string) bool {
+	if pattern == mediaType {
+		return true
+	}
+	patternType, patternSub, ok := strings.Cut(pattern, "/")
+	if !ok {
+		return false
+	}
+	mainType, subType, _ := strings.Cut(mediaType, "/")
+	if patternType != mainType {
+		return false
+	}
+	if patternSub == "*" {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(patternSub, "*+"); ok {
+		return strings.HasSuffix(subType, "+"+suffix)
+	}
+	return false
+}
+
+// addVary adds a header name to a response's Vary header unless it is
+// already listed
+func addVary(header http.Header, name string) {
+	names, ok := cache.ParseVary(header)
+	if !ok {
+		return
+	}
+	for _, existing := range names {
+		if existing == name {
+			return
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// writeBody streams the origin body to the client, compressed with encoding
+// when one is given. body receives a copy of exactly what the client was
+// sent, so compressed responses are cached compressed.
+func (p *ProxyService) writeBody(w http.ResponseWriter, resp *http.Response, encoding string, body *bodyBuffer) (int64, error) {
+	if encoding == "" {
+		return p.streamBody(w, resp, body)
+	}
+
+	cw := newCompressWriter(w, encoding, body)
+	written, err := p.streamBody(cw, resp, nil)
+	if closeErr := cw.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+// encoder is the part of gzip.Writer and brotli.Writer the edge uses
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter compresses everything written to it on its way to the
+// client. Flush pushes out what has been compressed so far, so streamed
+// responses are not held back.
+type compressWriter struct {
+	http.ResponseWriter
+	encoder encoder
+}
+
+func newCompressWriter(w http.ResponseWriter, encoding string, body *bodyBuffer) *compressWriter {
+	var out io.Writer = w
+	if body != nil {
+		out = io.MultiWriter(w, body)
+	}
+
+	cw := &compressWriter{ResponseWriter: w}
+	switch encoding {
+	case EncodingBrotli:
+		if bw, ok := brotliWriters.Get().(*brotli.Writer); ok {
+			bw.Reset(out)
+			cw.encoder = bw
+		} else {
+			cw.encoder = brotli.NewWriterLevel(out, brotliLevel)
+		}
+	default:
+		if gw, ok := gzipWriters.Get().(*gzip.Writer); ok {
+			gw.Reset(out)
+			cw.encoder = gw
+		} else {
+			cw.encoder = gzip.NewWriter(out)
+		}
+	}
+	return cw
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	return cw.encoder.Write(p)
+}
+
+func (cw *compressWriter) Flush() {
+	if err := cw.encoder.Flush(); err != nil {
+		return
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close finishes the compressed stream and returns the encoder to its pool
+func (cw *compressWriter) Close() error {
+	err := cw.encoder.Close()
+	switch enc := cw.encoder.(type) {
+	case *brotli.Writer:
+		enc.Reset(io.Discard)
+		brotliWriters.Put(enc)
+	case *gzip.Writer:
+		enc.Reset(io.Discard)
+		gzipWriters.Put(enc)
+	}
+	return err
+}
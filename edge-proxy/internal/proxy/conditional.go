@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/naijcloud/edge-proxy/internal/cache"
+)
+
+// conditionalHeaders are the client validators replaced by the edge's own
+// when it revalidates a cached entry with the origin.
+var conditionalHeaders = []string{
+	"If-None-Match",
+	"If-Modified-Since",
+}
+
+// addValidators turns an origin request into a conditional request using the
+// validators stored with entry. It reports whether any were added.
+func addValidators(req *http.Request, entry *cache.CacheEntry) bool {
+	if entry == nil || !entry.HasValidators() {
+		return false
+	}
+
+	// The client's own validators may not match the cached copy, and a 304
+	// for them would leave nothing to refresh the entry with
+	for _, name := range conditionalHeaders {
+		req.Header.Del(name)
+	}
+
+	if etag := entry.Headers.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.Headers.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	return true
+}
+
+// refreshEntry returns a copy of entry updated from a 304 Not Modified
+// response. The stored entry is left untouched since other requests may be
+// serving it.
+func (p *ProxyService) refreshEntry(r *http.Request, entry *cache.CacheEntry, resp *http.Response, domain DomainConfig) *cache.CacheEntry {
+	headers := entry.Headers.Clone()
+	for name, values := range resp.Header {
+		if p.isHopByHopHeader(name) || !p.isCacheableHeader(name) || http.CanonicalHeaderKey(name) == "Content-Length" {
+			continue
+		}
+		headers[name] = values
+	}
+
+	// A copy the edge compressed keeps the weak form of the origin's ETag
+	if etag := entry.Headers.Get("ETag"); etag != "" && etag == "W/"+headers.Get("ETag") {
+		headers.Set("ETag", etag)
+	}
+
+	return p.newCacheEntry(r, &http.Response{
+		StatusCode: entry.StatusCode,
+		Header:     headers,
+	}, entry.Body, domain)
+}
+
+// notModified reports whether a client's conditional request is satisfied by
+// the cached entry, so it can be answered with 304 Not Modified.
+func notModified(r *http.Request, entry *cache.CacheEntry) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if entry.StatusCode != http.StatusOK {
+		return false
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := entry.Headers.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakETagMatch(candidate, etag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		lastModified := entry.Headers.Get("Last-Modified")
+		if lastModified == "" {
+			return false
+		}
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(lastModified)
+		if err != nil {
+			return false
+		}
+		return !modified.After(since)
+	}
+
+	return false
+}
+
+// weakETagMatch compares two entity tags ignoring the weak indicator, as
+// required for If-None-Match.
+func weakETagMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
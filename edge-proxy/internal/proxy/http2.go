@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// Origin HTTP/2 modes for ProxyConfig.OriginHTTP2
+const (
+	// OriginHTTP2Auto negotiates HTTP/2 with https origins that offer it
+	OriginHTTP2Auto = "auto"
+	// OriginHTTP2Off always uses HTTP/1.1
+	OriginHTTP2Off = "off"
+	// OriginHTTP2H2C additionally speaks cleartext HTTP/2 (h2c, prior
+	// knowledge) to http origins, which must support it
+	OriginHTTP2H2C = "h2c"
+)
+
+// HTTP/2 connections to origins are pinged after this long without frames
+// and dropped if the ping is not answered in time, so a dead connection does
+// not stall every request multiplexed onto it
+const (
+	originHTTP2ReadIdleTimeout = 30 * time.Second
+	originHTTP2PingTimeout     = 15 * time.Second
+)
+
+var originResponses = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "edge_origin_responses_total",
+		Help: "Origin responses by HTTP protocol version",
+	},
+	[]string{"protocol"},
+)
+
+// configureOriginHTTP2 sets up transport for the given OriginHTTP2 mode.
+// HTTP/2 connections are shared by concurrent requests to the same origin,
+// with more opened once an origin's stream limit is reached.
+func configureOriginHTTP2(transport *http.Transport, dialer *net.Dialer, mode string) {
+	switch mode {
+	case "", OriginHTTP2Auto, OriginHTTP2H2C:
+	case OriginHTTP2Off:
+		// A non-nil empty map keeps the transport on HTTP/1.1
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		return
+	default:
+		logrus.WithField("mode", mode).Warn("Unknown origin HTTP/2 mode, using auto")
+	}
+
+	h2, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to enable HTTP/2 to origins")
+		return
+	}
+	h2.ReadIdleTimeout = originHTTP2ReadIdleTimeout
+	h2.PingTimeout = originHTTP2PingTimeout
+
+	if mode == OriginHTTP2H2C {
+		transport.RegisterProtocol("http", &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			DisableCompression: transport.DisableCompression,
+			ReadIdleTimeout:    originHTTP2ReadIdleTimeout,
+			PingTimeout:        originHTTP2PingTimeout,
+		})
+	}
+}
+
+// protocolRecorder counts origin responses by protocol version
+type protocolRecorder struct {
+	transport http.RoundTripper
+}
+
+func (t *protocolRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err == nil {
+		originResponses.WithLabelValues(resp.Proto).Inc()
+	}
+	return resp, err
+}
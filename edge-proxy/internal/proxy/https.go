@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// isHTTPS reports whether the client reached the edge over TLS, either
+// directly or through a load balancer that terminated it
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// enforceHTTPS applies a domain's HTTPS options. Plain HTTP requests are
+// redirected when the domain asks for it, in which case it returns true and
+// the request is done. HTTPS responses get the domain's HSTS header, which
+// comes before any the origin sends and so takes precedence.
+func (p *ProxyService) enforceHTTPS(w http.ResponseWriter, r *http.Request, domain DomainConfig) bool {
+	if !isHTTPS(r) {
+		if !domain.HTTPSRedirect {
+			return false
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if p.httpsPort != 0 && p.httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(p.httpsPort))
+		}
+
+		// 308 keeps the method and body of non-idempotent requests
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+		return true
+	}
+
+	if domain.HSTSMaxAge > 0 {
+		value := "max-age=" + strconv.Itoa(int(domain.HSTSMaxAge.Seconds()))
+		if domain.HSTSIncludeSubdomains {
+			value += "; includeSubDomains"
+		}
+		if domain.HSTSPreload {
+			value += "; preload"
+		}
+		w.Header().Set("Strict-Transport-Security", value)
+	}
+	return false
+}
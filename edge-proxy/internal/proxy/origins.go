@@ -0,0 +1,438 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// Load balancing modes for DomainConfig.LoadBalancing
+const (
+	LoadBalancingRoundRobin       = "round_robin"
+	LoadBalancingLeastConnections = "least_connections"
+	LoadBalancingConsistentHash   = "consistent_hash"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = 10 * time.Second
+
+	// Consecutive probe results needed to change an origin's state, so one
+	// slow response does not take an origin out of rotation
+	unhealthyThreshold = 2
+	healthyThreshold   = 2
+
+	// originIdleExpiry stops probing origins no request has been routed
+	// through for this long, such as those removed from a pool
+	originIdleExpiry = 10 * time.Minute
+)
+
+var (
+	originHealthy = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "edge_origin_healthy",
+			Help: "Whether a pool origin passes this edge's health checks (1) or not (0)",
+		},
+		[]string{"origin"},
+	)
+
+	originSelections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "edge_origin_selections_total",
+			Help: "Requests routed to pool origins, by origin and tier (primary, failover, unhealthy)",
+		},
+		[]string{"origin", "tier"},
+	)
+)
+
+// Origin is one server in a domain's origin pool
+type Origin struct {
+	ID     string // control plane origin ID, used when reporting health
+	URL    string
+	Weight int // share of requests relative to the other origins of its priority
+	// Priority groups origins; requests go to the lowest priority with a
+	// healthy origin, so higher priorities only take traffic on failover
+	Priority int
+}
+
+// OriginStatus is the edge's view of a pool origin
+type OriginStatus struct {
+	ID                string
+	URL               string
+	Healthy           bool
+	Latency           time.Duration // of the last health check
+	Error             string        // why the last health check failed
+	ActiveConnections int64
+	CheckedAt         time.Time
+}
+
+// originState tracks the health and load of one pool origin. Fields other
+// than active are guarded by originPool.mu.
+type originState struct {
+	id       string
+	url      string
+	probeURL string
+	weight   int
+	active   atomic.Int64
+
+	healthy   bool
+	failures  int // consecutive failed probes
+	successes int // consecutive passed probes
+	checkedAt time.Time
+	latency   time.Duration
+	lastErr   string
+	lastUsed  time.Time
+
+	// current is the smooth weighted round-robin position
+	current int
+}
+
+// originPool holds the state of every pool origin the edge routes to and
+// probes them in the background
+type originPool struct {
+	mu       sync.Mutex
+	origins  map[string]*originState
+	client   *http.Client
+	interval time.Duration
+	timeout  time.Duration
+	// available reports whether an origin's circuit breaker lets requests
+	// through; origins it holds back are skipped like unhealthy ones
+	available func(origin string) bool
+}
+
+func newOriginPool(interval, timeout time.Duration, dialer *net.Dialer) *originPool {
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	return &originPool{
+		origins: make(map[string]*originState),
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         dialer.DialContext,
+				MaxIdleConnsPerHost: 1,
+				IdleConnTimeout:     2 * interval,
+			},
+			Timeout: timeout,
+			// A redirect still shows the origin is serving
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		interval: interval,
+		timeout:  timeout,
+	}
+}
+
+// originLease is the origin chosen for one request. Releasing it ends the
+// request's share of the origin's active connections.
+type originLease struct {
+	url   string
+	state *originState
+}
+
+func (l *originLease) release() {
+	if l.state != nil {
+		l.state.active.Add(-1)
+	}
+}
+
+// selectOrigin picks the origin for a request, avoiding the origins in tried
+// when the pool has others to offer. Domains without a pool use their
+// OriginURL.
+func (p *ProxyService) selectOrigin(r *http.Request, domain DomainConfig, tried []string) *originLease {
+	if len(domain.Origins) == 0 {
+		return &originLease{url: domain.OriginURL}
+	}
+	return p.origins.acquire(r, domain, tried)
+}
+
+// acquire picks an origin from the lowest priority of the domain's pool that
+// has a healthy member whose circuit breaker is not open and that is not in
+// tried, spreading requests as the domain's load balancing mode says. When
+// every origin is down the first priority is used anyway, since failing the
+// request is no better than trying.
+func (o *originPool) acquire(r *http.Request, domain DomainConfig, tried []string) *originLease {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	states := o.register(domain)
+
+	priorities := make([]int, 0, len(domain.Origins))
+	for _, origin := range domain.Origins {
+		priorities = append(priorities, origin.Priority)
+	}
+	sort.Ints(priorities)
+
+	var candidates []*originState
+	tier := "primary"
+	for i, priority := range priorities {
+		if i > 0 && priority == priorities[i-1] {
+			continue
+		}
+		for j, origin := range domain.Origins {
+			if origin.Priority == priority && states[j].healthy && o.isAvailable(states[j]) && !slices.Contains(tried, origin.URL) {
+				candidates = append(candidates, states[j])
+			}
+		}
+		if len(candidates) > 0 {
+			break
+		}
+		tier = "failover"
+	}
+	if len(candidates) == 0 {
+		tier = "unhealthy"
+		for j, origin := range domain.Origins {
+			if origin.Priority == priorities[0] {
+				candidates = append(candidates, states[j])
+			}
+		}
+	}
+
+	var chosen *originState
+	switch domain.LoadBalancing {
+	case LoadBalancingLeastConnections:
+		chosen = leastConnections(candidates)
+	case LoadBalancingConsistentHash:
+		chosen = rendezvous(candidates, r.Host+r.URL.Path)
+	default:
+		chosen = roundRobin(candidates)
+	}
+
+	chosen.active.Add(1)
+	originSelections.WithLabelValues(chosen.url, tier).Inc()
+	return &originLease{url: chosen.url, state: chosen}
+}
+
+func (o *originPool) isAvailable(s *originState) bool {
+	return o.available == nil || o.available(s.url)
+}
+
+// register returns the state of each origin in the domain's pool, creating
+// state for origins not seen before. New origins count as healthy until
+// probed. Callers hold o.mu.
+func (o *originPool) register(domain DomainConfig) []*originState {
+	healthPath := domain.HealthCheckPath
+	if healthPath == "" {
+		healthPath = "/"
+	}
+
+	now := time.Now()
+	states := make([]*originState, len(domain.Origins))
+	for i, origin := range domain.Origins {
+		key := origin.ID + " " + origin.URL + healthPath
+		state, ok := o.origins[key]
+		if !ok {
+			state = &originState{
+				id:       origin.ID,
+				url:      origin.URL,
+				probeURL: origin.URL + healthPath,
+				healthy:  true,
+			}
+			o.origins[key] = state
+			originHealthy.WithLabelValues(origin.URL).Set(1)
+		}
+		state.weight = origin.Weight
+		if state.weight < 1 {
+			state.weight = 1
+		}
+		state.lastUsed = now
+		states[i] = state
+	}
+	return states
+}
+
+// roundRobin spreads requests over the candidates in proportion to their
+// weights, interleaving them rather than sending runs to one origin
+func roundRobin(candidates []*originState) *originState {
+	var best *originState
+	total := 0
+	for _, s := range candidates {
+		s.current += s.weight
+		total += s.weight
+		if best == nil || s.current > best.current {
+			best = s
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// leastConnections picks the candidate with the fewest active requests for
+// its weight, taking turns between candidates that tie
+func leastConnections(candidates []*originState) *originState {
+	var least []*originState
+	var leastActive, leastWeight int64
+	for _, s := range candidates {
+		active, weight := s.active.Load(), int64(s.weight)
+		switch {
+		case least == nil || active*leastWeight < leastActive*weight:
+			least = append(least[:0], s)
+			leastActive, leastWeight = active, weight
+		case active*leastWeight == leastActive*weight:
+			least = append(least, s)
+		}
+	}
+	return roundRobin(least)
+}
+
+// rendezvous picks the candidate with the highest weighted hash score for
+// key, so a key keeps reaching the same origin and only the keys of an
+// origin that leaves the candidates move elsewhere
+func rendezvous(candidates []*originState, key string) *originState {
+	var best *originState
+	bestScore := math.Inf(-1)
+	for _, s := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(s.url))
+		// Map the hash into (0, 1) and weight it as in weighted
+		// rendezvous hashing
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -float64(s.weight) / math.Log(u)
+		if score > bestScore {
+			best, bestScore = s, score
+		}
+	}
+	return best
+}
+
+// RunHealthChecks probes every pool origin in use each health check
+// interval until ctx is done
+func (p *ProxyService) RunHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(p.origins.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.origins.checkAll(ctx)
+		}
+	}
+}
+
+// OriginStatuses returns the edge's view of every pool origin it has
+// health checked
+func (p *ProxyService) OriginStatuses() []OriginStatus {
+	p.origins.mu.Lock()
+	defer p.origins.mu.Unlock()
+
+	statuses := make([]OriginStatus, 0, len(p.origins.origins))
+	for _, s := range p.origins.origins {
+		if s.checkedAt.IsZero() {
+			continue
+		}
+		statuses = append(statuses, OriginStatus{
+			ID:                s.id,
+			URL:               s.url,
+			Healthy:           s.healthy,
+			Latency:           s.latency,
+			Error:             s.lastErr,
+			ActiveConnections: s.active.Load(),
+			CheckedAt:         s.checkedAt,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].URL < statuses[j].URL })
+	return statuses
+}
+
+// checkAll probes every origin in use concurrently, first dropping those no
+// longer routed to
+func (o *originPool) checkAll(ctx context.Context) {
+	o.mu.Lock()
+	cutoff := time.Now().Add(-originIdleExpiry)
+	states := make([]*originState, 0, len(o.origins))
+	for key, s := range o.origins {
+		if s.lastUsed.Before(cutoff) && s.active.Load() == 0 {
+			delete(o.origins, key)
+			originHealthy.DeleteLabelValues(s.url)
+			continue
+		}
+		states = append(states, s)
+	}
+	o.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range states {
+		wg.Add(1)
+		go func(s *originState) {
+			defer wg.Done()
+			latency, err := o.probe(ctx, s.probeURL)
+			o.record(s, latency, err)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// probe requests an origin's health check URL. Any response below 400 passes.
+func (o *originPool) probe(ctx context.Context, probeURL string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "NaijCloud-Edge-HealthCheck/1.0")
+
+	start := time.Now()
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return time.Since(start), err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	latency := time.Since(start)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return latency, fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return latency, nil
+}
+
+// record applies a probe result, changing the origin's state once enough
+// consecutive probes agree
+func (o *originPool) record(s *originState, latency time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	s.checkedAt = time.Now()
+	s.latency = latency
+	if err != nil {
+		s.lastErr = err.Error()
+		s.successes = 0
+		s.failures++
+		if s.healthy && s.failures >= unhealthyThreshold {
+			s.healthy = false
+			originHealthy.WithLabelValues(s.url).Set(0)
+			logrus.WithError(err).WithField("origin", s.url).Warn("Origin failed health checks, taking it out of rotation")
+		}
+		return
+	}
+
+	s.lastErr = ""
+	s.failures = 0
+	s.successes++
+	if !s.healthy && s.successes >= healthyThreshold {
+		s.healthy = true
+		originHealthy.WithLabelValues(s.url).Set(1)
+		logrus.WithField("origin", s.url).Info("Origin passed health checks, returning it to rotation")
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/naijcloud/edge-proxy/internal/cache"
+	"github.com/sirupsen/logrus"
+)
+
+// Match types for cache policy patterns
+const (
+	MatchGlob  = "glob"
+	MatchRegex = "regex"
+)
+
+// keyTemplateVariable matches {name} and {name:argument} placeholders in a
+// cache key template
+var keyTemplateVariable = regexp.MustCompile(`\{([a-z]+)(?::([^{}]*))?\}`)
+
+// CachePolicy is a per-domain cache rule. A domain's policies are checked in
+// order and the first whose pattern matches the request path decides how the
+// request is cached.
+type CachePolicy struct {
+	// TTL replaces the TTL taken from the origin response when positive
+	TTL time.Duration
+	// KeyTemplate replaces the path and query part of the cache key, which
+	// stays scoped to the requesting host whatever the template says. It may
+	// use {scheme}, {host}, {path}, {query}, {query:name}, {header:name} and
+	// {cookie:name}.
+	KeyTemplate string
+	// VaryHeaders are request headers whose values become part of the key
+	VaryHeaders []string
+	// Bypass sends matching requests to the origin without caching them
+	Bypass bool
+
+	pattern *regexp.Regexp
+}
+
+// NewCachePolicy compiles a policy for a path pattern. Globs match the whole
+// path, with "*" matching any run of characters and "?" any character other
+// than "/". Regular expressions match anywhere in the path unless anchored.
+func NewCachePolicy(pattern, matchType string) (*CachePolicy, error) {
+	var expr string
+	switch matchType {
+	case MatchGlob, "":
+		expr = globToRegexp(pattern)
+	case MatchRegex:
+		expr = pattern
+	default:
+		return nil, fmt.Errorf("unknown match type %q", matchType)
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return &CachePolicy{pattern: re}, nil
+}
+
+// Matches reports whether the policy applies to a request path
+func (cp *CachePolicy) Matches(path string) bool {
+	return cp.pattern != nil && cp.pattern.MatchString(path)
+}
+
+// globToRegexp translates a path glob into an anchored regular expression
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// matchPolicy returns the first of the domain's policies matching r, or nil
+func (d DomainConfig) matchPolicy(r *http.Request) *CachePolicy {
+	for _, policy := range d.CachePolicies {
+		if policy.Matches(r.URL.Path) {
+			return policy
+		}
+	}
+	return nil
+}
+
+// cacheKey builds the primary cache key for r. Without a policy this is the
+// standard method, host, path and query key. The method always leads the key
+// so GET and HEAD responses stay separate, followed by the host. A rendered
+// template comes after the host and a "#", which no host or standard key has
+// there, so no template can produce another domain's keys.
+func (cp *CachePolicy) cacheKey(r *http.Request) string {
+	if cp == nil || (cp.KeyTemplate == "" && len(cp.VaryHeaders) == 0) {
+		return cache.GenerateCacheKey(r)
+	}
+
+	var b strings.Builder
+	if cp.KeyTemplate != "" {
+		b.WriteString(r.Method)
+		b.WriteByte(':')
+		b.WriteString(requestHost(r))
+		b.WriteByte('#')
+		b.WriteString(renderKeyTemplate(cp.KeyTemplate, r))
+	} else {
+		b.WriteString(cache.GenerateCacheKey(r))
+	}
+
+	for _, name := range cp.VaryHeaders {
+		b.WriteString("|")
+		b.WriteString(strings.ToLower(name))
+		b.WriteByte('=')
+		b.WriteString(url.QueryEscape(cache.NormalizeHeader(name, r.Header.Values(name))))
+	}
+	return b.String()
+}
+
+// renderKeyTemplate fills in a cache key template for r. Unknown placeholders
+// are kept as written.
+func renderKeyTemplate(template string, r *http.Request) string {
+	return keyTemplateVariable.ReplaceAllStringFunc(template, func(placeholder string) string {
+		m := keyTemplateVariable.FindStringSubmatch(placeholder)
+		name, arg := m[1], m[2]
+
+		switch name {
+		case "scheme":
+			if r.TLS != nil {
+				return "https"
+			}
+			return "http"
+		case "host":
+			return r.Host
+		case "path":
+			return r.URL.Path
+		case "query":
+			if arg != "" {
+				return r.URL.Query().Get(arg)
+			}
+			return r.URL.RawQuery
+		case "header":
+			return r.Header.Get(arg)
+		case "cookie":
+			if cookie, err := r.Cookie(arg); err == nil {
+				return cookie.Value
+			}
+			return ""
+		}
+		return placeholder
+	})
+}
+
+// bypassAndServe relays a request to the origin without consulting or
+// filling the cache
+func (p *ProxyService) bypassAndServe(w http.ResponseWriter, r *http.Request, domain DomainConfig) {
+	resp, originURL, err := p.originRequest(r, domain, nil)
+	if shortCircuited(err) {
+		p.serveShortCircuit(w, r, nil, err)
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("origin", originURL).Error("Failed to fetch from origin")
+		http.Error(w, "Failed to fetch from origin", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	encoding := p.prepareCompression(r, resp, domain)
+	p.copyResponseHeaders(resp, w)
+	w.Header().Set("X-Cache-Status", "BYPASS")
+	w.WriteHeader(resp.StatusCode)
+
+	written, err := p.writeBody(w, resp, encoding, nil)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"origin":  originURL,
+			"path":    r.URL.Path,
+			"written": written,
+		}).Warn("Streaming origin response aborted")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"status":      "BYPASS",
+		"status_code": resp.StatusCode,
+		"size":        written,
+	}).Info("Cache bypassed by policy")
+}
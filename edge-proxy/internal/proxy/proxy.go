@@ -2,8 +2,9 @@ package proxy
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -15,60 +16,347 @@ import (
 )
 
 type ProxyService struct {
-	httpClient  *http.Client
-	cache       cache.Cache
-	defaultTTL  time.Duration
-	maxBodySize int64
+	httpClient      *http.Client
+	cache           cache.Cache
+	defaultTTL      time.Duration
+	minTTL          time.Duration
+	maxTTL          time.Duration
+	maxBodySize     int64
+	coalesceTimeout time.Duration
+	coalescer       *coalescer
+	sliceSize       int64
+	origins         *originPool
+	gates           *originGates
+	retries         int
+	retryBackoff    time.Duration
+	retryStatuses   map[int]bool
+
+	connectTimeout    time.Duration
+	responseTimeout   time.Duration
+	tunnelIdleTimeout time.Duration
+	httpsPort         int
+	region            string
+	shieldSecret      string
 }
 
 type ProxyConfig struct {
-	DefaultTTL       time.Duration
+	DefaultTTL time.Duration
+	// MinTTL and MaxTTL clamp TTLs taken from origin headers or domain
+	// defaults. Zero leaves that side unbounded. Cache policy TTLs are set
+	// explicitly by the domain owner and are not clamped.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// MaxBodySize is the largest origin body that is copied into the cache.
+	// Larger responses are still streamed to the client, just not stored.
 	MaxBodySize      int64
 	ConnectTimeout   time.Duration
 	ResponseTimeout  time.Duration
 	IdleConnTimeout  time.Duration
 	MaxIdleConns     int
 	MaxIdleConnsHost int
+	// CoalesceTimeout is how long a request waits on another request's
+	// origin fetch for the same cache key before fetching on its own.
+	// Defaults to 5s.
+	CoalesceTimeout time.Duration
+	// SliceSize is the size of the pieces that objects requested with Range
+	// are fetched and cached in. Defaults to 1MB.
+	SliceSize int64
+	// TunnelIdleTimeout closes WebSocket and other upgraded connections
+	// with no traffic in either direction for this long, unless the domain
+	// sets its own. Defaults to 5m.
+	TunnelIdleTimeout time.Duration
+	// OriginHTTP2 selects how HTTP/2 is used towards origins: "auto"
+	// (default), "off" or "h2c". See the OriginHTTP2 constants.
+	OriginHTTP2 string
+	// HTTPSPort is the port HTTP requests are redirected to for domains that
+	// require HTTPS. Zero or 443 leaves the port out of the redirect.
+	HTTPSPort int
+	// Region is the edge's region. Edges in a domain's shield region fetch
+	// from the origin; others fetch through them.
+	Region string
+	// ShieldSecret is shared by all edges and sent with requests fetched
+	// through a shield. The shield hop header is only honoured on requests
+	// that carry it or come from one of the domain's shield edges.
+	ShieldSecret string
+	// HealthCheckInterval is how often pool origins are probed, and
+	// HealthCheckTimeout how long a probe may take. Default to 30s and 10s.
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	// CircuitBreaker enables a breaker per origin. It opens when, within
+	// BreakerWindow, at least BreakerMinRequests requests were sent and
+	// BreakerThreshold of them failed or took longer than BreakerSlowCall.
+	// Requests to an open origin are served stale or fail fast with a 503
+	// for BreakerOpenDuration, then a single trial request is let through.
+	// Default to 10s, 20 requests, 0.5, 5s and 30s.
+	CircuitBreaker      bool
+	BreakerWindow       time.Duration
+	BreakerMinRequests  int
+	BreakerThreshold    float64
+	BreakerSlowCall     time.Duration
+	BreakerOpenDuration time.Duration
+	// OriginMaxConcurrent caps the requests in flight to each origin; zero
+	// leaves them uncapped. Requests over the cap queue, up to
+	// OriginMaxQueue of them, for at most OriginQueueTimeout (default 5s).
+	OriginMaxConcurrent int
+	OriginMaxQueue      int
+	OriginQueueTimeout  time.Duration
+	// OriginRetries is how many more times an idempotent request without a
+	// body is sent after a connection error or a RetryStatuses response
+	// (default 502, 503 and 504). Retries wait a jittered backoff of up to
+	// RetryBackoff (default 50ms), doubling with each retry, and are only
+	// started before the request's deadline, or its ResponseTimeout. Pool
+	// domains retry on another origin when there is one. Zero disables
+	// retries.
+	OriginRetries int
+	RetryBackoff  time.Duration
+	RetryStatuses []int
+}
+
+// DomainConfig carries the per-domain settings that shape how a request is
+// proxied.
+type DomainConfig struct {
+	OriginURL        string
+	CoalesceRequests bool
+	CoalesceTimeout  time.Duration // zero uses ProxyConfig.CoalesceTimeout
+
+	// DefaultTTL is used for responses without Cache-Control max-age or
+	// Expires; zero uses ProxyConfig.DefaultTTL
+	DefaultTTL time.Duration
+
+	// Default stale windows for responses without their own
+	// stale-while-revalidate / stale-if-error Cache-Control directives
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+
+	// CachePolicies override TTL, cache key and bypass behaviour for the
+	// paths they match; the first matching policy wins
+	CachePolicies []*CachePolicy
+
+	// AllowUpgrades lets WebSocket and other Upgrade requests be tunnelled
+	// to the origin; UpgradeIdleTimeout overrides
+	// ProxyConfig.TunnelIdleTimeout when set
+	AllowUpgrades      bool
+	UpgradeIdleTimeout time.Duration
+
+	// HTTPSRedirect redirects plain HTTP requests to HTTPS. A non-zero
+	// HSTSMaxAge adds a Strict-Transport-Security header to HTTPS responses.
+	HTTPSRedirect         bool
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+
+	// Compression lets the edge compress responses the origin sent
+	// uncompressed, with brotli or gzip as the client accepts. Only
+	// CompressionTypes (DefaultCompressibleTypes when empty) of at least
+	// CompressionMinSize bytes are compressed; zero uses 1KB.
+	Compression        bool
+	CompressionTypes   []string
+	CompressionMinSize int64
+
+	// Origins replaces OriginURL with a pool when set. Requests go to the
+	// healthy origins of the lowest priority, spread by LoadBalancing
+	// (round robin when empty). Origins are probed at HealthCheckPath,
+	// "/" when empty.
+	Origins         []Origin
+	LoadBalancing   string
+	HealthCheckPath string
+
+	// ShieldRegion names the region whose edges act as the domain's origin
+	// shield. Edges elsewhere fetch through one of Shields, the host:port
+	// addresses of the healthy edges there, instead of from the origin.
+	ShieldRegion string
+	Shields      []string
 }
 
 func NewProxyService(cache cache.Cache, config ProxyConfig) *ProxyService {
-	// Configure HTTP client with timeouts
+	// Configure HTTP client with timeouts. ResponseTimeout bounds the wait
+	// for response headers only, so large bodies can stream for as long as
+	// the origin keeps sending.
+	dialer := &net.Dialer{
+		Timeout:   config.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
 	transport := &http.Transport{
-		MaxIdleConns:        config.MaxIdleConns,
-		MaxIdleConnsPerHost: config.MaxIdleConnsHost,
-		IdleConnTimeout:     config.IdleConnTimeout,
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		ResponseHeaderTimeout: config.ResponseTimeout,
+		// Forward the client's Accept-Encoding as-is so cached variants hold
+		// exactly what the origin sent for it
+		DisableCompression: true,
 	}
 
+	configureOriginHTTP2(transport, dialer, config.OriginHTTP2)
+
 	client := &http.Client{
-		Transport: transport,
-		Timeout:   config.ResponseTimeout,
+		Transport: &protocolRecorder{transport: transport},
+	}
+
+	sliceSize := config.SliceSize
+	if sliceSize <= 0 {
+		sliceSize = defaultSliceSize
+	}
+	coalesceTimeout := config.CoalesceTimeout
+	if coalesceTimeout <= 0 {
+		coalesceTimeout = defaultCoalesceTimeout
+	}
+	tunnelIdleTimeout := config.TunnelIdleTimeout
+	if tunnelIdleTimeout <= 0 {
+		tunnelIdleTimeout = defaultTunnelIdleTimeout
+	}
+
+	retryBackoff := config.RetryBackoff
+	if retryBackoff <= 0 {
+		retryBackoff = defaultRetryBackoff
+	}
+	statuses := config.RetryStatuses
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+	retryStatuses := make(map[int]bool, len(statuses))
+	for _, status := range statuses {
+		retryStatuses[status] = true
 	}
 
+	gates := newOriginGates(newGateConfig(config))
+	origins := newOriginPool(config.HealthCheckInterval, config.HealthCheckTimeout, dialer)
+	origins.available = gates.available
+
 	return &ProxyService{
-		httpClient:  client,
-		cache:       cache,
-		defaultTTL:  config.DefaultTTL,
-		maxBodySize: config.MaxBodySize,
+		httpClient:      client,
+		cache:           cache,
+		defaultTTL:      config.DefaultTTL,
+		minTTL:          config.MinTTL,
+		maxTTL:          config.MaxTTL,
+		maxBodySize:     config.MaxBodySize,
+		coalesceTimeout: coalesceTimeout,
+		coalescer:       newCoalescer(),
+		sliceSize:       sliceSize,
+		origins:         origins,
+		gates:           gates,
+		retries:         config.OriginRetries,
+		retryBackoff:    retryBackoff,
+		retryStatuses:   retryStatuses,
+
+		connectTimeout:    config.ConnectTimeout,
+		responseTimeout:   config.ResponseTimeout,
+		tunnelIdleTimeout: tunnelIdleTimeout,
+		httpsPort:         config.HTTPSPort,
+		region:            config.Region,
+		shieldSecret:      config.ShieldSecret,
 	}
 }
 
+// ServeHTTP proxies a request to originURL using the default domain settings.
 func (p *ProxyService) ServeHTTP(w http.ResponseWriter, r *http.Request, originURL string) {
+	p.Serve(w, r, DomainConfig{
+		OriginURL:        originURL,
+		CoalesceRequests: true,
+	})
+}
+
+// Serve proxies a request using the given domain configuration.
+func (p *ProxyService) Serve(w http.ResponseWriter, r *http.Request, domain DomainConfig) {
 	ctx := r.Context()
 
+	// Clients must not be able to skip the shield
+	if !p.fromEdge(r, domain) {
+		r.Header.Del(ShieldHopHeader)
+	}
+
+	if p.enforceHTTPS(w, r, domain) {
+		return
+	}
+
+	// WebSocket and other upgraded connections bypass the cache entirely
+	if isUpgradeRequest(r) {
+		p.tunnelAndServe(w, r, domain)
+		return
+	}
+
+	policy := domain.matchPolicy(r)
+	if policy != nil && policy.Bypass {
+		p.bypassAndServe(w, r, domain)
+		return
+	}
+
 	// Generate cache key
-	cacheKey := cache.GenerateCacheKey(r)
+	cacheKey := policy.cacheKey(r)
+
+	// Try to serve from cache first. Expired entries inside their
+	// stale-while-revalidate window are served while a background fetch
+	// refreshes them; anything older is revalidated with a conditional
+	// request and kept as a fallback for origin errors.
+	var stale *cache.CacheEntry
+	entry, flightKey, found := cache.Lookup(ctx, p.cache, cacheKey, r)
+	if found {
+		if entry.IsFresh() {
+			p.serveCachedResponse(w, r, entry, "HIT")
+			return
+		}
+		if entry.CanServeWhileRevalidating() {
+			p.serveCachedResponse(w, r, entry, "UPDATING")
+			p.revalidate(r, domain, cacheKey, flightKey, entry)
+			return
+		}
+		stale = entry
+	}
+
+	// Ranges of objects not cached whole are served from cached slices
+	if r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+		p.sliceAndServe(w, r, domain, cacheKey)
+		return
+	}
 
-	// Try to serve from cache first
-	if entry, found := p.cache.Get(ctx, cacheKey); found {
-		p.serveCachedResponse(w, r, entry)
+	// Cache miss - collapse concurrent misses into a single origin fetch
+	if domain.CoalesceRequests && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		p.coalesceAndServe(w, r, domain, cacheKey, flightKey, stale)
 		return
 	}
 
-	// Cache miss - fetch from origin
-	p.fetchAndServe(w, r, originURL, cacheKey)
+	p.fetchAndServe(w, r, domain, cacheKey, stale)
 }
 
-func (p *ProxyService) serveCachedResponse(w http.ResponseWriter, r *http.Request, entry *cache.CacheEntry) {
+// coalesceAndServe lets the first request for flightKey fetch from the origin
+// while concurrent requests wait for its result. Waiters fall back to their
+// own origin fetch if the wait times out or the response cannot be shared,
+// including when it turns out to be a different variant.
+func (p *ProxyService) coalesceAndServe(w http.ResponseWriter, r *http.Request, domain DomainConfig, cacheKey, flightKey string, stale *cache.CacheEntry) {
+	f, leader := p.coalescer.join(flightKey)
+	if leader {
+		entry := p.fetchAndServe(w, r, domain, cacheKey, stale)
+		p.coalescer.finish(flightKey, f, entry)
+		return
+	}
+
+	timeout := domain.CoalesceTimeout
+	if timeout <= 0 {
+		timeout = p.coalesceTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		if f.entry != nil && f.entry.Matches(r) {
+			p.serveCachedResponse(w, r, f.entry, "COALESCED")
+			return
+		}
+	case <-timer.C:
+		logrus.WithFields(logrus.Fields{
+			"cache_key": cacheKey,
+			"timeout":   timeout.String(),
+		}).Warn("Timed out waiting for coalesced origin fetch")
+	case <-r.Context().Done():
+		return
+	}
+
+	p.fetchAndServe(w, r, domain, cacheKey, stale)
+}
+
+func (p *ProxyService) serveCachedResponse(w http.ResponseWriter, r *http.Request, entry *cache.CacheEntry, status string) {
 	// Copy headers from cache
 	for name, values := range entry.Headers {
 		for _, value := range values {
@@ -77,106 +365,204 @@ func (p *ProxyService) serveCachedResponse(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Add cache status header
-	w.Header().Set("X-Cache-Status", "HIT")
+	w.Header().Set("X-Cache-Status", status)
 	w.Header().Set("X-Cache-Date", entry.CachedAt.Format(time.RFC3339))
 
-	// Set status code and write body
-	w.WriteHeader(entry.StatusCode)
-	w.Write(entry.Body)
+	// Answer conditional requests from the cached validators
+	statusCode := entry.StatusCode
+	if notModified(r, entry) {
+		statusCode = http.StatusNotModified
+		w.Header().Del("Content-Length")
+		w.WriteHeader(statusCode)
+	} else if entry.StatusCode == http.StatusOK && r.Method == http.MethodGet {
+		// Full objects can answer Range requests directly
+		statusCode, _ = serveRange(w, r, int64(len(entry.Body)), func(dst io.Writer, start, length int64) error {
+			_, err := dst.Write(entry.Body[start : start+length])
+			return err
+		})
+	} else {
+		// Set status code and write body
+		w.WriteHeader(statusCode)
+		w.Write(entry.Body)
+	}
 
 	logrus.WithFields(logrus.Fields{
 		"method":      r.Method,
 		"path":        r.URL.Path,
 		"cache_key":   cache.GenerateCacheKey(r),
-		"status":      "HIT",
-		"status_code": entry.StatusCode,
+		"status":      status,
+		"status_code": statusCode,
 		"size":        len(entry.Body),
 	}).Info("Cache hit")
 }
 
-func (p *ProxyService) fetchAndServe(w http.ResponseWriter, r *http.Request, originURL, cacheKey string) {
-	ctx := r.Context()
-
-	// Parse origin URL
-	origin, err := url.Parse(originURL)
-	if err != nil {
-		http.Error(w, "Invalid origin URL", http.StatusBadGateway)
-		return
-	}
-
-	// Create proxy request
-	proxyReq, err := p.createProxyRequest(r, origin)
-	if err != nil {
-		http.Error(w, "Failed to create proxy request", http.StatusBadGateway)
-		return
+// fetchAndServe streams the origin response to the client and returns the
+// entry it cached, or nil when the response was not cacheable. An expired
+// entry passed as stale is revalidated with a conditional request, and is
+// served in place of an origin error while inside its stale-if-error window.
+func (p *ProxyService) fetchAndServe(w http.ResponseWriter, r *http.Request, domain DomainConfig, cacheKey string, stale *cache.CacheEntry) *cache.CacheEntry {
+	var validating bool
+	resp, originURL, err := p.originRequest(r, domain, func(proxyReq *http.Request) {
+		validating = addValidators(proxyReq, stale)
+	})
+	if shortCircuited(err) {
+		p.serveShortCircuit(w, r, stale, err)
+		return nil
 	}
-
-	// Execute request
-	resp, err := p.httpClient.Do(proxyReq)
 	if err != nil {
 		logrus.WithError(err).WithField("origin", originURL).Error("Failed to fetch from origin")
+		if stale != nil && stale.CanServeOnError() {
+			p.serveCachedResponse(w, r, stale, "STALE")
+			return nil
+		}
 		http.Error(w, "Failed to fetch from origin", http.StatusBadGateway)
-		return
+		return nil
 	}
 	defer resp.Body.Close()
 
-	// Read response body
-	body, err := p.readResponseBody(resp)
-	if err != nil {
-		http.Error(w, "Failed to read response body", http.StatusBadGateway)
-		return
+	if resp.StatusCode >= http.StatusInternalServerError && stale != nil && stale.CanServeOnError() {
+		logrus.WithFields(logrus.Fields{
+			"origin":      originURL,
+			"status_code": resp.StatusCode,
+		}).Warn("Origin error - serving stale response")
+		p.serveCachedResponse(w, r, stale, "STALE")
+		return nil
 	}
 
+	// The cached copy is still current - refresh its TTL and serve it
+	if validating && resp.StatusCode == http.StatusNotModified {
+		entry := p.refreshEntry(r, stale, resp, domain)
+		p.storeEntry(r.Context(), cacheKey, entry)
+		p.serveCachedResponse(w, r, entry, "REVALIDATED")
+		return entry
+	}
+
+	return p.relayResponse(w, r, resp, domain, cacheKey)
+}
+
+// relayResponse streams an origin response to the client, caching a copy when
+// it is cacheable, and returns the cached entry or nil.
+func (p *ProxyService) relayResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, domain DomainConfig, cacheKey string) *cache.CacheEntry {
+	ctx := r.Context()
+
+	encoding := p.prepareCompression(r, resp, domain)
+
 	// Copy response headers (excluding hop-by-hop headers)
 	p.copyResponseHeaders(resp, w)
 
 	// Add cache status
 	w.Header().Set("X-Cache-Status", "MISS")
-
-	// Write response
 	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
+
+	// Only buffer a copy of the body when the response could end up in the
+	// cache; everything else is passed straight through.
+	var body *bodyBuffer
+	cacheable := cache.IsCacheable(r, resp) && resp.ContentLength <= p.maxBodySize
+	if cacheable {
+		body = newBodyBuffer(resp.ContentLength, p.maxBodySize)
+	}
+
+	written, err := p.writeBody(w, resp, encoding, body)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"origin":  resp.Request.URL.Host,
+			"path":    r.URL.Path,
+			"written": written,
+		}).Warn("Streaming origin response aborted")
+		return nil
+	}
+
+	if body != nil && body.overflowed {
+		cacheable = false
+	}
 
 	// Cache the response if it's cacheable
-	if cache.IsCacheable(r, resp) {
-		ttl := p.determineTTL(resp)
-		entry := &cache.CacheEntry{
-			StatusCode: resp.StatusCode,
-			Headers:    make(http.Header),
-			Body:       body,
-			CachedAt:   time.Now(),
-			TTL:        ttl,
+	if cacheable {
+		entry := p.newCacheEntry(r, resp, body.Bytes(), domain)
+		p.storeEntry(ctx, cacheKey, entry)
+
+		logrus.WithFields(logrus.Fields{
+			"method":       r.Method,
+			"path":         r.URL.Path,
+			"cache_key":    cacheKey,
+			"status":       "MISS",
+			"status_code":  resp.StatusCode,
+			"size":         written,
+			"ttl":          entry.TTL.Seconds(),
+			"proto":        r.Proto,
+			"origin_proto": resp.Proto,
+			"encoding":     encoding,
+		}).Info("Cache miss - response cached")
+
+		return entry
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"status":      "MISS",
+		"status_code": resp.StatusCode,
+		"size":        written,
+		"cacheable":   false,
+	}).Info("Cache miss - response not cached")
+	return nil
+}
+
+// newCacheEntry builds a cache entry from an origin response to r and its body
+func (p *ProxyService) newCacheEntry(r *http.Request, resp *http.Response, body []byte, domain DomainConfig) *cache.CacheEntry {
+	entry := &cache.CacheEntry{
+		StatusCode: resp.StatusCode,
+		Headers:    make(http.Header),
+		Body:       body,
+		CachedAt:   time.Now(),
+		TTL:        p.determineTTL(resp.Header, domain.DefaultTTL),
+
+		StaleWhileRevalidate: domain.StaleWhileRevalidate,
+		StaleIfError:         domain.StaleIfError,
+
+		Host: requestHost(r),
+		Path: requestPath(r),
+		Tags: parseCacheTags(resp.Header),
+	}
+	if policy := domain.matchPolicy(r); policy != nil && policy.TTL > 0 {
+		entry.TTL = policy.TTL
+	}
+
+	// Stale windows from the origin take precedence over domain defaults
+	if cacheControl := resp.Header.Get("Cache-Control"); cacheControl != "" {
+		if secs, ok := p.extractDirectiveSeconds(cacheControl, "stale-while-revalidate"); ok {
+			entry.StaleWhileRevalidate = time.Duration(secs) * time.Second
+		}
+		if secs, ok := p.extractDirectiveSeconds(cacheControl, "stale-if-error"); ok {
+			entry.StaleIfError = time.Duration(secs) * time.Second
 		}
+	}
 
-		// Copy cacheable headers
-		for name, values := range resp.Header {
-			if p.isCacheableHeader(name) {
-				entry.Headers[name] = values
-			}
+	// Copy cacheable headers
+	for name, values := range resp.Header {
+		if p.isCacheableHeader(name) {
+			entry.Headers[name] = values
 		}
+	}
 
-		if err := p.cache.Set(ctx, cacheKey, entry); err != nil {
+	// Record which variant of the resource this is
+	if vary, ok := cache.ParseVary(resp.Header); ok && len(vary) > 0 {
+		entry.Vary = vary
+		entry.Variant = cache.VariantID(r, vary)
+	}
+
+	return entry
+}
+
+// storeEntry caches entry under the primary key cacheKey, or under its
+// variant key when the response varies
+func (p *ProxyService) storeEntry(ctx context.Context, cacheKey string, entry *cache.CacheEntry) {
+	if err := cache.Store(ctx, p.cache, cacheKey, entry); err != nil {
+		if errors.Is(err, cache.ErrEntryTooLarge) {
+			logrus.WithField("cache_key", cacheKey).Debug("Response too large for cache")
+		} else {
 			logrus.WithError(err).Warn("Failed to cache response")
 		}
-
-		logrus.WithFields(logrus.Fields{
-			"method":      r.Method,
-			"path":        r.URL.Path,
-			"cache_key":   cacheKey,
-			"status":      "MISS",
-			"status_code": resp.StatusCode,
-			"size":        len(body),
-			"ttl":         ttl.Seconds(),
-		}).Info("Cache miss - response cached")
-	} else {
-		logrus.WithFields(logrus.Fields{
-			"method":      r.Method,
-			"path":        r.URL.Path,
-			"status":      "MISS",
-			"status_code": resp.StatusCode,
-			"size":        len(body),
-			"cacheable":   false,
-		}).Info("Cache miss - response not cached")
 	}
 }
 
@@ -204,7 +590,10 @@ func (p *ProxyService) createProxyRequest(r *http.Request, origin *url.URL) (*ht
 		}
 	}
 
-	// Set/override some headers
+	// Set/override some headers. The shield headers are only ever set by
+	// edges, for other edges.
+	proxyReq.Header.Del(ShieldHopHeader)
+	proxyReq.Header.Del(ShieldAuthHeader)
 	proxyReq.Header.Set("Host", origin.Host)
 	proxyReq.Header.Set("X-Forwarded-For", r.RemoteAddr)
 	proxyReq.Header.Set("X-Forwarded-Proto", r.URL.Scheme)
@@ -215,21 +604,9 @@ func (p *ProxyService) createProxyRequest(r *http.Request, origin *url.URL) (*ht
 	return proxyReq, nil
 }
 
-func (p *ProxyService) readResponseBody(resp *http.Response) ([]byte, error) {
-	// Check content length
-	if resp.ContentLength > p.maxBodySize {
-		return nil, fmt.Errorf("response body too large: %d bytes", resp.ContentLength)
-	}
-
-	// Use LimitReader to prevent reading too much data
-	limitedReader := io.LimitReader(resp.Body, p.maxBodySize)
-
-	return io.ReadAll(limitedReader)
-}
-
 func (p *ProxyService) copyResponseHeaders(resp *http.Response, w http.ResponseWriter) {
 	for name, values := range resp.Header {
-		if !p.isHopByHopHeader(name) {
+		if !p.isHopByHopHeader(name) && !isTagHeader(name) {
 			for _, value := range values {
 				w.Header().Add(name, value)
 			}
@@ -237,16 +614,23 @@ func (p *ProxyService) copyResponseHeaders(resp *http.Response, w http.ResponseW
 	}
 }
 
-func (p *ProxyService) determineTTL(resp *http.Response) time.Duration {
+// determineTTL picks the TTL for an origin response from its Cache-Control
+// max-age or Expires header, falling back to the domain's default and then
+// the edge's, clamped to the configured bounds
+func (p *ProxyService) determineTTL(header http.Header, domainTTL time.Duration) time.Duration {
+	return p.clampTTL(p.originTTL(header, domainTTL))
+}
+
+func (p *ProxyService) originTTL(header http.Header, domainTTL time.Duration) time.Duration {
 	// Check Cache-Control header
-	if cacheControl := resp.Header.Get("Cache-Control"); cacheControl != "" {
+	if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
 		if maxAge := p.extractMaxAge(cacheControl); maxAge > 0 {
 			return time.Duration(maxAge) * time.Second
 		}
 	}
 
 	// Check Expires header
-	if expires := resp.Header.Get("Expires"); expires != "" {
+	if expires := header.Get("Expires"); expires != "" {
 		if expTime, err := time.Parse(time.RFC1123, expires); err == nil {
 			if ttl := time.Until(expTime); ttl > 0 {
 				return ttl
@@ -254,21 +638,43 @@ func (p *ProxyService) determineTTL(resp *http.Response) time.Duration {
 		}
 	}
 
-	// Use default TTL
+	// Use the domain's TTL, then the default TTL
+	if domainTTL > 0 {
+		return domainTTL
+	}
 	return p.defaultTTL
 }
 
+// clampTTL bounds ttl by MinTTL and MaxTTL
+func (p *ProxyService) clampTTL(ttl time.Duration) time.Duration {
+	if p.minTTL > 0 && ttl < p.minTTL {
+		return p.minTTL
+	}
+	if p.maxTTL > 0 && ttl > p.maxTTL {
+		return p.maxTTL
+	}
+	return ttl
+}
+
 func (p *ProxyService) extractMaxAge(cacheControl string) int {
+	maxAge, _ := p.extractDirectiveSeconds(cacheControl, "max-age")
+	return maxAge
+}
+
+// extractDirectiveSeconds returns the value of a delta-seconds Cache-Control
+// directive such as max-age or stale-if-error
+func (p *ProxyService) extractDirectiveSeconds(cacheControl, directive string) (int, bool) {
+	prefix := directive + "="
 	parts := strings.Split(strings.ToLower(cacheControl), ",")
 	for _, part := range parts {
 		part = strings.TrimSpace(part)
-		if strings.HasPrefix(part, "max-age=") {
-			if maxAge, err := strconv.Atoi(part[8:]); err == nil {
-				return maxAge
+		if strings.HasPrefix(part, prefix) {
+			if secs, err := strconv.Atoi(strings.Trim(part[len(prefix):], `"`)); err == nil && secs >= 0 {
+				return secs, true
 			}
 		}
 	}
-	return 0
+	return 0, false
 }
 
 func (p *ProxyService) isHopByHopHeader(name string) bool {
@@ -302,6 +708,11 @@ func (p *ProxyService) isCacheableHeader(name string) bool {
 		"Server",
 	}
 
+	// Cache tags are kept on the entry itself and never served
+	if isTagHeader(name) {
+		return false
+	}
+
 	name = strings.ToLower(name)
 	for _, header := range nonCacheableHeaders {
 		if strings.ToLower(header) == name {
@@ -310,53 +721,3 @@ func (p *ProxyService) isCacheableHeader(name string) bool {
 	}
 	return true
 }
-
-// PurgeCache removes cached content for specific paths
-func (p *ProxyService) PurgeCache(ctx context.Context, domain string, paths []string) error {
-	// Common header variations to purge
-	headerVariations := []map[string]string{
-		{}, // No headers
-		{"Accept": "*/*"},
-		{"Accept": "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
-		{"Accept": "application/json"},
-		{"Accept-Encoding": "gzip"},
-		{"Accept": "*/*", "Accept-Encoding": "gzip"},
-	}
-
-	for _, path := range paths {
-		purgedCount := 0
-
-		// For exact paths, try different header variations
-		for _, headers := range headerVariations {
-			req := &http.Request{
-				Method: "GET",
-				Host:   domain,
-				URL:    &url.URL{Path: path},
-				Header: make(http.Header),
-			}
-
-			for key, value := range headers {
-				req.Header.Set(key, value)
-			}
-
-			cacheKey := cache.GenerateCacheKey(req)
-			if err := p.cache.Delete(ctx, cacheKey); err == nil {
-				purgedCount++
-				logrus.WithFields(logrus.Fields{
-					"cache_key": cacheKey,
-					"domain":    domain,
-					"path":      path,
-				}).Info("Cache entry purged")
-			}
-		}
-
-		if purgedCount == 0 {
-			logrus.WithFields(logrus.Fields{
-				"domain": domain,
-				"path":   path,
-			}).Warn("No cache entries found to purge")
-		}
-	}
-
-	return nil
-}
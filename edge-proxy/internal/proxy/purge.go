@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/naijcloud/edge-proxy/internal/cache"
+	"github.com/sirupsen/logrus"
+)
+
+// PurgeCache removes a domain's cached content matching any of paths or
+// carrying any of tags, found through the cache's index of the keys stored
+// for each domain. Tags are the values of the origin's Surrogate-Key and
+// Cache-Tag response headers. A path may be:
+//
+//   - an exact URL such as "/a/b.css", which covers every query string of
+//     that path, or "/a/b.css?v=2", which covers only that query string
+//   - a prefix ending in "*", such as "/images/*"
+//   - a glob with "*" elsewhere, such as "/assets/*.js", where "*" matches
+//     any run of characters including "/"
+//   - "*" or "/*" for everything cached for the domain
+//
+// Variants, slices and keys built by cache policies are purged along with
+// the paths they were stored for.
+func (p *ProxyService) PurgeCache(ctx context.Context, domain string, paths, tags []string) error {
+	matchers := make([]func(string) bool, 0, len(paths))
+	for _, path := range paths {
+		match, err := purgeMatcher(path)
+		if err != nil {
+			return err
+		}
+		matchers = append(matchers, match)
+	}
+	purgeTags := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		purgeTags[tag] = true
+	}
+
+	keys, listErr := p.cache.DomainKeys(ctx, strings.ToLower(domain))
+	if listErr != nil {
+		// Purge what the cache could list, then report the failure
+		logrus.WithError(listErr).WithField("domain", domain).Warn("Cache index incomplete for purge")
+	}
+
+	purged := 0
+	for key, info := range keys {
+		if !purgeCovers(info, matchers, purgeTags) {
+			continue
+		}
+		if err := p.cache.Delete(ctx, key); err != nil {
+			return fmt.Errorf("failed to purge %s: %w", key, err)
+		}
+		purged++
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"domain": domain,
+		"paths":  paths,
+		"tags":   tags,
+		"purged": purged,
+	}).Info("Cache entries purged")
+
+	if listErr != nil {
+		return fmt.Errorf("failed to list cached keys for %s: %w", domain, listErr)
+	}
+	return nil
+}
+
+// purgeCovers reports whether a purge's paths or tags cover a cached key
+func purgeCovers(info cache.KeyInfo, matchers []func(string) bool, tags map[string]bool) bool {
+	for _, match := range matchers {
+		if match(info.Path) {
+			return true
+		}
+	}
+	for _, tag := range info.Tags {
+		if tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeMatcher returns a function reporting whether a cached path, including
+// its query string, is covered by a purge path. See PurgeCache for the
+// accepted forms.
+func purgeMatcher(pattern string) (func(string) bool, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("empty purge path")
+	}
+
+	wildcards := strings.Count(pattern, "*")
+	switch {
+	case pattern == "*" || pattern == "/*":
+		return func(string) bool { return true }, nil
+
+	case wildcards == 1 && strings.HasSuffix(pattern, "*"):
+		prefix := strings.TrimSuffix(pattern, "*")
+		return func(path string) bool { return strings.HasPrefix(path, prefix) }, nil
+
+	case wildcards > 0:
+		var b strings.Builder
+		b.WriteString("^")
+		for i, part := range strings.Split(pattern, "*") {
+			if i > 0 {
+				b.WriteString(".*")
+			}
+			b.WriteString(regexp.QuoteMeta(part))
+		}
+		b.WriteString("$")
+		re, err := regexp.Compile(b.String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid purge path %q: %w", pattern, err)
+		}
+		return re.MatchString, nil
+
+	case strings.Contains(pattern, "?"):
+		return func(path string) bool { return path == pattern }, nil
+	}
+
+	return func(path string) bool {
+		withoutQuery, _, _ := strings.Cut(path, "?")
+		return withoutQuery == pattern
+	}, nil
+}
+
+// requestHost is the host a request was made to, without port, as recorded
+// in the cache index
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// requestPath is the path and query string a request was made for, as
+// recorded in the cache index
+func requestPath(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return r.URL.Path
+	}
+	return r.URL.Path + "?" + r.URL.RawQuery
+}
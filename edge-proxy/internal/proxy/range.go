@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidRange = errors.New("invalid range")
+	errNoOverlap    = errors.New("invalid range: failed to overlap")
+)
+
+// byteRange is a resolved byte range of a body of known size.
+type byteRange struct {
+	start, length int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+// parseRange resolves a Range header against a body of the given size. It
+// returns errNoOverlap when every range lies beyond the end of the body.
+func parseRange(s string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errInvalidRange
+	}
+
+	var ranges []byteRange
+	noOverlap := false
+	for _, spec := range strings.Split(s[len(prefix):], ",") {
+		spec = textproto.TrimString(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		first, last = textproto.TrimString(first), textproto.TrimString(last)
+
+		var br byteRange
+		if first == "" {
+			// Suffix range: the last N bytes
+			n, err := parseRangeInt(last)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 || size == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			br.start = size - n
+			br.length = n
+		} else {
+			start, err := parseRangeInt(first)
+			if err != nil {
+				return nil, err
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+			br.start = start
+			if last == "" {
+				br.length = size - start
+			} else {
+				end, err := parseRangeInt(last)
+				if err != nil || end < start {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+				br.length = end - start + 1
+			}
+		}
+		ranges = append(ranges, br)
+	}
+
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+func parseRangeInt(s string) (int64, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, errInvalidRange
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errInvalidRange
+	}
+	return n, nil
+}
+
+// ifRangeMatches reports whether the If-Range precondition, if any, holds for
+// a response with the given headers. When it does not the full body is sent.
+func ifRangeMatches(r *http.Request, header http.Header) bool {
+	ifRange := textproto.TrimString(r.Header.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+
+	// Entity tags must match strongly
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := header.Get("ETag")
+		return etag != "" && !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+
+	since, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && modified.Equal(since)
+}
+
+// rangeWriter writes length bytes of a body starting at start.
+type rangeWriter func(w io.Writer, start, length int64) error
+
+// serveRange answers r from a body of the given size, honouring any Range
+// and If-Range headers. The full object's headers must already be set on w.
+// It returns the status code written.
+func serveRange(w http.ResponseWriter, r *http.Request, size int64, write rangeWriter) (int, error) {
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Del("Content-Range")
+
+	var ranges []byteRange
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && ifRangeMatches(r, w.Header()) {
+		var err error
+		ranges, err = parseRange(rangeHeader, size)
+		if err == errNoOverlap {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return http.StatusRequestedRangeNotSatisfiable, nil
+		}
+		if err != nil {
+			// A malformed Range header is ignored
+			ranges = nil
+		}
+
+		// Overlapping ranges that add up to more than the body are answered
+		// with the whole body rather than amplifying it
+		var total int64
+		for _, br := range ranges {
+			total += br.length
+		}
+		if total > size {
+			ranges = nil
+		}
+	}
+
+	bodyAllowed := r.Method != http.MethodHead
+
+	switch len(ranges) {
+	case 0:
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		if bodyAllowed {
+			return http.StatusOK, write(w, 0, size)
+		}
+		return http.StatusOK, nil
+
+	case 1:
+		br := ranges[0]
+		w.Header().Set("Content-Range", br.contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(br.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if bodyAllowed {
+			return http.StatusPartialContent, write(w, br.start, br.length)
+		}
+		return http.StatusPartialContent, nil
+	}
+
+	contentType := w.Header().Get("Content-Type")
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusPartialContent)
+	if !bodyAllowed {
+		return http.StatusPartialContent, nil
+	}
+
+	for _, br := range ranges {
+		partHeader := textproto.MIMEHeader{}
+		if contentType != "" {
+			partHeader.Set("Content-Type", contentType)
+		}
+		partHeader.Set("Content-Range", br.contentRange(size))
+		part, err := mw.CreatePart(partHeader)
+		if err != nil {
+			return http.StatusPartialContent, err
+		}
+		if err := write(part, br.start, br.length); err != nil {
+			return http.StatusPartialContent, err
+		}
+	}
+	return http.StatusPartialContent, mw.Close()
+}
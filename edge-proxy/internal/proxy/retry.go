@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRetryBackoff = 50 * time.Millisecond
+	maxRetryBackoff     = time.Second
+)
+
+// defaultRetryStatuses are the origin statuses retried unless configured
+// otherwise: those a proxy or an overloaded server in front of the
+// application answers with
+var defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+var (
+	originRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "edge_origin_retries_total",
+			Help: "Origin requests retried, by the origin that failed and reason (error, held_back or the status code)",
+		},
+		[]string{"origin", "reason"},
+	)
+
+	originRetriesExhausted = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "edge_origin_retries_exhausted_total",
+			Help: "Retried origin requests that failed on their last attempt",
+		},
+	)
+)
+
+// originRequest sends r to one of the domain's origins, or through its
+// shield, and returns the response along with the origin that answered.
+// prepare, when set, adjusts the request made for each attempt. Idempotent
+// requests without a body are retried after connection errors and retry
+// statuses, waiting a jittered backoff, as long as the retry can start before
+// the request's deadline. Retries go to an origin not tried yet when the
+// domain's pool has one. The origin lease is held until the response body is
+// closed.
+func (p *ProxyService) originRequest(r *http.Request, domain DomainConfig, prepare func(*http.Request)) (*http.Response, string, error) {
+	if resp, shield, err := p.fetchThroughShield(r, domain, prepare); resp != nil || err != nil {
+		return resp, shield, err
+	}
+
+	attempts := 1
+	if retryable(r) {
+		attempts += p.retries
+	}
+	deadline := p.retryDeadline(r)
+
+	var tried []string
+	for attempt := 1; ; attempt++ {
+		lease := p.selectOrigin(r, domain, tried)
+
+		origin, err := url.Parse(lease.url)
+		if err != nil {
+			lease.release()
+			return nil, lease.url, fmt.Errorf("invalid origin URL: %w", err)
+		}
+		proxyReq, err := p.createProxyRequest(r, origin)
+		if err != nil {
+			lease.release()
+			return nil, lease.url, fmt.Errorf("failed to create proxy request: %w", err)
+		}
+		if prepare != nil {
+			prepare(proxyReq)
+		}
+
+		resp, err := p.doOrigin(proxyReq)
+		reason := p.retryReason(r, domain, resp, err)
+		if reason == "" {
+			if attempt > 1 {
+				logrus.WithFields(logrus.Fields{
+					"host":     r.Host,
+					"path":     r.URL.Path,
+					"origin":   lease.url,
+					"attempts": attempt,
+				}).Info("Origin request succeeded on retry")
+			}
+			return p.leaseResponse(resp, err, lease)
+		}
+
+		backoff := p.backoff(attempt)
+		if attempt >= attempts || time.Now().Add(backoff).After(deadline) {
+			if attempt > 1 {
+				originRetriesExhausted.Inc()
+				logrus.WithFields(logrus.Fields{
+					"host":     r.Host,
+					"path":     r.URL.Path,
+					"origin":   lease.url,
+					"attempts": attempt,
+					"reason":   reason,
+				}).Warn("Origin request failed after retries")
+			}
+			return p.leaseResponse(resp, err, lease)
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		lease.release()
+		tried = append(tried, lease.url)
+
+		originRetries.WithLabelValues(originKey(origin), reason).Inc()
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"host":    r.Host,
+			"path":    r.URL.Path,
+			"origin":  lease.url,
+			"attempt": attempt,
+			"reason":  reason,
+			"backoff": backoff.String(),
+		}).Warn("Retrying origin request")
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, lease.url, r.Context().Err()
+		}
+	}
+}
+
+// leaseResponse ties the origin lease to the response body, releasing it
+// right away when there is no response
+func (p *ProxyService) leaseResponse(resp *http.Response, err error, lease *originLease) (*http.Response, string, error) {
+	if err != nil {
+		lease.release()
+		return nil, lease.url, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: lease.release}
+	return resp, lease.url, nil
+}
+
+// retryReason says why an attempt should be retried, or returns "" when its
+// outcome stands
+func (p *ProxyService) retryReason(r *http.Request, domain DomainConfig, resp *http.Response, err error) string {
+	switch {
+	case err == nil:
+		if p.retryStatuses[resp.StatusCode] {
+			return strconv.Itoa(resp.StatusCode)
+		}
+		return ""
+	case r.Context().Err() != nil:
+		// The client went away or the request ran out of time
+		return ""
+	case shortCircuited(err):
+		// The same origin would hold the request back again
+		if len(domain.Origins) > 1 {
+			return "held_back"
+		}
+		return ""
+	default:
+		return "error"
+	}
+}
+
+// retryable reports whether r may be sent to an origin more than once: its
+// method must be idempotent, and it must have no body the first attempt
+// could have consumed
+func retryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return r.Body == nil || r.Body == http.NoBody || (r.ContentLength == 0 && len(r.TransferEncoding) == 0)
+}
+
+// retryDeadline is when retries of r stop being started: the request's own
+// deadline, or otherwise one response timeout after it began
+func (p *ProxyService) retryDeadline(r *http.Request) time.Time {
+	if deadline, ok := r.Context().Deadline(); ok {
+		return deadline
+	}
+	timeout := p.responseTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return time.Now().Add(timeout)
+}
+
+// backoff returns a random wait before retrying after attempt, up to the
+// base backoff doubled for each earlier retry and at most maxRetryBackoff
+func (p *ProxyService) backoff(attempt int) time.Duration {
+	ceiling := maxRetryBackoff
+	if attempt < 16 && p.retryBackoff<<(attempt-1) < ceiling {
+		ceiling = p.retryBackoff << (attempt - 1)
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ShieldHopHeader marks a request an edge sent to a shield edge, with
+	// the sending edge's region as its value. Requests carrying it are
+	// always fetched from the origin, so a request never passes through
+	// more than one shield.
+	ShieldHopHeader = "X-NaijCloud-Shield-Hop"
+	// ShieldAuthHeader carries ProxyConfig.ShieldSecret on requests an edge
+	// sends to a shield edge
+	ShieldAuthHeader = "X-NaijCloud-Shield-Auth"
+	// ShieldCacheStatusHeader carries the shield edge's X-Cache-Status on
+	// responses fetched through it
+	ShieldCacheStatusHeader = "X-Shield-Cache-Status"
+)
+
+var shieldFetches = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "edge_shield_fetches_total",
+		Help: "Cache misses fetched through a shield edge, by result (ok, fallback, error)",
+	},
+	[]string{"result"},
+)
+
+// selectShield returns the shield edge to fetch r through, or "" when r goes
+// straight to the origin: the domain has no shield, this edge is in the
+// shield region, r already came through a shield, or r is neither a GET or
+// HEAD the shield could cache nor safe to send again. Each path maps to the
+// same shield edge so the shield region caches it once.
+func (p *ProxyService) selectShield(r *http.Request, domain DomainConfig) string {
+	if domain.ShieldRegion == "" || domain.ShieldRegion == p.region || r.Header.Get(ShieldHopHeader) != "" {
+		return ""
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !retryable(r) {
+		return ""
+	}
+
+	var best string
+	var bestScore uint64
+	for _, shield := range domain.Shields {
+		if !p.gates.available("http://" + shield) {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(r.Host + r.URL.Path))
+		h.Write([]byte{0})
+		h.Write([]byte(shield))
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = shield, score
+		}
+	}
+	return best
+}
+
+// fromEdge reports whether r was sent by another edge: it carries the shared
+// shield secret, or comes from one of the domain's shield edges, which covers
+// shields whose configurations disagree about the shield region without a
+// secret configured
+func (p *ProxyService) fromEdge(r *http.Request, domain DomainConfig) bool {
+	if r.Header.Get(ShieldHopHeader) == "" {
+		return false
+	}
+	if p.shieldSecret != "" {
+		auth := r.Header.Get(ShieldAuthHeader)
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(p.shieldSecret)) == 1 {
+			return true
+		}
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	for _, shield := range domain.Shields {
+		if host, _, err := net.SplitHostPort(shield); err == nil && host == client {
+			return true
+		}
+	}
+	return false
+}
+
+// shieldRequest fetches r through a shield edge. The shield edge serves it
+// like any client request for the domain, from its cache or its origin, and
+// its cache status is passed on in ShieldCacheStatusHeader.
+func (p *ProxyService) shieldRequest(r *http.Request, shield string, prepare func(*http.Request)) (*http.Response, error) {
+	proxyReq, err := p.createProxyRequest(r, &url.URL{Scheme: "http", Host: shield})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create shield request: %w", err)
+	}
+	// The shield looks the domain up by host like any edge
+	proxyReq.Host = r.Host
+	proxyReq.Header.Set(ShieldHopHeader, p.region)
+	if p.shieldSecret != "" {
+		proxyReq.Header.Set(ShieldAuthHeader, p.shieldSecret)
+	}
+	if isHTTPS(r) {
+		// The client's request already passed any HTTPS redirect here
+		proxyReq.Header.Set("X-Forwarded-Proto", "https")
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		// Rate limit the client at the shield, not this edge
+		proxyReq.Header.Set("X-Forwarded-For", host)
+	}
+	if prepare != nil {
+		prepare(proxyReq)
+	}
+
+	resp, err := p.doOrigin(proxyReq)
+	if err != nil {
+		return nil, err
+	}
+
+	// This edge reports its own cache status and date
+	if status := resp.Header.Get("X-Cache-Status"); status != "" {
+		resp.Header.Set(ShieldCacheStatusHeader, status)
+	}
+	resp.Header.Del("X-Cache-Status")
+	resp.Header.Del("X-Cache-Date")
+	return resp, nil
+}
+
+// fetchThroughShield tries the domain's shield for r. It returns neither a
+// response nor an error when r should go to the origin instead, including
+// when the shield edge could not be reached and r can be sent again. When r
+// cannot, because the attempt consumed its body, the shield's error is
+// returned. Responses from the shield, errors included, are final so origin
+// failures are not retried from every edge.
+func (p *ProxyService) fetchThroughShield(r *http.Request, domain DomainConfig, prepare func(*http.Request)) (*http.Response, string, error) {
+	shield := p.selectShield(r, domain)
+	if shield == "" {
+		return nil, "", nil
+	}
+
+	resp, err := p.shieldRequest(r, shield, prepare)
+	if err != nil {
+		if !retryable(r) {
+			if r.Context().Err() == nil {
+				shieldFetches.WithLabelValues("error").Inc()
+			}
+			return nil, "http://" + shield, fmt.Errorf("shield edge unavailable: %w", err)
+		}
+		if r.Context().Err() == nil {
+			shieldFetches.WithLabelValues("fallback").Inc()
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"host":   r.Host,
+				"shield": shield,
+			}).Warn("Shield edge unavailable, fetching from origin")
+		}
+		return nil, "", nil
+	}
+
+	shieldFetches.WithLabelValues("ok").Inc()
+	return resp, "http://" + shield, nil
+}
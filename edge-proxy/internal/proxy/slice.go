@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/naijcloud/edge-proxy/internal/cache"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultSliceSize is used when ProxyConfig.SliceSize is not set.
+const defaultSliceSize = 1024 * 1024
+
+// errSliceMismatch means the object changed at the origin between slices.
+var errSliceMismatch = errors.New("slice does not match the rest of the object")
+
+// sliceKey is the cache key for one slice of the object cached at cacheKey.
+func sliceKey(cacheKey string, index int64) string {
+	return fmt.Sprintf("%s|slice=%d", cacheKey, index)
+}
+
+// sliceAndServe answers a Range request from fixed-size slices of the object.
+// Each slice is fetched from the origin with its own range request and cached
+// under its own key, so only the parts clients actually ask for are pulled
+// through the edge.
+func (p *ProxyService) sliceAndServe(w http.ResponseWriter, r *http.Request, domain DomainConfig, cacheKey string) {
+	first, status, resp, err := p.loadSlice(r, domain, cacheKey, 0)
+	if shortCircuited(err) {
+		p.serveShortCircuit(w, r, nil, err)
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("host", r.Host).Error("Failed to fetch slice from origin")
+		http.Error(w, "Failed to fetch from origin", http.StatusBadGateway)
+		return
+	}
+	if resp != nil {
+		// The origin ignored the range request; relay its full response
+		defer resp.Body.Close()
+		p.relayResponse(w, r, resp, domain, cacheKey)
+		return
+	}
+
+	size, ok := sliceObjectSize(first)
+	if !ok {
+		logrus.WithField("content_range", first.Headers.Get("Content-Range")).Error("Origin sent an unusable Content-Range")
+		http.Error(w, "Failed to fetch from origin", http.StatusBadGateway)
+		return
+	}
+
+	// Headers describe the whole object; serveRange adds the range ones
+	for name, values := range first.Headers {
+		if name == "Content-Range" || name == "Content-Length" {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Set("X-Cache-Status", status)
+	w.Header().Set("X-Cache-Date", first.CachedAt.Format(time.RFC3339))
+
+	statusCode, err := serveRange(w, r, size, func(dst io.Writer, start, length int64) error {
+		for length > 0 {
+			index := start / p.sliceSize
+			slice := first
+			if index > 0 {
+				next, _, resp, err := p.loadSlice(r, domain, cacheKey, index)
+				if resp != nil {
+					resp.Body.Close()
+					return fmt.Errorf("origin answered slice %d with status %d", index, resp.StatusCode)
+				}
+				if err != nil {
+					return err
+				}
+				if !sameObject(first, next) {
+					// Drop the outdated copy so the next request refetches it
+					p.cache.Delete(r.Context(), sliceKey(cacheKey, index))
+					return errSliceMismatch
+				}
+				slice = next
+			}
+
+			offset := start - index*p.sliceSize
+			n := int64(len(slice.Body)) - offset
+			if n <= 0 {
+				return fmt.Errorf("slice %d is shorter than expected", index)
+			}
+			if n > length {
+				n = length
+			}
+			if _, err := dst.Write(slice.Body[offset : offset+n]); err != nil {
+				return err
+			}
+			start += n
+			length -= n
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"host": r.Host,
+			"path": r.URL.Path,
+		}).Warn("Serving sliced response aborted")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"cache_key":   cacheKey,
+		"status":      status,
+		"status_code": statusCode,
+		"range":       r.Header.Get("Range"),
+		"object_size": size,
+	}).Info("Served sliced response")
+}
+
+// loadSlice returns slice index of the object from the cache or the origin,
+// along with its cache status. If the origin does not answer with partial
+// content its response is returned unread for the caller to relay.
+func (p *ProxyService) loadSlice(r *http.Request, domain DomainConfig, cacheKey string, index int64) (*cache.CacheEntry, string, *http.Response, error) {
+	key := sliceKey(cacheKey, index)
+
+	cached, flightKey, found := cache.Lookup(r.Context(), p.cache, key, r)
+	if found && cached.IsFresh() {
+		return cached, "HIT", nil, nil
+	}
+	var stale *cache.CacheEntry
+	if found {
+		stale = cached
+	}
+
+	// Concurrent requests for the same slice share one origin fetch
+	if domain.CoalesceRequests {
+		f, leader := p.coalescer.join(flightKey)
+		if !leader {
+			if entry := p.waitForFlight(r, f, domain); entry != nil && entry.Matches(r) {
+				return entry, "COALESCED", nil, nil
+			}
+		} else {
+			entry, resp, err := p.fetchSlice(r, domain, key, index, stale)
+			p.coalescer.finish(flightKey, f, entry)
+			return entry, "MISS", resp, err
+		}
+	}
+
+	entry, resp, err := p.fetchSlice(r, domain, key, index, stale)
+	return entry, "MISS", resp, err
+}
+
+// waitForFlight waits for another request's fetch and returns its entry, or
+// nil if the wait timed out or the result could not be shared.
+func (p *ProxyService) waitForFlight(r *http.Request, f *flight, domain DomainConfig) *cache.CacheEntry {
+	timeout := domain.CoalesceTimeout
+	if timeout <= 0 {
+		timeout = p.coalesceTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		return f.entry
+	case <-timer.C:
+		return nil
+	case <-r.Context().Done():
+		return nil
+	}
+}
+
+// fetchSlice requests one slice of the object from the origin and caches it.
+// A stale slice with validators is revalidated with a conditional request.
+func (p *ProxyService) fetchSlice(r *http.Request, domain DomainConfig, key string, index int64, stale *cache.CacheEntry) (*cache.CacheEntry, *http.Response, error) {
+	var validating bool
+	resp, _, err := p.originRequest(r, domain, func(proxyReq *http.Request) {
+		// The slice request replaces the client's range and preconditions
+		start := index * p.sliceSize
+		proxyReq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+p.sliceSize-1))
+		proxyReq.Header.Del("If-Range")
+		for _, name := range conditionalHeaders {
+			proxyReq.Header.Del(name)
+		}
+		validating = addValidators(proxyReq, stale)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch from origin: %w", err)
+	}
+
+	if validating && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		entry := p.refreshEntry(r, stale, resp, domain)
+		p.storeEntry(r.Context(), key, entry)
+		return entry, nil, nil
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, resp, nil
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, p.sliceSize+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read origin response: %w", err)
+	}
+	if int64(len(body)) > p.sliceSize {
+		return nil, nil, fmt.Errorf("origin sent more than the requested slice")
+	}
+
+	entry := p.newCacheEntry(r, resp, body, domain)
+	if cache.IsCacheableSlice(r, resp) {
+		p.storeEntry(r.Context(), key, entry)
+	}
+	return entry, nil, nil
+}
+
+// sliceObjectSize returns the full object size from a slice's Content-Range.
+func sliceObjectSize(slice *cache.CacheEntry) (int64, bool) {
+	contentRange := slice.Headers.Get("Content-Range")
+	i := strings.LastIndexByte(contentRange, '/')
+	if i < 0 {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// sameObject reports whether two slices were cut from the same version of an
+// object.
+func sameObject(a, b *cache.CacheEntry) bool {
+	sizeA, okA := sliceObjectSize(a)
+	sizeB, okB := sliceObjectSize(b)
+	if !okA || !okB || sizeA != sizeB {
+		return false
+	}
+	return a.Headers.Get("ETag") == b.Headers.Get("ETag") &&
+		a.Headers.Get("Last-Modified") == b.Headers.Get("Last-Modified")
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/naijcloud/edge-proxy/internal/cache"
+	"github.com/sirupsen/logrus"
+)
+
+// revalidateTimeout bounds a background refresh of a stale cache entry.
+const revalidateTimeout = 30 * time.Second
+
+// revalidate refreshes the stale entry for cacheKey from the origin in the
+// background. It shares the coalescer with cache misses, so only one refresh
+// runs per variant and any miss that arrives meanwhile waits for it instead
+// of fetching again.
+func (p *ProxyService) revalidate(r *http.Request, domain DomainConfig, cacheKey, flightKey string, stale *cache.CacheEntry) {
+	f, leader := p.coalescer.join(flightKey)
+	if !leader {
+		return
+	}
+
+	// Detach from the client request, which ends as soon as the stale
+	// response has been written
+	ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+	req := r.Clone(ctx)
+	req.Body = http.NoBody
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+
+	go func() {
+		defer cancel()
+
+		entry, err := p.fetchEntry(req, domain, stale)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"host":      r.Host,
+				"cache_key": cacheKey,
+			}).Warn("Background revalidation failed")
+		} else if entry != nil {
+			p.storeEntry(ctx, cacheKey, entry)
+			logrus.WithFields(logrus.Fields{
+				"cache_key": cacheKey,
+				"ttl":       entry.TTL.Seconds(),
+			}).Debug("Stale entry revalidated")
+		}
+
+		p.coalescer.finish(flightKey, f, entry)
+	}()
+}
+
+// fetchEntry fetches r from the origin without a client attached and returns
+// the resulting cache entry, or nil when the response is not cacheable. When
+// stale carries validators the fetch is conditional and a 304 refreshes it.
+func (p *ProxyService) fetchEntry(r *http.Request, domain DomainConfig, stale *cache.CacheEntry) (*cache.CacheEntry, error) {
+	var validating bool
+	resp, _, err := p.originRequest(r, domain, func(proxyReq *http.Request) {
+		validating = addValidators(proxyReq, stale)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch from origin: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if validating && resp.StatusCode == http.StatusNotModified {
+		return p.refreshEntry(r, stale, resp, domain), nil
+	}
+
+	if !cache.IsCacheable(r, resp) || resp.ContentLength > p.maxBodySize {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, p.maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read origin response: %w", err)
+	}
+	if int64(len(body)) > p.maxBodySize {
+		return nil, nil
+	}
+
+	return p.newCacheEntry(r, resp, body, domain), nil
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// streamChunkSize is the read size used when relaying origin bodies.
+const streamChunkSize = 32 * 1024
+
+// bodyBuffer collects a copy of a streamed body for the cache. Once the body
+// grows past limit the buffer is released and the response is marked as too
+// large to store.
+type bodyBuffer struct {
+	buf        bytes.Buffer
+	limit      int64
+	overflowed bool
+}
+
+func newBodyBuffer(contentLength, limit int64) *bodyBuffer {
+	b := &bodyBuffer{limit: limit}
+	if contentLength > 0 && contentLength <= limit {
+		b.buf.Grow(int(contentLength))
+	}
+	return b
+}
+
+func (b *bodyBuffer) Write(p []byte) (int, error) {
+	if b.overflowed {
+		return len(p), nil
+	}
+	if int64(b.buf.Len()+len(p)) > b.limit {
+		b.overflowed = true
+		b.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *bodyBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// streamBody relays the origin body to the client as it arrives, copying it
+// into body when one is given. Responses without a known length are flushed
+// after every chunk so event streams and long polls are not held back.
+func (p *ProxyService) streamBody(w http.ResponseWriter, resp *http.Response, body *bodyBuffer) (int64, error) {
+	flusher, _ := w.(http.Flusher)
+	flushEachChunk := flusher != nil && resp.ContentLength < 0
+
+	chunk := make([]byte, streamChunkSize)
+	var written int64
+	for {
+		n, readErr := resp.Body.Read(chunk)
+		if n > 0 {
+			if _, err := w.Write(chunk[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+
+			if body != nil {
+				body.Write(chunk[:n])
+			}
+			if flushEachChunk {
+				flusher.Flush()
+			}
+		}
+
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
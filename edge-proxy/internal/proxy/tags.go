@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Response headers origins use to tag content for purging. They are meant for
+// the CDN only and never reach clients.
+const (
+	surrogateKeyHeader = "Surrogate-Key" // space separated
+	cacheTagHeader     = "Cache-Tag"     // comma separated
+)
+
+// isTagHeader reports whether name is one of the cache tag headers
+func isTagHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return name == surrogateKeyHeader || name == cacheTagHeader
+}
+
+// parseCacheTags returns the sorted, de-duplicated tags a response carries
+func parseCacheTags(header http.Header) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	add := func(tag string) {
+		if tag = strings.TrimSpace(tag); tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	for _, value := range header.Values(surrogateKeyHeader) {
+		for _, tag := range strings.Fields(value) {
+			add(tag)
+		}
+	}
+	for _, value := range header.Values(cacheTagHeader) {
+		for _, tag := range strings.Split(value, ",") {
+			add(tag)
+		}
+	}
+
+	sort.Strings(tags)
+	return tags
+}
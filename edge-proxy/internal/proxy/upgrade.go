@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultTunnelIdleTimeout closes upgraded connections with no traffic in
+// either direction for this long
+const defaultTunnelIdleTimeout = 5 * time.Minute
+
+var (
+	tunnelsActive = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "edge_tunnels_active",
+			Help: "Upgraded connections currently tunnelled to origins, by protocol",
+		},
+		[]string{"protocol"},
+	)
+
+	tunnelsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "edge_tunnels_total",
+			Help: "Upgrade requests by protocol and result (upgraded, refused, disabled, error)",
+		},
+		[]string{"protocol", "result"},
+	)
+
+	tunnelBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "edge_tunnel_bytes_total",
+			Help: "Bytes relayed through upgraded connections, by direction (upstream, downstream)",
+		},
+		[]string{"direction"},
+	)
+)
+
+// isUpgradeRequest reports whether r asks to switch protocols, as WebSocket
+// handshakes do
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeProtocol is the metrics label for an upgrade request, limited to
+// known protocols so clients cannot create arbitrary series
+func upgradeProtocol(r *http.Request) string {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return "websocket"
+	}
+	return "other"
+}
+
+// tunnelAndServe forwards an upgrade request to the origin on a dedicated
+// connection. If the origin switches protocols, the client connection is
+// hijacked and bytes are relayed both ways until either side closes or the
+// tunnel is idle for the domain's timeout. Any other origin response is
+// relayed as is and never cached.
+func (p *ProxyService) tunnelAndServe(w http.ResponseWriter, r *http.Request, domain DomainConfig) {
+	protocol := upgradeProtocol(r)
+
+	if !domain.AllowUpgrades {
+		tunnelsTotal.WithLabelValues(protocol, "disabled").Inc()
+		http.Error(w, "Upgrade not enabled for this domain", http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		tunnelsTotal.WithLabelValues(protocol, "error").Inc()
+		http.Error(w, "Upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// The tunnel counts as an active connection to the origin for as long
+	// as it stays open
+	lease := p.selectOrigin(r, domain, nil)
+	defer lease.release()
+
+	origin, err := url.Parse(lease.url)
+	if err != nil {
+		tunnelsTotal.WithLabelValues(protocol, "error").Inc()
+		logrus.WithError(err).WithField("origin", lease.url).Error("Invalid origin URL")
+		http.Error(w, "Invalid origin configuration", http.StatusBadGateway)
+		return
+	}
+
+	proxyReq, err := p.createProxyRequest(r, origin)
+	if err != nil {
+		tunnelsTotal.WithLabelValues(protocol, "error").Inc()
+		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
+		return
+	}
+	// Hop-by-hop headers are dropped for normal requests, but the upgrade
+	// handshake is exactly what must reach the origin
+	proxyReq.Header.Set("Connection", "Upgrade")
+	proxyReq.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	proxyReq.Host = origin.Host
+
+	// Tunnels live too long to hold a concurrency slot, but the handshake
+	// still goes through the origin's circuit breaker
+	gate := p.gates.get(originKey(origin))
+	trial, err := gate.allow()
+	if err != nil {
+		tunnelsTotal.WithLabelValues(protocol, "error").Inc()
+		p.serveShortCircuit(w, r, nil, err)
+		return
+	}
+
+	dialStart := time.Now()
+	originConn, err := p.dialOrigin(r, origin)
+	if err != nil {
+		gate.record(r.Context(), trial, 0, err, time.Since(dialStart))
+		tunnelsTotal.WithLabelValues(protocol, "error").Inc()
+		logrus.WithError(err).WithField("origin", lease.url).Error("Failed to connect to origin for upgrade")
+		http.Error(w, "Origin server error", http.StatusBadGateway)
+		return
+	}
+
+	// Bound the handshake like any other origin response
+	originConn.SetDeadline(time.Now().Add(p.handshakeTimeout()))
+	originReader := bufio.NewReader(originConn)
+	resp, err := p.originHandshake(originConn, originReader, proxyReq)
+	if err != nil {
+		gate.record(r.Context(), trial, 0, err, time.Since(dialStart))
+		originConn.Close()
+		tunnelsTotal.WithLabelValues(protocol, "error").Inc()
+		logrus.WithError(err).WithField("origin", lease.url).Error("Upgrade handshake with origin failed")
+		http.Error(w, "Origin server error", http.StatusBadGateway)
+		return
+	}
+	originConn.SetDeadline(time.Time{})
+	gate.record(r.Context(), trial, resp.StatusCode, nil, time.Since(dialStart))
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// The origin declined; pass its answer on
+		defer originConn.Close()
+		defer resp.Body.Close()
+		tunnelsTotal.WithLabelValues(protocol, "refused").Inc()
+		p.copyResponseHeaders(resp, w)
+		w.Header().Set("X-Cache-Status", "BYPASS")
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		originConn.Close()
+		tunnelsTotal.WithLabelValues(protocol, "error").Inc()
+		logrus.WithError(err).Error("Failed to hijack client connection")
+		return
+	}
+
+	// Relay the origin's 101 with its handshake headers, such as
+	// Sec-WebSocket-Accept, before switching to raw bytes
+	fmt.Fprintf(clientBuf, "HTTP/1.1 101 %s\r\n", http.StatusText(http.StatusSwitchingProtocols))
+	resp.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	if err := clientBuf.Flush(); err != nil {
+		clientConn.Close()
+		originConn.Close()
+		tunnelsTotal.WithLabelValues(protocol, "error").Inc()
+		return
+	}
+
+	tunnelsTotal.WithLabelValues(protocol, "upgraded").Inc()
+	tunnelsActive.WithLabelValues(protocol).Inc()
+	defer tunnelsActive.WithLabelValues(protocol).Dec()
+
+	idleTimeout := domain.UpgradeIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = p.tunnelIdleTimeout
+	}
+
+	start := time.Now()
+	up, down := relayTunnel(clientConn, clientBuf.Reader, originConn, originReader, idleTimeout)
+
+	logrus.WithFields(logrus.Fields{
+		"host":       r.Host,
+		"path":       r.URL.Path,
+		"protocol":   protocol,
+		"duration":   time.Since(start),
+		"upstream":   up,
+		"downstream": down,
+	}).Debug("Upgraded connection closed")
+}
+
+// dialOrigin opens a connection to the origin for an upgrade request,
+// negotiating TLS for https origins
+func (p *ProxyService) dialOrigin(r *http.Request, origin *url.URL) (net.Conn, error) {
+	host := origin.Host
+	if origin.Port() == "" {
+		if origin.Scheme == "https" {
+			host = net.JoinHostPort(origin.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(origin.Hostname(), "80")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: p.connectTimeout, KeepAlive: 30 * time.Second}
+	if origin.Scheme != "https" {
+		return dialer.DialContext(r.Context(), "tcp", host)
+	}
+
+	tlsDialer := &tls.Dialer{
+		NetDialer: dialer,
+		// The tunnel carries HTTP/1.1 framing, so never negotiate h2
+		Config: &tls.Config{ServerName: origin.Hostname(), NextProtos: []string{"http/1.1"}},
+	}
+	return tlsDialer.DialContext(r.Context(), "tcp", host)
+}
+
+// originHandshake sends the upgrade request and reads the origin's response
+func (p *ProxyService) originHandshake(conn net.Conn, reader *bufio.Reader, req *http.Request) (*http.Response, error) {
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to send upgrade request: %w", err)
+	}
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upgrade response: %w", err)
+	}
+	return resp, nil
+}
+
+// handshakeTimeout bounds the wait for the origin's upgrade response
+func (p *ProxyService) handshakeTimeout() time.Duration {
+	if p.responseTimeout > 0 {
+		return p.responseTimeout
+	}
+	return 30 * time.Second
+}
+
+// relayTunnel copies bytes between the client and origin until either side
+// closes or neither sends anything for idleTimeout, then closes both. The
+// readers carry any bytes already buffered from each connection. It returns
+// the bytes sent upstream and downstream.
+func relayTunnel(client net.Conn, clientReader io.Reader, origin net.Conn, originReader io.Reader, idleTimeout time.Duration) (int64, int64) {
+	activity := &tunnelActivity{conns: []net.Conn{client, origin}, timeout: idleTimeout}
+	activity.touch()
+
+	var up, down int64
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			client.Close()
+			origin.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		up, _ = io.Copy(origin, &activityReader{reader: clientReader, activity: activity})
+		tunnelBytes.WithLabelValues("upstream").Add(float64(up))
+	}()
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		down, _ = io.Copy(client, &activityReader{reader: originReader, activity: activity})
+		tunnelBytes.WithLabelValues("downstream").Add(float64(down))
+	}()
+	wg.Wait()
+
+	return up, down
+}
+
+// tunnelActivity pushes back the read deadlines of both ends of a tunnel
+// whenever either end sends data, so a tunnel only times out when it is idle
+// in both directions
+type tunnelActivity struct {
+	conns   []net.Conn
+	timeout time.Duration
+}
+
+func (a *tunnelActivity) touch() {
+	deadline := time.Now().Add(a.timeout)
+	for _, conn := range a.conns {
+		conn.SetReadDeadline(deadline)
+	}
+}
+
+type activityReader struct {
+	reader   io.Reader
+	activity *tunnelActivity
+}
+
+func (r *activityReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		r.activity.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// ACMEChallengePath is where ACME CAs fetch HTTP-01 challenge responses
+const ACMEChallengePath = "/.well-known/acme-challenge/"
+
+// GetACMEChallenge returns the key authorization for an HTTP-01 challenge
+// token of a certificate the control plane is ordering, or ErrNotFound if
+// the token is not one of its challenges
+func (c *ControlPlaneClient) GetACMEChallenge(ctx context.Context, token string) (string, error) {
+	endpoint := fmt.Sprintf("%s/api/v1/acme/http-01/%s", c.baseURL, url.PathEscape(token))
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		recordError(ctx, "acme_challenge", "transport")
+		return "", fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		recordError(ctx, "acme_challenge", "not_found")
+		return "", fmt.Errorf("request failed with status %d: %w", resp.StatusCode, ErrNotFound)
+	}
+	if resp.StatusCode >= 400 {
+		recordError(ctx, "acme_challenge", "status")
+		return "", fmt.Errorf("request failed with status %d", resp.StatusCode)
+	}
+
+	// Key authorizations are a token and a key thumbprint
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("failed to read challenge response: %w", err)
+	}
+	return string(body), nil
+}
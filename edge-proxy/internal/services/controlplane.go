@@ -4,19 +4,40 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
 )
 
+// ErrNotFound is returned when the control plane has no such resource
+var ErrNotFound = errors.New("not found")
+
+var controlPlaneErrors = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "edge_control_plane_errors_total",
+		Help: "Failed control plane calls, by operation and reason (transport, not_found, status, decode)",
+	},
+	[]string{"operation", "reason"},
+)
+
 type ControlPlaneClient struct {
 	baseURL    string
 	httpClient *http.Client
-	edgeID     uuid.UUID
-	region     string
+	// streamClient has no overall timeout, for the long-lived event stream
+	streamClient *http.Client
+	edgeID       uuid.UUID
+	// registrationSecret is the operator's secret edges register with, and
+	// edgeToken the token registration issues, which authenticates the edge
+	// on routes only it may call
+	registrationSecret string
+	edgeToken          string
+	region             string
 }
 
 type EdgeRegistrationRequest struct {
@@ -24,6 +45,7 @@ type EdgeRegistrationRequest struct {
 	IPAddress string `json:"ip_address"`
 	Hostname  string `json:"hostname"`
 	Capacity  int    `json:"capacity"`
+	Port      int    `json:"port"`
 }
 
 type EdgeRegistrationResponse struct {
@@ -35,6 +57,7 @@ type EdgeRegistrationResponse struct {
 	Status    string    `json:"status"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	Token     string    `json:"token"`
 }
 
 type HeartbeatRequest struct {
@@ -42,50 +65,148 @@ type HeartbeatRequest struct {
 	Metrics map[string]interface{} `json:"metrics"`
 }
 
+// OriginHealthReport carries an edge's latest health check result for each
+// pool origin it routes to
+type OriginHealthReport struct {
+	Origins []OriginHealthCheck `json:"origins"`
+}
+
+type OriginHealthCheck struct {
+	OriginID          uuid.UUID `json:"origin_id"`
+	Healthy           bool      `json:"healthy"`
+	LatencyMs         int64     `json:"latency_ms"`
+	Error             string    `json:"error,omitempty"`
+	ActiveConnections int64     `json:"active_connections"`
+	CheckedAt         time.Time `json:"checked_at"`
+}
+
 type DomainResponse struct {
-	ID        uuid.UUID `json:"id"`
-	Domain    string    `json:"domain"`
-	OriginURL string    `json:"origin_url"`
-	CacheTTL  int       `json:"cache_ttl"`
-	RateLimit int       `json:"rate_limit"`
-	Status    string    `json:"status"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        uuid.UUID      `json:"id"`
+	Domain    string         `json:"domain"`
+	OriginURL string         `json:"origin_url"`
+	CacheTTL  int            `json:"cache_ttl"`
+	RateLimit int            `json:"rate_limit"`
+	Status    string         `json:"status"`
+	Settings  DomainSettings `json:"settings"`
+	// CachePolicies are the domain's cache rules in evaluation order
+	CachePolicies []CachePolicy `json:"cache_policies"`
+	// Origins is the domain's origin pool; when empty OriginURL is used
+	Origins []DomainOrigin `json:"origins"`
+	// Certificate is served to TLS clients asking for the domain, if set
+	Certificate *DomainCertificate `json:"certificate,omitempty"`
+	// Shield lists the edges cache misses are fetched through, if set
+	Shield    *DomainShield `json:"shield,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// DomainShield mirrors the healthy edges of a domain's shield region
+type DomainShield struct {
+	Region string       `json:"region"`
+	Edges  []ShieldEdge `json:"edges"`
+}
+
+// ShieldEdge is an edge in the shield region
+type ShieldEdge struct {
+	ID      uuid.UUID `json:"id"`
+	Address string    `json:"address"` // host:port of its HTTP listener
+}
+
+// DomainCertificate mirrors the TLS certificate the control plane stores for
+// a domain. KeyPEM is only set by GetDomainCertificate, never in the domain
+// configuration.
+type DomainCertificate struct {
+	CertPEM   string    `json:"cert_pem"`
+	KeyPEM    string    `json:"key_pem"`
+	NotAfter  time.Time `json:"not_after"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// DomainSettings mirrors the per-domain edge settings managed by the control plane
+type DomainSettings struct {
+	CoalesceRequests      bool `json:"coalesce_requests"`
+	CoalesceTimeoutMs     int  `json:"coalesce_timeout_ms"`
+	StaleWhileRevalidate  int  `json:"stale_while_revalidate"` // seconds
+	StaleIfError          int  `json:"stale_if_error"`         // seconds
+	AllowUpgrades         bool `json:"allow_upgrades"`
+	UpgradeIdleTimeout    int  `json:"upgrade_idle_timeout"` // seconds
+	HTTPSRedirect         bool `json:"https_redirect"`
+	HSTSMaxAge            int  `json:"hsts_max_age"` // seconds, 0 disables HSTS
+	HSTSIncludeSubdomains bool `json:"hsts_include_subdomains"`
+	HSTSPreload           bool `json:"hsts_preload"`
+
+	Compression        bool     `json:"compression"`
+	CompressionTypes   []string `json:"compression_types"`    // empty uses the edge's defaults
+	CompressionMinSize int      `json:"compression_min_size"` // bytes, 0 uses the edge's default
+
+	LoadBalancing   string `json:"load_balancing"` // round_robin, least_connections, consistent_hash
+	HealthCheckPath string `json:"health_check_path"`
+
+	ShieldRegion string `json:"shield_region"` // region whose edges cache misses are fetched through
+}
+
+// DomainOrigin mirrors an origin of a domain's pool managed by the control plane
+type DomainOrigin struct {
+	ID       uuid.UUID `json:"id"`
+	URL      string    `json:"url"`
+	Weight   int       `json:"weight"`
+	Priority int       `json:"priority"` // lower is preferred
+	Enabled  bool      `json:"enabled"`
+}
+
+// CachePolicy mirrors a per-domain cache rule managed by the control plane
+type CachePolicy struct {
+	ID               uuid.UUID `json:"id"`
+	Priority         int       `json:"priority"`
+	MatchType        string    `json:"match_type"` // glob, regex
+	PathPattern      string    `json:"path_pattern"`
+	CacheTTL         int       `json:"cache_ttl"` // seconds, 0 keeps the origin's TTL
+	CacheKeyTemplate string    `json:"cache_key_template"`
+	HeadersToVary    []string  `json:"headers_to_vary"`
+	Bypass           bool      `json:"bypass"`
+}
+
 type PurgeRequest struct {
 	ID          uuid.UUID `json:"id"`
 	DomainID    uuid.UUID `json:"domain_id"`
 	Paths       []string  `json:"paths"`
+	Tags        []string  `json:"tags"`
 	Status      string    `json:"status"`
 	RequestedBy string    `json:"requested_by"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
-func NewControlPlaneClient(baseURL, region string) *ControlPlaneClient {
+func NewControlPlaneClient(baseURL, region, registrationSecret string) *ControlPlaneClient {
 	return &ControlPlaneClient{
 		baseURL: baseURL,
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
-		region: region,
+		streamClient:       &http.Client{},
+		registrationSecret: registrationSecret,
+		region:             region,
 	}
 }
 
-func (c *ControlPlaneClient) RegisterEdge(ctx context.Context, ipAddress, hostname string, capacity int) (*EdgeRegistrationResponse, error) {
+// RegisterEdge announces the edge to the control plane, authenticated with
+// the registration secret. port is the HTTP port other edges fetch through
+// when this edge is in a domain's shield region.
+func (c *ControlPlaneClient) RegisterEdge(ctx context.Context, ipAddress, hostname string, port, capacity int) (*EdgeRegistrationResponse, error) {
 	req := EdgeRegistrationRequest{
 		Region:    c.region,
 		IPAddress: ipAddress,
 		Hostname:  hostname,
 		Capacity:  capacity,
+		Port:      port,
 	}
 
 	var resp EdgeRegistrationResponse
-	if err := c.makeRequest(ctx, "POST", "/api/v1/edges", req, &resp); err != nil {
+	if err := c.doRequest(ctx, "register_edge", "POST", "/api/v1/edges", c.registrationSecret, req, &resp); err != nil {
 		return nil, fmt.Errorf("failed to register edge: %w", err)
 	}
 
 	c.edgeID = resp.ID
+	c.edgeToken = resp.Token
 	logrus.WithFields(logrus.Fields{
 		"edge_id":  resp.ID,
 		"region":   resp.Region,
@@ -106,14 +227,24 @@ func (c *ControlPlaneClient) SendHeartbeat(ctx context.Context, status string, m
 	}
 
 	endpoint := fmt.Sprintf("/api/v1/edges/%s/heartbeat", c.edgeID)
-	return c.makeRequest(ctx, "POST", endpoint, req, nil)
+	return c.makeRequest(ctx, "heartbeat", "POST", endpoint, req, nil)
+}
+
+// ReportOriginHealth sends the edge's latest origin health check results
+func (c *ControlPlaneClient) ReportOriginHealth(ctx context.Context, checks []OriginHealthCheck) error {
+	if c.edgeID == uuid.Nil {
+		return fmt.Errorf("edge not registered")
+	}
+
+	endpoint := fmt.Sprintf("/api/v1/edges/%s/origin-health", c.edgeID)
+	return c.makeAuthenticatedRequest(ctx, "origin_health", "POST", endpoint, OriginHealthReport{Origins: checks}, nil)
 }
 
 func (c *ControlPlaneClient) GetDomain(ctx context.Context, domain string) (*DomainResponse, error) {
 	var resp DomainResponse
 	endpoint := fmt.Sprintf("/v1/domains/%s", domain)
 
-	if err := c.makeRequest(ctx, "GET", endpoint, nil, &resp); err != nil {
+	if err := c.makeRequest(ctx, "get_domain", "GET", endpoint, nil, &resp); err != nil {
 		return nil, fmt.Errorf("failed to get domain info: %w", err)
 	}
 
@@ -124,13 +255,30 @@ func (c *ControlPlaneClient) GetDomainByID(ctx context.Context, domainID uuid.UU
 	var resp DomainResponse
 	endpoint := fmt.Sprintf("/v1/domains/id/%s", domainID)
 
-	if err := c.makeRequest(ctx, "GET", endpoint, nil, &resp); err != nil {
+	if err := c.makeRequest(ctx, "get_domain", "GET", endpoint, nil, &resp); err != nil {
 		return nil, fmt.Errorf("failed to get domain info by ID: %w", err)
 	}
 
 	return &resp, nil
 }
 
+// GetDomainCertificate fetches a domain's certificate with its private key,
+// authenticating with the token the edge was issued at registration
+func (c *ControlPlaneClient) GetDomainCertificate(ctx context.Context, domain string) (*DomainCertificate, error) {
+	if c.edgeID == uuid.Nil {
+		return nil, fmt.Errorf("edge not registered")
+	}
+
+	var resp DomainCertificate
+	endpoint := fmt.Sprintf("/api/v1/edges/%s/certificates/%s", c.edgeID, domain)
+
+	if err := c.makeAuthenticatedRequest(ctx, "domain_certificate", "GET", endpoint, nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to get domain certificate: %w", err)
+	}
+
+	return &resp, nil
+}
+
 func (c *ControlPlaneClient) GetPendingPurges(ctx context.Context) ([]PurgeRequest, error) {
 	if c.edgeID == uuid.Nil {
 		return nil, fmt.Errorf("edge not registered")
@@ -142,7 +290,7 @@ func (c *ControlPlaneClient) GetPendingPurges(ctx context.Context) ([]PurgeReque
 	}
 	endpoint := fmt.Sprintf("/api/v1/edges/%s/purges", c.edgeID)
 
-	if err := c.makeRequest(ctx, "GET", endpoint, nil, &response); err != nil {
+	if err := c.makeAuthenticatedRequest(ctx, "pending_purges", "GET", endpoint, nil, &response); err != nil {
 		return nil, fmt.Errorf("failed to get pending purges: %w", err)
 	}
 
@@ -155,10 +303,21 @@ func (c *ControlPlaneClient) CompletePurge(ctx context.Context, purgeID uuid.UUI
 	}
 
 	endpoint := fmt.Sprintf("/api/v1/edges/%s/purges/%s/complete", c.edgeID, purgeID)
-	return c.makeRequest(ctx, "POST", endpoint, nil, nil)
+	return c.makeAuthenticatedRequest(ctx, "complete_purge", "POST", endpoint, nil, nil)
+}
+
+// makeRequest calls the control plane, counting failures under operation
+func (c *ControlPlaneClient) makeRequest(ctx context.Context, operation, method, endpoint string, reqBody interface{}, respBody interface{}) error {
+	return c.doRequest(ctx, operation, method, endpoint, "", reqBody, respBody)
+}
+
+// makeAuthenticatedRequest is makeRequest with the edge's token, for routes
+// only the edge itself may call
+func (c *ControlPlaneClient) makeAuthenticatedRequest(ctx context.Context, operation, method, endpoint string, reqBody interface{}, respBody interface{}) error {
+	return c.doRequest(ctx, operation, method, endpoint, c.edgeToken, reqBody, respBody)
 }
 
-func (c *ControlPlaneClient) makeRequest(ctx context.Context, method, endpoint string, reqBody interface{}, respBody interface{}) error {
+func (c *ControlPlaneClient) doRequest(ctx context.Context, operation, method, endpoint, token string, reqBody interface{}, respBody interface{}) error {
 	url := c.baseURL + endpoint
 
 	var body bytes.Buffer
@@ -176,19 +335,29 @@ func (c *ControlPlaneClient) makeRequest(ctx context.Context, method, endpoint s
 	if reqBody != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
+		recordError(ctx, operation, "transport")
 		return fmt.Errorf("failed to make request: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		recordError(ctx, operation, "not_found")
+		return fmt.Errorf("request failed with status %d: %w", resp.StatusCode, ErrNotFound)
+	}
 	if resp.StatusCode >= 400 {
+		recordError(ctx, operation, "status")
 		return fmt.Errorf("request failed with status %d", resp.StatusCode)
 	}
 
 	if respBody != nil {
 		if err := json.NewDecoder(resp.Body).Decode(respBody); err != nil {
+			recordError(ctx, operation, "decode")
 			return fmt.Errorf("failed to decode response: %w", err)
 		}
 	}
@@ -196,6 +365,15 @@ func (c *ControlPlaneClient) makeRequest(ctx context.Context, method, endpoint s
 	return nil
 }
 
+// recordError counts a failed control plane call, unless the caller gave up
+// on it
+func recordError(ctx context.Context, operation, reason string) {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	controlPlaneErrors.WithLabelValues(operation, reason).Inc()
+}
+
 func (c *ControlPlaneClient) GetEdgeID() uuid.UUID {
 	return c.edgeID
 }
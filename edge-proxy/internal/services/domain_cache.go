@@ -0,0 +1,282 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	domainConfigLookups = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "edge_domain_config_lookups_total",
+			Help: "Domain configuration lookups by result (hit, negative_hit, stale, miss, not_found, error)",
+		},
+		[]string{"result"},
+	)
+
+	domainConfigStaleness = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "edge_domain_config_staleness_seconds",
+			Help:    "How long past its TTL a domain configuration was when served stale",
+			Buckets: []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600},
+		},
+	)
+
+	domainConfigInvalidations = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "edge_domain_config_invalidations_total",
+			Help: "Domain configurations dropped because the control plane reported a change",
+		},
+	)
+)
+
+// DomainFetcher loads a domain's configuration from the control plane
+type DomainFetcher interface {
+	GetDomain(ctx context.Context, domain string) (*DomainResponse, error)
+}
+
+// DomainCacheConfig controls how long domain configurations are kept
+type DomainCacheConfig struct {
+	// TTL is how long a configuration is used before it is refreshed
+	TTL time.Duration
+	// NegativeTTL is how long an unknown host is remembered as unknown
+	NegativeTTL time.Duration
+	// MaxStale is how long past its TTL a configuration may still be served
+	// while a refresh is in progress or the control plane is unreachable
+	MaxStale time.Duration
+	// FetchTimeout bounds each control plane lookup. Defaults to 5s.
+	FetchTimeout time.Duration
+}
+
+// DomainCache keeps domain configurations in the edge so proxied requests do
+// not wait on the control plane. Expired configurations are served while
+// they are refreshed in the background; only hosts the edge has never seen
+// (or has not seen for longer than MaxStale) block on a lookup.
+type DomainCache struct {
+	fetcher  DomainFetcher
+	config   DomainCacheConfig
+	mu       sync.Mutex
+	entries  map[string]*domainCacheEntry
+	inflight map[string]*domainFetch
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// domainCacheEntry is a cached configuration, or an unknown host when domain
+// is nil
+type domainCacheEntry struct {
+	domain    *DomainResponse
+	expiresAt time.Time
+}
+
+// domainFetch is a control plane lookup shared by every request for a host
+type domainFetch struct {
+	done   chan struct{}
+	domain *DomainResponse
+	err    error
+}
+
+// NewDomainCache creates a domain configuration cache in front of fetcher
+func NewDomainCache(fetcher DomainFetcher, config DomainCacheConfig) *DomainCache {
+	if config.FetchTimeout <= 0 {
+		config.FetchTimeout = 5 * time.Second
+	}
+
+	c := &DomainCache{
+		fetcher:  fetcher,
+		config:   config,
+		entries:  make(map[string]*domainCacheEntry),
+		inflight: make(map[string]*domainFetch),
+		stop:     make(chan struct{}),
+	}
+	go c.expireLoop()
+	return c
+}
+
+// Get returns the configuration for a domain. It returns an error wrapping
+// ErrNotFound when the control plane does not know the domain.
+func (c *DomainCache) Get(ctx context.Context, domain string) (*DomainResponse, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	entry := c.entries[domain]
+	if entry != nil && now.Before(entry.expiresAt) {
+		c.mu.Unlock()
+		if entry.domain == nil {
+			domainConfigLookups.WithLabelValues("negative_hit").Inc()
+			return nil, ErrNotFound
+		}
+		domainConfigLookups.WithLabelValues("hit").Inc()
+		return entry.domain, nil
+	}
+
+	fetch := c.inflight[domain]
+	if fetch == nil {
+		fetch = &domainFetch{done: make(chan struct{})}
+		c.inflight[domain] = fetch
+		go c.fetch(domain, fetch)
+	}
+	c.mu.Unlock()
+
+	// Serve a recently expired configuration while the refresh runs
+	if entry != nil && entry.domain != nil {
+		if staleness := now.Sub(entry.expiresAt); staleness < c.config.MaxStale {
+			domainConfigLookups.WithLabelValues("stale").Inc()
+			domainConfigStaleness.Observe(staleness.Seconds())
+			return entry.domain, nil
+		}
+	}
+
+	select {
+	case <-fetch.done:
+	case <-ctx.Done():
+		domainConfigLookups.WithLabelValues("error").Inc()
+		return nil, ctx.Err()
+	}
+
+	switch {
+	case fetch.err == nil:
+		domainConfigLookups.WithLabelValues("miss").Inc()
+		return fetch.domain, nil
+	case errors.Is(fetch.err, ErrNotFound):
+		domainConfigLookups.WithLabelValues("not_found").Inc()
+	default:
+		domainConfigLookups.WithLabelValues("error").Inc()
+	}
+	return nil, fetch.err
+}
+
+// Invalidate drops a domain's configuration so the next request fetches it
+// again. A lookup already in flight is not stored.
+func (c *DomainCache) Invalidate(domain string) {
+	c.mu.Lock()
+	delete(c.entries, domain)
+	delete(c.inflight, domain)
+	c.mu.Unlock()
+
+	domainConfigInvalidations.Inc()
+	logrus.WithField("domain", domain).Debug("Domain configuration invalidated")
+}
+
+// InvalidateAll drops every cached configuration
+func (c *DomainCache) InvalidateAll() {
+	c.mu.Lock()
+	c.entries = make(map[string]*domainCacheEntry)
+	c.inflight = make(map[string]*domainFetch)
+	c.mu.Unlock()
+
+	domainConfigInvalidations.Inc()
+}
+
+// Len returns the number of cached domains, including unknown hosts
+func (c *DomainCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Close stops the background expiry sweep
+func (c *DomainCache) Close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// fetch looks a domain up on the control plane and stores the result unless
+// the domain was invalidated meanwhile. Failures other than "not found" keep
+// the existing entry so it can still be served stale.
+func (c *DomainCache) fetch(domain string, fetch *domainFetch) {
+	defer close(fetch.done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.FetchTimeout)
+	defer cancel()
+
+	fetch.domain, fetch.err = c.fetcher.GetDomain(ctx, domain)
+	if fetch.err != nil && !errors.Is(fetch.err, ErrNotFound) {
+		logrus.WithError(fetch.err).WithField("domain", domain).Warn("Failed to refresh domain configuration")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inflight[domain] != fetch {
+		return
+	}
+	delete(c.inflight, domain)
+
+	now := time.Now()
+	switch {
+	case fetch.err == nil:
+		c.entries[domain] = &domainCacheEntry{domain: fetch.domain, expiresAt: now.Add(c.config.TTL)}
+	case errors.Is(fetch.err, ErrNotFound):
+		c.entries[domain] = &domainCacheEntry{expiresAt: now.Add(c.config.NegativeTTL)}
+	}
+}
+
+// expireLoop drops entries that can no longer be served, so lookups for
+// many unknown hosts do not grow the cache without bound
+func (c *DomainCache) expireLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			for domain, entry := range c.entries {
+				if now.Sub(entry.expiresAt) > c.config.MaxStale {
+					delete(c.entries, domain)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// DomainChangesChannel is the Redis channel the control plane publishes the
+// name of each changed domain on
+const DomainChangesChannel = "domain-config-changes"
+
+// WatchDomainChanges subscribes to the control plane's domain change
+// notifications and invalidates the affected configurations until ctx is
+// done. Every (re)subscription drops the whole cache, since changes made
+// while disconnected were missed.
+func (c *DomainCache) WatchDomainChanges(ctx context.Context, redisURL string) error {
+	opt, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse Redis URL: %w", err)
+	}
+
+	client := redis.NewClient(opt)
+	pubsub := client.Subscribe(ctx, DomainChangesChannel)
+
+	go func() {
+		<-ctx.Done()
+		pubsub.Close()
+		client.Close()
+	}()
+
+	go func() {
+		for msg := range pubsub.ChannelWithSubscriptions() {
+			switch m := msg.(type) {
+			case *redis.Subscription:
+				if m.Kind == "subscribe" {
+					c.InvalidateAll()
+					logrus.WithField("channel", m.Channel).Info("Subscribed to domain configuration changes")
+				}
+			case *redis.Message:
+				c.Invalidate(m.Payload)
+			}
+		}
+	}()
+
+	return nil
+}
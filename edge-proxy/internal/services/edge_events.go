@@ -0,0 +1,117 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Edge event types pushed by the control plane
+const (
+	EdgeEventPurge         = "purge"
+	EdgeEventDomainChanged = "domain_changed"
+)
+
+// eventStreamIdleTimeout is how long the event stream may go without data,
+// keepalives included, before it is considered dead. The control plane sends
+// a keepalive every 15 seconds.
+const eventStreamIdleTimeout = 45 * time.Second
+
+// EdgeEvent is a purge or domain change pushed by the control plane
+type EdgeEvent struct {
+	Type   string        `json:"type"`
+	Purge  *PurgeRequest `json:"purge,omitempty"`
+	Domain string        `json:"domain,omitempty"`
+}
+
+// StreamEvents connects to the control plane's event stream for this edge and
+// passes each event to handle until the stream ends, ctx is done or the
+// stream is idle for too long. connected is called once the stream is open.
+// Purges delivered this way must still be completed to acknowledge them;
+// those left pending are delivered again on the next connection.
+func (c *ControlPlaneClient) StreamEvents(ctx context.Context, connected func(), handle func(EdgeEvent)) error {
+	if c.edgeID == uuid.Nil {
+		return fmt.Errorf("edge not registered")
+	}
+
+	// Cancelled when the stream goes idle
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/api/v1/edges/%s/events", c.baseURL, c.edgeID)
+	req, err := http.NewRequestWithContext(streamCtx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Authorization", "Bearer "+c.edgeToken)
+
+	resp, err := c.streamClient.Do(req)
+	if err != nil {
+		recordError(ctx, "event_stream", "transport")
+		return fmt.Errorf("failed to open event stream: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		recordError(ctx, "event_stream", "status")
+		return fmt.Errorf("event stream failed with status %d", resp.StatusCode)
+	}
+
+	idle := time.AfterFunc(eventStreamIdleTimeout, cancel)
+	defer idle.Stop()
+
+	connected()
+
+	var eventType string
+	var data strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		idle.Reset(eventStreamIdleTimeout)
+
+		line := scanner.Text()
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch {
+		case line == "":
+			if data.Len() > 0 {
+				var event EdgeEvent
+				if err := json.Unmarshal([]byte(data.String()), &event); err != nil {
+					logrus.WithError(err).WithField("event", eventType).Warn("Dropping malformed control plane event")
+				} else {
+					handle(event)
+				}
+			}
+			eventType = ""
+			data.Reset()
+		case field == "":
+			// Comment, used for keepalives
+		case field == "event":
+			eventType = value
+		case field == "data":
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+		}
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case streamCtx.Err() != nil:
+		return fmt.Errorf("event stream idle for %s", eventStreamIdleTimeout)
+	case scanner.Err() != nil:
+		return fmt.Errorf("event stream failed: %w", scanner.Err())
+	}
+	return fmt.Errorf("event stream closed")
+}
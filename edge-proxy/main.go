@@ -2,23 +2,32 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/naijcloud/edge-proxy/internal/cache"
+	"github.com/naijcloud/edge-proxy/internal/certs"
 	"github.com/naijcloud/edge-proxy/internal/config"
 	"github.com/naijcloud/edge-proxy/internal/middleware"
 	"github.com/naijcloud/edge-proxy/internal/proxy"
 	"github.com/naijcloud/edge-proxy/internal/services"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func main() {
@@ -40,49 +49,87 @@ func main() {
 	logrus.WithField("config", cfg).Info("Starting edge proxy")
 
 	// Initialize cache
-	var cacheImpl cache.Cache
-	if cfg.RedisURL != "" {
-		redisCache, err := cache.NewRedisCache(cfg.RedisURL, "edge-cache:", time.Duration(cfg.DefaultTTL)*time.Second)
-		if err != nil {
-			logrus.WithError(err).Warn("Failed to initialize Redis cache, falling back to memory cache")
-			cacheImpl = cache.NewMemoryCache(parseSize(cfg.CacheSize))
-		} else {
-			cacheImpl = redisCache
-			logrus.Info("Initialized Redis cache")
-		}
-	} else {
-		cacheImpl = cache.NewMemoryCache(parseSize(cfg.CacheSize))
-		logrus.Info("Initialized memory cache")
-	}
+	cacheImpl := initCache(cfg)
+	cache.RegisterMetrics(cacheImpl)
 
 	// Initialize proxy service
 	proxyConfig := proxy.ProxyConfig{
-		DefaultTTL:       time.Duration(cfg.DefaultTTL) * time.Second,
-		MaxBodySize:      10 * 1024 * 1024, // 10MB
-		ConnectTimeout:   10 * time.Second,
-		ResponseTimeout:  30 * time.Second,
-		IdleConnTimeout:  90 * time.Second,
-		MaxIdleConns:     100,
-		MaxIdleConnsHost: 10,
+		DefaultTTL:        time.Duration(cfg.DefaultTTL) * time.Second,
+		MinTTL:            time.Duration(cfg.MinCacheAge) * time.Second,
+		MaxTTL:            time.Duration(cfg.MaxCacheAge) * time.Second,
+		MaxBodySize:       10 * 1024 * 1024, // largest body kept in cache
+		ConnectTimeout:    10 * time.Second,
+		ResponseTimeout:   30 * time.Second,
+		IdleConnTimeout:   90 * time.Second,
+		MaxIdleConns:      100,
+		MaxIdleConnsHost:  10,
+		CoalesceTimeout:   5 * time.Second,
+		SliceSize:         1024 * 1024,
+		TunnelIdleTimeout: time.Duration(cfg.TunnelIdleTimeout) * time.Second,
+		OriginHTTP2:       cfg.OriginHTTP2,
+
+		HealthCheckInterval: time.Duration(cfg.HealthCheckInterval) * time.Second,
+		HealthCheckTimeout:  time.Duration(cfg.HealthCheckTimeout) * time.Second,
+
+		CircuitBreaker:      cfg.CircuitBreakerEnabled,
+		BreakerWindow:       time.Duration(cfg.CircuitBreakerWindow) * time.Second,
+		BreakerMinRequests:  cfg.CircuitBreakerMinRequests,
+		BreakerThreshold:    cfg.CircuitBreakerThreshold,
+		BreakerSlowCall:     time.Duration(cfg.CircuitBreakerSlowCall) * time.Second,
+		BreakerOpenDuration: time.Duration(cfg.CircuitBreakerOpenDuration) * time.Second,
+		OriginMaxConcurrent: cfg.OriginMaxConcurrent,
+		OriginMaxQueue:      cfg.OriginMaxQueue,
+		OriginQueueTimeout:  time.Duration(cfg.OriginQueueTimeout) * time.Second,
+
+		OriginRetries: cfg.OriginRetries,
+		RetryBackoff:  time.Duration(cfg.OriginRetryBackoffMs) * time.Millisecond,
+		RetryStatuses: cfg.OriginRetryStatuses,
+	}
+	if cfg.TLSEnabled {
+		proxyConfig.HTTPSPort = cfg.TLSPort
 	}
+	proxyConfig.Region = cfg.Region
+	proxyConfig.ShieldSecret = cfg.ShieldSecret
 	proxyService := proxy.NewProxyService(cacheImpl, proxyConfig)
 
 	// Initialize control plane client
-	controlPlane := services.NewControlPlaneClient(cfg.ControlPlaneURL, cfg.Region)
+	controlPlane := services.NewControlPlaneClient(cfg.ControlPlaneURL, cfg.Region, cfg.EdgeRegistrationSecret)
+
+	// Cache domain configurations locally so requests do not wait on the
+	// control plane, dropping them as the control plane announces changes
+	domainCache := services.NewDomainCache(controlPlane, services.DomainCacheConfig{
+		TTL:          time.Duration(cfg.DomainCacheTTL) * time.Second,
+		NegativeTTL:  time.Duration(cfg.DomainNegativeTTL) * time.Second,
+		MaxStale:     time.Duration(cfg.DomainMaxStale) * time.Second,
+		FetchTimeout: 5 * time.Second,
+	})
+	defer domainCache.Close()
+	if cfg.RedisURL != "" {
+		if err := domainCache.WatchDomainChanges(context.Background(), cfg.RedisURL); err != nil {
+			logrus.WithError(err).Warn("Domain change notifications unavailable, relying on domain cache TTL")
+		}
+	}
 
 	// Register with control plane
 	hostname, _ := os.Hostname()
 	ipAddress := getLocalIP()
-	_, err = controlPlane.RegisterEdge(context.Background(), ipAddress, hostname, 1000)
+	_, err = controlPlane.RegisterEdge(context.Background(), ipAddress, hostname, cfg.Port, 1000)
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to register with control plane")
 	}
 
 	// Start heartbeat goroutine
-	go startHeartbeat(controlPlane, cacheImpl)
+	go startHeartbeat(controlPlane, cacheImpl, domainCache, proxyService)
+
+	// Probe pool origins and share what the probes see with the control plane
+	go proxyService.RunHealthChecks(context.Background())
+	go startOriginHealthReports(controlPlane, proxyService, time.Duration(cfg.HealthCheckInterval)*time.Second)
 
-	// Start purge handler goroutine
-	go startPurgeHandler(controlPlane, proxyService)
+	// Receive purges and domain changes as the control plane pushes them,
+	// polling for purges more often while the event stream is down
+	var streaming atomic.Bool
+	go startEventStream(controlPlane, proxyService, domainCache, &streaming)
+	go startPurgeHandler(controlPlane, proxyService, &streaming)
 
 	// Initialize rate limiter
 	rateLimiter := middleware.NewRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
@@ -93,7 +140,7 @@ func main() {
 
 	// Add middleware
 	router.Use(middleware.LoggingMiddleware())
-	router.Use(middleware.MetricsMiddleware())
+	router.Use(middleware.MetricsMiddleware(cfg.MetricsMaxDomains))
 	router.Use(rateLimiter.PerDomainRateLimit())
 
 	// Health check endpoint
@@ -105,9 +152,16 @@ func main() {
 		})
 	})
 
+	// HTTP-01 challenges for the certificates the control plane orders
+	router.GET(services.ACMEChallengePath+":token", func(c *gin.Context) {
+		handleACMEChallenge(c, controlPlane, func() {
+			handleProxyRequest(c, domainCache, proxyService, rateLimiter)
+		})
+	})
+
 	// Proxy handler - catch all other requests
 	router.NoRoute(func(c *gin.Context) {
-		handleProxyRequest(c, controlPlane, proxyService)
+		handleProxyRequest(c, domainCache, proxyService, rateLimiter)
 	})
 
 	// Start metrics server
@@ -129,19 +183,47 @@ func main() {
 		}
 	}()
 
-	// Start main server
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.Port),
-		Handler: router,
-	}
+	// Start main servers: plain HTTP always, and HTTPS with certificates
+	// chosen by SNI when TLS is enabled
+	servers := []*http.Server{newServer(cfg, cfg.Port, nil, router)}
+	if cfg.TLSEnabled {
+		certStore := certs.NewStore(domainCache, controlPlane)
+		if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+			if err := certStore.LoadDefault(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+				logrus.WithError(err).Fatal("Failed to load default TLS certificate")
+			}
+			go certStore.WatchDefault(context.Background(), 30*time.Second)
+		}
 
-	// Graceful shutdown
-	go func() {
-		logrus.WithField("port", cfg.Port).Info("Starting edge proxy server")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logrus.WithError(err).Fatal("Server failed to start")
+		tlsConfig := &tls.Config{
+			GetCertificate: certStore.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
 		}
-	}()
+		servers = append(servers, newServer(cfg, cfg.TLSPort, tlsConfig, router))
+	}
+
+	for _, server := range servers {
+		go func(server *http.Server) {
+			tlsServer := server.TLSConfig != nil
+			logrus.WithFields(logrus.Fields{
+				"addr":  server.Addr,
+				"tls":   tlsServer,
+				"http2": cfg.HTTP2Enabled,
+				"h2c":   cfg.H2CEnabled && !tlsServer,
+			}).Info("Starting edge proxy server")
+
+			var err error
+			if tlsServer {
+				// Certificates come from TLSConfig.GetCertificate
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				logrus.WithError(err).Fatal("Server failed to start")
+			}
+		}(server)
+	}
 
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
@@ -154,14 +236,66 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := server.Shutdown(ctx); err != nil {
-		logrus.WithError(err).Error("Server forced to shutdown")
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logrus.WithError(err).WithField("addr", server.Addr).Error("Server forced to shutdown")
+		}
 	}
 
 	logrus.Info("Edge proxy stopped")
 }
 
-func handleProxyRequest(c *gin.Context, controlPlane *services.ControlPlaneClient, proxyService *proxy.ProxyService) {
+// newServer builds an edge server listening on port, serving TLS when
+// tlsConfig is set. TLS clients can negotiate HTTP/2 unless it is disabled;
+// with h2c enabled, cleartext clients can use HTTP/2 too, either with prior
+// knowledge or by upgrading.
+func newServer(cfg *config.Config, port int, tlsConfig *tls.Config, handler http.Handler) *http.Server {
+	h2s := &http2.Server{
+		MaxConcurrentStreams: uint32(cfg.HTTP2MaxConcurrentStreams),
+	}
+	if cfg.H2CEnabled && tlsConfig == nil {
+		handler = h2c.NewHandler(handler, h2s)
+	}
+
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+
+	if !cfg.HTTP2Enabled {
+		// A non-nil empty map keeps TLS clients on HTTP/1.1
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		return server
+	}
+	if err := http2.ConfigureServer(server, h2s); err != nil {
+		logrus.WithError(err).Warn("Failed to configure HTTP/2")
+	}
+	return server
+}
+
+// handleACMEChallenge answers an ACME HTTP-01 challenge with the key
+// authorization from the control plane. Tokens the control plane does not
+// know are passed to proxy, since origins may run their own ACME clients.
+func handleACMEChallenge(c *gin.Context, controlPlane *services.ControlPlaneClient, proxy func()) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	keyAuth, err := controlPlane.GetACMEChallenge(ctx, c.Param("token"))
+	if err != nil {
+		if errors.Is(err, services.ErrNotFound) {
+			proxy()
+			return
+		}
+		logrus.WithError(err).WithField("host", c.Request.Host).Warn("Failed to get ACME challenge from control plane")
+		c.String(http.StatusServiceUnavailable, "Challenge unavailable")
+		return
+	}
+
+	c.String(http.StatusOK, keyAuth)
+}
+
+func handleProxyRequest(c *gin.Context, domainCache *services.DomainCache, proxyService *proxy.ProxyService, rateLimiter *middleware.RateLimiter) {
 	domain := c.Request.Host
 
 	// Remove port from domain if present
@@ -169,35 +303,144 @@ func handleProxyRequest(c *gin.Context, controlPlane *services.ControlPlaneClien
 		domain = domain[:colonPos]
 	}
 
-	// Get domain configuration from control plane
+	// Get domain configuration, from the control plane on a cache miss
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
 
-	domainInfo, err := controlPlane.GetDomain(ctx, domain)
+	domainInfo, err := domainCache.Get(ctx, domain)
 	if err != nil {
 		logrus.WithError(err).WithField("domain", domain).Warn("Domain not found or control plane error")
 		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not configured"})
 		return
 	}
+	middleware.SetMetricsDomain(c, domain)
 
 	if domainInfo.Status != "active" {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Domain not active"})
 		return
 	}
 
+	// Enforce the domain's own request rate across all of its clients
+	if !rateLimiter.AllowDomain(domain, domainInfo.RateLimit) {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "Rate limit exceeded for this domain",
+			"retry_after": "1s",
+		})
+		return
+	}
+
 	// Proxy the request
-	proxyService.ServeHTTP(c.Writer, c.Request, domainInfo.OriginURL)
+	proxyService.Serve(c.Writer, c.Request, domainConfig(domainInfo))
+}
+
+// domainConfig translates the control plane's domain settings into proxy options
+func domainConfig(domainInfo *services.DomainResponse) proxy.DomainConfig {
+	return proxy.DomainConfig{
+		OriginURL:             domainInfo.OriginURL,
+		DefaultTTL:            time.Duration(domainInfo.CacheTTL) * time.Second,
+		CoalesceRequests:      domainInfo.Settings.CoalesceRequests,
+		CoalesceTimeout:       time.Duration(domainInfo.Settings.CoalesceTimeoutMs) * time.Millisecond,
+		StaleWhileRevalidate:  time.Duration(domainInfo.Settings.StaleWhileRevalidate) * time.Second,
+		StaleIfError:          time.Duration(domainInfo.Settings.StaleIfError) * time.Second,
+		CachePolicies:         cachePolicies(domainInfo),
+		AllowUpgrades:         domainInfo.Settings.AllowUpgrades,
+		UpgradeIdleTimeout:    time.Duration(domainInfo.Settings.UpgradeIdleTimeout) * time.Second,
+		HTTPSRedirect:         domainInfo.Settings.HTTPSRedirect,
+		HSTSMaxAge:            time.Duration(domainInfo.Settings.HSTSMaxAge) * time.Second,
+		HSTSIncludeSubdomains: domainInfo.Settings.HSTSIncludeSubdomains,
+		HSTSPreload:           domainInfo.Settings.HSTSPreload,
+		Compression:           domainInfo.Settings.Compression,
+		CompressionTypes:      domainInfo.Settings.CompressionTypes,
+		CompressionMinSize:    int64(domainInfo.Settings.CompressionMinSize),
+		Origins:               origins(domainInfo),
+		LoadBalancing:         domainInfo.Settings.LoadBalancing,
+		HealthCheckPath:       domainInfo.Settings.HealthCheckPath,
+		ShieldRegion:          domainInfo.Settings.ShieldRegion,
+		Shields:               shields(domainInfo),
+	}
+}
+
+// shields returns the addresses of the edges in a domain's shield region
+func shields(domainInfo *services.DomainResponse) []string {
+	if domainInfo.Shield == nil {
+		return nil
+	}
+	addresses := make([]string, 0, len(domainInfo.Shield.Edges))
+	for _, edge := range domainInfo.Shield.Edges {
+		addresses = append(addresses, edge.Address)
+	}
+	return addresses
+}
+
+// origins returns the enabled origins of a domain's pool in priority order
+func origins(domainInfo *services.DomainResponse) []proxy.Origin {
+	var pool []proxy.Origin
+	for _, origin := range domainInfo.Origins {
+		if !origin.Enabled {
+			continue
+		}
+		pool = append(pool, proxy.Origin{
+			ID:       origin.ID.String(),
+			URL:      origin.URL,
+			Weight:   origin.Weight,
+			Priority: origin.Priority,
+		})
+	}
+	sort.SliceStable(pool, func(i, j int) bool { return pool[i].Priority < pool[j].Priority })
+	return pool
+}
+
+// cachePolicies compiles a domain's cache policies in priority order,
+// skipping any the edge cannot compile
+func cachePolicies(domainInfo *services.DomainResponse) []*proxy.CachePolicy {
+	rules := append([]services.CachePolicy(nil), domainInfo.CachePolicies...)
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority < rules[j].Priority })
+
+	policies := make([]*proxy.CachePolicy, 0, len(rules))
+	for _, rule := range rules {
+		policy, err := proxy.NewCachePolicy(rule.PathPattern, rule.MatchType)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"domain":    domainInfo.Domain,
+				"policy_id": rule.ID,
+			}).Warn("Skipping invalid cache policy")
+			continue
+		}
+		policy.TTL = time.Duration(rule.CacheTTL) * time.Second
+		policy.KeyTemplate = rule.CacheKeyTemplate
+		policy.VaryHeaders = rule.HeadersToVary
+		policy.Bypass = rule.Bypass
+		policies = append(policies, policy)
+	}
+	return policies
 }
 
-func startHeartbeat(controlPlane *services.ControlPlaneClient, cache cache.Cache) {
+func startHeartbeat(controlPlane *services.ControlPlaneClient, cacheImpl cache.Cache, domainCache *services.DomainCache, proxyService *proxy.ProxyService) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
 	for range ticker.C {
 		metrics := map[string]interface{}{
-			"cache_size":       cache.Size(),
+			"cache_size":       cacheImpl.Size(),
 			"timestamp":        time.Now().Unix(),
-			"requests_handled": 0, // TODO: implement request counter
+			"requests_handled": middleware.RequestsHandled(),
+		}
+		metrics["domain_cache_entries"] = domainCache.Len()
+		// Origins whose circuit breaker is not closed or that have requests
+		// queued at their concurrency cap
+		metrics["origin_circuits"] = proxyService.OriginCircuits()
+		layers := []cache.Cache{cacheImpl}
+		if layered, ok := cacheImpl.(*cache.LayeredCache); ok {
+			layers = layered.Layers()
+		}
+		for _, layer := range layers {
+			switch c := layer.(type) {
+			case *cache.MemoryCache:
+				metrics["cache_shards"] = c.Stats()
+			case *cache.DiskCache:
+				metrics["disk_cache_entries"] = c.Len()
+				metrics["disk_cache_bytes"] = c.Size()
+			}
 		}
 
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -208,11 +451,60 @@ func startHeartbeat(controlPlane *services.ControlPlaneClient, cache cache.Cache
 	}
 }
 
-func startPurgeHandler(controlPlane *services.ControlPlaneClient, proxyService *proxy.ProxyService) {
+// startOriginHealthReports sends the control plane this edge's origin health
+// check results once per health check interval
+func startOriginHealthReports(controlPlane *services.ControlPlaneClient, proxyService *proxy.ProxyService, interval time.Duration) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		statuses := proxyService.OriginStatuses()
+		checks := make([]services.OriginHealthCheck, 0, len(statuses))
+		for _, status := range statuses {
+			originID, err := uuid.Parse(status.ID)
+			if err != nil {
+				continue
+			}
+			checks = append(checks, services.OriginHealthCheck{
+				OriginID:          originID,
+				Healthy:           status.Healthy,
+				LatencyMs:         status.Latency.Milliseconds(),
+				Error:             status.Error,
+				ActiveConnections: status.ActiveConnections,
+				CheckedAt:         status.CheckedAt,
+			})
+		}
+		if len(checks) == 0 {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := controlPlane.ReportOriginHealth(ctx, checks); err != nil {
+			logrus.WithError(err).Warn("Failed to report origin health")
+		}
+		cancel()
+	}
+}
+
+// startPurgeHandler polls the control plane for pending purges. While the
+// event stream is connected it polls less often, only to retry pushed purges
+// that failed and so were never acknowledged.
+func startPurgeHandler(controlPlane *services.ControlPlaneClient, proxyService *proxy.ProxyService, streaming *atomic.Bool) {
+	const streamingPollInterval = time.Minute
+
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
+	var lastPoll time.Time
 	for range ticker.C {
+		if streaming.Load() && time.Since(lastPoll) < streamingPollInterval {
+			continue
+		}
+		lastPoll = time.Now()
+
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 
 		purges, err := controlPlane.GetPendingPurges(ctx)
@@ -223,41 +515,171 @@ func startPurgeHandler(controlPlane *services.ControlPlaneClient, proxyService *
 		}
 
 		for _, purge := range purges {
-			// Get domain info using the domain ID from the purge request
-			domainInfo, err := controlPlane.GetDomainByID(ctx, purge.DomainID)
-			if err != nil {
-				logrus.WithError(err).WithField("purge_id", purge.ID).Warn("Failed to get domain info for purge")
-				continue
-			}
+			processPurge(ctx, controlPlane, proxyService, purge)
+		}
 
-			// Purge cache entries
-			if err := proxyService.PurgeCache(ctx, domainInfo.Domain, purge.Paths); err != nil {
-				logrus.WithError(err).WithField("purge_id", purge.ID).Warn("Failed to purge cache")
-				continue
-			}
+		cancel()
+	}
+}
 
-			// Mark purge as complete
-			if err := controlPlane.CompletePurge(ctx, purge.ID); err != nil {
-				logrus.WithError(err).WithField("purge_id", purge.ID).Warn("Failed to mark purge as complete")
+// startEventStream keeps the control plane's event stream connected,
+// applying purges and domain changes as they are pushed. streaming is set
+// while connected so polling can slow down.
+func startEventStream(controlPlane *services.ControlPlaneClient, proxyService *proxy.ProxyService, domainCache *services.DomainCache, streaming *atomic.Bool) {
+	const maxBackoff = 30 * time.Second
+	backoff := time.Second
+
+	for {
+		err := controlPlane.StreamEvents(context.Background(), func() {
+			streaming.Store(true)
+			backoff = time.Second
+			// Domain changes made while disconnected were missed
+			domainCache.InvalidateAll()
+			logrus.Info("Connected to control plane event stream")
+		}, func(event services.EdgeEvent) {
+			switch event.Type {
+			case services.EdgeEventPurge:
+				if event.Purge == nil {
+					return
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				processPurge(ctx, controlPlane, proxyService, *event.Purge)
+				cancel()
+			case services.EdgeEventDomainChanged:
+				domainCache.Invalidate(event.Domain)
 			}
+		})
+		streaming.Store(false)
 
-			logrus.WithFields(logrus.Fields{
-				"purge_id": purge.ID,
-				"domain":   domainInfo.Domain,
-				"paths":    purge.Paths,
-			}).Info("Cache purge completed")
+		logrus.WithError(err).WithField("retry_in", backoff).Warn("Control plane event stream disconnected, polling for purges")
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// processPurge applies a purge request to the cache and acknowledges it
+func processPurge(ctx context.Context, controlPlane *services.ControlPlaneClient, proxyService *proxy.ProxyService, purge services.PurgeRequest) {
+	// Get domain info using the domain ID from the purge request
+	domainInfo, err := controlPlane.GetDomainByID(ctx, purge.DomainID)
+	if err != nil {
+		logrus.WithError(err).WithField("purge_id", purge.ID).Warn("Failed to get domain info for purge")
+		return
+	}
+
+	// Purge cache entries
+	if err := proxyService.PurgeCache(ctx, domainInfo.Domain, purge.Paths, purge.Tags); err != nil {
+		logrus.WithError(err).WithField("purge_id", purge.ID).Warn("Failed to purge cache")
+		return
+	}
+
+	// Mark purge as complete
+	if err := controlPlane.CompletePurge(ctx, purge.ID); err != nil {
+		logrus.WithError(err).WithField("purge_id", purge.ID).Warn("Failed to mark purge as complete")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"purge_id": purge.ID,
+		"domain":   domainInfo.Domain,
+		"paths":    purge.Paths,
+		"tags":     purge.Tags,
+	}).Info("Cache purge completed")
+}
+
+// initCache builds the cache backend selected by cfg.CacheMode
+func initCache(cfg *config.Config) cache.Cache {
+	memorySize := parseSize(cfg.CacheSize)
+
+	newRedis := func() cache.Cache {
+		if cfg.RedisURL == "" {
+			return nil
+		}
+		redisCache, err := cache.NewRedisCache(cfg.RedisURL, "edge-cache:", time.Duration(cfg.DefaultTTL)*time.Second)
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to initialize Redis cache")
+			return nil
 		}
+		return redisCache
+	}
+	newDisk := func() cache.Cache {
+		diskCache, err := cache.NewDiskCache(cfg.DiskCacheDir, parseSize(cfg.DiskCacheSize))
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to initialize disk cache")
+			return nil
+		}
+		return diskCache
+	}
 
-		cancel()
+	switch cfg.CacheMode {
+	case "memory":
+		// handled below
+	case "disk":
+		if diskCache := newDisk(); diskCache != nil {
+			logrus.WithField("dir", cfg.DiskCacheDir).Info("Initialized disk cache")
+			return diskCache
+		}
+		logrus.Warn("Falling back to memory cache")
+	case "layered":
+		layers := []cache.Cache{cache.NewMemoryCache(memorySize)}
+		names := []string{"memory"}
+		if diskCache := newDisk(); diskCache != nil {
+			layers = append(layers, diskCache)
+			names = append(names, "disk")
+		}
+		if redisCache := newRedis(); redisCache != nil {
+			layers = append(layers, redisCache)
+			names = append(names, "redis")
+		}
+		logrus.WithField("layers", names).Info("Initialized layered cache")
+		return cache.NewLayeredCache(layers...)
+	default:
+		if cfg.CacheMode != "auto" && cfg.CacheMode != "redis" {
+			logrus.WithField("cache_mode", cfg.CacheMode).Warn("Unknown cache mode, using auto")
+		}
+		if redisCache := newRedis(); redisCache != nil {
+			logrus.Info("Initialized Redis cache")
+			return redisCache
+		}
+		if cfg.RedisURL != "" {
+			logrus.Warn("Falling back to memory cache")
+		}
 	}
+
+	logrus.Info("Initialized memory cache")
+	return cache.NewMemoryCache(memorySize)
 }
 
+// parseSize parses sizes such as "512KB", "100MB" or "10GB", falling back to
+// 100MB for values it cannot read
 func parseSize(sizeStr string) int64 {
-	sizeStr = strings.ToUpper(sizeStr)
-	if strings.HasSuffix(sizeStr, "MB") {
-		return 100 * 1024 * 1024 // Default 100MB
+	const defaultSize = 100 * 1024 * 1024 // Default 100MB
+
+	sizeStr = strings.ToUpper(strings.TrimSpace(sizeStr))
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"TB", 1 << 40},
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(sizeStr, unit.suffix) {
+			multiplier = unit.multiplier
+			sizeStr = strings.TrimSpace(strings.TrimSuffix(sizeStr, unit.suffix))
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil || value <= 0 {
+		logrus.WithField("size", sizeStr).Warn("Invalid size, using 100MB")
+		return defaultSize
 	}
-	return 100 * 1024 * 1024 // Default 100MB
+	return value * multiplier
 }
 
 func getLocalIP() string {
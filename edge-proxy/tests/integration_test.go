@@ -1,25 +1,60 @@
 package tests
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/naijcloud/edge-proxy/internal/cache"
+	"github.com/naijcloud/edge-proxy/internal/certs"
 	"github.com/naijcloud/edge-proxy/internal/middleware"
 	"github.com/naijcloud/edge-proxy/internal/proxy"
 	"github.com/naijcloud/edge-proxy/internal/services"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// videoContent is served by the origin mock for range request tests
+var videoContent = bytes.Repeat([]byte("0123456789"), 300*1024)
+
+// articleContent is served uncompressed by the origin mock for compression
+// tests
+var articleContent = bytes.Repeat([]byte("<p>The quick brown fox jumps over the lazy dog.</p>\n"), 200)
+
+// testRegistrationSecret is the secret the mock control plane takes for edge
+// registration, and testEdgeToken the edge token it issues
+const (
+	testRegistrationSecret = "test-registration-secret"
+	testEdgeToken          = "test-edge-token"
 )
 
 type EdgeProxyIntegrationTestSuite struct {
@@ -37,6 +72,7 @@ type EdgeProxyIntegrationTestSuite struct {
 	// Edge proxy components
 	proxyService *proxy.ProxyService
 	controlPlane *services.ControlPlaneClient
+	domainCache  *services.DomainCache
 	rateLimiter  *middleware.RateLimiter
 	router       *gin.Engine
 
@@ -77,8 +113,12 @@ func (suite *EdgeProxyIntegrationTestSuite) setupMockServers() {
 	// Setup control plane mock server
 	suite.controlPlaneMock = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch {
-		case r.Method == "POST" && strings.Contains(r.URL.Path, "/v1/edges"):
-			// Edge registration
+		case r.Method == "POST" && r.URL.Path == "/api/v1/edges":
+			// Edge registration, which takes the registration secret
+			if r.Header.Get("Authorization") != "Bearer "+testRegistrationSecret {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusCreated)
 			response := map[string]interface{}{
@@ -90,6 +130,7 @@ func (suite *EdgeProxyIntegrationTestSuite) setupMockServers() {
 				"status":     "healthy",
 				"created_at": time.Now(),
 				"updated_at": time.Now(),
+				"token":      testEdgeToken,
 			}
 			json.NewEncoder(w).Encode(response)
 
@@ -116,7 +157,11 @@ func (suite *EdgeProxyIntegrationTestSuite) setupMockServers() {
 			}
 
 		case r.Method == "GET" && strings.Contains(r.URL.Path, "/v1/edges/") && strings.Contains(r.URL.Path, "/purges"):
-			// Pending purges for specific edge
+			// Pending purges for specific edge, only listed for the edge itself
+			if r.Header.Get("Authorization") != "Bearer "+testEdgeToken {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
 			response := map[string]interface{}{
 				"purges": []map[string]interface{}{
@@ -147,6 +192,10 @@ func (suite *EdgeProxyIntegrationTestSuite) setupMockServers() {
 			// Complete purge
 			w.WriteHeader(http.StatusOK)
 
+		case r.Method == "GET" && r.URL.Path == "/api/v1/acme/http-01/control-plane-token":
+			// Challenge for a certificate the control plane is ordering
+			w.Write([]byte("control-plane-token.thumbprint"))
+
 		default:
 			w.WriteHeader(http.StatusNotFound)
 		}
@@ -161,6 +210,13 @@ func (suite *EdgeProxyIntegrationTestSuite) setupMockServers() {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("Hello, World!"))
 
+		case "/article":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Header().Set("ETag", `"article-v1"`)
+			w.WriteHeader(http.StatusOK)
+			w.Write(articleContent)
+
 		case "/json":
 			w.Header().Set("Content-Type", "application/json")
 			w.Header().Set("Cache-Control", "public, max-age=1800")
@@ -181,6 +237,66 @@ func (suite *EdgeProxyIntegrationTestSuite) setupMockServers() {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("Slow response"))
 
+		case "/etag":
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Versioned content"))
+
+		case "/video":
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Header().Set("ETag", `"video-v1"`)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(videoContent))
+
+		case "/vary":
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Header().Set("Vary", "Accept-Encoding")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("encoding=" + r.Header.Get("Accept-Encoding")))
+
+		case "/tagged":
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Header().Set("Surrogate-Key", "product-123 blog")
+			w.Header().Set("Cache-Tag", "catalog, blog")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Tagged content"))
+
+		case "/echo":
+			// Line echo over an upgraded connection
+			if r.Header.Get("Upgrade") != "echo" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\nX-Echo-Forwarded-For: " + r.Header.Get("X-Forwarded-For") + "\r\n\r\n")
+			buf.Flush()
+			for {
+				line, err := buf.ReadString('\n')
+				if err != nil {
+					return
+				}
+				buf.WriteString(line)
+				buf.Flush()
+			}
+
+		case "/.well-known/acme-challenge/origin-token":
+			w.Write([]byte("origin-token.origin-thumbprint"))
+
+		case "/large":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes.Repeat([]byte("a"), 11*1024*1024))
+
 		default:
 			w.WriteHeader(http.StatusNotFound)
 			w.Write([]byte("Not Found"))
@@ -204,7 +320,12 @@ func (suite *EdgeProxyIntegrationTestSuite) setupEdgeProxyComponents() {
 	suite.proxyService = proxy.NewProxyService(suite.memoryCache, proxyConfig)
 
 	// Setup control plane client
-	suite.controlPlane = services.NewControlPlaneClient(suite.controlPlaneMock.URL, "test-region")
+	suite.controlPlane = services.NewControlPlaneClient(suite.controlPlaneMock.URL, "test-region", testRegistrationSecret)
+	suite.domainCache = services.NewDomainCache(suite.controlPlane, services.DomainCacheConfig{
+		TTL:         time.Minute,
+		NegativeTTL: time.Minute,
+		MaxStale:    time.Hour,
+	})
 
 	// Setup rate limiter
 	suite.rateLimiter = middleware.NewRateLimiter(1000, 2000)
@@ -213,7 +334,7 @@ func (suite *EdgeProxyIntegrationTestSuite) setupEdgeProxyComponents() {
 	suite.router = gin.New()
 	suite.router.Use(gin.Recovery())
 	suite.router.Use(middleware.LoggingMiddleware())
-	suite.router.Use(middleware.MetricsMiddleware())
+	suite.router.Use(middleware.MetricsMiddleware(0))
 
 	// Health endpoint
 	suite.router.GET("/health", func(c *gin.Context) {
@@ -224,6 +345,21 @@ func (suite *EdgeProxyIntegrationTestSuite) setupEdgeProxyComponents() {
 		})
 	})
 
+	// ACME HTTP-01 challenges, passed to the origin when the control plane
+	// does not know the token
+	suite.router.GET(services.ACMEChallengePath+":token", func(c *gin.Context) {
+		keyAuth, err := suite.controlPlane.GetACMEChallenge(c.Request.Context(), c.Param("token"))
+		if errors.Is(err, services.ErrNotFound) {
+			suite.handleProxyRequest(c)
+			return
+		}
+		if err != nil {
+			c.String(http.StatusServiceUnavailable, "Challenge unavailable")
+			return
+		}
+		c.String(http.StatusOK, keyAuth)
+	})
+
 	// Proxy handler
 	suite.router.NoRoute(func(c *gin.Context) {
 		suite.handleProxyRequest(c)
@@ -242,22 +378,30 @@ func (suite *EdgeProxyIntegrationTestSuite) handleProxyRequest(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
 
-	domainInfo, err := suite.controlPlane.GetDomain(ctx, domain)
+	domainInfo, err := suite.domainCache.Get(ctx, domain)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not configured"})
 		return
 	}
+	middleware.SetMetricsDomain(c, domain)
 
 	if domainInfo.Status != "active" {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Domain not active"})
 		return
 	}
 
+	if !suite.rateLimiter.AllowDomain(domain, domainInfo.RateLimit) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded for this domain"})
+		return
+	}
+
 	// Proxy the request
 	suite.proxyService.ServeHTTP(c.Writer, c.Request, domainInfo.OriginURL)
 }
 
 func (suite *EdgeProxyIntegrationTestSuite) TearDownSuite() {
+	suite.domainCache.Close()
+
 	// Clean up test data
 	ctx := context.Background()
 	suite.redis.FlushDB(ctx)
@@ -307,6 +451,8 @@ func (suite *EdgeProxyIntegrationTestSuite) TestCacheHitMiss() {
 
 func (suite *EdgeProxyIntegrationTestSuite) TestCacheWithRedis() {
 	// Switch to Redis cache for this test
+	memoryProxy := suite.proxyService
+	defer func() { suite.proxyService = memoryProxy }()
 	suite.proxyService = proxy.NewProxyService(suite.redisCache, proxy.ProxyConfig{
 		DefaultTTL:       3600 * time.Second,
 		MaxBodySize:      10 * 1024 * 1024,
@@ -385,6 +531,54 @@ func (suite *EdgeProxyIntegrationTestSuite) TestErrorResponses() {
 	assert.False(suite.T(), exists)
 }
 
+func (suite *EdgeProxyIntegrationTestSuite) TestLargeResponseStreamed() {
+	// Bodies over MaxBodySize are streamed in full but never cached
+	req := httptest.NewRequest("GET", "http://"+suite.testDomain+"/large", nil)
+	w := httptest.NewRecorder()
+
+	suite.router.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), 11*1024*1024, w.Body.Len())
+
+	cacheKey := cache.GenerateCacheKey(req)
+	ctx := context.Background()
+	_, exists := suite.memoryCache.Get(ctx, cacheKey)
+	assert.False(suite.T(), exists)
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestRequestCoalescing() {
+	// Concurrent misses for the same key should share a single origin fetch
+	const numRequests = 10
+
+	statuses := make(chan string, numRequests)
+	var wg sync.WaitGroup
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "http://"+suite.testDomain+"/slow", nil)
+			w := httptest.NewRecorder()
+
+			suite.router.ServeHTTP(w, req)
+
+			assert.Equal(suite.T(), http.StatusOK, w.Code)
+			assert.Equal(suite.T(), "Slow response", w.Body.String())
+			statuses <- w.Header().Get("X-Cache-Status")
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	misses := 0
+	for status := range statuses {
+		if status == "MISS" {
+			misses++
+		}
+	}
+	assert.Equal(suite.T(), 1, misses)
+}
+
 func (suite *EdgeProxyIntegrationTestSuite) TestUnconfiguredDomain() {
 	// Test request to unconfigured domain
 	req := httptest.NewRequest("GET", "http://unknown.domain.com/hello", nil)
@@ -443,6 +637,119 @@ func (suite *EdgeProxyIntegrationTestSuite) TestRateLimiting() {
 	// Note: Rate limiting might not kick in immediately in test environment
 }
 
+func (suite *EdgeProxyIntegrationTestSuite) TestDomainRateLimit() {
+	limiter := middleware.NewRateLimiter(1000, 2000)
+
+	// A domain may burst to twice its rate, shared by all clients
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if limiter.AllowDomain("limited.example.com", 2) {
+			allowed++
+		}
+	}
+	assert.Equal(suite.T(), 4, allowed)
+
+	// Other domains keep their own budget, and no limit means unlimited
+	assert.True(suite.T(), limiter.AllowDomain("other.example.com", 2))
+	for i := 0; i < 10; i++ {
+		assert.True(suite.T(), limiter.AllowDomain("unlimited.example.com", 0))
+	}
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestMetrics() {
+	// Only the first configured domain gets its own label
+	testRouter := gin.New()
+	testRouter.Use(middleware.MetricsMiddleware(1))
+	testRouter.GET("/labelled/:domain", func(c *gin.Context) {
+		middleware.SetMetricsDomain(c, c.Param("domain"))
+		c.String(http.StatusOK, "ok")
+	})
+	testRouter.NoRoute(func(c *gin.Context) {
+		suite.handleProxyRequest(c)
+	})
+	serve := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	miss := `edge_http_requests_total{cache_status="MISS",domain="test.example.com",status_class="2xx"}`
+	hit := `edge_http_requests_total{cache_status="HIT",domain="test.example.com",status_class="2xx"}`
+	hitDuration := `edge_http_request_duration_seconds_count{cache_status="HIT",domain="test.example.com",status_class="2xx"}`
+	hitBytes := `edge_http_response_bytes_total{cache_status="HIT",domain="test.example.com"}`
+	originDuration := `edge_origin_request_duration_seconds_count{origin="` + suite.testOriginURL + `",status_class="2xx"}`
+	unknown := `edge_http_requests_total{cache_status="none",domain="unknown",status_class="4xx"}`
+	other := `edge_http_requests_total{cache_status="none",domain="other",status_class="2xx"}`
+	lookupErrors := `edge_control_plane_errors_total{operation="get_domain",reason="not_found"}`
+	rejections := `edge_rate_limit_rejections_total{scope="domain"}`
+	evictions := `edge_cache_evictions_total{tier="disk"}`
+	before := scrapeMetrics(suite.T())
+
+	// A miss and a hit, labelled with the cache status from the response
+	target := "http://" + suite.testDomain + "/hello?metrics=" + uuid.NewString()
+	suite.Require().Equal(http.StatusOK, serve(target).Code)
+	w := serve(target)
+	suite.Require().Equal("HIT", w.Header().Get("X-Cache-Status"))
+
+	// Hosts that are not configured share one label
+	assert.Equal(suite.T(), http.StatusNotFound, serve("http://"+uuid.NewString()+".example.net/").Code)
+	assert.Equal(suite.T(), http.StatusOK, serve("http://"+suite.testDomain+"/labelled/second.example.com").Code)
+
+	limiter := middleware.NewRateLimiter(1000, 2000)
+	for i := 0; i < 3; i++ {
+		limiter.AllowDomain("metrics.example.com", 1)
+	}
+
+	// Each entry takes more than half the disk cache, evicting the last one
+	diskCache, err := cache.NewDiskCache(suite.T().TempDir(), 1024)
+	suite.Require().NoError(err)
+	defer diskCache.Close()
+	for i := 0; i < 3; i++ {
+		suite.Require().NoError(diskCache.Set(context.Background(), fmt.Sprintf("GET:example.com/%d", i), &cache.CacheEntry{
+			StatusCode: http.StatusOK,
+			Headers:    make(http.Header),
+			Body:       make([]byte, 400),
+			CachedAt:   time.Now(),
+			TTL:        time.Hour,
+		}))
+	}
+
+	after := scrapeMetrics(suite.T())
+	assert.Equal(suite.T(), 1.0, after[miss]-before[miss])
+	assert.Equal(suite.T(), 1.0, after[hit]-before[hit])
+	assert.Equal(suite.T(), 1.0, after[hitDuration]-before[hitDuration])
+	assert.Equal(suite.T(), float64(w.Body.Len()), after[hitBytes]-before[hitBytes])
+	assert.Equal(suite.T(), 1.0, after[originDuration]-before[originDuration])
+	assert.Equal(suite.T(), 1.0, after[unknown]-before[unknown])
+	assert.Equal(suite.T(), 1.0, after[other]-before[other])
+	assert.Equal(suite.T(), 1.0, after[lookupErrors]-before[lookupErrors])
+	assert.Equal(suite.T(), 1.0, after[rejections]-before[rejections])
+	assert.Equal(suite.T(), 2.0, after[evictions]-before[evictions])
+}
+
+// scrapeMetrics reads the edge's Prometheus metrics, keyed by sample name
+// and labels as they appear in the exposition format
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.LastIndex(line, " ")
+		if strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		var value float64
+		if _, err := fmt.Sscan(line[i+1:], &value); err != nil {
+			t.Fatalf("unreadable metric sample %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
 func (suite *EdgeProxyIntegrationTestSuite) TestCachePurge() {
 	// First, cache some content
 	req := httptest.NewRequest("GET", "http://"+suite.testDomain+"/hello", nil)
@@ -458,7 +765,7 @@ func (suite *EdgeProxyIntegrationTestSuite) TestCachePurge() {
 	assert.True(suite.T(), exists)
 
 	// Test cache purge
-	err := suite.proxyService.PurgeCache(ctx, suite.testDomain, []string{"/hello"})
+	err := suite.proxyService.PurgeCache(ctx, suite.testDomain, []string{"/hello"}, nil)
 	assert.NoError(suite.T(), err)
 
 	// Verify content was purged
@@ -466,10 +773,836 @@ func (suite *EdgeProxyIntegrationTestSuite) TestCachePurge() {
 	assert.False(suite.T(), exists)
 }
 
+func (suite *EdgeProxyIntegrationTestSuite) TestCachePurgePatterns() {
+	ctx := context.Background()
+	memoryCache := cache.NewMemoryCache(8 * 1024 * 1024)
+	proxyService := proxy.NewProxyService(memoryCache, proxy.ProxyConfig{
+		DefaultTTL:      time.Hour,
+		ConnectTimeout:  10 * time.Second,
+		ResponseTimeout: 30 * time.Second,
+		MaxBodySize:     10 * 1024 * 1024,
+	})
+	domain := proxy.DomainConfig{OriginURL: suite.testOriginURL}
+
+	targets := []string{"/hello", "/hello?v=1", "/hello?v=2", "/json", "/etag", "/vary"}
+	fill := func() {
+		for _, target := range targets {
+			req := httptest.NewRequest("GET", "http://"+suite.testDomain+":8081"+target, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			proxyService.Serve(httptest.NewRecorder(), req, domain)
+		}
+	}
+	cached := func() []string {
+		keys, err := memoryCache.DomainKeys(ctx, suite.testDomain)
+		suite.Require().NoError(err)
+		paths := make(map[string]bool)
+		for _, info := range keys {
+			paths[info.Path] = true
+		}
+		var list []string
+		for _, target := range targets {
+			if paths[target] {
+				list = append(list, target)
+			}
+		}
+		return list
+	}
+
+	fill()
+	suite.Require().Equal(targets, cached())
+
+	// An exact URL with a query string purges only that URL
+	suite.Require().NoError(proxyService.PurgeCache(ctx, suite.testDomain, []string{"/hello?v=1"}, nil))
+	assert.Equal(suite.T(), []string{"/hello", "/hello?v=2", "/json", "/etag", "/vary"}, cached())
+
+	// Without one it purges every query string of the path
+	suite.Require().NoError(proxyService.PurgeCache(ctx, suite.testDomain, []string{"/hello"}, nil))
+	assert.Equal(suite.T(), []string{"/json", "/etag", "/vary"}, cached())
+
+	// Prefixes and globs, including the variants of a varying resource
+	suite.Require().NoError(proxyService.PurgeCache(ctx, suite.testDomain, []string{"/j*", "/v*y"}, nil))
+	assert.Equal(suite.T(), []string{"/etag"}, cached())
+	_, exists := memoryCache.Get(ctx, "GET:"+suite.testDomain+":8081/vary")
+	assert.False(suite.T(), exists)
+
+	// Everything for the domain
+	fill()
+	suite.Require().NoError(proxyService.PurgeCache(ctx, suite.testDomain, []string{"/*"}, nil))
+	assert.Empty(suite.T(), cached())
+	assert.Equal(suite.T(), int64(0), memoryCache.Size())
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestCacheTags() {
+	ctx := context.Background()
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+suite.testDomain+target, nil)
+		w := httptest.NewRecorder()
+		suite.router.ServeHTTP(w, req)
+		suite.Require().Equal(http.StatusOK, w.Code)
+		return w
+	}
+
+	// Tags are recorded on the entry but never sent to clients
+	for _, status := range []string{"MISS", "HIT"} {
+		w := serve("/tagged")
+		assert.Equal(suite.T(), status, w.Header().Get("X-Cache-Status"))
+		assert.Empty(suite.T(), w.Header().Get("Surrogate-Key"))
+		assert.Empty(suite.T(), w.Header().Get("Cache-Tag"))
+	}
+	entry, exists := suite.memoryCache.Get(ctx, "GET:"+suite.testDomain+"/tagged")
+	suite.Require().True(exists)
+	assert.Equal(suite.T(), []string{"blog", "catalog", "product-123"}, entry.Tags)
+
+	serve("/hello")
+
+	// Purging an unrelated tag leaves both entries in place
+	suite.Require().NoError(suite.proxyService.PurgeCache(ctx, suite.testDomain, nil, []string{"product-456"}))
+	assert.Equal(suite.T(), "HIT", serve("/tagged").Header().Get("X-Cache-Status"))
+
+	// Purging any of its tags removes only the tagged entry
+	suite.Require().NoError(suite.proxyService.PurgeCache(ctx, suite.testDomain, nil, []string{"product-123"}))
+	assert.Equal(suite.T(), "MISS", serve("/tagged").Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "HIT", serve("/hello").Header().Get("X-Cache-Status"))
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestUpgradeTunnel() {
+	domain := proxy.DomainConfig{
+		OriginURL:          suite.testOriginURL,
+		AllowUpgrades:      true,
+		UpgradeIdleTimeout: 200 * time.Millisecond,
+	}
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.proxyService.Serve(w, r, domain)
+	}))
+	defer edge.Close()
+
+	// handshake dials the edge and sends an upgrade request for path
+	handshake := func(path string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", edge.Listener.Addr().String())
+		suite.Require().NoError(err)
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", path, suite.testDomain)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		suite.Require().NoError(err)
+		return conn, reader, resp
+	}
+
+	// Bytes flow both ways once the origin switches protocols
+	conn, reader, resp := handshake("/echo")
+	defer conn.Close()
+	suite.Require().Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(suite.T(), "echo", resp.Header.Get("Upgrade"))
+	assert.NotEmpty(suite.T(), resp.Header.Get("X-Echo-Forwarded-For"))
+
+	for _, msg := range []string{"ping\n", "pong\n"} {
+		_, err := io.WriteString(conn, msg)
+		suite.Require().NoError(err)
+		line, err := reader.ReadString('\n')
+		suite.Require().NoError(err)
+		assert.Equal(suite.T(), msg, line)
+	}
+
+	// Idle tunnels are closed
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := reader.ReadString('\n')
+	assert.ErrorIs(suite.T(), err, io.EOF)
+
+	// An origin that does not switch protocols is answered normally
+	conn, _, resp = handshake("/hello")
+	defer conn.Close()
+	assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, int64(len("Hello, World!"))))
+	assert.Equal(suite.T(), "Hello, World!", string(body))
+
+	// Domains must opt in
+	req := httptest.NewRequest("GET", "/echo", nil)
+	req.Host = suite.testDomain
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	w := httptest.NewRecorder()
+	suite.proxyService.Serve(w, req, proxy.DomainConfig{OriginURL: suite.testOriginURL})
+	assert.Equal(suite.T(), http.StatusForbidden, w.Code)
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestOriginHTTP2() {
+	// Cleartext origin that speaks HTTP/2 with prior knowledge
+	var protos sync.Map
+	origin := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos.Store(r.URL.Path, r.Proto)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer origin.Close()
+
+	for mode, want := range map[string]string{
+		proxy.OriginHTTP2H2C:  "HTTP/2.0",
+		proxy.OriginHTTP2Auto: "HTTP/1.1",
+		proxy.OriginHTTP2Off:  "HTTP/1.1",
+	} {
+		proxyService := proxy.NewProxyService(cache.NewMemoryCache(1024*1024), proxy.ProxyConfig{
+			ConnectTimeout:  time.Second,
+			ResponseTimeout: time.Second,
+			OriginHTTP2:     mode,
+		})
+
+		// Concurrent requests share the origin connection
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				req := httptest.NewRequest("GET", fmt.Sprintf("/%s/%d", mode, i), nil)
+				req.Host = suite.testDomain
+				w := httptest.NewRecorder()
+				proxyService.Serve(w, req, proxy.DomainConfig{OriginURL: origin.URL})
+				assert.Equal(suite.T(), http.StatusOK, w.Code)
+				assert.Equal(suite.T(), want, w.Body.String(), "mode %s", mode)
+			}(i)
+		}
+		wg.Wait()
+
+		proto, _ := protos.Load(fmt.Sprintf("/%s/0", mode))
+		assert.Equal(suite.T(), want, proto, "mode %s", mode)
+	}
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestOriginPools() {
+	type poolOrigin struct {
+		server  *httptest.Server
+		healthy atomic.Bool
+	}
+	held := make(chan string, 1)
+	release := make(chan struct{})
+	newOrigin := func(name string) *poolOrigin {
+		o := &poolOrigin{}
+		o.healthy.Store(true)
+		o.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/healthz":
+				if !o.healthy.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+				return
+			case "/slow":
+				held <- name
+				<-release
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write([]byte(name))
+		}))
+		return o
+	}
+	a, b, backup := newOrigin("a"), newOrigin("b"), newOrigin("backup")
+	defer a.server.Close()
+	defer b.server.Close()
+	defer backup.server.Close()
+
+	proxyService := proxy.NewProxyService(cache.NewMemoryCache(1024*1024), proxy.ProxyConfig{
+		ConnectTimeout:      time.Second,
+		ResponseTimeout:     5 * time.Second,
+		HealthCheckInterval: 20 * time.Millisecond,
+		HealthCheckTimeout:  time.Second,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxyService.RunHealthChecks(ctx)
+
+	domain := proxy.DomainConfig{
+		Origins: []proxy.Origin{
+			{ID: "a", URL: a.server.URL, Weight: 3},
+			{ID: "b", URL: b.server.URL, Weight: 1},
+			{ID: "backup", URL: backup.server.URL, Priority: 1, Weight: 1},
+		},
+		HealthCheckPath: "/healthz",
+	}
+	serve := func(target string) string {
+		req := httptest.NewRequest("GET", "http://"+suite.testDomain+target, nil)
+		w := httptest.NewRecorder()
+		proxyService.Serve(w, req, domain)
+		suite.Require().Equal(http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	spread := func(n int) map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < n; i++ {
+			counts[serve(fmt.Sprintf("/page/%d", i))]++
+		}
+		return counts
+	}
+	healthy := func(url string, want bool) func() bool {
+		return func() bool {
+			for _, status := range proxyService.OriginStatuses() {
+				if status.URL == url {
+					return status.Healthy == want
+				}
+			}
+			return false
+		}
+	}
+
+	// Round robin follows the weights and leaves the failover tier idle
+	assert.Equal(suite.T(), map[string]int{"a": 6, "b": 2}, spread(8))
+
+	// An unhealthy origin leaves the rotation until it recovers
+	a.healthy.Store(false)
+	suite.Require().Eventually(healthy(a.server.URL, false), 2*time.Second, 10*time.Millisecond)
+	assert.Equal(suite.T(), map[string]int{"b": 4}, spread(4))
+
+	// With the whole primary tier down, the next priority takes over
+	b.healthy.Store(false)
+	suite.Require().Eventually(healthy(b.server.URL, false), 2*time.Second, 10*time.Millisecond)
+	assert.Equal(suite.T(), map[string]int{"backup": 4}, spread(4))
+
+	a.healthy.Store(true)
+	b.healthy.Store(true)
+	suite.Require().Eventually(healthy(a.server.URL, true), 2*time.Second, 10*time.Millisecond)
+	suite.Require().Eventually(healthy(b.server.URL, true), 2*time.Second, 10*time.Millisecond)
+	assert.Equal(suite.T(), map[string]int{"a": 3, "b": 1}, spread(4))
+
+	// Consistent hashing keeps each path on one origin while spreading paths
+	domain.LoadBalancing = proxy.LoadBalancingConsistentHash
+	domain.Origins[0].Weight = 1
+	first := map[string]string{}
+	for i := 0; i < 20; i++ {
+		first[fmt.Sprintf("/page/%d", i)] = serve(fmt.Sprintf("/page/%d", i))
+	}
+	for path, origin := range first {
+		assert.Equal(suite.T(), origin, serve(path), path)
+	}
+	assert.Len(suite.T(), spread(20), 2)
+
+	// Least connections steers around an origin busy with a slow request
+	domain.LoadBalancing = proxy.LoadBalancingLeastConnections
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve("/slow")
+	}()
+	busy := <-held
+	for _, origin := range []string{serve("/page/1"), serve("/page/2"), serve("/page/3")} {
+		assert.NotEqual(suite.T(), busy, origin)
+	}
+	close(release)
+	<-done
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestCircuitBreaker() {
+	var failing atomic.Bool
+	failing.Store(true)
+	var requests atomic.Int64
+	held := make(chan struct{}, 1)
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/hold" {
+			held <- struct{}{}
+			<-release
+		}
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	memoryCache := cache.NewMemoryCache(1024 * 1024)
+	proxyService := proxy.NewProxyService(memoryCache, proxy.ProxyConfig{
+		ConnectTimeout:      time.Second,
+		ResponseTimeout:     5 * time.Second,
+		CircuitBreaker:      true,
+		BreakerMinRequests:  4,
+		BreakerOpenDuration: 200 * time.Millisecond,
+		OriginMaxConcurrent: 1,
+		OriginMaxQueue:      1,
+		OriginQueueTimeout:  100 * time.Millisecond,
+	})
+	domain := proxy.DomainConfig{OriginURL: origin.URL}
+	serve := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+suite.testDomain+target, nil)
+		w := httptest.NewRecorder()
+		proxyService.Serve(w, req, domain)
+		return w
+	}
+
+	// Enough failures in the window open the breaker, after which requests
+	// fail fast without reaching the origin
+	for i := 0; i < 4; i++ {
+		assert.Equal(suite.T(), http.StatusInternalServerError, serve("/fail").Code)
+	}
+	sent := requests.Load()
+	w := serve("/fail")
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, w.Code)
+	assert.Equal(suite.T(), "1", w.Header().Get("Retry-After"))
+	assert.Equal(suite.T(), sent, requests.Load())
+
+	circuits := proxyService.OriginCircuits()
+	suite.Require().Len(circuits, 1)
+	assert.Equal(suite.T(), origin.URL, circuits[0].Origin)
+	assert.Equal(suite.T(), proxy.CircuitOpen, circuits[0].State)
+
+	// Expired content stands in for the origin while the breaker is open,
+	// even outside its stale-if-error window
+	req := httptest.NewRequest("GET", "http://"+suite.testDomain+"/stale", nil)
+	err := memoryCache.Set(context.Background(), cache.GenerateCacheKey(req), &cache.CacheEntry{
+		StatusCode: http.StatusOK,
+		Headers:    http.Header{"Etag": []string{`"v1"`}},
+		Body:       []byte("stale content"),
+		CachedAt:   time.Now().Add(-2 * time.Second),
+		TTL:        time.Second,
+	})
+	suite.Require().NoError(err)
+	w = serve("/stale")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "STALE", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "stale content", w.Body.String())
+
+	// Once the open period passes, a successful trial request closes it
+	failing.Store(false)
+	suite.Require().Eventually(func() bool {
+		return serve("/ok").Code == http.StatusOK
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.Empty(suite.T(), proxyService.OriginCircuits())
+
+	// At the concurrency cap one request may queue and the rest are refused
+	codes := make(chan int, 2)
+	go func() { codes <- serve("/hold").Code }()
+	<-held
+	go func() { codes <- serve("/queued").Code }()
+	suite.Require().Eventually(func() bool {
+		circuits := proxyService.OriginCircuits()
+		return len(circuits) == 1 && circuits[0].Queued == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, serve("/refused").Code)
+
+	// The queued request gives up after the queue timeout
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, <-codes)
+	close(release)
+	assert.Equal(suite.T(), http.StatusOK, <-codes)
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestOriginRetries() {
+	var failures, requests atomic.Int64
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("flaky"))
+	}))
+	defer flaky.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	proxyService := proxy.NewProxyService(cache.NewMemoryCache(1024*1024), proxy.ProxyConfig{
+		ConnectTimeout:  time.Second,
+		ResponseTimeout: 5 * time.Second,
+		OriginRetries:   2,
+		RetryBackoff:    time.Millisecond,
+	})
+	serve := func(method, target string, body io.Reader, domain proxy.DomainConfig) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://"+suite.testDomain+target, body)
+		w := httptest.NewRecorder()
+		proxyService.Serve(w, req, domain)
+		return w
+	}
+	single := proxy.DomainConfig{OriginURL: flaky.URL}
+
+	// Retry statuses are retried until the origin recovers
+	failures.Store(2)
+	w := serve("GET", "/page", nil, single)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "flaky", w.Body.String())
+	assert.Equal(suite.T(), int64(3), requests.Load())
+
+	// The last attempt's response is relayed once retries run out
+	requests.Store(0)
+	failures.Store(5)
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, serve("GET", "/page", nil, single).Code)
+	assert.Equal(suite.T(), int64(3), requests.Load())
+
+	// Requests that are not idempotent, or whose body cannot be replayed,
+	// are only sent once
+	requests.Store(0)
+	failures.Store(1)
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, serve("POST", "/form", nil, single).Code)
+	failures.Store(1)
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, serve("PUT", "/file", strings.NewReader("data"), single).Code)
+	assert.Equal(suite.T(), int64(2), requests.Load())
+
+	// Pool domains retry connection errors on another origin
+	failures.Store(0)
+	pool := proxy.DomainConfig{
+		Origins: []proxy.Origin{
+			{ID: "down", URL: down.URL, Weight: 1},
+			{ID: "flaky", URL: flaky.URL, Weight: 1},
+		},
+	}
+	for i := 0; i < 4; i++ {
+		w := serve("GET", fmt.Sprintf("/pool/%d", i), nil, pool)
+		assert.Equal(suite.T(), http.StatusOK, w.Code)
+		assert.Equal(suite.T(), "flaky", w.Body.String())
+	}
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestOriginShield() {
+	var originRequests atomic.Int64
+	hops := make(chan string, 10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Add(1)
+		hops <- r.Header.Get(proxy.ShieldHopHeader)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Write([]byte("asset " + r.URL.Path + string(body)))
+	}))
+	defer origin.Close()
+
+	newEdge := func(region string) *proxy.ProxyService {
+		return proxy.NewProxyService(cache.NewMemoryCache(1024*1024), proxy.ProxyConfig{
+			DefaultTTL:      time.Minute,
+			MaxBodySize:     1024 * 1024,
+			ConnectTimeout:  time.Second,
+			ResponseTimeout: 5 * time.Second,
+			Region:          region,
+		})
+	}
+	shieldEdge := newEdge("eu-west")
+	shieldServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops <- "shield:" + r.Header.Get(proxy.ShieldHopHeader)
+		shieldEdge.Serve(w, r, proxy.DomainConfig{OriginURL: origin.URL, ShieldRegion: "eu-west"})
+	}))
+	defer shieldServer.Close()
+
+	domain := proxy.DomainConfig{
+		OriginURL:    origin.URL,
+		ShieldRegion: "eu-west",
+		Shields:      []string{strings.TrimPrefix(shieldServer.URL, "http://")},
+	}
+	serve := func(edge *proxy.ProxyService, target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+suite.testDomain+target, nil)
+		for name, values := range header {
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+		w := httptest.NewRecorder()
+		edge.Serve(w, req, domain)
+		suite.Require().Equal(http.StatusOK, w.Code)
+		return w
+	}
+
+	// A miss outside the shield region is fetched through the shield, which
+	// fetches from the origin without the hop header
+	w := serve(newEdge("us-east"), "/app.js", nil)
+	assert.Equal(suite.T(), "asset /app.js", w.Body.String())
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "MISS", w.Header().Get(proxy.ShieldCacheStatusHeader))
+	assert.Equal(suite.T(), "shield:us-east", <-hops)
+	assert.Equal(suite.T(), "", <-hops)
+
+	// Other edges' misses are answered from the shield's cache
+	w = serve(newEdge("ap-south"), "/app.js", nil)
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "HIT", w.Header().Get(proxy.ShieldCacheStatusHeader))
+	assert.Equal(suite.T(), "shield:ap-south", <-hops)
+	assert.Equal(suite.T(), int64(1), originRequests.Load())
+
+	// Edges in the shield region go straight to the origin
+	w = serve(newEdge("eu-west"), "/direct.js", nil)
+	assert.Empty(suite.T(), w.Header().Get(proxy.ShieldCacheStatusHeader))
+	assert.Equal(suite.T(), "", <-hops)
+
+	// So do requests that already passed a shield, when another edge sent
+	// them: one with the shared secret, or one of the domain's shields
+	hopped := func(edge *proxy.ProxyService, target, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+suite.testDomain+target, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(proxy.ShieldHopHeader, "ap-south")
+		for name, values := range header {
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+		w := httptest.NewRecorder()
+		edge.Serve(w, req, domain)
+		suite.Require().Equal(http.StatusOK, w.Code)
+		return w
+	}
+	secretEdge := proxy.NewProxyService(cache.NewMemoryCache(1024*1024), proxy.ProxyConfig{
+		ConnectTimeout:  time.Second,
+		ResponseTimeout: 5 * time.Second,
+		Region:          "us-east",
+		ShieldSecret:    "edge-secret",
+	})
+	w = hopped(secretEdge, "/hop.js", "192.0.2.1:1234", http.Header{proxy.ShieldAuthHeader: {"edge-secret"}})
+	assert.Empty(suite.T(), w.Header().Get(proxy.ShieldCacheStatusHeader))
+	assert.Equal(suite.T(), "", <-hops)
+	shieldHost, _, _ := net.SplitHostPort(domain.Shields[0])
+	w = hopped(newEdge("us-east"), "/hop-shield.js", net.JoinHostPort(shieldHost, "40000"), nil)
+	assert.Empty(suite.T(), w.Header().Get(proxy.ShieldCacheStatusHeader))
+	assert.Equal(suite.T(), "", <-hops)
+
+	// Clients cannot skip the shield by sending the hop header themselves
+	w = hopped(secretEdge, "/spoofed.js", "192.0.2.1:1234", http.Header{proxy.ShieldAuthHeader: {"guess"}})
+	assert.Equal(suite.T(), "MISS", w.Header().Get(proxy.ShieldCacheStatusHeader))
+	assert.Equal(suite.T(), "shield:us-east", <-hops)
+	assert.Equal(suite.T(), "", <-hops)
+	w = hopped(newEdge("us-east"), "/spoofed-too.js", "192.0.2.1:1234", nil)
+	assert.Equal(suite.T(), "MISS", w.Header().Get(proxy.ShieldCacheStatusHeader))
+	assert.Equal(suite.T(), "shield:us-east", <-hops)
+	assert.Equal(suite.T(), "", <-hops)
+
+	// Requests the shield cannot cache and that are unsafe to send twice go
+	// straight to the origin
+	req := httptest.NewRequest("POST", "http://"+suite.testDomain+"/form", strings.NewReader(" posted"))
+	w = httptest.NewRecorder()
+	newEdge("us-east").Serve(w, req, domain)
+	suite.Require().Equal(http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "asset /form posted", w.Body.String())
+	assert.Empty(suite.T(), w.Header().Get(proxy.ShieldCacheStatusHeader))
+	assert.Equal(suite.T(), "", <-hops)
+
+	// An unreachable shield falls back to the origin
+	shieldServer.Close()
+	w = serve(newEdge("us-east"), "/fallback.js", nil)
+	assert.Equal(suite.T(), "asset /fallback.js", w.Body.String())
+	assert.Empty(suite.T(), w.Header().Get(proxy.ShieldCacheStatusHeader))
+	assert.Equal(suite.T(), "", <-hops)
+
+	// unless the failed attempt already sent the request's body
+	req = httptest.NewRequest("GET", "http://"+suite.testDomain+"/search", strings.NewReader("q=shield"))
+	w = httptest.NewRecorder()
+	newEdge("us-east").Serve(w, req, domain)
+	assert.Equal(suite.T(), http.StatusBadGateway, w.Code)
+	assert.Equal(suite.T(), int64(8), originRequests.Load())
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestTLSCertificates() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	domains := &staticDomains{domains: map[string]*services.DomainResponse{}, certs: map[string]*services.DomainCertificate{}}
+	store := certs.NewStore(domains, domains)
+
+	// The default certificate is reloaded when its files change
+	dir := suite.T().TempDir()
+	certFile, keyFile := dir+"/default.crt", dir+"/default.key"
+	writePair := func(host string, modTime time.Time) {
+		certPEM, keyPEM := selfSignedPEM(suite.T(), host)
+		suite.Require().NoError(os.WriteFile(certFile, certPEM, 0o600))
+		suite.Require().NoError(os.WriteFile(keyFile, keyPEM, 0o600))
+		suite.Require().NoError(os.Chtimes(certFile, modTime, modTime))
+		suite.Require().NoError(os.Chtimes(keyFile, modTime, modTime))
+	}
+	writePair("default.example.com", time.Now().Add(-time.Hour))
+	suite.Require().NoError(store.LoadDefault(certFile, keyFile))
+	go store.WatchDefault(ctx, 20*time.Millisecond)
+
+	edge := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.ServerName))
+	}))
+	// httptest's own certificate would answer clients without SNI
+	edge.Listener = tls.NewListener(edge.Listener, &tls.Config{GetCertificate: store.GetCertificate})
+	edge.Start()
+	defer edge.Close()
+
+	// servedName returns the common name of the certificate served for host
+	servedName := func(host string) string {
+		conn, err := tls.Dial("tcp", edge.Listener.Addr().String(), &tls.Config{ServerName: host, InsecureSkipVerify: true})
+		suite.Require().NoError(err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	// Domains without a certificate get the default one
+	domains.set(suite.testDomain, nil)
+	assert.Equal(suite.T(), "default.example.com", servedName(suite.testDomain))
+
+	// Domain certificates are chosen by SNI, with the key fetched once per
+	// certificate
+	certPEM, keyPEM := selfSignedPEM(suite.T(), suite.testDomain)
+	domains.set(suite.testDomain, &services.DomainCertificate{CertPEM: string(certPEM), KeyPEM: string(keyPEM)})
+	assert.Equal(suite.T(), suite.testDomain, servedName(suite.testDomain))
+	assert.Equal(suite.T(), suite.testDomain, servedName(suite.testDomain))
+	assert.Equal(suite.T(), "default.example.com", servedName("unknown.example.com"))
+	assert.Equal(suite.T(), 1, store.Len())
+	assert.Equal(suite.T(), 1, domains.fetches())
+
+	// A rotated domain certificate is served from the next handshake on,
+	// without disturbing established connections
+	conn, err := tls.Dial("tcp", edge.Listener.Addr().String(), &tls.Config{ServerName: suite.testDomain, InsecureSkipVerify: true})
+	suite.Require().NoError(err)
+	defer conn.Close()
+	serial := conn.ConnectionState().PeerCertificates[0].SerialNumber
+
+	certPEM, keyPEM = selfSignedPEM(suite.T(), suite.testDomain)
+	domains.set(suite.testDomain, &services.DomainCertificate{CertPEM: string(certPEM), KeyPEM: string(keyPEM)})
+	rotated, err := tls.Dial("tcp", edge.Listener.Addr().String(), &tls.Config{ServerName: suite.testDomain, InsecureSkipVerify: true})
+	suite.Require().NoError(err)
+	defer rotated.Close()
+	assert.NotEqual(suite.T(), serial, rotated.ConnectionState().PeerCertificates[0].SerialNumber)
+	assert.Equal(suite.T(), 2, domains.fetches())
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", suite.testDomain)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	suite.Require().NoError(err)
+	resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
+
+	writePair("renewed.example.com", time.Now())
+	assert.Eventually(suite.T(), func() bool {
+		return servedName("") == "renewed.example.com"
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestHTTPSRedirectAndHSTS() {
+	proxyService := proxy.NewProxyService(cache.NewMemoryCache(1024*1024), proxy.ProxyConfig{
+		ConnectTimeout:  time.Second,
+		ResponseTimeout: time.Second,
+		HTTPSPort:       8443,
+	})
+	domain := proxy.DomainConfig{
+		OriginURL:             suite.testOriginURL,
+		HTTPSRedirect:         true,
+		HSTSMaxAge:            365 * 24 * time.Hour,
+		HSTSIncludeSubdomains: true,
+	}
+
+	// Plain HTTP is redirected, keeping the method for non-GET requests
+	req := httptest.NewRequest("GET", "/hello?x=1", nil)
+	req.Host = suite.testDomain + ":8080"
+	w := httptest.NewRecorder()
+	proxyService.Serve(w, req, domain)
+	assert.Equal(suite.T(), http.StatusMovedPermanently, w.Code)
+	assert.Equal(suite.T(), "https://"+suite.testDomain+":8443/hello?x=1", w.Header().Get("Location"))
+	assert.Empty(suite.T(), w.Header().Get("Strict-Transport-Security"))
+
+	req = httptest.NewRequest("POST", "/api/data", strings.NewReader("{}"))
+	req.Host = suite.testDomain
+	w = httptest.NewRecorder()
+	proxyService.Serve(w, req, domain)
+	assert.Equal(suite.T(), http.StatusPermanentRedirect, w.Code)
+
+	// HTTPS requests, including those terminated by a load balancer, are
+	// served with HSTS
+	req = httptest.NewRequest("GET", "/hello", nil)
+	req.Host = suite.testDomain
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	proxyService.Serve(w, req, domain)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "max-age=31536000; includeSubDomains", w.Header().Get("Strict-Transport-Security"))
+
+	// Neither applies unless the domain asks for it
+	req = httptest.NewRequest("GET", "/hello", nil)
+	req.Host = suite.testDomain
+	w = httptest.NewRecorder()
+	proxyService.Serve(w, req, proxy.DomainConfig{OriginURL: suite.testOriginURL})
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Empty(suite.T(), w.Header().Get("Strict-Transport-Security"))
+}
+
+// staticDomains is a certs.DomainLookup and certs.KeyLookup over a fixed set
+// of domains. Like the control plane, it leaves private keys out of the
+// domain configuration.
+type staticDomains struct {
+	mu         sync.Mutex
+	domains    map[string]*services.DomainResponse
+	certs      map[string]*services.DomainCertificate
+	keyFetches int
+}
+
+func (d *staticDomains) set(domain string, cert *services.DomainCertificate) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	info := &services.DomainResponse{Domain: domain, Status: "active"}
+	if cert != nil {
+		info.Certificate = &services.DomainCertificate{CertPEM: cert.CertPEM, NotAfter: cert.NotAfter, UpdatedAt: cert.UpdatedAt}
+	}
+	d.domains[domain] = info
+	d.certs[domain] = cert
+}
+
+func (d *staticDomains) Get(ctx context.Context, domain string) (*services.DomainResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if info, ok := d.domains[domain]; ok {
+		return info, nil
+	}
+	return nil, services.ErrNotFound
+}
+
+func (d *staticDomains) GetDomainCertificate(ctx context.Context, domain string) (*services.DomainCertificate, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keyFetches++
+	if cert := d.certs[domain]; cert != nil {
+		return cert, nil
+	}
+	return nil, services.ErrNotFound
+}
+
+func (d *staticDomains) fetches() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.keyFetches
+}
+
+// selfSignedPEM generates a self-signed certificate and key for host
+func selfSignedPEM(t *testing.T, host string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestACMEChallenge() {
+	for token, want := range map[string]struct {
+		code int
+		body string
+	}{
+		"control-plane-token": {http.StatusOK, "control-plane-token.thumbprint"},
+		"origin-token":        {http.StatusOK, "origin-token.origin-thumbprint"},
+		"unknown-token":       {http.StatusNotFound, "Not Found"},
+	} {
+		req := httptest.NewRequest("GET", services.ACMEChallengePath+token, nil)
+		req.Host = suite.testDomain
+		w := httptest.NewRecorder()
+		suite.router.ServeHTTP(w, req)
+		assert.Equal(suite.T(), want.code, w.Code, token)
+		assert.Equal(suite.T(), want.body, w.Body.String(), token)
+	}
+}
+
 func (suite *EdgeProxyIntegrationTestSuite) TestControlPlaneIntegration() {
 	// Test edge registration
 	ctx := context.Background()
-	edgeResp, err := suite.controlPlane.RegisterEdge(ctx, "192.168.1.100", "test-edge", 1000)
+	edgeResp, err := suite.controlPlane.RegisterEdge(ctx, "192.168.1.100", "test-edge", 8081, 1000)
 	assert.NoError(suite.T(), err)
 	assert.Equal(suite.T(), "test-region", edgeResp.Region)
 	assert.Equal(suite.T(), "192.168.1.100", edgeResp.IPAddress)
@@ -496,6 +1629,148 @@ func (suite *EdgeProxyIntegrationTestSuite) TestControlPlaneIntegration() {
 	assert.Greater(suite.T(), len(purges), 0)
 }
 
+func (suite *EdgeProxyIntegrationTestSuite) TestControlPlaneEventStream() {
+	purgeID := uuid.New()
+	eventsPath := fmt.Sprintf("/api/v1/edges/%s/events", suite.edgeID)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/api/v1/edges":
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": suite.edgeID.String(), "token": testEdgeToken})
+
+		case r.Method == "GET" && r.URL.Path == eventsPath:
+			// Only the registered edge may subscribe
+			if r.Header.Get("Authorization") != "Bearer "+testEdgeToken {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, ": ping\n\n")
+			fmt.Fprintf(w, "id: %s\nevent: purge\ndata: {\"type\":\"purge\",\"purge\":{\"id\":\"%s\",\"paths\":[\"/a\"],\"tags\":[\"t1\"]}}\n\n", purgeID, purgeID)
+			fmt.Fprint(w, "event: domain_changed\ndata: {\"type\":\"domain_changed\",\"domain\":\"test.example.com\"}\n\n")
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := services.NewControlPlaneClient(server.URL, "test-region", testRegistrationSecret)
+	err := client.StreamEvents(ctx, func() {}, func(services.EdgeEvent) {})
+	assert.Error(suite.T(), err, "streaming requires a registered edge")
+
+	_, err = client.RegisterEdge(ctx, "192.168.1.100", "test-edge", 8081, 1000)
+	suite.Require().NoError(err)
+
+	connected := false
+	var events []services.EdgeEvent
+	err = client.StreamEvents(ctx, func() { connected = true }, func(event services.EdgeEvent) {
+		events = append(events, event)
+	})
+	assert.EqualError(suite.T(), err, "event stream closed")
+	assert.True(suite.T(), connected)
+
+	suite.Require().Len(events, 2)
+	assert.Equal(suite.T(), services.EdgeEventPurge, events[0].Type)
+	suite.Require().NotNil(events[0].Purge)
+	assert.Equal(suite.T(), purgeID, events[0].Purge.ID)
+	assert.Equal(suite.T(), []string{"/a"}, events[0].Purge.Paths)
+	assert.Equal(suite.T(), []string{"t1"}, events[0].Purge.Tags)
+	assert.Equal(suite.T(), services.EdgeEventDomainChanged, events[1].Type)
+	assert.Equal(suite.T(), suite.testDomain, events[1].Domain)
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestDomainConfigCache() {
+	ctx := context.Background()
+	fetcher := &countingFetcher{fetcher: suite.controlPlane}
+	domainCache := services.NewDomainCache(fetcher, services.DomainCacheConfig{
+		TTL:         50 * time.Millisecond,
+		NegativeTTL: time.Minute,
+		MaxStale:    time.Hour,
+	})
+	defer domainCache.Close()
+
+	// Repeated lookups are answered locally
+	for i := 0; i < 3; i++ {
+		domainInfo, err := domainCache.Get(ctx, suite.testDomain)
+		suite.Require().NoError(err)
+		assert.Equal(suite.T(), suite.testOriginURL, domainInfo.OriginURL)
+	}
+	assert.Equal(suite.T(), int32(1), fetcher.calls.Load())
+
+	// Unknown hosts are remembered too
+	for i := 0; i < 3; i++ {
+		_, err := domainCache.Get(ctx, "unknown.example.com")
+		assert.ErrorIs(suite.T(), err, services.ErrNotFound)
+	}
+	assert.Equal(suite.T(), int32(2), fetcher.calls.Load())
+
+	// An expired configuration is served while the control plane is down
+	fetcher.fail.Store(true)
+	time.Sleep(100 * time.Millisecond)
+	domainInfo, err := domainCache.Get(ctx, suite.testDomain)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), suite.testOriginURL, domainInfo.OriginURL)
+	suite.Require().Eventually(func() bool { return fetcher.calls.Load() == 3 }, time.Second, 10*time.Millisecond)
+
+	// Invalidation forces a fresh lookup
+	fetcher.fail.Store(false)
+	domainCache.Invalidate(suite.testDomain)
+	calls := fetcher.calls.Load()
+	_, err = domainCache.Get(ctx, suite.testDomain)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), calls+1, fetcher.calls.Load())
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestDomainChangeNotifications() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fetcher := &countingFetcher{fetcher: suite.controlPlane}
+	domainCache := services.NewDomainCache(fetcher, services.DomainCacheConfig{
+		TTL:         time.Hour,
+		NegativeTTL: time.Hour,
+		MaxStale:    time.Hour,
+	})
+	defer domainCache.Close()
+	suite.Require().NoError(domainCache.WatchDomainChanges(ctx, "redis://localhost:6379/2"))
+
+	// Wait for the subscription before caching, since subscribing drops
+	// everything cached
+	suite.Require().Eventually(func() bool {
+		n, err := suite.redis.PubSubNumSub(ctx, services.DomainChangesChannel).Result()
+		return err == nil && n[services.DomainChangesChannel] > 0
+	}, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	_, err := domainCache.Get(ctx, suite.testDomain)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, domainCache.Len())
+
+	suite.Require().NoError(suite.redis.Publish(ctx, services.DomainChangesChannel, suite.testDomain).Err())
+	assert.Eventually(suite.T(), func() bool { return domainCache.Len() == 0 }, 2*time.Second, 10*time.Millisecond)
+}
+
+// countingFetcher counts control plane domain lookups and can simulate an
+// outage
+type countingFetcher struct {
+	fetcher services.DomainFetcher
+	calls   atomic.Int32
+	fail    atomic.Bool
+}
+
+func (f *countingFetcher) GetDomain(ctx context.Context, domain string) (*services.DomainResponse, error) {
+	f.calls.Add(1)
+	if f.fail.Load() {
+		return nil, fmt.Errorf("control plane unavailable")
+	}
+	return f.fetcher.GetDomain(ctx, domain)
+}
+
 func (suite *EdgeProxyIntegrationTestSuite) TestCacheKeyGeneration() {
 	tests := []struct {
 		method   string
@@ -521,7 +1796,8 @@ func (suite *EdgeProxyIntegrationTestSuite) TestCacheKeyGeneration() {
 			headers: map[string]string{
 				"Accept": "application/json",
 			},
-			expected: "GET:example.com/path|Accept=application/json",
+			// Headers only split the cache when the origin varies on them
+			expected: "GET:example.com/path",
 		},
 	}
 
@@ -564,6 +1840,660 @@ func (suite *EdgeProxyIntegrationTestSuite) TestCacheExpiration() {
 	assert.False(suite.T(), exists)
 }
 
+func (suite *EdgeProxyIntegrationTestSuite) TestDomainDefaultTTL() {
+	ctx := context.Background()
+	memoryCache := cache.NewMemoryCache(8 * 1024 * 1024)
+	proxyService := proxy.NewProxyService(memoryCache, proxy.ProxyConfig{
+		DefaultTTL:      10 * time.Minute,
+		MinTTL:          time.Minute,
+		MaxTTL:          time.Hour,
+		ConnectTimeout:  10 * time.Second,
+		ResponseTimeout: 30 * time.Second,
+		MaxBodySize:     10 * 1024 * 1024,
+	})
+
+	ttlFor := func(path string, domainTTL time.Duration) time.Duration {
+		key := "GET:" + suite.testDomain + path
+		memoryCache.Delete(ctx, key)
+
+		req := httptest.NewRequest("GET", "http://"+suite.testDomain+path, nil)
+		w := httptest.NewRecorder()
+		proxyService.Serve(w, req, proxy.DomainConfig{OriginURL: suite.testOriginURL, DefaultTTL: domainTTL})
+		suite.Require().Equal(http.StatusOK, w.Code)
+
+		entry, exists := memoryCache.Get(ctx, key)
+		suite.Require().True(exists)
+		return entry.TTL
+	}
+
+	// Without cache headers the domain's TTL applies, then the edge default
+	assert.Equal(suite.T(), 30*time.Minute, ttlFor("/slow", 30*time.Minute))
+	assert.Equal(suite.T(), 10*time.Minute, ttlFor("/slow", 0))
+
+	// Both are clamped to the configured bounds
+	assert.Equal(suite.T(), time.Hour, ttlFor("/slow", 2*time.Hour))
+	assert.Equal(suite.T(), time.Minute, ttlFor("/slow", 10*time.Second))
+
+	// Origin cache headers still win over the domain's TTL
+	assert.Equal(suite.T(), 30*time.Minute, ttlFor("/json", 5*time.Minute))
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestStaleWhileRevalidate() {
+	req := httptest.NewRequest("GET", "http://"+suite.testDomain+"/hello", nil)
+	cacheKey := cache.GenerateCacheKey(req)
+	ctx := context.Background()
+
+	// Seed an expired entry that is still inside its revalidation window
+	err := suite.memoryCache.Set(ctx, cacheKey, &cache.CacheEntry{
+		StatusCode:           http.StatusOK,
+		Headers:              make(http.Header),
+		Body:                 []byte("stale content"),
+		CachedAt:             time.Now().Add(-2 * time.Second),
+		TTL:                  time.Second,
+		StaleWhileRevalidate: time.Minute,
+	})
+	suite.Require().NoError(err)
+
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "UPDATING", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "stale content", w.Body.String())
+
+	// The background refresh replaces the entry with the origin's response
+	assert.Eventually(suite.T(), func() bool {
+		entry, exists := suite.memoryCache.Get(ctx, cacheKey)
+		return exists && string(entry.Body) == "Hello, World!"
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestStaleIfError() {
+	req := httptest.NewRequest("GET", "http://"+suite.testDomain+"/error", nil)
+	cacheKey := cache.GenerateCacheKey(req)
+
+	// Seed an expired entry that may stand in for origin errors
+	err := suite.memoryCache.Set(context.Background(), cacheKey, &cache.CacheEntry{
+		StatusCode:   http.StatusOK,
+		Headers:      make(http.Header),
+		Body:         []byte("last good content"),
+		CachedAt:     time.Now().Add(-2 * time.Second),
+		TTL:          time.Second,
+		StaleIfError: time.Minute,
+	})
+	suite.Require().NoError(err)
+
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "STALE", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "last good content", w.Body.String())
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestConditionalRequests() {
+	// Populate the cache
+	req := httptest.NewRequest("GET", "http://"+suite.testDomain+"/etag", nil)
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+
+	// A matching validator is answered from cache with 304
+	req = httptest.NewRequest("GET", "http://"+suite.testDomain+"/etag", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusNotModified, w.Code)
+	assert.Equal(suite.T(), "HIT", w.Header().Get("X-Cache-Status"))
+	assert.Empty(suite.T(), w.Body.String())
+
+	// Expire the entry; the edge revalidates it with the origin instead of
+	// refetching the body
+	ctx := context.Background()
+	cacheKey := cache.GenerateCacheKey(httptest.NewRequest("GET", "http://"+suite.testDomain+"/etag", nil))
+	entry, exists := suite.memoryCache.Get(ctx, cacheKey)
+	suite.Require().True(exists)
+	expired := *entry
+	expired.CachedAt = time.Now().Add(-expired.TTL - time.Minute)
+	suite.Require().NoError(suite.memoryCache.Set(ctx, cacheKey, &expired))
+
+	req = httptest.NewRequest("GET", "http://"+suite.testDomain+"/etag", nil)
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "REVALIDATED", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "Versioned content", w.Body.String())
+
+	entry, exists = suite.memoryCache.Get(ctx, cacheKey)
+	suite.Require().True(exists)
+	assert.True(suite.T(), entry.IsFresh())
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestRangeRequests() {
+	// A range spanning two slices of an uncached object
+	req := httptest.NewRequest("GET", "http://"+suite.testDomain+"/video", nil)
+	req.Header.Set("Range", "bytes=1000000-1100000")
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), http.StatusPartialContent, w.Code)
+	assert.Equal(suite.T(), fmt.Sprintf("bytes 1000000-1100000/%d", len(videoContent)), w.Header().Get("Content-Range"))
+	assert.Equal(suite.T(), videoContent[1000000:1100001], w.Body.Bytes())
+
+	// The whole object is never cached, only the slices that were requested
+	ctx := context.Background()
+	_, exists := suite.memoryCache.Get(ctx, cache.GenerateCacheKey(req))
+	assert.False(suite.T(), exists)
+
+	// Seeking back into the same slices is served from cache
+	req = httptest.NewRequest("GET", "http://"+suite.testDomain+"/video", nil)
+	req.Header.Set("Range", "bytes=1048570-1048579")
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), http.StatusPartialContent, w.Code)
+	assert.Equal(suite.T(), "HIT", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), videoContent[1048570:1048580], w.Body.Bytes())
+
+	// Ranges past the end are unsatisfiable
+	req = httptest.NewRequest("GET", "http://"+suite.testDomain+"/video", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(videoContent)))
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), http.StatusRequestedRangeNotSatisfiable, w.Code)
+	assert.Equal(suite.T(), fmt.Sprintf("bytes */%d", len(videoContent)), w.Header().Get("Content-Range"))
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestRangeFromCachedObject() {
+	// Populate the cache with the full object
+	req := httptest.NewRequest("GET", "http://"+suite.testDomain+"/hello", nil)
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("GET", "http://"+suite.testDomain+"/hello", nil)
+	req.Header.Set("Range", "bytes=0-4")
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), http.StatusPartialContent, w.Code)
+	assert.Equal(suite.T(), "HIT", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "bytes 0-4/13", w.Header().Get("Content-Range"))
+	assert.Equal(suite.T(), "Hello", w.Body.String())
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestVaryVariants() {
+	fetch := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+suite.testDomain+"/vary", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		suite.router.ServeHTTP(w, req)
+		assert.Equal(suite.T(), http.StatusOK, w.Code)
+		return w
+	}
+
+	w := fetch("gzip")
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "encoding=gzip", w.Body.String())
+
+	// A different encoding is a different variant
+	w = fetch("")
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "encoding=", w.Body.String())
+
+	// Equivalent Accept-Encoding values share the normalized variant
+	w = fetch("deflate, gzip;q=0.8")
+	assert.Equal(suite.T(), "HIT", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "encoding=gzip", w.Body.String())
+
+	w = fetch("")
+	assert.Equal(suite.T(), "HIT", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "encoding=", w.Body.String())
+
+	// Purging the path drops every variant
+	ctx := context.Background()
+	suite.Require().NoError(suite.proxyService.PurgeCache(ctx, suite.testDomain, []string{"/vary"}, nil))
+	w = fetch("gzip")
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestVaryIndexTags() {
+	ctx := context.Background()
+	memoryCache := cache.NewMemoryCache(8 * 1024 * 1024)
+	defer memoryCache.Close()
+
+	store := func(variant string, tags []string) {
+		suite.Require().NoError(cache.Store(ctx, memoryCache, "GET:tags.example.com/page", &cache.CacheEntry{
+			StatusCode: http.StatusOK,
+			Headers:    make(http.Header),
+			Body:       []byte(variant),
+			CachedAt:   time.Now(),
+			TTL:        time.Hour,
+			Vary:       []string{"Accept-Encoding"},
+			Variant:    variant,
+			Host:       "tags.example.com",
+			Path:       "/page",
+			Tags:       tags,
+		}))
+	}
+	store("accept-encoding=gzip", []string{"blog"})
+	store("accept-encoding=br", []string{"catalog"})
+
+	// The index carries the tags of every variant, not just the last stored
+	index, exists := memoryCache.Get(ctx, "GET:tags.example.com/page")
+	suite.Require().True(exists)
+	suite.Require().True(index.IsVaryIndex())
+	assert.Equal(suite.T(), []string{"blog", "catalog"}, index.Tags)
+
+	keys, err := memoryCache.DomainKeys(ctx, "tags.example.com")
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), []string{"blog", "catalog"}, keys["GET:tags.example.com/page"].Tags)
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestCompression() {
+	domain := proxy.DomainConfig{
+		OriginURL:   suite.testOriginURL,
+		Compression: true,
+	}
+	serve := func(target, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+suite.testDomain+target, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		suite.proxyService.Serve(w, req, domain)
+		suite.Require().Equal(http.StatusOK, w.Code)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) []byte {
+		var reader io.Reader
+		switch w.Header().Get("Content-Encoding") {
+		case "br":
+			reader = brotli.NewReader(w.Body)
+		case "gzip":
+			gz, err := gzip.NewReader(w.Body)
+			suite.Require().NoError(err)
+			reader = gz
+		default:
+			reader = w.Body
+		}
+		body, err := io.ReadAll(reader)
+		suite.Require().NoError(err)
+		return body
+	}
+
+	// Brotli is preferred when the client accepts it
+	w := serve("/article", "gzip, deflate, br")
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "br", w.Header().Get("Content-Encoding"))
+	assert.Contains(suite.T(), w.Header().Values("Vary"), "Accept-Encoding")
+	assert.Equal(suite.T(), `W/"article-v1"`, w.Header().Get("ETag"))
+	assert.Less(suite.T(), w.Body.Len(), len(articleContent))
+	assert.Equal(suite.T(), articleContent, decode(w))
+
+	// Each encoding is cached once, whatever the exact header
+	w = serve("/article", "br;q=1.0, gzip;q=0.5")
+	assert.Equal(suite.T(), "HIT", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "br", w.Header().Get("Content-Encoding"))
+	assert.Equal(suite.T(), articleContent, decode(w))
+
+	w = serve("/article", "gzip")
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(suite.T(), articleContent, decode(w))
+
+	w = serve("/article", "deflate, gzip")
+	assert.Equal(suite.T(), "HIT", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(suite.T(), articleContent, decode(w))
+
+	// Clients that accept no compression get the origin's body
+	w = serve("/article", "")
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+	assert.Empty(suite.T(), w.Header().Get("Content-Encoding"))
+	assert.Equal(suite.T(), `"article-v1"`, w.Header().Get("ETag"))
+	assert.Equal(suite.T(), articleContent, w.Body.Bytes())
+
+	// Small bodies are left alone
+	w = serve("/hello", "gzip")
+	assert.Empty(suite.T(), w.Header().Get("Content-Encoding"))
+	assert.Equal(suite.T(), "Hello, World!", w.Body.String())
+
+	// Domains can turn compression off
+	suite.Require().NoError(suite.proxyService.PurgeCache(context.Background(), suite.testDomain, []string{"/article"}, nil))
+	domain.Compression = false
+	w = serve("/article", "gzip, br")
+	assert.Empty(suite.T(), w.Header().Get("Content-Encoding"))
+	assert.Equal(suite.T(), articleContent, w.Body.Bytes())
+
+	// Domains can choose which content types are compressed
+	suite.Require().NoError(suite.proxyService.PurgeCache(context.Background(), suite.testDomain, []string{"/article"}, nil))
+	domain.Compression = true
+	domain.CompressionTypes = []string{"application/*+json"}
+	w = serve("/article", "gzip")
+	assert.Empty(suite.T(), w.Header().Get("Content-Encoding"))
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestHeadersOutsideVaryShareEntry() {
+	req := httptest.NewRequest("GET", "http://"+suite.testDomain+"/hello", nil)
+	req.Header.Set("Accept", "text/plain")
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+
+	// The origin does not vary on Accept, so another value is still a hit
+	req = httptest.NewRequest("GET", "http://"+suite.testDomain+"/hello", nil)
+	req.Header.Set("Accept", "*/*")
+	w = httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	assert.Equal(suite.T(), "HIT", w.Header().Get("X-Cache-Status"))
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestCachePolicies() {
+	ctx := context.Background()
+
+	bypass, err := proxy.NewCachePolicy("/json", proxy.MatchGlob)
+	suite.Require().NoError(err)
+	bypass.Bypass = true
+
+	hello, err := proxy.NewCachePolicy(`^/hel+o$`, proxy.MatchRegex)
+	suite.Require().NoError(err)
+	hello.TTL = 10 * time.Minute
+	hello.KeyTemplate = "{host}{path}"
+	hello.VaryHeaders = []string{"X-Device"}
+
+	catchAll, err := proxy.NewCachePolicy("/*", proxy.MatchGlob)
+	suite.Require().NoError(err)
+	catchAll.TTL = time.Minute
+
+	domain := proxy.DomainConfig{
+		OriginURL:     suite.testOriginURL,
+		CachePolicies: []*proxy.CachePolicy{bypass, hello, catchAll},
+	}
+	serve := func(target, device string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+suite.testDomain+target, nil)
+		if device != "" {
+			req.Header.Set("X-Device", device)
+		}
+		w := httptest.NewRecorder()
+		suite.proxyService.Serve(w, req, domain)
+		return w
+	}
+
+	// Bypassed paths always go to the origin and are never stored
+	for i := 0; i < 2; i++ {
+		w := serve("/json", "")
+		assert.Equal(suite.T(), http.StatusOK, w.Code)
+		assert.Equal(suite.T(), "BYPASS", w.Header().Get("X-Cache-Status"))
+	}
+	_, exists := suite.memoryCache.Get(ctx, "GET:"+suite.testDomain+"/json")
+	assert.False(suite.T(), exists)
+
+	// The first matching policy sets the TTL and cache key, which here
+	// ignores the query string but includes the device header
+	w := serve("/hello?utm=1", "mobile")
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+
+	entry, exists := suite.memoryCache.Get(ctx, "GET:"+suite.testDomain+"#"+suite.testDomain+"/hello|x-device=mobile")
+	suite.Require().True(exists)
+	assert.Equal(suite.T(), 10*time.Minute, entry.TTL)
+
+	w = serve("/hello?utm=2", "mobile")
+	assert.Equal(suite.T(), "HIT", w.Header().Get("X-Cache-Status"))
+
+	w = serve("/hello?utm=1", "desktop")
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+
+	// Later policies apply when earlier ones do not match
+	serve("/etag", "")
+	entry, exists = suite.memoryCache.Get(ctx, "GET:"+suite.testDomain+"/etag")
+	suite.Require().True(exists)
+	assert.Equal(suite.T(), time.Minute, entry.TTL)
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestCachePolicyKeysScopedToHost() {
+	var originRequests atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := originRequests.Add(1)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		fmt.Fprintf(w, "response %d", n)
+	}))
+	defer origin.Close()
+
+	edgeCache := cache.NewMemoryCache(1024 * 1024)
+	defer edgeCache.Close()
+	edge := proxy.NewProxyService(edgeCache, proxy.ProxyConfig{
+		DefaultTTL:      time.Minute,
+		MaxBodySize:     1024 * 1024,
+		ConnectTimeout:  time.Second,
+		ResponseTimeout: 5 * time.Second,
+	})
+
+	domainWithTemplate := func(template string) proxy.DomainConfig {
+		policy, err := proxy.NewCachePolicy("/*", proxy.MatchGlob)
+		suite.Require().NoError(err)
+		policy.KeyTemplate = template
+		return proxy.DomainConfig{OriginURL: origin.URL, CachePolicies: []*proxy.CachePolicy{policy}}
+	}
+	serve := func(host string, domain proxy.DomainConfig) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		edge.Serve(w, httptest.NewRequest("GET", "http://"+host+"/shared", nil), domain)
+		suite.Require().Equal(http.StatusOK, w.Code)
+		return w
+	}
+
+	// Two domains with the same template keep separate entries
+	pathOnly := domainWithTemplate("{path}")
+	w := serve("one.example.com", pathOnly)
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+	w = serve("two.example.com", pathOnly)
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "response 2", w.Body.String())
+
+	// A template naming another domain cannot fill that domain's cache
+	serve("attacker.example.com", domainWithTemplate("victim.example.com{path}"))
+	w = serve("victim.example.com", proxy.DomainConfig{OriginURL: origin.URL})
+	assert.Equal(suite.T(), "MISS", w.Header().Get("X-Cache-Status"))
+	assert.Equal(suite.T(), "response 4", w.Body.String())
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestMemoryCacheAdmission() {
+	ctx := context.Background()
+	smallCache := cache.NewMemoryCache(8 * 1024 * 1024)
+	defer smallCache.Close()
+
+	newEntry := func() *cache.CacheEntry {
+		return &cache.CacheEntry{
+			StatusCode: http.StatusOK,
+			Headers:    make(http.Header),
+			Body:       make([]byte, 64*1024),
+			CachedAt:   time.Now(),
+			TTL:        time.Hour,
+		}
+	}
+
+	// Popular objects are requested repeatedly
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("popular-%d", i)
+		smallCache.Get(ctx, key)
+		suite.Require().NoError(smallCache.Set(ctx, key, newEntry()))
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 50; i++ {
+			smallCache.Get(ctx, fmt.Sprintf("popular-%d", i))
+		}
+	}
+
+	// A scan of one-off requests larger than the cache
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("one-off-%d", i)
+		smallCache.Get(ctx, key)
+		suite.Require().NoError(smallCache.Set(ctx, key, newEntry()))
+	}
+
+	for i := 0; i < 50; i++ {
+		_, exists := smallCache.Get(ctx, fmt.Sprintf("popular-%d", i))
+		assert.True(suite.T(), exists, "popular-%d was evicted", i)
+	}
+	assert.LessOrEqual(suite.T(), smallCache.Size(), int64(8*1024*1024))
+
+	var rejections int64
+	for _, shard := range smallCache.Stats() {
+		rejections += shard.Rejections
+	}
+	assert.Greater(suite.T(), rejections, int64(0))
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestDiskCachePersistence() {
+	ctx := context.Background()
+	dir := suite.T().TempDir()
+
+	diskCache, err := cache.NewDiskCache(dir, 1024*1024)
+	suite.Require().NoError(err)
+
+	entry := &cache.CacheEntry{
+		StatusCode: http.StatusOK,
+		Headers:    http.Header{"Content-Type": []string{"text/plain"}},
+		Body:       []byte("persisted body"),
+		CachedAt:   time.Now(),
+		TTL:        time.Hour,
+		Host:       "example.com",
+		Path:       "/persisted",
+	}
+	suite.Require().NoError(diskCache.Set(ctx, "GET:example.com/persisted", entry))
+	suite.Require().NoError(diskCache.Set(ctx, "GET:example.com/expired", &cache.CacheEntry{
+		StatusCode: http.StatusOK,
+		Headers:    make(http.Header),
+		Body:       []byte("old"),
+		CachedAt:   time.Now().Add(-2 * time.Hour),
+		TTL:        time.Minute,
+	}))
+	diskCache.Close()
+
+	// A new instance rebuilds its index from the files on disk
+	reopened, err := cache.NewDiskCache(dir, 1024*1024)
+	suite.Require().NoError(err)
+	defer reopened.Close()
+
+	cached, exists := reopened.Get(ctx, "GET:example.com/persisted")
+	suite.Require().True(exists)
+	assert.Equal(suite.T(), "persisted body", string(cached.Body))
+	assert.Equal(suite.T(), "text/plain", cached.Headers.Get("Content-Type"))
+
+	_, exists = reopened.Get(ctx, "GET:example.com/expired")
+	assert.False(suite.T(), exists)
+	assert.Equal(suite.T(), 1, reopened.Len())
+
+	// The purge index is rebuilt too
+	keys, err := reopened.DomainKeys(ctx, "example.com")
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), map[string]cache.KeyInfo{"GET:example.com/persisted": {Path: "/persisted"}}, keys)
+
+	// Writing past the size bound evicts the least recently used entries
+	for i := 0; i < 20; i++ {
+		suite.Require().NoError(reopened.Set(ctx, fmt.Sprintf("GET:example.com/large-%d", i), &cache.CacheEntry{
+			StatusCode: http.StatusOK,
+			Headers:    make(http.Header),
+			Body:       make([]byte, 100*1024),
+			CachedAt:   time.Now(),
+			TTL:        time.Hour,
+		}))
+	}
+	assert.LessOrEqual(suite.T(), reopened.Size(), int64(1024*1024))
+	_, exists = reopened.Get(ctx, "GET:example.com/large-0")
+	assert.False(suite.T(), exists)
+	_, exists = reopened.Get(ctx, "GET:example.com/large-19")
+	assert.True(suite.T(), exists)
+
+	// An entry that can never fit is refused without replacing the stored one
+	size := reopened.Size()
+	err = reopened.Set(ctx, "GET:example.com/large-19", &cache.CacheEntry{
+		StatusCode: http.StatusOK,
+		Headers:    make(http.Header),
+		Body:       make([]byte, 2*1024*1024),
+		CachedAt:   time.Now(),
+		TTL:        time.Hour,
+	})
+	assert.ErrorIs(suite.T(), err, cache.ErrEntryTooLarge)
+	assert.Equal(suite.T(), size, reopened.Size())
+	cached, exists = reopened.Get(ctx, "GET:example.com/large-19")
+	suite.Require().True(exists)
+	assert.Len(suite.T(), cached.Body, 100*1024)
+
+	// Racing writes and deletes of one key leave the files matching the index
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if (i+j)%3 == 0 {
+					reopened.Delete(ctx, "GET:example.com/raced")
+					continue
+				}
+				reopened.Set(ctx, "GET:example.com/raced", &cache.CacheEntry{
+					StatusCode: http.StatusOK,
+					Headers:    make(http.Header),
+					Body:       make([]byte, 1024*(i+1)),
+					CachedAt:   time.Now(),
+					TTL:        time.Hour,
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	size = reopened.Size()
+	reopened.Close()
+
+	rebuilt, err := cache.NewDiskCache(dir, 1024*1024)
+	suite.Require().NoError(err)
+	defer rebuilt.Close()
+	assert.Equal(suite.T(), size, rebuilt.Size())
+}
+
+func (suite *EdgeProxyIntegrationTestSuite) TestLayeredCachePromotion() {
+	ctx := context.Background()
+
+	memoryCache := cache.NewMemoryCache(8 * 1024 * 1024)
+	defer memoryCache.Close()
+	diskCache, err := cache.NewDiskCache(suite.T().TempDir(), 8*1024*1024)
+	suite.Require().NoError(err)
+	defer diskCache.Close()
+
+	layered := cache.NewLayeredCache(memoryCache, diskCache)
+
+	entry := &cache.CacheEntry{
+		StatusCode: http.StatusOK,
+		Headers:    make(http.Header),
+		Body:       []byte("layered body"),
+		CachedAt:   time.Now(),
+		TTL:        time.Hour,
+	}
+
+	// An entry only on disk is promoted into memory on the first hit
+	suite.Require().NoError(diskCache.Set(ctx, "GET:example.com/layered", entry))
+	_, exists := memoryCache.Get(ctx, "GET:example.com/layered")
+	suite.Require().False(exists)
+
+	cached, exists := layered.Get(ctx, "GET:example.com/layered")
+	suite.Require().True(exists)
+	assert.Equal(suite.T(), "layered body", string(cached.Body))
+
+	_, exists = memoryCache.Get(ctx, "GET:example.com/layered")
+	assert.True(suite.T(), exists)
+
+	// Deletes reach every layer
+	suite.Require().NoError(layered.Delete(ctx, "GET:example.com/layered"))
+	_, exists = memoryCache.Get(ctx, "GET:example.com/layered")
+	assert.False(suite.T(), exists)
+	_, exists = diskCache.Get(ctx, "GET:example.com/layered")
+	assert.False(suite.T(), exists)
+}
+
 func (suite *EdgeProxyIntegrationTestSuite) TestConcurrentCacheAccess() {
 	ctx := context.Background()
 
@@ -4,6 +4,7 @@ set -e
 echo "🧪 Running NaijCloud D-CDN API tests..."
 
 BASE_URL="http://localhost:8080"
+EDGE_REGISTRATION_SECRET=${EDGE_REGISTRATION_SECRET:-"dev-edge-registration-secret-change-in-production"}
 
 # Colors for output
 RED='\033[0;31m'
@@ -85,8 +86,9 @@ echo "🌍 Edge Management Tests"
 
 # Register an edge node
 EDGE_DATA="{\"region\":\"test-region\",\"ip_address\":\"10.0.1.100\",\"hostname\":\"test-edge-01\",\"capacity\":1000}"
-EDGE_RESPONSE=$(curl -s -f -X POST $BASE_URL/v1/edges -H 'Content-Type: application/json' -d "$EDGE_DATA")
+EDGE_RESPONSE=$(curl -s -f -X POST $BASE_URL/v1/edges -H 'Content-Type: application/json' -H "Authorization: Bearer $EDGE_REGISTRATION_SECRET" -d "$EDGE_DATA")
 EDGE_ID=$(echo "$EDGE_RESPONSE" | grep -o '"id":"[^"]*"' | cut -d'"' -f4)
+EDGE_TOKEN=$(echo "$EDGE_RESPONSE" | grep -o '"token":"[^"]*"' | cut -d'"' -f4)
 
 run_test "POST /v1/edges (register edge)" "echo '$EDGE_RESPONSE' | grep -q id"
 
@@ -99,7 +101,7 @@ if [ -n "$EDGE_ID" ]; then
     HEARTBEAT_DATA="{\"status\":\"healthy\",\"metrics\":{\"requests_per_second\":100,\"cache_hit_ratio\":0.85}}"
     run_test "POST /v1/edges/$EDGE_ID/heartbeat (send heartbeat)" "curl -s -f -X POST $BASE_URL/v1/edges/$EDGE_ID/heartbeat -H 'Content-Type: application/json' -d '$HEARTBEAT_DATA'"
     
-    run_test "GET /v1/edges/$EDGE_ID/purges (get pending purges)" "curl -s -f $BASE_URL/v1/edges/$EDGE_ID/purges"
+    run_test "GET /v1/edges/$EDGE_ID/purges (get pending purges)" "curl -s -f $BASE_URL/v1/edges/$EDGE_ID/purges -H 'Authorization: Bearer $EDGE_TOKEN'"
 fi
 
 echo ""